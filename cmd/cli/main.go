@@ -3,13 +3,32 @@ package main
 import (
 	"context"
 	"flag"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/phuslu/log"
 	gpsv2 "nuha.dev/gpstracker/internal/gpsv2/server"
+
+	//device protocols register themselves to the gps server
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/gt06"
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/h02"
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/jt808"
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/simplejson"
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/teltonika"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/alert"
+	"nuha.dev/gpstracker/internal/gpsv2/geofence"
+	"nuha.dev/gpstracker/internal/gpsv2/geoloc"
+	"nuha.dev/gpstracker/internal/gpsv2/natspub"
+	"nuha.dev/gpstracker/internal/gpsv2/scheduler"
 	"nuha.dev/gpstracker/internal/gpsv2/sublist"
+	"nuha.dev/gpstracker/internal/gpsv2/trip"
+	"nuha.dev/gpstracker/internal/gpsv2/usage"
+	"nuha.dev/gpstracker/internal/gpsv2/webhook"
 	"nuha.dev/gpstracker/internal/store/impl/pgstore"
 	"nuha.dev/gpstracker/internal/webapp"
 
@@ -25,12 +44,30 @@ func main() {
 	// gps_server_mock_login := flag.Bool("gps_mock_login", true, "mock gps login")
 	// gps_server_mock_store := flag.Bool("gps_mock_store", true, "mock gps store")
 	gps_server_listen_addr := flag.String("gps_address", ":6000", "gps server address to listen to")
+	gps_http_listen_addr := flag.String("osmand_address", "", "osmand http address to listen to, empty to disable")
+	gps_udp_listen_addr := flag.String("udp_address", "", "gps server udp address to listen to, empty to disable")
+	gps_udp_idle_timeout := flag.Duration("udp_idle_timeout", 5*time.Minute, "close udp session idle for this long")
+	gps_tls_listen_addr := flag.String("tls_address", "", "gps server tls address to listen to, empty to disable")
+	gps_tls_cert := flag.String("tls_cert", "", "gps server tls certificate file")
+	gps_tls_key := flag.String("tls_key", "", "gps server tls key file")
+	gps_tls_client_ca := flag.String("tls_client_ca", "", "ca file to verify device client certificate")
+	gps_tls_require_client_cert := flag.Bool("tls_require_client_cert", false, "reject tls connection without client certificate")
+	geolocation_enabled := flag.Bool("geolocation", false, "estimate location of tracker without gps fix from imported cell tower and wifi table")
+	trips_enabled := flag.Bool("trips", false, "detect trip and stop from live location")
+	usage_enabled := flag.Bool("usage", false, "account daily odometer and engine hour of tracker")
+	geofence_enabled := flag.Bool("geofence", false, "evaluate geofence and emit enter and exit event")
+	alerts_enabled := flag.Bool("alerts", false, "evaluate alert rule against live tracker data")
+	webhooks_enabled := flag.Bool("webhooks", false, "deliver live location and event to subscribed webhook")
+	nats_url := flag.String("nats_url", "", "nats server to publish live location and event to, empty to disable")
+	scheduler_enabled := flag.Bool("scheduler", true, "run command job scheduler")
 	ws_server := flag.Bool("ws_server", true, "run ws server")
 	ws_server_mock_login := flag.Bool("ws_mock_login", false, "mock ws login")
 	ws_server_listen_addr := flag.String("ws_address", ":7000", "ws server address to listen to")
 	api_server := flag.Bool("api_server", true, "run api server")
 	api_server_listen_addr := flag.String("api_address", ":3333", "api server address to listen to")
 	api_server_cookie_domain := flag.String("cookie_domain", "localhost", "domain to set the cookie")
+	spool_dir := flag.String("spool_dir", "", "directory to spool location batch when database is unavailable, empty to disable")
+	shutdown_timeout := flag.Duration("shutdown_timeout", 10*time.Second, "deadline for graceful shutdown")
 	flag.Parse()
 	log.DefaultLogger.Level = log.TraceLevel
 
@@ -39,10 +76,17 @@ func main() {
 		panic(err.Error())
 	}
 
-	store := pgstore.NewStore(pool, "locations_history", &pgstore.StoreConfig{BufSize: 10, TickerDur: 50 * time.Second, MaxAgeFlush: 50 * time.Second})
+	//database write of bus subscriber and usage meter, out of the device read loop
+	persist_worker := eventbus.NewWorker("persist", 10000)
+	go persist_worker.Run()
+	store := pgstore.NewStore(pool, "locations_history", &pgstore.StoreConfig{BufSize: 10, TickerDur: 50 * time.Second, MaxAgeFlush: 50 * time.Second, SpoolDir: *spool_dir})
 	misc_store := pgstore.NewMiscStore(pool)
+	command_store := pgstore.NewCommandStore(pool)
 	store.Run()
-	wg := sync.WaitGroup{}
+	var geolocator *geoloc.Resolver
+	if *geolocation_enabled {
+		geolocator = geoloc.NewResolver(pgstore.NewGeoStore(pool), nil)
+	}
 	var srv *gpsv2.Server
 	// if *gps_server {
 	// 	srv = gps.NewServer(pool, store, &gps.ServerConfig{DirectListenerAddr: *gps_server_listen_addr, MockStore: *gps_server_mock_store})
@@ -50,28 +94,115 @@ func main() {
 	// 	wg.Add(1)
 	// }
 	sublistmap := sublist.NewSublistMap()
+	//device publish to the bus, subscriber must be added before the gps server start
+	bus := eventbus.NewEventBus()
+	eventbus.Persist(bus, store, misc_store, persist_worker)
+	sublistmap.Attach(bus)
+	if *trips_enabled {
+		trip.Subscribe(bus, pgstore.NewTripStore(pool))
+	}
+	if *usage_enabled {
+		usage.Subscribe(bus, usage.Queued(pgstore.NewUsageStore(pool), persist_worker))
+	}
+	if *geofence_enabled {
+		geofence.Subscribe(bus, pgstore.NewGeofenceStore(pool))
+	}
+	var alerts *alert.Engine
+	if *alerts_enabled {
+		alerts = alert.NewEngine(pgstore.NewAlertStore(pool), bus, &alert.EngineConfig{})
+		go alerts.Run()
+	}
+	var webhooks *webhook.Dispatcher
+	if *webhooks_enabled {
+		webhooks = webhook.NewDispatcher(pgstore.NewWebhookStore(pool), bus, &webhook.DispatcherConfig{})
+		go webhooks.Run()
+	}
+	var natspublisher *natspub.Publisher
+	if *nats_url != "" {
+		nc, err := natspub.Connect(*nats_url)
+		if err != nil {
+			panic(err.Error())
+		}
+		natspublisher = natspub.NewPublisher(nc, bus, &natspub.PublisherConfig{})
+	}
 	if *gps_server {
-		srv = gpsv2.NewServer(pool, store, misc_store, sublistmap, &gpsv2.ServerConfig{ListenerAddr: *gps_server_listen_addr})
+		srv = gpsv2.NewServer(pool, bus, misc_store, command_store, geolocator, &gpsv2.ServerConfig{ListenerAddr: *gps_server_listen_addr, HttpListenerAddr: *gps_http_listen_addr,
+			UdpListenerAddr: *gps_udp_listen_addr, UdpIdleTimeout: *gps_udp_idle_timeout,
+			TlsListenerAddr: *gps_tls_listen_addr, TlsCertFile: *gps_tls_cert, TlsKeyFile: *gps_tls_key,
+			TlsClientCAFile: *gps_tls_client_ca, TlsRequireClientCert: *gps_tls_require_client_cert})
 		go srv.Run()
-		wg.Add(1)
+	}
+	var sched *scheduler.Scheduler
+	if *gps_server && *scheduler_enabled {
+		sched = scheduler.NewScheduler(pool, srv, &scheduler.SchedulerConfig{})
+		go sched.Run()
 	}
 
+	var wss *ws.WebstreamServer
 	if *ws_server {
-		ws := ws.NewWebstream(pool, srv, sublistmap, ws.WebStreamConfig{MockToken: *ws_server_mock_login, ListenAddr: *ws_server_listen_addr})
-		go ws.Run()
-		wg.Add(1)
+		wss = ws.NewWebstream(pool, srv, sublistmap, ws.WebStreamConfig{MockToken: *ws_server_mock_login, ListenAddr: *ws_server_listen_addr})
+		go wss.Run()
 	}
+	var api *webapp.Api
 	if *api_server {
-		api := webapp.NewApi(pool, srv, &webapp.ApiConfig{ListenAddr: *api_server_listen_addr, CookieDomain: *api_server_cookie_domain, VerifyCSRF: true})
+		api = webapp.NewApi(pool, srv, &webapp.ApiConfig{ListenAddr: *api_server_listen_addr, CookieDomain: *api_server_cookie_domain, VerifyCSRF: true})
 		go api.Run()
-		wg.Add(1)
 	}
-	wg.Add(1)
 	go func() {
 
 		http.ListenAndServe("localhost:6060", nil)
 
 	}()
-	wg.Wait()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Info().Msg("shutting down")
+
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), *shutdown_timeout)
+	defer cancel()
+	//stop the sources first so nothing is written to the store after it is closed
+	if api != nil {
+		if err := api.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error shutting down api-server")
+		}
+	}
+	if wss != nil {
+		if err := wss.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error shutting down ws-server")
+		}
+	}
+	if sched != nil {
+		if err := sched.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error shutting down scheduler")
+		}
+	}
+	if srv != nil {
+		if err := srv.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error shutting down gps-server")
+		}
+	}
+	if alerts != nil {
+		if err := alerts.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error shutting down alert engine")
+		}
+	}
+	if webhooks != nil {
+		if err := webhooks.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error shutting down webhook dispatcher")
+		}
+	}
+	if natspublisher != nil {
+		if err := natspublisher.Shutdown(shutdown_ctx); err != nil {
+			log.Error().Err(err).Msg("error flushing nats publisher")
+		}
+	}
+	if err := persist_worker.Shutdown(shutdown_ctx); err != nil {
+		log.Error().Err(err).Msg("error flushing event and usage write")
+	}
+	if err := store.Close(shutdown_ctx); err != nil {
+		log.Error().Err(err).Msg("error flushing location store")
+	}
+	pool.Close()
+	log.Info().Msg("shutdown complete")
 }
@@ -9,17 +9,16 @@ require (
 	github.com/deepmap/oapi-codegen v1.8.2 // indirect
 	github.com/getkin/kin-openapi v0.74.0 // indirect
 	github.com/go-chi/chi/v5 v5.0.2
-	github.com/go-chi/cors v1.2.0 // indirect
+	github.com/go-chi/cors v1.2.0
 	github.com/go-kit/kit v0.10.0 // indirect
 	github.com/go-playground/validator/v10 v10.4.1
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/hashicorp/yamux v0.0.0-20210316155119-a95892c5f864
-	github.com/jackc/pgconn v1.10.0 // indirect
-	github.com/jackc/pgerrcode v0.0.0-20201024163028-a0d42d470451 // indirect
+	github.com/jackc/pgconn v1.10.0
+	github.com/jackc/pgerrcode v0.0.0-20201024163028-a0d42d470451
 	github.com/jackc/pgx/v4 v4.13.0
-	github.com/mustafaturan/bus/v3 v3.0.3
-	github.com/mustafaturan/monoton/v2 v2.0.2
+	github.com/nats-io/nats-server/v2 v2.3.0
 	github.com/nats-io/nats.go v1.11.0
 	github.com/phuslu/log v1.0.76
 	github.com/pires/go-proxyproto v0.6.1
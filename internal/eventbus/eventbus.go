@@ -1,12 +1,147 @@
 package eventbus
 
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+// Location is a location kept after validation. Store and Live carry the tracker setting
+// deciding whether it is written to history and sent to live subscriber, Config is the
+// whole setting for subscriber keeping state per tracker such as trip and usage
+type Location struct {
+	TrackerId  uint64
+	Nsn        uint64
+	Location   *device.Location
+	ServerTime time.Time
+	Store      bool
+	Live       bool
+	Config     *device.DeviceConfig
+	//estimated from cell or wifi, it is never stored
+	Approximate bool
+}
+
+// Status is the acc state of a tracker reported by a status packet, it is not stored.
+// Config is the tracker setting as in Location
+type Status struct {
+	TrackerId uint64
+	ACC       bool
+	Time      time.Time
+	Config    *device.DeviceConfig
+}
+
+// Event is a tracker event such as status change, alarm or connection. Message and Data
+// are kept in history, Data is sent to live subscriber as json
+type Event struct {
+	TrackerId uint64
+	Topic     string
+	Message   string
+	Data      interface{}
+	Time      time.Time
+	//raw observation not worth sending live
+	HistoryOnly bool
+	//frequent reading only worth sending live
+	LiveOnly bool
+}
+
+// Payload return Data as json, empty when there is no data
+func (e *Event) Payload() []byte {
+	if e.Data == nil {
+		return []byte{}
+	}
+	buf, _ := json.Marshal(e.Data)
+	return buf
+}
+
+// CommandResponse is the response of a command sent by the server, Command is empty
+// when the response does not match the command waiting for it
+type CommandResponse struct {
+	TrackerId  uint64
+	ServerFlag uint32
+	Command    string
+	SentTime   time.Time
+	Response   string
+	Time       time.Time
+}
+
+type LocationHandler func(l *Location)
+type EventHandler func(e *Event)
+type CommandResponseHandler func(r *CommandResponse)
+type StatusHandler func(s *Status)
+
+// EventBus deliver what device publish to every subscriber of its type, synchronously and
+// in subscription order on the publishing goroutine so handler must not block. Subscriber
+// should be added before any device start publishing
 type EventBus struct {
+	mu       sync.RWMutex
+	location []LocationHandler
+	event    []EventHandler
+	response []CommandResponseHandler
+	status   []StatusHandler
 }
 
-func NewEventBut() *EventBus {
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+func (bus *EventBus) SubscribeLocation(h LocationHandler) {
+	bus.mu.Lock()
+	bus.location = append(bus.location, h)
+	bus.mu.Unlock()
+}
+
+func (bus *EventBus) SubscribeEvent(h EventHandler) {
+	bus.mu.Lock()
+	bus.event = append(bus.event, h)
+	bus.mu.Unlock()
+}
+
+func (bus *EventBus) SubscribeCommandResponse(h CommandResponseHandler) {
+	bus.mu.Lock()
+	bus.response = append(bus.response, h)
+	bus.mu.Unlock()
+}
+
+func (bus *EventBus) SubscribeStatus(h StatusHandler) {
+	bus.mu.Lock()
+	bus.status = append(bus.status, h)
+	bus.mu.Unlock()
+}
 
+func (bus *EventBus) PublishLocation(l *Location) {
+	bus.mu.RLock()
+	handlers := bus.location
+	bus.mu.RUnlock()
+	for _, h := range handlers {
+		h(l)
+	}
 }
 
-func (bus *EventBus) Publish() {
+func (bus *EventBus) PublishEvent(e *Event) {
+	bus.mu.RLock()
+	handlers := bus.event
+	bus.mu.RUnlock()
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+func (bus *EventBus) PublishCommandResponse(r *CommandResponse) {
+	bus.mu.RLock()
+	handlers := bus.response
+	bus.mu.RUnlock()
+	for _, h := range handlers {
+		h(r)
+	}
+}
 
+func (bus *EventBus) PublishStatus(st *Status) {
+	bus.mu.RLock()
+	handlers := bus.status
+	bus.mu.RUnlock()
+	for _, h := range handlers {
+		h(st)
+	}
 }
@@ -0,0 +1,53 @@
+package eventbus
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFanOut(t *testing.T) {
+	bus := NewEventBus()
+	var mu sync.Mutex
+	got := make([]string, 0)
+	record := func(s string) {
+		mu.Lock()
+		got = append(got, s)
+		mu.Unlock()
+	}
+	for _, name := range []string{"a", "b"} {
+		name := name
+		bus.SubscribeLocation(func(l *Location) { record(name + ":location") })
+		bus.SubscribeEvent(func(e *Event) { record(name + ":" + e.Topic) })
+		bus.SubscribeCommandResponse(func(r *CommandResponse) { record(name + ":response") })
+		bus.SubscribeStatus(func(s *Status) { record(name + ":status") })
+	}
+	bus.PublishLocation(&Location{TrackerId: 1})
+	bus.PublishEvent(&Event{TrackerId: 1, Topic: "started"})
+	bus.PublishCommandResponse(&CommandResponse{TrackerId: 1})
+	bus.PublishStatus(&Status{TrackerId: 1, ACC: true})
+	expected := []string{"a:location", "b:location", "a:started", "b:started", "a:response", "b:response", "a:status", "b:status"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("delivered %v, expected %v", got, expected)
+	}
+}
+
+func TestPublishWithoutSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	bus.PublishLocation(&Location{})
+	bus.PublishEvent(&Event{})
+	bus.PublishCommandResponse(&CommandResponse{})
+	bus.PublishStatus(&Status{})
+}
+
+func TestPayload(t *testing.T) {
+	e := Event{Data: map[string]int{"code": 1}, Time: time.Now()}
+	if p := string(e.Payload()); p != `{"code":1}` {
+		t.Fatalf("payload %s", p)
+	}
+	e.Data = nil
+	if p := e.Payload(); len(p) != 0 {
+		t.Fatalf("payload %s", p)
+	}
+}
@@ -0,0 +1,36 @@
+package eventbus
+
+import (
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// Persist subscribe the location and misc store to bus, location is written when its
+// tracker store it and event unless it is live only. Location store buffer what it is
+// given, event and command response are written by w so a slow database does not block
+// the publishing device. History only event are raw observation dropped when w is full,
+// other event such as alarm and disconnection wait for room
+func Persist(bus *EventBus, st store.LocationStore, misc_store store.MiscStore, w *Worker) {
+	bus.SubscribeLocation(func(l *Location) {
+		if l.Store {
+			st.Put(l.Nsn, l.Location, l.ServerTime)
+		}
+	})
+	bus.SubscribeEvent(func(e *Event) {
+		if e.LiveOnly {
+			return
+		}
+		save := func() {
+			misc_store.SaveEvent(e.TrackerId, e.Topic, e.Message, e.Data, e.Time)
+		}
+		if e.HistoryOnly {
+			w.Submit(save)
+		} else {
+			w.SubmitWait(save)
+		}
+	})
+	bus.SubscribeCommandResponse(func(r *CommandResponse) {
+		w.SubmitWait(func() {
+			misc_store.SaveCommandResponse(r.TrackerId, r.ServerFlag, r.Command, r.SentTime, r.Response, r.Time)
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package eventbus
+
+import (
+	"context"
+	"expvar"
+	"sync"
+
+	"github.com/phuslu/log"
+)
+
+// work dropped because the queue of a worker was full, by worker name
+var dropped = expvar.NewMap("eventbus_worker_dropped")
+
+// Worker run the slow part of subscriber, database write in particular, on its own
+// goroutine so the publishing device is not blocked. Work run in submission order.
+// Work submitted with Submit while the queue is full is dropped, SubmitWait wait for room
+// instead. Work submitted after Shutdown is dropped, both are counted and logged
+type Worker struct {
+	name string
+	log  log.Logger
+	//mu is held for reading while queueing, Shutdown close the queue holding it for writing
+	mu     sync.RWMutex
+	closed bool
+	queue  chan func()
+	done   chan struct{}
+}
+
+// NewWorker return a worker queueing up to size work, Run must be called to start it
+func NewWorker(name string, size int) *Worker {
+	w := &Worker{name: name}
+	w.log = log.DefaultLogger
+	w.log.Context = log.NewContext(nil).Str("module", "eventbus").Str("worker", name).Value()
+	w.queue = make(chan func(), size)
+	w.done = make(chan struct{})
+	return w
+}
+
+func (w *Worker) Run() {
+	defer close(w.done)
+	for f := range w.queue {
+		f()
+	}
+}
+
+// Submit queue f without blocking, f is dropped when the queue is full. It is meant for
+// frequent write where losing one is harmless
+func (w *Worker) Submit(f func()) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.drop("worker closed, dropping work")
+		return
+	}
+	select {
+	case w.queue <- f:
+	default:
+		w.drop("worker queue full, dropping work")
+	}
+}
+
+// SubmitWait queue f, blocking while the queue is full. It is meant for write which must
+// not be lost, the publisher is only held back once the whole queue is waiting
+func (w *Worker) SubmitWait(f func()) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.drop("worker closed, dropping work")
+		return
+	}
+	select {
+	case w.queue <- f:
+	default:
+		w.log.Warn().Msg("worker queue full, waiting")
+		w.queue <- f
+	}
+}
+
+func (w *Worker) drop(msg string) {
+	dropped.Add(w.name, 1)
+	w.log.Warn().Msg(msg)
+}
+
+// Shutdown run the work already queued and wait for it or ctx to expire
+func (w *Worker) Shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
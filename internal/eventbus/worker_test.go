@@ -0,0 +1,130 @@
+package eventbus
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func shutdownWorker(t *testing.T, w *Worker) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func droppedCount(name string) int64 {
+	v := dropped.Get(name)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
+
+func TestWorkerOrder(t *testing.T) {
+	w := NewWorker("test_order", 100)
+	go w.Run()
+	got := make([]int, 0)
+	for i := 0; i < 50; i++ {
+		i := i
+		w.Submit(func() { got = append(got, i) })
+	}
+	shutdownWorker(t, w)
+	if len(got) != 50 {
+		t.Fatalf("ran %d work", len(got))
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("ran out of order %v", got)
+		}
+	}
+}
+
+func TestWorkerOverflow(t *testing.T) {
+	w := NewWorker("test_overflow", 2)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var mu sync.Mutex
+	got := make([]string, 0)
+	run := func(s string) func() {
+		return func() {
+			mu.Lock()
+			got = append(got, s)
+			mu.Unlock()
+		}
+	}
+	go w.Run()
+	w.Submit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	//the queue hold 2 work while the first one run
+	w.Submit(run("a"))
+	w.Submit(run("b"))
+	before := droppedCount("test_overflow")
+	w.Submit(run("dropped"))
+	if n := droppedCount("test_overflow") - before; n != 1 {
+		t.Fatalf("%d work dropped", n)
+	}
+	queued := make(chan struct{})
+	go func() {
+		w.SubmitWait(run("waited"))
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		t.Fatal("SubmitWait did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SubmitWait still blocked")
+	}
+	shutdownWorker(t, w)
+	if !reflect.DeepEqual(got, []string{"a", "b", "waited"}) {
+		t.Fatalf("ran %v", got)
+	}
+}
+
+func TestWorkerShutdown(t *testing.T) {
+	w := NewWorker("test_shutdown", 10)
+	ran := 0
+	for i := 0; i < 3; i++ {
+		w.Submit(func() { ran++ })
+	}
+	//work queued before Run is still run by Shutdown
+	go w.Run()
+	shutdownWorker(t, w)
+	if ran != 3 {
+		t.Fatalf("ran %d work", ran)
+	}
+	before := droppedCount("test_shutdown")
+	w.Submit(func() { ran++ })
+	w.SubmitWait(func() { ran++ })
+	if ran != 3 || droppedCount("test_shutdown")-before != 2 {
+		t.Fatalf("work run after shutdown")
+	}
+	//Shutdown twice is harmless
+	shutdownWorker(t, w)
+}
+
+func TestWorkerShutdownTimeout(t *testing.T) {
+	w := NewWorker("test_timeout", 10)
+	release := make(chan struct{})
+	defer close(release)
+	go w.Run()
+	w.Submit(func() { <-release })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returned %v", err)
+	}
+}
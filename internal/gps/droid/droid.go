@@ -11,6 +11,7 @@ import (
 	"github.com/phuslu/log"
 	"nuha.dev/gpstracker/internal/gps/client"
 	"nuha.dev/gpstracker/internal/gps/server"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
 	"nuha.dev/gpstracker/internal/store"
 	"nuha.dev/gpstracker/internal/util/wc"
 )
@@ -212,7 +213,7 @@ func (dr *Droid) run() {
 			}
 			dr.log.Debug().Str("event", "location update").RawJSON("event_data", msg.Data).Msg("")
 			dr.session.Sublist.MarshalSend(dr.tid, dr.loc.Latitude, dr.loc.Longitude, dr.loc.Speed, dr.loc.GpsTime, tread)
-			dr.store.Put(fsn, dr.loc.Latitude, dr.loc.Longitude, dr.loc.Altitude, dr.loc.Speed, dr.loc.GpsTime, tread)
+			dr.store.Put(fsn, &device.Location{Latitude: dr.loc.Latitude, Longitude: dr.loc.Longitude, Altitude: dr.loc.Altitude, Speed: dr.loc.Speed, Timestamp: dr.loc.GpsTime}, tread)
 			dr.session.UpdateLocation(dr.loc.Longitude, dr.loc.Latitude, dr.loc.GpsTime.UTC())
 		case "status":
 			status := StatusData{}
@@ -11,6 +11,7 @@ import (
 	"nuha.dev/gpstracker/internal/gps/client"
 	"nuha.dev/gpstracker/internal/gps/server"
 	"nuha.dev/gpstracker/internal/gps/subscriber"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
 	"nuha.dev/gpstracker/internal/store"
 	"nuha.dev/gpstracker/internal/util/wc"
 )
@@ -239,7 +240,7 @@ func (gt06 *GT06) run() {
 
 			loc := parseGK310GPSMessage(gt06.msg.Payload)
 			mps_speed := (float32(loc.Speed) * 1000) / 3600
-			gt06.store.Put(fsn, loc.Latitude, loc.Longitude, -1, mps_speed, loc.Timestamp, tread)
+			gt06.store.Put(fsn, &device.Location{Latitude: loc.Latitude, Longitude: loc.Longitude, Altitude: -1, Speed: mps_speed, Timestamp: loc.Timestamp}, tread)
 			gt06.session.Sublist.MarshalSend(gt06.tid, loc.Latitude, loc.Longitude, mps_speed, loc.Timestamp, tread)
 			gt06.session.UpdateLocation(loc.Longitude, loc.Latitude, loc.Timestamp.UTC())
 			gt06.lastGK310Location = loc
@@ -247,7 +248,7 @@ func (gt06 *GT06) run() {
 		case byte(gt06GPS):
 			loc := parseGT06GPSMessage(gt06.msg.Payload)
 			mps_speed := (float32(loc.Speed) * 1000) / 3600
-			gt06.store.Put(fsn, loc.Latitude, loc.Longitude, -1, mps_speed, loc.Timestamp, tread)
+			gt06.store.Put(fsn, &device.Location{Latitude: loc.Latitude, Longitude: loc.Longitude, Altitude: -1, Speed: mps_speed, Timestamp: loc.Timestamp}, tread)
 			gt06.session.Sublist.MarshalSend(gt06.tid, loc.Latitude, loc.Longitude, mps_speed, loc.Timestamp, tread)
 			gt06.session.UpdateLocation(loc.Longitude, loc.Latitude, loc.Timestamp.UTC())
 			gt06.lastGT06Location = loc
@@ -0,0 +1,390 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/geofence"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const ALERT_TRIGGERED string = "alert.triggered"
+
+type EngineConfig struct {
+	//rule edited through the api are picked up after this long, default 1 minute
+	ReloadInterval time.Duration
+	//how often offline tracker are looked for, default 30 second
+	CheckInterval time.Duration
+}
+
+// Engine evaluate alert rule against location and event of every tracker published on the bus.
+// A stateful rule trigger once when its condition start holding and is armed again when the
+// condition clear, the alert itself stay open until acknowledged and resolved through the api.
+// Offline rule only watch tracker which sent something since the engine started
+type Engine struct {
+	mu     sync.Mutex
+	store  store.AlertStore
+	bus    *eventbus.EventBus
+	log    log.Logger
+	config *EngineConfig
+
+	rules     []*rule
+	state     map[state_key]*rule_state
+	last_seen map[uint64]time.Time
+
+	//save triggered alert out of the publishing goroutine
+	worker *eventbus.Worker
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type rule struct {
+	store.AlertRule
+	trackers map[uint64]bool
+	zone     *time.Location
+	start    int //minute of day
+	end      int
+	weekdays map[time.Weekday]bool
+}
+
+type state_key struct {
+	rule uint64
+	tid  uint64
+}
+
+type rule_state struct {
+	since  time.Time
+	active bool
+}
+
+type trigger struct {
+	r      *rule
+	tid    uint64
+	detail interface{}
+	t      time.Time
+}
+
+// NewEngine subscribe the engine to bus, triggered alert are published back to it
+func NewEngine(st store.AlertStore, bus *eventbus.EventBus, config *EngineConfig) *Engine {
+	e := &Engine{store: st, bus: bus, config: config}
+	if e.config.ReloadInterval == 0 {
+		e.config.ReloadInterval = time.Minute
+	}
+	if e.config.CheckInterval == 0 {
+		e.config.CheckInterval = 30 * time.Second
+	}
+	e.log = log.DefaultLogger
+	e.log.Context = log.NewContext(nil).Str("module", "alert").Value()
+	e.state = make(map[state_key]*rule_state)
+	e.last_seen = make(map[uint64]time.Time)
+	e.worker = eventbus.NewWorker("alert", 1000)
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	bus.SubscribeLocation(e.handle_location)
+	bus.SubscribeEvent(e.handle_event)
+	return e
+}
+
+func (e *Engine) Run() {
+	e.log.Info().Msg("starting alert engine")
+	defer close(e.done)
+	go e.worker.Run()
+	e.reload()
+	reload := time.NewTicker(e.config.ReloadInterval)
+	defer reload.Stop()
+	check := time.NewTicker(e.config.CheckInterval)
+	defer check.Stop()
+	for {
+		select {
+		case <-reload.C:
+			e.reload()
+		case t := <-check.C:
+			e.check_offline(t)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Shutdown stop the engine and wait for triggered alert to be saved
+func (e *Engine) Shutdown(ctx context.Context) error {
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.worker.Shutdown(ctx)
+}
+
+// reload keep the state of rule still present, a failed reload keep the previous rules
+func (e *Engine) reload() {
+	rules, err := e.store.AlertRules()
+	if err != nil {
+		e.log.Error().Err(err).Msg("error loading alert rule")
+		return
+	}
+	parsed := make([]*rule, 0, len(rules))
+	ids := make(map[uint64]bool, len(rules))
+	for _, ar := range rules {
+		r, err := parse_rule(ar)
+		if err != nil {
+			e.log.Error().Err(err).Uint64("rule_id", ar.Id).Msg("invalid alert rule")
+			continue
+		}
+		parsed = append(parsed, r)
+		ids[r.Id] = true
+	}
+	e.mu.Lock()
+	e.rules = parsed
+	for k := range e.state {
+		if !ids[k.rule] {
+			delete(e.state, k)
+		}
+	}
+	e.mu.Unlock()
+}
+
+func parse_rule(ar store.AlertRule) (*rule, error) {
+	r := &rule{AlertRule: ar}
+	if ar.Trackers != nil {
+		r.trackers = make(map[uint64]bool, len(ar.Trackers))
+		for _, tid := range ar.Trackers {
+			r.trackers[tid] = true
+		}
+	}
+	if ar.Kind != store.RULE_ACC_HOURS {
+		return r, nil
+	}
+	r.zone = time.Local
+	if ar.Params.Timezone != "" {
+		z, err := device.ParseTimezone(ar.Params.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		r.zone = z
+	}
+	var err error
+	r.start, err = ParseClock(ar.Params.Start)
+	if err != nil {
+		return nil, err
+	}
+	r.end, err = ParseClock(ar.Params.End)
+	if err != nil {
+		return nil, err
+	}
+	if len(ar.Params.Weekdays) > 0 {
+		r.weekdays = make(map[time.Weekday]bool)
+		for _, d := range ar.Params.Weekdays {
+			r.weekdays[time.Weekday(d)] = true
+		}
+	}
+	return r, nil
+}
+
+// ParseClock parse hh:mm into minute of day
+func ParseClock(s string) (int, error) {
+	var h, m int
+	_, err := fmt.Sscanf(s, "%d:%d", &h, &m)
+	if err != nil || h < 0 || h > 24 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %s", s)
+	}
+	return h*60 + m, nil
+}
+
+func (r *rule) applies(tid uint64) bool {
+	return r.trackers == nil || r.trackers[tid]
+}
+
+// business_hours return whether t fall in the business hours of an acc_off_hours rule
+func (r *rule) business_hours(t time.Time) bool {
+	lt := t.In(r.zone)
+	if r.weekdays != nil && !r.weekdays[lt.Weekday()] {
+		return false
+	}
+	m := lt.Hour()*60 + lt.Minute()
+	if r.start <= r.end {
+		return m >= r.start && m < r.end
+	}
+	//business hours spanning midnight
+	return m >= r.start || m < r.end
+}
+
+// hold update the condition of rule r for tid and return true when it start holding for dur
+func (e *Engine) hold(r *rule, tid uint64, cond bool, t time.Time, dur time.Duration) bool {
+	k := state_key{rule: r.Id, tid: tid}
+	s, ok := e.state[k]
+	if !ok {
+		s = &rule_state{}
+		e.state[k] = s
+	}
+	if !cond {
+		s.since = time.Time{}
+		s.active = false
+		return false
+	}
+	if s.since.IsZero() {
+		s.since = t
+	}
+	if !s.active && t.Sub(s.since) >= dur {
+		s.active = true
+		return true
+	}
+	return false
+}
+
+// position is where a location rule triggered
+type position struct {
+	Speed     float32   `json:"speed"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lon"`
+	Timestamp time.Time `json:"gps_time"`
+}
+
+func (e *Engine) handle_location(l *eventbus.Location) {
+	tid, loc, server_time := l.TrackerId, l.Location, l.ServerTime
+	triggers := make([]trigger, 0)
+	e.mu.Lock()
+	e.last_seen[tid] = server_time
+	if l.Approximate {
+		//speed and acc are not known
+		e.mu.Unlock()
+		return
+	}
+	for _, r := range e.rules {
+		if !r.applies(tid) {
+			continue
+		}
+		switch r.Kind {
+		case store.RULE_OVERSPEED:
+			cond := float64(loc.Speed) > r.Params.Speed
+			if e.hold(r, tid, cond, loc.Timestamp, time.Duration(r.Params.Duration)*time.Second) {
+				triggers = append(triggers, trigger{r: r, tid: tid, t: server_time,
+					detail: position{Speed: loc.Speed, Latitude: loc.Latitude, Longitude: loc.Longitude, Timestamp: loc.Timestamp}})
+			}
+		case store.RULE_ACC_HOURS:
+			if loc.ACC == nil {
+				continue
+			}
+			cond := *loc.ACC && !r.business_hours(loc.Timestamp)
+			if e.hold(r, tid, cond, loc.Timestamp, 0) {
+				triggers = append(triggers, trigger{r: r, tid: tid, t: server_time,
+					detail: position{Speed: loc.Speed, Latitude: loc.Latitude, Longitude: loc.Longitude, Timestamp: loc.Timestamp}})
+			}
+		}
+	}
+	e.mu.Unlock()
+	e.fire(triggers)
+}
+
+func (e *Engine) handle_event(ev *eventbus.Event) {
+	tid, topic, t := ev.TrackerId, ev.Topic, ev.Time
+	if ev.HistoryOnly || strings.HasPrefix(topic, "alert.") {
+		return
+	}
+	triggers := make([]trigger, 0)
+	e.mu.Lock()
+	//event raised by the server does not mean the tracker is online
+	if topic != "disconnected" && topic != "server_shutdown" {
+		e.last_seen[tid] = t
+	}
+	for _, r := range e.rules {
+		if !r.applies(tid) {
+			continue
+		}
+		switch r.Kind {
+		case store.RULE_LOW_VOLTAGE:
+			if topic != device.EVENT_POWER_VOLTAGE {
+				continue
+			}
+			pv, ok := ev.Data.(device.PowerVoltage)
+			if !ok {
+				continue
+			}
+			v := pv.Battery
+			if r.Params.External {
+				v = pv.External
+			}
+			if v == nil {
+				continue
+			}
+			if e.hold(r, tid, *v < r.Params.Voltage, t, 0) {
+				triggers = append(triggers, trigger{r: r, tid: tid, t: t, detail: pv})
+			}
+		case store.RULE_GEOFENCE:
+			if topic != geofence.GEOFENCE_ENTER && topic != geofence.GEOFENCE_EXIT {
+				continue
+			}
+			if r.Params.Transition != "" && "geofence."+r.Params.Transition != topic {
+				continue
+			}
+			c, ok := ev.Data.(geofence.Crossing)
+			if !ok {
+				continue
+			}
+			if r.Params.GeofenceId != 0 && r.Params.GeofenceId != c.GeofenceId {
+				continue
+			}
+			triggers = append(triggers, trigger{r: r, tid: tid, t: t, detail: struct {
+				Topic string `json:"topic"`
+				geofence.Crossing
+			}{topic, c}})
+		}
+	}
+	e.mu.Unlock()
+	e.fire(triggers)
+}
+
+type offline struct {
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (e *Engine) check_offline(now time.Time) {
+	triggers := make([]trigger, 0)
+	e.mu.Lock()
+	for _, r := range e.rules {
+		if r.Kind != store.RULE_OFFLINE {
+			continue
+		}
+		for tid, seen := range e.last_seen {
+			if !r.applies(tid) {
+				continue
+			}
+			cond := now.Sub(seen) >= time.Duration(r.Params.Minutes)*time.Minute
+			if e.hold(r, tid, cond, now, 0) {
+				triggers = append(triggers, trigger{r: r, tid: tid, t: now, detail: offline{LastSeen: seen}})
+			}
+		}
+	}
+	e.mu.Unlock()
+	e.fire(triggers)
+}
+
+// fire hand triggered alert to the worker, saving them must not block the publishing device
+func (e *Engine) fire(triggers []trigger) {
+	if len(triggers) == 0 {
+		return
+	}
+	e.worker.SubmitWait(func() { e.save(triggers) })
+}
+
+// save record the alert and publish it as alert.triggered event
+func (e *Engine) save(triggers []trigger) {
+	for _, tr := range triggers {
+		a := store.Alert{RuleId: tr.r.Id, TrackerId: tr.tid, Kind: tr.r.Kind, Name: tr.r.Name, Detail: tr.detail, TriggeredAt: tr.t}
+		err := e.store.SaveAlert(&a)
+		if err != nil {
+			e.log.Error().Err(err).Uint64("rule_id", a.RuleId).Uint64("tracker_id", a.TrackerId).Msg("error saving alert")
+			continue
+		}
+		e.log.Info().Uint64("rule_id", a.RuleId).Uint64("tracker_id", a.TrackerId).Str("kind", a.Kind).Msg("alert triggered")
+		e.bus.PublishEvent(&eventbus.Event{TrackerId: tr.tid, Topic: ALERT_TRIGGERED, Message: a.Name, Data: a, Time: tr.t})
+	}
+}
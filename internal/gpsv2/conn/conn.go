@@ -2,6 +2,8 @@ package conn
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 
 	"github.com/phuslu/log"
@@ -25,10 +27,36 @@ func (b *Conn) Peek(n int) ([]byte, error) {
 	return b.r.Peek(n)
 }
 
+func (b *Conn) Buffered() int {
+	return b.r.Buffered()
+}
+
+func (b *Conn) ReadSlice(delim byte) ([]byte, error) {
+	return b.r.ReadSlice(delim)
+}
+
+func (b *Conn) UnreadByte() error {
+	return b.r.UnreadByte()
+}
+
 func (b *Conn) Read(p []byte) (int, error) {
 	return b.r.Read(p)
 }
 
+// PeerCertificate return the client certificate of a tls connection, nil when the
+// connection is not tls or no certificate was presented
+func (b *Conn) PeerCertificate() *x509.Certificate {
+	tc, ok := b.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
 func (b *Conn) ConnAddr() []string {
 	return b.tuple
 }
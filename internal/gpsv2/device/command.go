@@ -0,0 +1,49 @@
+package device
+
+import (
+	"errors"
+)
+
+type CommandType string
+
+const (
+	COMMAND_ENGINE_CUT    CommandType = "engine_cut"
+	COMMAND_ENGINE_RESUME CommandType = "engine_resume"
+	COMMAND_SET_INTERVAL  CommandType = "set_interval"
+	COMMAND_REBOOT        CommandType = "reboot"
+	COMMAND_RAW           CommandType = "raw"
+)
+
+var ErrCommandNotSupported = errors.New("command not supported by device")
+var ErrInvalidCommand = errors.New("invalid command")
+
+// Command is protocol neutral, each device translate it into its own message
+type Command struct {
+	Type CommandType `json:"type" validate:"required,oneof=engine_cut engine_resume set_interval reboot raw"`
+	//report interval in second, for set_interval
+	Interval int `json:"interval,omitempty"`
+	//passed as is to the device, for raw
+	Raw string `json:"raw,omitempty"`
+}
+
+// Commander is implemented by device accepting command, ExecuteCommand return true
+// when a previous command is still pending and force is not set
+type Commander interface {
+	Capabilities() []CommandType
+	ExecuteCommand(cmd Command, force bool) (bool, error)
+}
+
+// CommandQueuer is implemented by device delivering command from the persistent queue,
+// DeliverQueued wake the delivery after a command is queued
+type CommandQueuer interface {
+	DeliverQueued()
+}
+
+func HasCapability(c Commander, t CommandType) bool {
+	for _, v := range c.Capabilities() {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
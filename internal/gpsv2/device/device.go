@@ -1,7 +1,9 @@
 package device
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/phuslu/log"
@@ -11,14 +13,36 @@ import (
 const (
 	DEVICE_GT06       string = "gt06"
 	DEVICE_SIMPLEJSON string = "simplejson"
+	DEVICE_H02        string = "h02"
+	DEVICE_TELTONIKA  string = "teltonika"
+	DEVICE_JT808      string = "jt808"
+	DEVICE_OSMAND     string = "osmand"
 )
 
 type DeviceIf interface {
+	Run()
 	ReplaceConn(c *conn.Conn)
 	Stop()
 	CurrentConnInfo() []string
 	GetLocation() Location
 }
+
+// Registrar is implemented by device whose terminal register for an authentication code,
+// ResetRegistration let the terminal register again after losing its code
+type Registrar interface {
+	ResetRegistration()
+}
+
+// EVENT_POWER_VOLTAGE is sent to the sublist with PowerVoltage when a device report its
+// voltage, it is not saved as event since the value is kept as tracker attribute
+const EVENT_POWER_VOLTAGE string = "power.voltage"
+
+// PowerVoltage is in volt, absent field is not reported by the device
+type PowerVoltage struct {
+	External *float64 `json:"external_voltage,omitempty"`
+	Battery  *float64 `json:"battery_voltage,omitempty"`
+}
+
 type FSN struct {
 	SnType string
 	Serial uint64
@@ -31,6 +55,20 @@ type Location struct {
 	Altitude  float32   `json:"alt"`
 	Speed     float32   `json:"speed"`
 	Timestamp time.Time `json:"gps_time"`
+	//optional field below are nil when the protocol does not report them
+	Course   *float32 `json:"course,omitempty"`
+	SatCount *int     `json:"sat_count,omitempty"`
+	HDOP     *float32 `json:"hdop,omitempty"`
+	Accuracy *float32 `json:"accuracy,omitempty"` //meter
+	Valid    *bool    `json:"valid,omitempty"`
+	ACC      *bool    `json:"acc,omitempty"`
+	Odometer *float64 `json:"odometer,omitempty"` //meter
+}
+
+// IsValid is false when the device reported no fix or the validator tagged the location,
+// such location is stored but not used for trip, usage and geofence
+func (l *Location) IsValid() bool {
+	return l.Valid == nil || *l.Valid
 }
 
 type Serial struct {
@@ -102,13 +140,62 @@ func SnTypeString(sn_type int) string {
 		return "misc1"
 	case 4:
 		return "misc2"
+	case 6:
+		return "phone"
+	case 7:
+		return "osmand"
 	}
 	return "other"
 }
 
+func SnTypeFromString(sn_type string) (int, bool) {
+	switch sn_type {
+	case "imei":
+		return 0, true
+	case "mac":
+		return 1, true
+	case "aid":
+		return 2, true
+	case "misc1":
+		return 3, true
+	case "misc2":
+		return 4, true
+	case "phone":
+		return 6, true
+	case "osmand":
+		return 7, true
+	}
+	return 0, false
+}
+
+// ParseSerial parse serial formatted as `<sn_type>:<sn>`, sn is formatted the
+// same way as FormatSnPretty
+func ParseSerial(s string) (Serial, error) {
+	sntypesn := strings.SplitN(s, ":", 2)
+	if len(sntypesn) != 2 {
+		return Serial{}, fmt.Errorf("invalid serial format : %s", s)
+	}
+	sn_type, ok := SnTypeFromString(sntypesn[0])
+	if !ok {
+		return Serial{}, fmt.Errorf("unknown sn_type : %s", sntypesn[0])
+	}
+	base := 16
+	if sn_type == 0 || sn_type == 6 || sn_type == 7 {
+		base = 10
+	}
+	sn, err := strconv.ParseUint(sntypesn[1], base, 64)
+	if err != nil {
+		return Serial{}, fmt.Errorf("invalid serial number : %w", err)
+	}
+	return NewSerial(sn_type, sn), nil
+}
+
 func FormatSnPretty(sn_type int, sn uint64) string {
 	switch sn_type {
-	case 0:
+	case 0, 7:
+		return strconv.FormatUint(sn, 10)
+	case 6:
+		//2013 and 2019 version phone are padded to different length, the padding is not kept
 		return strconv.FormatUint(sn, 10)
 	default:
 		return strconv.FormatUint(sn, 16)
@@ -145,4 +232,62 @@ type DeviceConfig struct {
 	Broadcast    bool   `json:"broadcast"`
 	LogLevel     string `json:"log_level" `
 	ReadDeadline int    `json:"read_deadline"`
+	//second to wait for a queued command response before retrying it
+	CommandTimeout int `json:"command_timeout"`
+	//what to do with location failing validation : drop, tag or none, drop when empty
+	Validation string `json:"validation"`
+	//max speed in m/s between two consecutive location, default 70
+	MaxSpeed float64 `json:"max_speed"`
+	//second gps time may be ahead of server time, default 300
+	MaxFutureTime int `json:"max_future_time"`
+	//second gps time may be behind server time, default 7 days
+	MaxGpsAge int `json:"max_gps_age"`
+	//timezone of device reporting local time, IANA name or offset like +07:00,
+	//it take precedence over the offset reported by the device
+	Timezone string `json:"timezone"`
+	//second between gps time and server time before the device clock is flagged as drifting, default 300
+	MaxClockDrift int `json:"max_clock_drift"`
+	//min speed in m/s for the tracker to be moving, default 1.5
+	TripMinSpeed float64 `json:"trip_min_speed"`
+	//second standing still before a trip end, default 300
+	TripStopDuration int `json:"trip_stop_duration"`
+	//trip shorter than this distance in meter is ignored, default 300
+	TripMinDistance float64 `json:"trip_min_distance"`
+	//geofence assigned to this group apply to the tracker too
+	Group string `json:"group"`
+	//meter a tracker must be past a geofence boundary to enter or exit it, default 20
+	GeofenceHysteresis float64 `json:"geofence_hysteresis"`
+}
+
+// ParseTimezone parse IANA timezone name or fixed offset formatted as +07:00, +0700 or +07
+func ParseTimezone(s string) (*time.Location, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty timezone")
+	}
+	if s[0] == '+' || s[0] == '-' {
+		d := strings.ReplaceAll(s[1:], ":", "")
+		if len(d) != 2 && len(d) != 4 {
+			return nil, fmt.Errorf("invalid timezone offset %s", s)
+		}
+		h, err := strconv.Atoi(d[:2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone offset %s", s)
+		}
+		m := 0
+		if len(d) == 4 {
+			m, err = strconv.Atoi(d[2:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid timezone offset %s", s)
+			}
+		}
+		if h > 14 || m > 59 {
+			return nil, fmt.Errorf("invalid timezone offset %s", s)
+		}
+		offset := h*3600 + m*60
+		if s[0] == '-' {
+			offset = -offset
+		}
+		return time.FixedZone("UTC"+s, offset), nil
+	}
+	return time.LoadLocation(s)
 }
@@ -0,0 +1,47 @@
+package gt06
+
+import "fmt"
+
+type alarmInfo struct {
+	topic   string
+	message string
+}
+
+// alarm value carried in the alarm/language byte of alarm packet, the event topic it is
+// published as and its message
+var altAlarms = map[int]alarmInfo{
+	0x01: {"alarm.sos", "SOS"},
+	0x02: {"alarm.power_cut", "power cut"},
+	0x03: {"alarm.vibration", "vibration"},
+	0x04: {"alarm.geofence_in", "entering geofence"},
+	0x05: {"alarm.geofence_out", "leaving geofence"},
+	0x06: {"alarm.overspeed", "overspeed"},
+	0x0E: {"alarm.low_battery", "low external power"},
+	0x0F: {"alarm.low_battery", "low battery"},
+	0x13: {"alarm.tamper", "tamper"},
+	0xFE: {"alarm.acc_on", "ACC on"},
+	0xFF: {"alarm.acc_off", "ACC off"},
+}
+
+// alarm value of bit 3-5 of the terminal information byte
+var alarms = map[int]alarmInfo{
+	0b001: {"alarm.vibration", "vibration"},
+	0b010: {"alarm.power_cut", "power cut"},
+	0b011: {"alarm.low_battery", "low battery"},
+	0b100: {"alarm.sos", "SOS"},
+}
+
+// decodeAlarm return event topic and message of the alarm in si, the alarm/language byte
+// take precedence since it is more specific than terminal information bits. fence is the
+// fence number reported by multi fence alarm, nil otherwise.
+// empty topic is returned when alarm is unknown
+func decodeAlarm(si statusInfo, fence *int) (string, string) {
+	a, ok := altAlarms[si.AltAlarmCode]
+	if !ok {
+		a = alarms[si.AlarmCode]
+	}
+	if a.topic != "" && fence != nil {
+		a.message = fmt.Sprintf("%s %d", a.message, *fence)
+	}
+	return a.topic, a.message
+}
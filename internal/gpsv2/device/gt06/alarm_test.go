@@ -0,0 +1,128 @@
+package gt06
+
+import (
+	"encoding/hex"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+)
+
+// gps 2011-11-15 14:36:29, 23.111755 N 114.409244 E, lbs 460/0 10365/8120,
+// terminal information 0x46 : gps positioned, charging, acc on
+var alarmFrames = []struct {
+	name    string
+	frame   string
+	topic   string
+	message string
+}{
+	{"gt06 alarm byte 01", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84604040102000180720D0A", "alarm.sos", "SOS"},
+	{"gt06 alarm byte 02", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84604040202000297240D0A", "alarm.power_cut", "power cut"},
+	{"gt06 alarm byte 03", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB8460404030200039A160D0A", "alarm.vibration", "vibration"},
+	{"gt06 alarm byte 04", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB846040404020004B9880D0A", "alarm.geofence_in", "entering geofence"},
+	{"gt06 alarm byte 05", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB846040405020005B4BA0D0A", "alarm.geofence_out", "leaving geofence"},
+	{"gt06 alarm byte 06", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB846040406020006A3EC0D0A", "alarm.overspeed", "overspeed"},
+	{"gt06 alarm byte 0e", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84604040E02000757BD0D0A", "alarm.low_battery", "low external power"},
+	{"gt06 alarm byte 0f", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84604040F020008B3F10D0A", "alarm.low_battery", "low battery"},
+	{"gt06 alarm byte 13", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB846040413020009F6ED0D0A", "alarm.tamper", "tamper"},
+	{"gt06 alarm byte fe", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB8460404FE02000AFB730D0A", "alarm.acc_on", "ACC on"},
+	{"gt06 alarm byte ff", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB8460404FF02000BF6410D0A", "alarm.acc_off", "ACC off"},
+	{"gt06 terminal information 001", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84E04040002000C99C00D0A", "alarm.vibration", "vibration"},
+	{"gt06 terminal information 010", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB85604040002000DE36C0D0A", "alarm.power_cut", "power cut"},
+	{"gt06 terminal information 011", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB85E04040002000E0F1B0D0A", "alarm.low_battery", "low battery"},
+	{"gt06 terminal information 100", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB86604040002000F16340D0A", "alarm.sos", "SOS"},
+	{"gk310 alarm byte 06", "787825260B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB846040406020010AAFA0D0A", "alarm.overspeed", "overspeed"},
+	{"gk310 without lbs", "78781D260B0B0F0E241DCF027AC8870C465800001454004604040102001177450D0A", "alarm.sos", "SOS"},
+	{"multi fence geofence in", "787826270B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84604040402020012C78A0D0A", "alarm.geofence_in", "entering geofence 2"},
+	{"multi fence geofence out", "787826270B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB84604040502030013879B0D0A", "alarm.geofence_out", "leaving geofence 3"},
+	{"unknown alarm", "787825160B0B0F0E241DCF027AC8870C4658000014540901CC00287D001FB846040400020014DBE50D0A", "", ""},
+}
+
+func readFrame(t *testing.T, frame string) Message {
+	d, err := hex.DecodeString(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(d)
+		client.Close()
+	}()
+	msg := Message{Buffer: make([]byte, 1024)}
+	err = readMessage(conn.NewConn(server, 1), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDecodeAlarm(t *testing.T) {
+	for _, c := range alarmFrames {
+		t.Run(c.name, func(t *testing.T) {
+			msg := readFrame(t, c.frame)
+			m, err := parseGPSAlarm(msg.Protocol, msg.Payload, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(m.Latitude-23.111755) > 1e-6 || math.Abs(m.Longitude-114.409244) > 1e-6 {
+				t.Fatalf("location %f %f", m.Latitude, m.Longitude)
+			}
+			if !m.Timestamp.Equal(time.Date(2011, 11, 15, 14, 36, 29, 0, time.UTC)) {
+				t.Fatalf("timestamp %s", m.Timestamp)
+			}
+			if !m.ACC || !m.Charging {
+				t.Fatalf("status %+v", m.statusInfo)
+			}
+			topic, message := decodeAlarm(m.statusInfo, m.Fence)
+			if topic != c.topic || message != c.message {
+				t.Fatalf("got %q %q, expected %q %q", topic, message, c.topic, c.message)
+			}
+		})
+	}
+}
+
+func TestParseGPSAlarmLocalTime(t *testing.T) {
+	zone := time.FixedZone("UTC+7", 7*3600)
+	msg := readFrame(t, alarmFrames[0].frame)
+	m, err := parseGPSAlarm(msg.Protocol, msg.Payload, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Timestamp.Equal(time.Date(2011, 11, 15, 7, 36, 29, 0, time.UTC)) {
+		t.Fatalf("timestamp %s", m.Timestamp)
+	}
+	if m.MCC != 460 || m.LAC != 10365 || m.CellID != 8120 {
+		t.Fatalf("lbs %+v", m.gt06CellInfo)
+	}
+}
+
+func TestParseGPSAlarmTruncated(t *testing.T) {
+	for _, c := range alarmFrames {
+		msg := readFrame(t, c.frame)
+		for n := 0; n < len(msg.Payload); n++ {
+			_, err := parseGPSAlarm(msg.Protocol, msg.Payload[:n], time.UTC)
+			if err == nil {
+				t.Fatalf("%s : no error for payload truncated to %d bytes", c.name, n)
+			}
+		}
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	for _, frame := range []string{"7878", "787801160D0A", "7878251600", "7878001600000D0A"} {
+		d, _ := hex.DecodeString(frame)
+		client, server := net.Pipe()
+		go func() {
+			client.Write(d)
+			client.Close()
+		}()
+		msg := Message{Buffer: make([]byte, 1024)}
+		if readMessage(conn.NewConn(server, 1), &msg) == nil {
+			t.Fatalf("no error reading %s", frame)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package gt06
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+const default_max_clock_drift = 300 * time.Second
+
+// consecutive drifting sample needed before the clock is flagged, a device uploading
+// buffered location show a shrinking drift instead of a steady one
+const drift_samples = 3
+
+// drift between two sample to consider them the same drift
+const drift_tolerance = 60 * time.Second
+
+type clock_state struct {
+	drift    time.Duration
+	count    int
+	drifting bool
+}
+
+type clockDrift struct {
+	Drift      float64   `json:"drift_seconds"`
+	GpsTime    time.Time `json:"gps_time"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+// device_zone return the zone gps time of gt06 packet is reported in, configured timezone
+// take precedence over the offset sent in login, server local time is kept as last resort
+func device_zone(conf *device.DeviceConfig, login_msg *LoginMessage) (*time.Location, error) {
+	if conf.Timezone != "" {
+		loc, err := device.ParseTimezone(conf.Timezone)
+		if err == nil {
+			return loc, nil
+		}
+		if login_msg.HasTimeOffset {
+			return time.FixedZone("login", int(login_msg.TimeOffset.Seconds())), err
+		}
+		return time.Local, err
+	}
+	if login_msg.HasTimeOffset {
+		return time.FixedZone("login", int(login_msg.TimeOffset.Seconds())), nil
+	}
+	return time.Local, nil
+}
+
+// check_clock flag the device clock when gps time steadily differ from server time t,
+// it must only be called with real time positioned fix
+func (gt06 *GT06) check_clock(gpst time.Time, t time.Time) {
+	max := default_max_clock_drift
+	if gt06.conf.MaxClockDrift > 0 {
+		max = time.Duration(gt06.conf.MaxClockDrift) * time.Second
+	}
+	drift := t.Sub(gpst)
+	cs := &gt06.clock
+	if math.Abs(float64(drift)) <= float64(max) {
+		cs.count = 0
+		if cs.drifting {
+			cs.drifting = false
+			gt06.log.Info().Dur("drift", drift).Msg("clock drift cleared")
+			gt06.save_clock_event("clock_drift.cleared", drift, gpst, t)
+		}
+		return
+	}
+	if cs.count > 0 && math.Abs(float64(drift-cs.drift)) > float64(drift_tolerance) {
+		cs.count = 0
+	}
+	cs.drift = drift
+	cs.count++
+	if cs.count >= drift_samples && !cs.drifting {
+		cs.drifting = true
+		gt06.log.Warn().Dur("drift", drift).Msg("clock drift detected")
+		gt06.misc_store.UpdateAttribute(gt06.tid, "clock_drift", strconv.FormatFloat(drift.Seconds(), 'f', 0, 64))
+		gt06.save_clock_event("clock_drift.detected", drift, gpst, t)
+	}
+}
+
+func (gt06 *GT06) save_clock_event(topic string, drift time.Duration, gpst time.Time, t time.Time) {
+	ev := clockDrift{Drift: math.Round(drift.Seconds()), GpsTime: gpst, ServerTime: t}
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: topic, Data: ev, Time: t})
+}
@@ -0,0 +1,50 @@
+package gt06
+
+import (
+	"fmt"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+var capabilities = []device.CommandType{
+	device.COMMAND_ENGINE_CUT,
+	device.COMMAND_ENGINE_RESUME,
+	device.COMMAND_SET_INTERVAL,
+	device.COMMAND_REBOOT,
+	device.COMMAND_RAW,
+}
+
+func (gt06 *GT06) Capabilities() []device.CommandType {
+	return capabilities
+}
+
+func (gt06 *GT06) ExecuteCommand(cmd device.Command, force bool) (bool, error) {
+	msg, err := translateCommand(cmd)
+	if err != nil {
+		return false, err
+	}
+	return gt06.SendCommand(msg, force)
+}
+
+// translateCommand map command into concox text command
+func translateCommand(cmd device.Command) (string, error) {
+	switch cmd.Type {
+	case device.COMMAND_ENGINE_CUT:
+		return "RELAY,1#", nil
+	case device.COMMAND_ENGINE_RESUME:
+		return "RELAY,0#", nil
+	case device.COMMAND_SET_INTERVAL:
+		if cmd.Interval < 10 || cmd.Interval > 18000 {
+			return "", fmt.Errorf("%w : interval must be between 10 and 18000 second", device.ErrInvalidCommand)
+		}
+		return fmt.Sprintf("TIMER,%d#", cmd.Interval), nil
+	case device.COMMAND_REBOOT:
+		return "RESET#", nil
+	case device.COMMAND_RAW:
+		if cmd.Raw == "" {
+			return "", fmt.Errorf("%w : empty raw command", device.ErrInvalidCommand)
+		}
+		return cmd.Raw, nil
+	}
+	return "", device.ErrCommandNotSupported
+}
@@ -45,6 +45,11 @@ func readMessage(c *conn.Conn, msg *Message) error {
 		return errBadFrame
 	}
 
+	//protocol(1) serial(2) crc(2)
+	if length < 5 {
+		return errBadFrame
+	}
+
 	if len(msg.Buffer) < frame_length {
 		return fmt.Errorf("buffer too small")
 	}
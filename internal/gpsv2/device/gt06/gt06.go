@@ -2,7 +2,6 @@ package gt06
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"net"
 	"strconv"
 	"strings"
@@ -10,9 +9,10 @@ import (
 	"time"
 
 	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
 	"nuha.dev/gpstracker/internal/gpsv2/conn"
 	"nuha.dev/gpstracker/internal/gpsv2/device"
-	"nuha.dev/gpstracker/internal/gpsv2/sublist"
+	"nuha.dev/gpstracker/internal/gpsv2/geoloc"
 
 	// "nuha.dev/gpstracker/internal/gpsv2/msgstore"
 	"nuha.dev/gpstracker/internal/store"
@@ -53,10 +53,13 @@ const (
 // }
 
 type GT06Param struct {
-	Store     store.LocationStore
-	MiscStore store.MiscStore
-	Logger    log.Logger
-	Sublist   *sublist.Sublist
+	Bus          *eventbus.EventBus
+	MiscStore    store.MiscStore
+	CommandStore store.CommandStore
+	Geolocator   *geoloc.Resolver
+	//Running track the read loop goroutine so shutdown can wait for its last publish
+	Running *sync.WaitGroup
+	Logger  log.Logger
 }
 type GT06 struct {
 	c          *conn.Conn
@@ -68,15 +71,21 @@ type GT06 struct {
 	attr       map[string]string
 	err        error_state
 	cmd        command_state
+	queue      queue_state
 	msg        Message
 	log        log.Logger
 	ser        device.Serial
 	tid        uint64
 	conf       *device.DeviceConfig
-	sublist    *sublist.Sublist
-	store      store.LocationStore
+	bus        *eventbus.EventBus
+	running    *sync.WaitGroup
 	misc_store store.MiscStore
-	offset     *time.Duration //offset from device
+	cmd_store  store.CommandStore
+	geo        *geoloc.Resolver
+	validator  *device.LocationValidator
+	zone       *time.Location //zone of gps time reported by device
+	zone_next  *time.Location //zone of c_next, guarded by c_next_mu
+	clock      clock_state
 
 	runningState
 	rs_mu sync.Mutex
@@ -115,6 +124,8 @@ type gt06_status struct {
 type gt06_location struct {
 	mu   sync.Mutex
 	loc  gt06GPSMessage
+	acc  *bool
+	cell gt06CellInfo
 	time time.Time
 }
 
@@ -142,17 +153,21 @@ func NewGT06(tid uint64, ser device.Serial, c *conn.Conn, login_msg *LoginMessag
 	o := &GT06{c: c}
 	o.log = param.Logger
 	o.log.Context = log.NewContext(nil).Str("module", "gt06").EmbedObject(ser).Value()
-	o.store = param.Store
+	o.bus = param.Bus
+	o.running = param.Running
 	o.misc_store = param.MiscStore
 	o.runningState = created
 	o.msg.Buffer = make([]byte, 1000)
-	o.offset = &login_msg.TimeOffset
 	o.conf = conf_attr.Config
-	o.sublist = param.Sublist
+	o.zone = o.login_zone(login_msg)
 	o.tid = tid
 	o.ser = ser
 	o.attr = conf_attr.Attribute
 	o.cmd.status = command_empty
+	o.cmd_store = param.CommandStore
+	o.geo = param.Geolocator
+	o.validator = device.NewLocationValidator(o.conf)
+	o.queue.wake = make(chan struct{}, 1)
 	return o
 }
 
@@ -188,6 +203,7 @@ func (gt06 *GT06) write(d []byte) error {
 }
 
 func (gt06 *GT06) Run() {
+	gt06.running.Add(1)
 	go gt06._run()
 }
 
@@ -210,7 +226,7 @@ func (gt06 *GT06) is_stopped() bool {
 }
 
 func (gt06 *GT06) _run() {
-
+	defer gt06.running.Done()
 	defer func() {
 		gt06.rs_mu.Lock()
 		gt06.runningState = paused
@@ -221,6 +237,12 @@ func (gt06 *GT06) _run() {
 	gt06.rs_mu.Lock()
 	gt06.runningState = running
 	gt06.rs_mu.Unlock()
+	if gt06.cmd_store != nil {
+		quit := make(chan struct{})
+		defer close(quit)
+		gt06.running.Add(1)
+		go gt06.run_queue(quit)
+	}
 	for {
 		gt06.run() //will block
 		if gt06.is_stopped() {
@@ -263,6 +285,12 @@ func (gt06 *GT06) SendCommand(msg string, force bool) (bool, error) {
 }
 
 func (gt06 *GT06) _send_command(msg string, force bool) (bool, error) {
+	return gt06.send_command_flag(msg, 0, force)
+}
+
+// send_command_flag send command with the given server flag, zero take the next one
+// from the counter
+func (gt06 *GT06) send_command_flag(msg string, server_flag uint32, force bool) (bool, error) {
 	gt06.cmd.mu.Lock()
 	if gt06.cmd.status != command_empty {
 		if !force {
@@ -272,9 +300,11 @@ func (gt06 *GT06) _send_command(msg string, force bool) (bool, error) {
 			gt06.log.Warn().Msg("there is pending command")
 		}
 	}
-	gt06.cmd.server_flag_counter++
+	if server_flag == 0 {
+		gt06.cmd.server_flag_counter++
+		server_flag = gt06.cmd.server_flag_counter
+	}
 	gt06.cmd.serial_counter++
-	server_flag := gt06.cmd.server_flag_counter
 	serial := gt06.cmd.serial_counter
 	gt06.cmd.current_server_flag = server_flag
 	gt06.cmd.current_msg = msg
@@ -298,14 +328,23 @@ func (gt06 *GT06) _send_command(msg string, force bool) (bool, error) {
 		gt06.cmd.status = command_sent
 		gt06.cmd.sent_time = t
 		gt06.cmd.mu.Unlock()
-		gt06.misc_store.SaveEvent(gt06.tid, "command.sent", msg, map[string]uint32{"server_flag": server_flag}, t)
+		gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "command.sent", Message: msg, Data: map[string]uint32{"server_flag": server_flag}, Time: t, HistoryOnly: true})
 		return false, nil
 	}
 }
 
-func (gt06 *GT06) set_next_conn(c *conn.Conn) {
+func (gt06 *GT06) login_zone(login_msg *LoginMessage) *time.Location {
+	zone, err := device_zone(gt06.conf, login_msg)
+	if err != nil {
+		gt06.log.Error().Err(err).Str("timezone", gt06.conf.Timezone).Msg("invalid configured timezone")
+	}
+	return zone
+}
+
+func (gt06 *GT06) set_next_conn(c *conn.Conn, zone *time.Location) {
 	gt06.c_next_mu.Lock()
 	gt06.c_next = c
+	gt06.zone_next = zone
 	gt06.c_next_mu.Unlock()
 }
 
@@ -315,6 +354,8 @@ func (gt06 *GT06) set_conn(c *conn.Conn) {
 	gt06.c_mu.Unlock()
 }
 
+// use_next_conn switch to the connection set by ReplaceConn, it is called by the read
+// loop which is the only reader of zone
 func (gt06 *GT06) use_next_conn() bool {
 	gt06.c_next_mu.Lock()
 	defer gt06.c_next_mu.Unlock()
@@ -326,21 +367,34 @@ func (gt06 *GT06) use_next_conn() bool {
 		defer gt06.c_mu.Unlock()
 		gt06.c = gt06.c_next
 		gt06.c_next = nil
+		if gt06.zone_next != nil {
+			gt06.zone = gt06.zone_next
+			gt06.zone_next = nil
+		}
 		return true
 	}
 }
 
 func (gt06 *GT06) ReplaceConn(c *conn.Conn) {
+	gt06.replace_conn(c, nil)
+}
+
+// replace_conn switch to c, zone is applied along with it when not nil
+func (gt06 *GT06) replace_conn(c *conn.Conn, zone *time.Location) {
 	gt06.rs_mu.Lock()
 	if gt06.runningState == running {
-		gt06.set_next_conn(c)
+		gt06.set_next_conn(c, zone)
 		gt06.rs_mu.Unlock()
 		gt06.log.Info().Str("event", CONNECTION_CLOSED).Msg("closing replaced connection")
 		gt06.c.Close()
 
 	} else if gt06.runningState == paused {
 		gt06.set_conn(c)
+		if zone != nil {
+			gt06.zone = zone
+		}
 		gt06.rs_mu.Unlock()
+		gt06.running.Add(1)
 		go gt06._run()
 	}
 }
@@ -354,66 +408,146 @@ func (gt06 *GT06) handle_heartbeat(si statusInfo, t time.Time) {
 	gt06.gt06_status.time = t
 	gt06.gt06_status.si = si
 	gt06.gt06_status.mu.Unlock()
+	gt06.bus.PublishStatus(&eventbus.Status{TrackerId: gt06.tid, ACC: si.ACC, Time: t, Config: gt06.conf})
 
 	if changed {
 		gt06.log.Info().Object("status", &si).Msg("status changed")
-		gt06.misc_store.SaveEvent(gt06.tid, "hearbeat.changed", "", si, t)
-		buf, _ := json.Marshal(si)
-		gt06.sublist.SendEvent("heartbeat.changed", buf, t)
+		//history keep the topic it has always been saved with
+		gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "hearbeat.changed", Data: si, Time: t, HistoryOnly: true})
+		gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "heartbeat.changed", Data: si, Time: t, LiveOnly: true})
 	}
 }
 
-func (gt06 *GT06) handle_alarm(si statusInfo, t time.Time) {
+func (gt06 *GT06) handle_alarm(si statusInfo, fence *int, t time.Time) {
 	gt06.gt06_status.mu.Lock()
 	gt06.gt06_status.time = t
 	gt06.gt06_status.si = si
 	gt06.gt06_status.mu.Unlock()
-	gt06.misc_store.SaveEvent(gt06.tid, "alarm", "", si, t)
-	buf, _ := json.Marshal(si)
-	gt06.sublist.SendEvent("alarm", buf, t)
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "alarm", Data: si, Time: t})
+
+	topic, msg := decodeAlarm(si, fence)
+	if topic == "" {
+		gt06.log.Warn().Int("alarm_code", si.AlarmCode).Int("alt_alarm_code", si.AltAlarmCode).Msg("unknown alarm code")
+		return
+	}
+	gt06.log.Info().Str("topic", topic).Msg("alarm")
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: topic, Message: msg, Data: si, Time: t})
+}
+
+func (gt06 *GT06) handle_lbs(m lbsMessage, t time.Time) {
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "cell_info.observed", Data: m, Time: t, HistoryOnly: true})
+	if gt06.geo == nil {
+		return
+	}
+	fix, ok := gt06.geo.ResolveCells(m.cells(), nil)
+	if ok {
+		fix.Timestamp = m.Timestamp
+		gt06.handle_approximate_location(fix, t)
+	}
+}
+
+func (gt06 *GT06) handle_wifi(m wifiMessage, t time.Time) {
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "wifi_info.observed", Data: m, Time: t, HistoryOnly: true})
+	if gt06.geo == nil {
+		return
+	}
+	macs := make([]string, len(m.WiFi))
+	signal := make([]int, len(m.WiFi))
+	for i, w := range m.WiFi {
+		macs[i] = w.MAC
+		signal[i] = w.RSSI
+	}
+	fix, ok := gt06.geo.ResolveWiFi(macs, signal)
+	if !ok {
+		fix, ok = gt06.geo.ResolveCells(m.cells(), nil)
+	}
+	if ok {
+		fix.Timestamp = m.Timestamp
+		gt06.handle_approximate_location(fix, t)
+	}
+}
+
+// handle_approximate_location publish location estimated from cell or wifi as a live
+// location marked invalid, it is not put into the location store so the gps track stay accurate
+func (gt06 *GT06) handle_approximate_location(fix geoloc.Fix, t time.Time) {
+	gt06.log.Debug().Str("source", fix.Source).Float64("accuracy", fix.Accuracy).Msg("approximate location")
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "location.approximate", Data: fix, Time: t})
+	accuracy := float32(fix.Accuracy)
+	valid := false
+	loc := device.Location{Latitude: fix.Latitude, Longitude: fix.Longitude, Timestamp: fix.Timestamp, Accuracy: &accuracy, Valid: &valid}
+	gt06.bus.PublishLocation(&eventbus.Location{TrackerId: gt06.tid, Nsn: gt06.ser.Nsn(), Location: &loc, ServerTime: t, Live: gt06.conf.SublistSend, Config: gt06.conf, Approximate: true})
+}
+
+func (gt06 *GT06) handle_power_voltage(d []byte, t time.Time) error {
+	ext, batt, has_batt, err := parsePowerVoltage(d)
+	if err != nil {
+		return err
+	}
+	gt06.log.Info().Float64("external_voltage", ext).Msg("information packet : external power voltage")
+	gt06.misc_store.UpdateAttribute(gt06.tid, "external_voltage", strconv.FormatFloat(ext, 'f', 2, 64))
+	pv := device.PowerVoltage{External: &ext}
+	if has_batt {
+		gt06.misc_store.UpdateAttribute(gt06.tid, "battery_voltage", strconv.FormatFloat(batt, 'f', 2, 64))
+		pv.Battery = &batt
+	}
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: device.EVENT_POWER_VOLTAGE, Data: pv, Time: t, LiveOnly: true})
+	return nil
 }
 
 func (gt06 *GT06) handle_diconnection(t time.Time) {
-	gt06.misc_store.SaveEvent(gt06.tid, "disconnected", "", nil, t)
-	gt06.sublist.SendEvent("disconnected", []byte{}, t)
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "disconnected", Time: t})
 }
 
 func (gt06 *GT06) event_run(t time.Time) {
-	gt06.misc_store.SaveEvent(gt06.tid, "started", "", nil, t)
-	gt06.sublist.SendEvent("started", []byte{}, t)
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "started", Time: t})
 }
 
-func (gt06 *GT06) handle_location(loc gt06GPSMessage, t time.Time) {
-	if gt06.conf.Store {
-		gt06.store.Put(gt06.ser.Nsn(), loc.Latitude, loc.Longitude, -1, loc.Speed, loc.Timestamp, t)
+// handle_location store and publish loc, acc is nil when the packet does not carry it
+func (gt06 *GT06) handle_location(loc gt06GPSMessage, acc *bool, t time.Time) {
+	dloc := loc.location(acc)
+	keep, reason := gt06.validator.Validate(&dloc, t)
+	if reason != "" {
+		gt06.log.Debug().Str("reason", reason).Bool("dropped", !keep).Msg("location failed validation")
 	}
-	if gt06.conf.SublistSend {
-		gt06.sublist.SendLocation(loc.Latitude, loc.Longitude, loc.Speed, loc.Timestamp, t)
+	if keep {
+		gt06.bus.PublishLocation(&eventbus.Location{TrackerId: gt06.tid, Nsn: gt06.ser.Nsn(), Location: &dloc, ServerTime: t, Store: gt06.conf.Store, Live: gt06.conf.SublistSend, Config: gt06.conf})
 	}
 	cell_info_changed := false
 
 	gt06.gt06_location.mu.Lock()
-	if loc.gt06CellInfo != gt06.gt06_location.loc.gt06CellInfo {
+	if loc.gt06CellInfo != gt06.gt06_location.cell {
 		cell_info_changed = true
 	}
-	gt06.gt06_location.loc = loc
-	gt06.gt06_location.time = t
+	gt06.gt06_location.cell = loc.gt06CellInfo
+	if keep {
+		gt06.gt06_location.loc = loc
+		gt06.gt06_location.acc = acc
+		gt06.gt06_location.time = t
+	}
 	gt06.gt06_location.mu.Unlock()
 
 	if cell_info_changed {
 		gt06.log.Info().Object("cell_info", &loc.gt06CellInfo).Msg("cell info changed")
-		gt06.misc_store.SaveEvent(gt06.tid, "cell_info.changed", "", loc.gt06CellInfo, t)
+		gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "cell_info.changed", Data: loc.gt06CellInfo, Time: t, HistoryOnly: true})
+	}
+	if !loc.GPSPositioned && gt06.geo != nil && loc.CellID != 0 {
+		c := loc.gt06CellInfo
+		fix, ok := gt06.geo.ResolveCells([]store.Cell{{MCC: c.MCC, MNC: c.MNC, LAC: c.LAC, CellID: c.CellID}}, nil)
+		if ok {
+			fix.Timestamp = loc.Timestamp
+			gt06.handle_approximate_location(fix, t)
+		}
 	}
 }
 
+func (gt06 *GT06) RejectCounts() map[string]uint64 {
+	return gt06.validator.Counts()
+}
+
 func (gt06 *GT06) GetLocation() device.Location {
 	gt06.gt06_location.mu.Lock()
 	defer gt06.gt06_location.mu.Unlock()
-	loc := device.Location{}
-	loc.Speed = gt06.gt06_location.loc.Speed
-	loc.Longitude = gt06.gt06_location.loc.Longitude
-	loc.Latitude = gt06.gt06_location.loc.Latitude
-	loc.Timestamp = gt06.gt06_location.loc.Timestamp
+	loc := gt06.gt06_location.loc.location(gt06.gt06_location.acc)
 	loc.Altitude = 0
 	return loc
 }
@@ -431,24 +565,31 @@ func (gt06 *GT06) handle_command_response(cmd_response CommandResponseMessage, t
 	flag_matched := false
 	do_update_attr := false
 	cmd := ""
+	var sent_time time.Time
 	gt06.cmd.mu.Lock()
 	if cmd_response.ServerFlag == gt06.cmd.current_server_flag {
 		flag_matched = true
 		gt06.cmd.status = command_empty
 		do_update_attr = should_update_attribute(gt06.cmd.current_msg)
 		cmd = gt06.cmd.current_msg
+		sent_time = gt06.cmd.sent_time
 	} else {
 		gt06.log.Error().Msgf("expecting response with server_flag %d, got %d", gt06.cmd.current_server_flag, cmd_response.ServerFlag)
 	}
 	gt06.cmd.mu.Unlock()
-	gt06.misc_store.SaveEvent(gt06.tid, "command.response", cmd_response.Message, map[string]uint32{
-		"server_flag": cmd_response.ServerFlag}, t)
+	gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "command.response", Message: cmd_response.Message, Data: map[string]uint32{
+		"server_flag": cmd_response.ServerFlag}, Time: t, HistoryOnly: true})
 	if flag_matched {
-		gt06.misc_store.SaveCommandResponse(gt06.tid, cmd_response.ServerFlag, gt06.cmd.current_msg, gt06.cmd.sent_time, cmd_response.Message, t)
+		gt06.bus.PublishCommandResponse(&eventbus.CommandResponse{TrackerId: gt06.tid, ServerFlag: cmd_response.ServerFlag, Command: cmd,
+			SentTime: sent_time, Response: cmd_response.Message, Time: t})
 	}
 	if do_update_attr {
 		gt06.misc_store.UpdateAttribute(gt06.tid, strings.ToUpper(cmd), cmd_response.Message)
 	}
+	if gt06.cmd_store != nil && cmd_response.ServerFlag&queue_flag != 0 {
+		gt06.cmd_store.MarkCommandAcknowledged(uint64(cmd_response.ServerFlag&^queue_flag), cmd_response.Message, t)
+		gt06.DeliverQueued()
+	}
 
 }
 
@@ -462,6 +603,7 @@ func (gt06 *GT06) run() {
 	// var prev_procotol byte
 	gt06.c_mu.RLock()
 	gt06.event_run(time.Now())
+	gt06.DeliverQueued()
 	defer func() {
 		gt06.c_mu.RUnlock()
 		gt06.log.Info().Msg("exit from readMessage loop")
@@ -517,25 +659,99 @@ func (gt06 *GT06) run() {
 
 		case byte(gk310GPS):
 			loc := parseGK310GPSMessage(gt06.msg.Payload)
-			gt06.handle_location(loc.gt06GPSMessage, tread)
+			var acc *bool
+			if loc.HasACC {
+				acc = &loc.ACC
+			}
+			gt06.handle_location(loc.gt06GPSMessage, acc, tread)
+			if loc.GPSPositioned && !loc.GPSIsReupload {
+				gt06.check_clock(loc.Timestamp, tread)
+			}
 			gt06.log.Debug().Str("procode", procode).Msg("location update")
 		case byte(gt06GPS):
-			loc := parseGT06GPSMessage(gt06.msg.Payload)
-			gt06.handle_location(loc, tread)
+			loc := parseGT06GPSMessage(gt06.msg.Payload, gt06.zone)
+			gt06.handle_location(loc, nil, tread)
+			if loc.GPSPositioned {
+				gt06.check_clock(loc.Timestamp, tread)
+			}
 			gt06.log.Debug().Str("procode", procode).Msg("location update")
-		case byte(gk310GPSAlarm):
-			gpsalm := parseGPSAlarm(gt06.msg.Payload, time.UTC)
-			gt06.handle_location(gpsalm.gt06GPSMessage, tread)
-			gt06.handle_alarm(gpsalm.statusInfo, tread)
-			gt06.log.Info().Str("procode", procode).Msg("location update with alarm")
-		case byte(gt06GPSAlarm):
-			gpsalm := parseGPSAlarm(gt06.msg.Payload, time.Local)
-			gt06.handle_location(gpsalm.gt06GPSMessage, tread)
-			gt06.handle_alarm(gpsalm.statusInfo, tread)
+		case byte(gpsInfo):
+			info, err := parseGPSInfoMessage(gt06.msg.Payload, gt06.zone)
+			if err != nil {
+				gt06.log.Error().Err(err).Hex("data", gt06.msg.Payload).Str("procode", procode).Msg("bad gps info packet")
+				break
+			}
+			//packet carry no cell info, keep the last one
+			gt06.gt06_location.mu.Lock()
+			info.gt06CellInfo = gt06.gt06_location.cell
+			gt06.gt06_location.mu.Unlock()
+			gt06.handle_location(info.gt06GPSMessage, nil, tread)
+			gt06.log.Debug().Str("procode", procode).Str("phone", info.Phone).Msg("location update from gps info")
+		case byte(lbsInformation):
+			lbs, err := parseLBSMessage(gt06.msg.Payload, gt06.zone)
+			if err != nil {
+				gt06.log.Error().Err(err).Hex("data", gt06.msg.Payload).Str("procode", procode).Msg("bad lbs packet")
+				break
+			}
+			gt06.handle_lbs(lbs, tread)
+			gt06.log.Debug().Str("procode", procode).Msg("lbs update")
+		case byte(lbsExtension):
+			lbs, err := parseLBSExtension(gt06.msg.Payload, gt06.zone)
+			if err != nil {
+				gt06.log.Error().Err(err).Hex("data", gt06.msg.Payload).Str("procode", procode).Msg("bad lbs packet")
+				break
+			}
+			gt06.handle_lbs(lbs, tread)
+			gt06.log.Debug().Str("procode", procode).Int("cells", len(lbs.Cells)).Msg("lbs update")
+		case byte(wifiInformation):
+			wifi, err := parseWiFiMessage(gt06.msg.Payload)
+			if err != nil {
+				gt06.log.Error().Err(err).Hex("data", gt06.msg.Payload).Str("procode", procode).Msg("bad wifi packet")
+				break
+			}
+			gt06.handle_wifi(wifi, tread)
+			gt06.log.Debug().Str("procode", procode).Int("cells", len(wifi.Cells)).Int("wifi", len(wifi.WiFi)).Msg("wifi update")
+		case byte(lbsStatus):
+			lbsalm, err := parseLBSStatus(gt06.msg.Payload)
+			if err != nil {
+				gt06.log.Error().Err(err).Hex("data", gt06.msg.Payload).Str("procode", procode).Msg("bad lbs status packet")
+				break
+			}
+			lbs := lbsMessage{MCC: lbsalm.MCC, MNC: lbsalm.MNC, Timestamp: tread, Cells: []cellObservation{{LAC: lbsalm.LAC, CellID: lbsalm.CellID}}}
+			gt06.handle_lbs(lbs, tread)
+			gt06.handle_alarm(lbsalm.statusInfo, nil, tread)
+			gt06.log.Info().Str("procode", procode).Msg("lbs update with alarm")
+		case byte(gt06GPSAlarm), byte(gk310GPSAlarm), byte(multiFenceAlarm):
+			gpsalm, err := parseGPSAlarm(gt06.msg.Protocol, gt06.msg.Payload, gt06.zone)
+			if err != nil {
+				gt06.log.Error().Err(err).Hex("data", gt06.msg.Payload).Str("procode", procode).Msg("bad alarm packet")
+				break
+			}
+			gt06.handle_location(gpsalm.gt06GPSMessage, &gpsalm.ACC, tread)
+			gt06.handle_alarm(gpsalm.statusInfo, gpsalm.Fence, tread)
 			gt06.log.Info().Str("procode", procode).Msg("location update with alarm")
 		case byte(informationTxPacket):
 			subprocode := strconv.FormatUint(uint64(gt06.msg.Payload[0]), 16)
 			switch gt06.msg.Payload[0] {
+			case 0x00:
+				err := gt06.handle_power_voltage(gt06.msg.Payload[1:], tread)
+				if err != nil {
+					gt06.log.Error().Err(err).Str("procode", procode).Str("subprocode", subprocode).Hex("data", gt06.msg.Payload[1:]).Msg("information packet : bad external power voltage")
+				}
+			case 0x05:
+				if len(gt06.msg.Payload) < 2 {
+					break
+				}
+				door := strconv.FormatBool(gt06.msg.Payload[1]&0x01 != 0)
+				gt06.log.Info().Str("procode", procode).Str("subprocode", subprocode).Str("door", door).Msg("information packet : door status")
+				gt06.misc_store.UpdateAttribute(gt06.tid, "door_open", door)
+			case 0x09:
+				if len(gt06.msg.Payload) < 2 {
+					break
+				}
+				sat := strconv.Itoa(int(gt06.msg.Payload[1]))
+				gt06.log.Info().Str("procode", procode).Str("subprocode", subprocode).Str("sat_count", sat).Msg("information packet : gps status")
+				gt06.misc_store.UpdateAttribute(gt06.tid, "sat_in_view", sat)
 			case 0x04:
 				gt06.log.Info().Str("procode", procode).Str("subprocode", subprocode).Str("message", string(gt06.msg.Payload[1:])).Msg("information packet : terminal status synchronization")
 				gt06.misc_store.UpdateAttribute(gt06.tid, "terminal_status", string(gt06.msg.Payload[1:]))
@@ -0,0 +1,69 @@
+package gt06
+
+import (
+	"fmt"
+	"strconv"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+func init() {
+	protocol.Register(&protocol.Protocol{
+		Name:    device.DEVICE_GT06,
+		PeekLen: 1,
+		Detect:  func(head []byte) bool { return head[0] == 0x78 },
+		Login:   login,
+	})
+}
+
+type gt06Login struct {
+	ser device.Serial
+	msg LoginMessage
+}
+
+func (l *gt06Login) Serial() device.Serial {
+	return l.ser
+}
+
+func (l *gt06Login) NewDevice(tid uint64, c *conn.Conn, param *protocol.Param, conf_attr *device.DeviceConfigAttribute) device.DeviceIf {
+	p := GT06Param{Bus: param.Bus, Logger: param.Logger, MiscStore: param.MiscStore, CommandStore: param.CommandStore, Geolocator: param.Geolocator, Running: param.Running}
+	return NewGT06(tid, l.ser, c, &l.msg, &p, conf_attr)
+}
+
+// Reconnect hand c to the device already serving the tracker, the zone is recomputed
+// since the time offset sent in login may have changed
+func (l *gt06Login) Reconnect(d device.DeviceIf, c *conn.Conn) {
+	gt06, ok := d.(*GT06)
+	if !ok {
+		d.ReplaceConn(c)
+		return
+	}
+	gt06.replace_conn(c, gt06.login_zone(&l.msg))
+}
+
+func login(c *conn.Conn) (protocol.Login, error) {
+	msg := Message{}
+	msg.Buffer = make([]byte, 100)
+	err := ReadMessage(c, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Protocol != LOGIN {
+		return nil, fmt.Errorf("message type is not login,type : %x", msg.Protocol)
+	}
+	if len(msg.Payload) < 8 {
+		return nil, fmt.Errorf("login message too short")
+	}
+	loginMessage := ParseLoginMessage(msg.Payload)
+	sn, err := strconv.ParseUint(loginMessage.SN, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing serial number : %w", err)
+	}
+	err = SendLoginOK(c, msg.Serial)
+	if err != nil {
+		return nil, fmt.Errorf("error sending login acknowledge : %w", err)
+	}
+	return &gt06Login{ser: device.NewSerial(0, sn), msg: loginMessage}, nil
+}
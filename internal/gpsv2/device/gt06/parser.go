@@ -5,22 +5,30 @@ import (
 	"encoding/hex"
 	"errors"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
 	"nuha.dev/gpstracker/internal/util/crc16"
 )
 
 const (
 	loginMessage byte = 0x01
 
+	lbsInformation        byte = 0x11
 	gt06GPS               byte = 0x12
 	statusInformation     byte = 0x13
 	stringInformation     byte = 0x15 //commandResponse gt06
 	gt06GPSAlarm          byte = 0x16
+	lbsExtension          byte = 0x18
+	lbsStatus             byte = 0x19
 	gpsInfo               byte = 0x1A
 	gk310GPS              byte = 0x22
 	gk310GPSAlarm         byte = 0x26
+	multiFenceAlarm       byte = 0x27
+	wifiInformation       byte = 0x2C
 	serverCommand         byte = 0x80
 	serverCommandResponse byte = 0x21
 	timeCheck             byte = 0x8A
@@ -30,6 +38,7 @@ const (
 const LOGIN = loginMessage
 
 var errBadFrame = errors.New("Bad frame")
+var errShortData = errors.New("data too short")
 
 type Message struct {
 	Extended bool
@@ -73,6 +82,8 @@ type gk310GPSAlarmMessage struct {
 	gt06GPSMessage
 	statusInfo
 	LBSLength int
+	//fence number of multi fence alarm
+	Fence *int
 }
 
 type gk310GPSMessage struct {
@@ -101,6 +112,24 @@ type gt06GPSMessage struct {
 	GPSPositioned   bool
 }
 
+// location convert m into device.Location, altitude is not reported
+func (m *gt06GPSMessage) location(acc *bool) device.Location {
+	course := float32(m.Course)
+	sat := m.SatCount
+	valid := m.GPSPositioned
+	return device.Location{
+		Latitude:  m.Latitude,
+		Longitude: m.Longitude,
+		Altitude:  -1,
+		Speed:     m.Speed,
+		Timestamp: m.Timestamp,
+		Course:    &course,
+		SatCount:  &sat,
+		Valid:     &valid,
+		ACC:       acc,
+	}
+}
+
 type gt06CellInfo struct {
 	MCC    int `json:"mcc"`
 	MNC    int `json:"mnc"`
@@ -185,8 +214,9 @@ func parseStatusInformation(d []byte) statusInfo {
 	return m
 }
 
+// parseGPSPart parse gps time reported in zone l and normalize it to UTC
 func parseGPSPart(d []byte, l *time.Location, m *gt06GPSMessage) {
-	m.Timestamp = time.Date(int(d[0])+2000, time.Month(d[1]), int(d[2]), int(d[3]), int(d[4]), int(d[5]), 0, l)
+	m.Timestamp = time.Date(int(d[0])+2000, time.Month(d[1]), int(d[2]), int(d[3]), int(d[4]), int(d[5]), 0, l).UTC()
 	m.SatCount = int(d[6] & 0x0F)
 	lat := float64(binary.BigEndian.Uint32(d[7:11])) / 1800000
 	lon := float64(binary.BigEndian.Uint32(d[11:15])) / 1800000
@@ -216,9 +246,9 @@ func parseLBSPart(d []byte, m *gt06GPSMessage) {
 	m.CellID = int(binary.BigEndian.Uint32(append([]byte{0}, d[5:8]...)))
 }
 
-func parseGT06GPSMessage(d []byte) gt06GPSMessage {
+func parseGT06GPSMessage(d []byte, l *time.Location) gt06GPSMessage {
 	m := gt06GPSMessage{}
-	parseGPSPart(d, time.Local, &m)
+	parseGPSPart(d, l, &m)
 	parseLBSPart(d[18:], &m)
 	return m
 }
@@ -243,13 +273,39 @@ func parseGK310GPSMessage(d []byte) gk310GPSMessage {
 	return m
 }
 
-func parseGPSAlarm(d []byte, loc *time.Location) gk310GPSAlarmMessage {
+// parseGPSAlarm parse gps(18) lbs length(1) lbs(8) status information(5), the lbs length
+// count itself and device without cell information send a zero length without lbs.
+// gk310 report time in UTC, multi fence alarm append the fence number(1)
+func parseGPSAlarm(protocol byte, d []byte, loc *time.Location) (gk310GPSAlarmMessage, error) {
 	m := gk310GPSAlarmMessage{}
-	parseGPSPart(d, loc, &m.gt06GPSMessage)
-	parseLBSPart(d[19:], &m.gt06GPSMessage)
+	if len(d) < 19 {
+		return m, errShortData
+	}
+	if protocol == gk310GPSAlarm {
+		loc = time.UTC
+	}
 	m.LBSLength = int(d[18])
-	m.statusInfo = parseStatusInformation(d[27:])
-	return m
+	lbs := 0
+	if m.LBSLength > 1 {
+		lbs = m.LBSLength - 1
+	}
+	status := 19 + lbs
+	if len(d) < status+5 || (lbs > 0 && lbs < 8) {
+		return m, errShortData
+	}
+	parseGPSPart(d, loc, &m.gt06GPSMessage)
+	if lbs > 0 {
+		parseLBSPart(d[19:], &m.gt06GPSMessage)
+	}
+	m.statusInfo = parseStatusInformation(d[status:])
+	if protocol == multiFenceAlarm {
+		if len(d) < status+6 {
+			return m, errShortData
+		}
+		fence := int(d[status+5])
+		m.Fence = &fence
+	}
+	return m, nil
 }
 
 func newFrame(protocol byte, payload []byte, serial int) []byte {
@@ -277,3 +333,172 @@ func newCommand(msg string, server_flag []byte, serial int) []byte {
 	copy(payload[5:], []byte(msg))
 	return newFrame(serverCommand, payload, serial)
 }
+
+type cellObservation struct {
+	LAC    int `json:"lac"`
+	CellID int `json:"cell_id"`
+	RSSI   int `json:"rssi"`
+}
+
+type wifiObservation struct {
+	MAC  string `json:"mac"`
+	RSSI int    `json:"rssi"`
+}
+
+// lbsMessage is cell tower observation, serving cell first
+type lbsMessage struct {
+	Timestamp     time.Time         `json:"time"`
+	MCC           int               `json:"mcc"`
+	MNC           int               `json:"mnc"`
+	Cells         []cellObservation `json:"cells"`
+	TimingAdvance int               `json:"timing_advance"`
+}
+
+func (m *lbsMessage) cells() []store.Cell {
+	cells := make([]store.Cell, len(m.Cells))
+	for i, c := range m.Cells {
+		cells[i] = store.Cell{MCC: m.MCC, MNC: m.MNC, LAC: c.LAC, CellID: c.CellID}
+	}
+	return cells
+}
+
+type wifiMessage struct {
+	lbsMessage
+	WiFi []wifiObservation `json:"wifi"`
+}
+
+type lbsStatusMessage struct {
+	gt06CellInfo
+	statusInfo
+}
+
+type gpsInfoMessage struct {
+	gt06GPSMessage
+	Phone string
+}
+
+func parseDateTime(d []byte, l *time.Location) time.Time {
+	return time.Date(int(d[0])+2000, time.Month(d[1]), int(d[2]), int(d[3]), int(d[4]), int(d[5]), 0, l).UTC()
+}
+
+func parseCell(d []byte) cellObservation {
+	return cellObservation{
+		LAC:    int(binary.BigEndian.Uint16(d[0:2])),
+		CellID: int(binary.BigEndian.Uint32(append([]byte{0}, d[2:5]...))),
+		RSSI:   int(d[5]),
+	}
+}
+
+// parseLBSMessage parse single cell packet : datetime(6) mcc(2) mnc(1) lac(2) cell id(3)
+func parseLBSMessage(d []byte, l *time.Location) (lbsMessage, error) {
+	m := lbsMessage{}
+	if len(d) < 14 {
+		return m, errShortData
+	}
+	m.Timestamp = parseDateTime(d, l)
+	m.MCC = int(binary.BigEndian.Uint16(d[6:8]))
+	m.MNC = int(d[8])
+	m.Cells = []cellObservation{{
+		LAC:    int(binary.BigEndian.Uint16(d[9:11])),
+		CellID: int(binary.BigEndian.Uint32(append([]byte{0}, d[11:14]...))),
+	}}
+	return m, nil
+}
+
+// parseLBSExtension parse multiple cell packet : datetime(6) mcc(2) mnc(1)
+// 7 x [lac(2) cell id(3) rssi(1)] timing advance(1), cell with zero id is not reported
+func parseLBSExtension(d []byte, l *time.Location) (lbsMessage, error) {
+	m := lbsMessage{}
+	if len(d) < 9+7*6+1 {
+		return m, errShortData
+	}
+	m.Timestamp = parseDateTime(d, l)
+	m.MCC = int(binary.BigEndian.Uint16(d[6:8]))
+	m.MNC = int(d[8])
+	m.Cells = make([]cellObservation, 0, 7)
+	for i := 0; i < 7; i++ {
+		c := parseCell(d[9+i*6:])
+		if c.LAC == 0 && c.CellID == 0 {
+			continue
+		}
+		m.Cells = append(m.Cells, c)
+	}
+	m.TimingAdvance = int(d[9+7*6])
+	return m, nil
+}
+
+// parseWiFiMessage parse lbs extension followed by wifi count(1) and count x [mac(6) rssi(1)]
+func parseWiFiMessage(d []byte) (wifiMessage, error) {
+	m := wifiMessage{}
+	var err error
+	m.lbsMessage, err = parseLBSExtension(d, time.UTC)
+	if err != nil {
+		return m, err
+	}
+	pos := 9 + 7*6 + 1
+	if len(d) < pos+1 {
+		return m, errShortData
+	}
+	n := int(d[pos])
+	pos++
+	if len(d) < pos+n*7 {
+		return m, errShortData
+	}
+	m.WiFi = make([]wifiObservation, n)
+	for i := range m.WiFi {
+		b := d[pos+i*7:]
+		m.WiFi[i].MAC = formatMAC(b[:6])
+		m.WiFi[i].RSSI = -int(b[6])
+	}
+	return m, nil
+}
+
+func formatMAC(b []byte) string {
+	s := make([]byte, 0, 17)
+	for i, v := range b {
+		if i > 0 {
+			s = append(s, ':')
+		}
+		s = append(s, hex.EncodeToString([]byte{v})...)
+	}
+	return string(s)
+}
+
+// parseLBSStatus parse lbs length(1) mcc(2) mnc(1) lac(2) cell id(3) followed by status information
+func parseLBSStatus(d []byte) (lbsStatusMessage, error) {
+	m := lbsStatusMessage{}
+	if len(d) < 9+5 {
+		return m, errShortData
+	}
+	m.MCC = int(binary.BigEndian.Uint16(d[1:3]))
+	m.MNC = int(d[3])
+	m.LAC = int(binary.BigEndian.Uint16(d[4:6]))
+	m.CellID = int(binary.BigEndian.Uint32(append([]byte{0}, d[6:9]...)))
+	m.statusInfo = parseStatusInformation(d[9:])
+	return m, nil
+}
+
+// parseGPSInfoMessage parse gps address request : gps(18) phone number(21) language(2)
+func parseGPSInfoMessage(d []byte, l *time.Location) (gpsInfoMessage, error) {
+	m := gpsInfoMessage{}
+	if len(d) < 18 {
+		return m, errShortData
+	}
+	parseGPSPart(d, l, &m.gt06GPSMessage)
+	if len(d) >= 18+21 {
+		m.Phone = strings.TrimRight(string(d[18:18+21]), "\x00 ")
+	}
+	return m, nil
+}
+
+// parsePowerVoltage parse external voltage(2) and optional battery voltage(2) in 0.01 V
+func parsePowerVoltage(d []byte) (float64, float64, bool, error) {
+	if len(d) < 2 {
+		return 0, 0, false, errShortData
+	}
+	ext := float64(binary.BigEndian.Uint16(d[0:2])) / 100
+	if len(d) < 4 {
+		return ext, 0, false, nil
+	}
+	return ext, float64(binary.BigEndian.Uint16(d[2:4])) / 100, true, nil
+}
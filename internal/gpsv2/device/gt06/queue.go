@@ -0,0 +1,116 @@
+package gt06
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// server flag of queued command carry the command id with the high bit set, so its
+// response is matched to the queue even after a reconnect or a server restart
+const queue_flag uint32 = store.QUEUE_SERVER_FLAG
+
+const default_command_timeout = 60 * time.Second
+
+type queue_state struct {
+	wake chan struct{}
+	//wake the delivery once the command sent is timed out, the queue is not polled
+	mu    sync.Mutex
+	retry *time.Timer
+}
+
+// DeliverQueued wake the queue delivery, it is called on every new connection,
+// after a queued command is acknowledged and when a command is queued
+func (gt06 *GT06) DeliverQueued() {
+	select {
+	case gt06.queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (gt06 *GT06) command_timeout() time.Duration {
+	if gt06.conf.CommandTimeout > 0 {
+		return time.Duration(gt06.conf.CommandTimeout) * time.Second
+	}
+	return default_command_timeout
+}
+
+func (gt06 *GT06) is_connected() bool {
+	gt06.rs_mu.Lock()
+	defer gt06.rs_mu.Unlock()
+	return gt06.runningState == running
+}
+
+// run_queue deliver queued command one at a time while the connection is served, it
+// is started by _run and exit with it. A command without response after the timeout is
+// sent again until max_attempt
+func (gt06 *GT06) run_queue(quit chan struct{}) {
+	defer gt06.running.Done()
+	defer gt06.retry_queue(0)
+	for {
+		select {
+		case <-gt06.queue.wake:
+		case <-quit:
+			return
+		}
+		if gt06.is_connected() {
+			gt06.process_queue()
+		}
+	}
+}
+
+// retry_queue wake the delivery after d, replacing the previous retry, zero cancel it
+func (gt06 *GT06) retry_queue(d time.Duration) {
+	gt06.queue.mu.Lock()
+	defer gt06.queue.mu.Unlock()
+	if gt06.queue.retry != nil {
+		gt06.queue.retry.Stop()
+		gt06.queue.retry = nil
+	}
+	if d > 0 {
+		gt06.queue.retry = time.AfterFunc(d, gt06.DeliverQueued)
+	}
+}
+
+func (gt06 *GT06) process_queue() {
+	cmds, err := gt06.cmd_store.PendingCommands(gt06.tid)
+	if err != nil {
+		gt06.log.Error().Err(err).Msg("error fetching queued command")
+		return
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	c := cmds[0]
+	now := time.Now().UTC()
+	timeout := gt06.command_timeout()
+	if c.Status == store.COMMAND_SENT && c.SentAt != nil && now.Sub(*c.SentAt) < timeout {
+		//waiting for response
+		gt06.retry_queue(timeout - now.Sub(*c.SentAt))
+		return
+	}
+	if c.Attempt >= c.MaxAttempt {
+		gt06.log.Warn().Uint64("command_id", c.Id).Str("command", c.Command).Msg("queued command failed")
+		gt06.cmd_store.MarkCommandFailed(c.Id, fmt.Sprintf("no response after %d attempt", c.Attempt), now)
+		gt06.bus.PublishEvent(&eventbus.Event{TrackerId: gt06.tid, Topic: "command.failed", Message: c.Command, Data: map[string]uint64{"command_id": c.Id}, Time: now, HistoryOnly: true})
+		gt06.DeliverQueued()
+		return
+	}
+	//a direct command without response does not block the queue past the timeout
+	gt06.cmd.mu.Lock()
+	stale := gt06.cmd.status == command_sent && now.Sub(gt06.cmd.sent_time) > timeout
+	gt06.cmd.mu.Unlock()
+	pending, err := gt06.send_command_flag(c.Command, queue_flag|uint32(c.Id), stale)
+	if err != nil {
+		return
+	}
+	gt06.retry_queue(timeout)
+	if pending {
+		return
+	}
+	gt06.log.Info().Uint64("command_id", c.Id).Str("command", c.Command).Int("attempt", c.Attempt+1).Msg("queued command sent")
+	gt06.cmd_store.MarkCommandSent(c.Id, c.Attempt+1, now)
+}
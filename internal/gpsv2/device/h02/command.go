@@ -0,0 +1,48 @@
+package h02
+
+import (
+	"fmt"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+var capabilities = []device.CommandType{
+	device.COMMAND_ENGINE_CUT,
+	device.COMMAND_ENGINE_RESUME,
+	device.COMMAND_SET_INTERVAL,
+	device.COMMAND_RAW,
+}
+
+func (h *H02) Capabilities() []device.CommandType {
+	return capabilities
+}
+
+func (h *H02) ExecuteCommand(cmd device.Command, force bool) (bool, error) {
+	msg, err := translateCommand(cmd)
+	if err != nil {
+		return false, err
+	}
+	return h.SendCommand(msg, force)
+}
+
+// translateCommand map command into the part of HQ command following the time field,
+// the command name is kept first so the response can be matched by it
+func translateCommand(cmd device.Command) (string, error) {
+	switch cmd.Type {
+	case device.COMMAND_ENGINE_CUT:
+		return "S20,1,1", nil
+	case device.COMMAND_ENGINE_RESUME:
+		return "S20,1,0", nil
+	case device.COMMAND_SET_INTERVAL:
+		if cmd.Interval < 10 {
+			return "", fmt.Errorf("%w : interval must be at least 10 second", device.ErrInvalidCommand)
+		}
+		return fmt.Sprintf("S71,22,%d", cmd.Interval), nil
+	case device.COMMAND_RAW:
+		if cmd.Raw == "" {
+			return "", fmt.Errorf("%w : empty raw command", device.ErrInvalidCommand)
+		}
+		return cmd.Raw, nil
+	}
+	return "", device.ErrCommandNotSupported
+}
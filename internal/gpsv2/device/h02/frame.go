@@ -0,0 +1,101 @@
+package h02
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+)
+
+const (
+	textStart   byte = '*'
+	textEnd     byte = '#'
+	binaryStart byte = '$'
+
+	binaryLength  int = 32
+	maxTextLength int = 512
+)
+
+func ReadMessage(c *conn.Conn, msg *Message) error {
+	return readMessage(c, msg)
+}
+
+func readMessage(c *conn.Conn, msg *Message) error {
+	b, err := c.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch b[0] {
+	case textStart:
+		d, err := c.ReadSlice(textEnd)
+		if err != nil {
+			return err
+		}
+		if len(d) > len(msg.Buffer) {
+			return fmt.Errorf("buffer too small")
+		}
+		msg.Length = copy(msg.Buffer, d)
+		msg.Binary = false
+	case binaryStart:
+		if len(msg.Buffer) < binaryLength {
+			return fmt.Errorf("buffer too small")
+		}
+		_, err := io.ReadFull(c, msg.Buffer[:binaryLength])
+		if err != nil {
+			return err
+		}
+		msg.Length = binaryLength
+		msg.Binary = true
+	default:
+		return errBadFrame
+	}
+	msg.Payload = msg.Buffer[:msg.Length]
+	return nil
+}
+
+// peekMessage return the first frame without consuming it, so the device
+// can process the message used for login as a regular message
+func peekMessage(c *conn.Conn) ([]byte, error) {
+	b, err := c.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case textStart:
+		n := c.Buffered()
+		for {
+			d, _ := c.Peek(n)
+			idx := bytes.IndexByte(d, textEnd)
+			if idx >= 0 {
+				return d[:idx+1], nil
+			}
+			if n >= maxTextLength {
+				return nil, errBadFrame
+			}
+			n = len(d) + 1
+			_, err = c.Peek(n)
+			if err != nil {
+				return nil, err
+			}
+			n = c.Buffered()
+		}
+	case binaryStart:
+		return c.Peek(binaryLength)
+	default:
+		return nil, errBadFrame
+	}
+}
+
+// newCommand encode command string such as `S20,1,1` into `*HQ,<id>,S20,<hhmmss>,1,1#`
+func newCommand(id string, cmd string, t time.Time) []byte {
+	name := cmd
+	param := ""
+	if idx := strings.IndexByte(cmd, ','); idx >= 0 {
+		name = cmd[:idx]
+		param = cmd[idx:]
+	}
+	return []byte(fmt.Sprintf("*HQ,%s,%s,%s%s#", id, name, t.Format("150405"), param))
+}
@@ -0,0 +1,89 @@
+package h02
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+)
+
+func TestNewCommand(t *testing.T) {
+	at := time.Date(2021, 9, 1, 13, 4, 5, 0, time.UTC)
+	cases := []struct {
+		cmd      string
+		expected string
+	}{
+		{"S20,1,1", "*HQ,4210051415,S20,130405,1,1#"},
+		{"D1,30", "*HQ,4210051415,D1,130405,30#"},
+		{"R1", "*HQ,4210051415,R1,130405#"},
+		{"SCF,0,1", "*HQ,4210051415,SCF,130405,0,1#"},
+	}
+	for _, c := range cases {
+		d := newCommand("4210051415", c.cmd, at)
+		if string(d) != c.expected {
+			t.Errorf("%s encoded to %s, expected %s", c.cmd, d, c.expected)
+		}
+		if _, err := parseText(d); err != nil {
+			t.Errorf("%s encoded to unparsable %s", c.cmd, d)
+		}
+	}
+}
+
+func pipeConn(t *testing.T, d []byte) *conn.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		client.Write(d)
+		client.Close()
+	}()
+	return conn.NewConn(server, 1)
+}
+
+func TestReadMessage(t *testing.T) {
+	text := "*HQ,4210051415,V1,164549,A,0956.3869,N,08406.7068,W,000.00,000,221215,FFFFFBFF,712,01,0,0,6#"
+	binary, _ := hex.DecodeString("2441060008262153213108150441939006074041830e012150fffffbff001506")
+	stream := append(append([]byte(text), binary...), []byte("*HQ,4106000826,XT,V,0,0#")...)
+	c := pipeConn(t, stream)
+
+	first, err := peekMessage(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != text {
+		t.Fatalf("peeked %s", first)
+	}
+
+	msg := Message{Buffer: make([]byte, maxTextLength)}
+	if err := readMessage(c, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Binary || string(msg.Payload) != text {
+		t.Fatalf("read binary %v %s, expected peeked frame", msg.Binary, msg.Payload)
+	}
+	if err := readMessage(c, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Binary || !bytes.Equal(msg.Payload, binary) {
+		t.Fatalf("read binary %v %x", msg.Binary, msg.Payload)
+	}
+	if err := readMessage(c, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := parseText(msg.Payload); err != nil || m.Type != typeHeartbeatAlt {
+		t.Fatalf("read %s", msg.Payload)
+	}
+}
+
+func TestReadMessageBadFrame(t *testing.T) {
+	c := pipeConn(t, []byte("GET / HTTP/1.1\r\n"))
+	msg := Message{Buffer: make([]byte, maxTextLength)}
+	if err := readMessage(c, &msg); err != errBadFrame {
+		t.Fatalf("expected bad frame, got %v", err)
+	}
+}
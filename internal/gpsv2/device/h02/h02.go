@@ -0,0 +1,419 @@
+package h02
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+type runningState int
+
+const (
+	created runningState = iota
+	running
+	paused
+)
+
+const (
+	CONNECTION_CLOSED string = "connection_closed"
+)
+
+const (
+	command_submitted int = iota
+	command_sent
+	command_empty
+)
+
+type H02Param struct {
+	Bus       *eventbus.EventBus
+	MiscStore store.MiscStore
+	//Running track the read loop goroutine so shutdown can wait for its last publish
+	Running *sync.WaitGroup
+	Logger  log.Logger
+}
+
+type H02 struct {
+	c          *conn.Conn
+	c_next     *conn.Conn
+	c_mu       sync.RWMutex
+	c_next_mu  sync.Mutex
+	stopped    bool
+	stopped_mu sync.Mutex
+	id         string //terminal id as sent by device, used when sending command
+	err        error_state
+	cmd        command_state
+	msg        Message
+	log        log.Logger
+	ser        device.Serial
+	tid        uint64
+	conf       *device.DeviceConfig
+	validator  *device.LocationValidator
+	bus        *eventbus.EventBus
+	running    *sync.WaitGroup
+	misc_store store.MiscStore
+
+	runningState
+	rs_mu sync.Mutex
+	h02_status
+	h02_location
+}
+
+type error_state struct {
+	mu  sync.Mutex
+	err error
+	t   time.Time
+}
+
+type command_state struct {
+	mu                  sync.Mutex
+	sent_time           time.Time
+	status              int
+	server_flag_counter uint32
+	current_msg         string
+	current_server_flag uint32
+}
+
+type h02_status struct {
+	mu   sync.Mutex
+	si   statusInfo
+	time time.Time
+}
+
+type h02_location struct {
+	mu   sync.Mutex
+	loc  location
+	cell cellInfo
+	time time.Time
+}
+
+func NewH02(tid uint64, ser device.Serial, id string, c *conn.Conn, param *H02Param, conf_attr *device.DeviceConfigAttribute) *H02 {
+	o := &H02{c: c}
+	o.log = param.Logger
+	o.log.Context = log.NewContext(nil).Str("module", "h02").EmbedObject(ser).Value()
+	o.bus = param.Bus
+	o.running = param.Running
+	o.misc_store = param.MiscStore
+	o.runningState = created
+	o.msg.Buffer = make([]byte, maxTextLength)
+	o.conf = conf_attr.Config
+	o.validator = device.NewLocationValidator(o.conf)
+	o.tid = tid
+	o.ser = ser
+	o.id = id
+	o.cmd.status = command_empty
+	return o
+}
+
+func (h *H02) closeAndSetErr(err error, t time.Time) {
+	h.err.mu.Lock()
+	h.err.err = err
+	h.err.t = t
+	h.err.mu.Unlock()
+	h.log.Error().Err(err).Str("event", CONNECTION_CLOSED).Msg("connection closed caused by error")
+	h.c.Close()
+}
+
+func (h *H02) Run() {
+	h.running.Add(1)
+	go h._run()
+}
+
+func (h *H02) Stop() {
+	h.stop()
+	h.c.Close()
+}
+
+func (h *H02) stop() {
+	h.stopped_mu.Lock()
+	h.stopped = true
+	h.stopped_mu.Unlock()
+}
+
+func (h *H02) is_stopped() bool {
+	h.stopped_mu.Lock()
+	f := h.stopped
+	h.stopped_mu.Unlock()
+	return f
+}
+
+func (h *H02) _run() {
+	defer h.running.Done()
+	defer func() {
+		h.rs_mu.Lock()
+		h.runningState = paused
+		h.rs_mu.Unlock()
+		h.log.Info().Msg("exit from goroutine runloop")
+	}()
+
+	h.rs_mu.Lock()
+	h.runningState = running
+	h.rs_mu.Unlock()
+	for {
+		h.run() //will block
+		if h.is_stopped() {
+			break
+		}
+		ok := h.use_next_conn()
+		if ok {
+			continue
+		} else {
+			break
+		}
+	}
+}
+
+func (h *H02) Error() (error, time.Time) {
+	h.err.mu.Lock()
+	defer h.err.mu.Unlock()
+	return h.err.err, h.err.t
+}
+
+// SendCommand send command such as `S20,1,1`, terminal id and time is added by the encoder
+func (h *H02) SendCommand(msg string, force bool) (bool, error) {
+	h.cmd.mu.Lock()
+	if h.cmd.status != command_empty {
+		if !force {
+			h.cmd.mu.Unlock()
+			return true, nil
+		} else {
+			h.log.Warn().Msg("there is pending command")
+		}
+	}
+	h.cmd.server_flag_counter++
+	server_flag := h.cmd.server_flag_counter
+	h.cmd.current_server_flag = server_flag
+	h.cmd.current_msg = msg
+	d := newCommand(h.id, msg, time.Now().UTC())
+	h.cmd.status = command_submitted
+	h.cmd.mu.Unlock()
+
+	h.c_mu.RLock()
+	defer h.c_mu.RUnlock()
+	h.log.Trace().Str("sending command", string(d)).Msg("")
+	_, err := h.c.Write(d)
+	if err != nil {
+		h.log.Error().Err(err).Msg("error when sending command")
+		return false, err
+	}
+	t := time.Now().UTC()
+	h.cmd.mu.Lock()
+	h.cmd.status = command_sent
+	h.cmd.sent_time = t
+	h.cmd.mu.Unlock()
+	h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "command.sent", Message: msg, Data: map[string]uint32{"server_flag": server_flag}, Time: t, HistoryOnly: true})
+	return false, nil
+}
+
+func (h *H02) set_next_conn(c *conn.Conn) {
+	h.c_next_mu.Lock()
+	h.c_next = c
+	h.c_next_mu.Unlock()
+}
+
+func (h *H02) set_conn(c *conn.Conn) {
+	h.c_mu.Lock()
+	h.c = c
+	h.c_mu.Unlock()
+}
+
+func (h *H02) use_next_conn() bool {
+	h.c_next_mu.Lock()
+	defer h.c_next_mu.Unlock()
+
+	if h.c_next == nil {
+		return false
+	} else {
+		h.c_mu.Lock()
+		defer h.c_mu.Unlock()
+		h.c = h.c_next
+		h.c_next = nil
+		return true
+	}
+}
+
+func (h *H02) ReplaceConn(c *conn.Conn) {
+	h.rs_mu.Lock()
+	if h.runningState == running {
+		h.set_next_conn(c)
+		h.rs_mu.Unlock()
+		h.log.Info().Str("event", CONNECTION_CLOSED).Msg("closing replaced connection")
+		h.c.Close()
+
+	} else if h.runningState == paused {
+		h.set_conn(c)
+		h.rs_mu.Unlock()
+		h.running.Add(1)
+		go h._run()
+	} else {
+		h.rs_mu.Unlock()
+	}
+}
+
+func (h *H02) handle_status(si statusInfo, t time.Time) {
+	changed := false
+	alarm := false
+	h.h02_status.mu.Lock()
+	if h.h02_status.si != si {
+		changed = true
+		alarm = si.Alarm != "" && si.Alarm != h.h02_status.si.Alarm
+	}
+	h.h02_status.time = t
+	h.h02_status.si = si
+	h.h02_status.mu.Unlock()
+
+	if changed {
+		h.log.Info().Object("status", &si).Msg("status changed")
+		h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "heartbeat.changed", Data: si, Time: t})
+	}
+	if alarm {
+		h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "alarm", Message: si.Alarm, Data: si, Time: t})
+	}
+}
+
+func (h *H02) handle_location(loc location, t time.Time) {
+	dloc := loc.location()
+	keep, reason := h.validator.Validate(&dloc, t)
+	if reason != "" {
+		h.log.Debug().Str("reason", reason).Bool("dropped", !keep).Msg("location failed validation")
+	}
+	if keep {
+		h.bus.PublishLocation(&eventbus.Location{TrackerId: h.tid, Nsn: h.ser.Nsn(), Location: &dloc, ServerTime: t, Store: h.conf.Store, Live: h.conf.SublistSend, Config: h.conf})
+		h.h02_location.mu.Lock()
+		h.h02_location.loc = loc
+		h.h02_location.time = t
+		h.h02_location.mu.Unlock()
+	}
+	h.handle_status(loc.statusInfo, t)
+}
+
+func (h *H02) handle_lbs(cell cellInfo, t time.Time) {
+	changed := false
+	h.h02_location.mu.Lock()
+	if h.h02_location.cell != cell {
+		changed = true
+	}
+	h.h02_location.cell = cell
+	h.h02_location.mu.Unlock()
+	if changed {
+		h.log.Info().Object("cell_info", &cell).Msg("cell info changed")
+		h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "cell_info.changed", Data: cell, Time: t, HistoryOnly: true})
+	}
+}
+
+func (h *H02) handle_diconnection(t time.Time) {
+	h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "disconnected", Time: t})
+}
+
+func (h *H02) event_run(t time.Time) {
+	h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "started", Time: t})
+}
+
+func (h *H02) handle_command_response(cmd_response commandResponse, t time.Time) {
+	flag_matched := false
+	var server_flag uint32
+	var cmd string
+	var sent_time time.Time
+	h.cmd.mu.Lock()
+	if h.cmd.status != command_empty && cmd_response.matches(h.cmd.current_msg) {
+		flag_matched = true
+		h.cmd.status = command_empty
+		server_flag = h.cmd.current_server_flag
+		cmd = h.cmd.current_msg
+		sent_time = h.cmd.sent_time
+	} else {
+		h.log.Error().Msgf("expecting response for %s, got %s", h.cmd.current_msg, cmd_response.Command)
+	}
+	h.cmd.mu.Unlock()
+	h.bus.PublishEvent(&eventbus.Event{TrackerId: h.tid, Topic: "command.response", Message: cmd_response.Message, Data: map[string]interface{}{
+		"server_flag": server_flag, "command": cmd_response.Command}, Time: t, HistoryOnly: true})
+	if flag_matched {
+		h.bus.PublishCommandResponse(&eventbus.CommandResponse{TrackerId: h.tid, ServerFlag: server_flag, Command: cmd, SentTime: sent_time, Response: cmd_response.Message, Time: t})
+	}
+}
+
+func (h *H02) RejectCounts() map[string]uint64 {
+	return h.validator.Counts()
+}
+
+func (h *H02) GetLocation() device.Location {
+	h.h02_location.mu.Lock()
+	defer h.h02_location.mu.Unlock()
+	return h.h02_location.loc.location()
+}
+
+func (h *H02) CurrentConnInfo() []string {
+	h.c_mu.RLock()
+	defer h.c_mu.RUnlock()
+	return h.c.ConnAddr()
+}
+
+func (h *H02) run() {
+	h.c_mu.RLock()
+	h.event_run(time.Now())
+	defer func() {
+		h.c_mu.RUnlock()
+		h.log.Info().Msg("exit from readMessage loop")
+	}()
+	for {
+		err := h.readMessage()
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				h.log.Info().Msg("read deadline exceeded")
+			}
+			h.handle_diconnection(time.Now())
+			h.closeAndSetErr(err, time.Now())
+			return
+		}
+		tread := time.Now().UTC()
+		if h.msg.Binary {
+			h.log.Trace().Hex("payload", h.msg.Payload).Msg("receive binary message from terminal")
+			loc := parseBinaryLocation(h.msg.Payload)
+			h.handle_location(loc, tread)
+			h.log.Debug().Msg("location update")
+			continue
+		}
+		h.log.Trace().Str("payload", string(h.msg.Payload)).Msg("receive message from terminal")
+		m, err := parseText(h.msg.Payload)
+		if err != nil {
+			h.log.Error().Err(err).Str("payload", string(h.msg.Payload)).Msg("error parsing message")
+			continue
+		}
+		switch m.Type {
+		case typeLocation:
+			loc, err := parseTextLocation(m.Fields)
+			if err != nil {
+				h.log.Error().Err(err).Str("payload", string(h.msg.Payload)).Msg("error parsing location")
+				continue
+			}
+			h.handle_location(loc, tread)
+			h.log.Debug().Str("type", m.Type).Msg("location update")
+		case typeLBS:
+			cell, err := parseTextLBS(m.Fields)
+			if err != nil {
+				h.log.Error().Err(err).Str("payload", string(h.msg.Payload)).Msg("error parsing lbs")
+				continue
+			}
+			h.handle_lbs(cell, tread)
+		case typeCommandResponse:
+			cmdRes := parseTextCommandResponse(m.Fields)
+			h.handle_command_response(cmdRes, tread)
+			h.log.Info().Str("command", cmdRes.Command).Str("message", cmdRes.Message).Msg("command response")
+		case typeHeartbeat, typeHeartbeatAlt:
+			h.log.Debug().Str("type", m.Type).Msg("heartbeat")
+		default:
+			h.log.Error().Str("payload", string(h.msg.Payload)).Str("type", m.Type).Str("error", "unknown message type").Msg("unhandled message type")
+		}
+	}
+}
+
+func (h *H02) readMessage() error {
+	minutes := h.conf.ReadDeadline
+	_ = h.c.SetReadDeadline(time.Now().Add(time.Duration(minutes) * time.Minute))
+	return readMessage(h.c, &h.msg)
+}
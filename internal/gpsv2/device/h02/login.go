@@ -0,0 +1,57 @@
+package h02
+
+import (
+	"fmt"
+	"strconv"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+func init() {
+	protocol.Register(&protocol.Protocol{
+		Name:    device.DEVICE_H02,
+		PeekLen: 1,
+		Detect:  func(head []byte) bool { return head[0] == textStart || head[0] == binaryStart },
+		Login:   login,
+	})
+}
+
+type h02Login struct {
+	ser device.Serial
+	id  string
+}
+
+func (l *h02Login) Serial() device.Serial {
+	return l.ser
+}
+
+func (l *h02Login) NewDevice(tid uint64, c *conn.Conn, param *protocol.Param, conf_attr *device.DeviceConfigAttribute) device.DeviceIf {
+	p := H02Param{Bus: param.Bus, Logger: param.Logger, MiscStore: param.MiscStore, Running: param.Running}
+	return NewH02(tid, l.ser, l.id, c, &p, conf_attr)
+}
+
+// login take the terminal id from the first frame, h02 has no login message
+// so the frame is left in the connection buffer to be handled by the device
+func login(c *conn.Conn) (protocol.Login, error) {
+	d, err := peekMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	var id string
+	if d[0] == binaryStart {
+		id = parseBinaryID(d)
+	} else {
+		m, err := parseText(d)
+		if err != nil {
+			return nil, err
+		}
+		id = m.ID
+	}
+	sn, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing serial number : %w", err)
+	}
+	return &h02Login{ser: device.NewSerial(0, sn), id: id}, nil
+}
@@ -0,0 +1,274 @@
+package h02
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+const (
+	typeLocation        string = "V1"
+	typeCommandResponse string = "V4"
+	typeLBS             string = "NBR"
+	typeHeartbeat       string = "LINK"
+	typeHeartbeatAlt    string = "XT"
+)
+
+var errBadFrame = errors.New("Bad frame")
+
+type Message struct {
+	Binary  bool
+	Length  int
+	Payload []byte
+	Buffer  []byte
+}
+
+type textMessage struct {
+	ID     string
+	Type   string
+	Fields []string
+}
+
+type location struct {
+	Timestamp time.Time `json:"gps_time"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lon"`
+	Speed     float32   `json:"speed"`
+	Course    int       `json:"course"`
+	Valid     bool      `json:"valid"`
+	statusInfo
+}
+
+// location convert l into device.Location, altitude is not reported and kept 0
+func (l *location) location() device.Location {
+	course := float32(l.Course)
+	valid := l.Valid
+	acc := l.ACC
+	return device.Location{
+		Latitude:  l.Latitude,
+		Longitude: l.Longitude,
+		Speed:     l.Speed,
+		Timestamp: l.Timestamp,
+		Course:    &course,
+		Valid:     &valid,
+		ACC:       &acc,
+	}
+}
+
+type statusInfo struct {
+	Status uint32 `json:"status"`
+	ACC    bool   `json:"acc"`
+	Alarm  string `json:"alarm,omitempty"`
+}
+
+func (s *statusInfo) MarshalObject(e *log.Entry) {
+	e.Bool("acc", s.ACC).Str("alarm", s.Alarm).Str("status", strconv.FormatUint(uint64(s.Status), 16))
+}
+
+type cellInfo struct {
+	MCC    int `json:"mcc"`
+	MNC    int `json:"mnc"`
+	LAC    int `json:"lac"`
+	CellID int `json:"cell_id"`
+}
+
+func (c *cellInfo) MarshalObject(e *log.Entry) {
+	e.Int("mnc", c.MNC).Int("mcc", c.MCC).Int("lac", c.LAC).Int("cell_id", c.CellID)
+}
+
+type commandResponse struct {
+	Command string
+	Message string
+}
+
+// status bits are active low, a cleared bit means the alarm or input is active
+var alarmBits = []struct {
+	bit  uint
+	name string
+}{
+	{1, "sos"},
+	{2, "overspeed"},
+	{0, "vibration"},
+	{19, "power_cut"},
+}
+
+func parseStatus(status uint32) statusInfo {
+	s := statusInfo{Status: status}
+	s.ACC = status&(1<<10) == 0
+	for _, v := range alarmBits {
+		if status&(1<<v.bit) == 0 {
+			s.Alarm = v.name
+			break
+		}
+	}
+	return s
+}
+
+// parseText split `*HQ,<id>,<type>,...#` into its fields
+func parseText(d []byte) (textMessage, error) {
+	m := textMessage{}
+	if len(d) < 2 || d[0] != textStart || d[len(d)-1] != textEnd {
+		return m, errBadFrame
+	}
+	f := strings.Split(string(d[1:len(d)-1]), ",")
+	if len(f) < 3 {
+		return m, errBadFrame
+	}
+	m.ID = f[1]
+	m.Type = f[2]
+	m.Fields = f[3:]
+	return m, nil
+}
+
+// parseTextLocation parse V1 fields : hhmmss,A,ddmm.mmmm,N,dddmm.mmmm,E,speed,course,ddmmyy,status
+func parseTextLocation(f []string) (location, error) {
+	m := location{}
+	if len(f) < 9 || len(f[0]) < 6 {
+		return m, fmt.Errorf("location message too short")
+	}
+	var err error
+	m.Timestamp, err = time.ParseInLocation("150405020106", f[0][:6]+f[8], time.UTC)
+	if err != nil {
+		return m, err
+	}
+	m.Valid = f[1] == "A"
+	m.Latitude, err = parseCoordinate(f[2], f[3] == "S")
+	if err != nil {
+		return m, err
+	}
+	m.Longitude, err = parseCoordinate(f[4], f[5] == "W")
+	if err != nil {
+		return m, err
+	}
+	knot, err := strconv.ParseFloat(f[6], 32)
+	if err != nil {
+		return m, err
+	}
+	m.Speed = float32(knot * 1852 / 3600) //knot to mps
+	course, err := strconv.ParseFloat(f[7], 32)
+	if err == nil {
+		m.Course = int(course)
+	}
+	if len(f) > 9 {
+		status, err := strconv.ParseUint(f[9], 16, 32)
+		if err == nil {
+			m.statusInfo = parseStatus(uint32(status))
+		}
+	}
+	return m, nil
+}
+
+// parseCoordinate convert NMEA style (d)ddmm.mmmm into decimal degree
+func parseCoordinate(s string, negative bool) (float64, error) {
+	idx := strings.IndexByte(s, '.')
+	if idx < 0 {
+		idx = len(s)
+	}
+	if idx < 3 {
+		return 0, fmt.Errorf("invalid coordinate %s", s)
+	}
+	deg, err := strconv.ParseFloat(s[:idx-2], 64)
+	if err != nil {
+		return 0, err
+	}
+	min, err := strconv.ParseFloat(s[idx-2:], 64)
+	if err != nil {
+		return 0, err
+	}
+	v := deg + min/60
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+// parseTextLBS parse NBR fields : hhmmss,mcc,mnc,ta,count,lac,cid,rssi,...
+func parseTextLBS(f []string) (cellInfo, error) {
+	m := cellInfo{}
+	if len(f) < 7 {
+		return m, fmt.Errorf("lbs message too short")
+	}
+	var err error
+	if m.MCC, err = strconv.Atoi(f[1]); err != nil {
+		return m, err
+	}
+	if m.MNC, err = strconv.Atoi(f[2]); err != nil {
+		return m, err
+	}
+	if m.LAC, err = strconv.Atoi(f[5]); err != nil {
+		return m, err
+	}
+	if m.CellID, err = strconv.Atoi(f[6]); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// parseTextCommandResponse parse V4 fields : <command>,<response...>
+func parseTextCommandResponse(f []string) commandResponse {
+	m := commandResponse{}
+	if len(f) > 0 {
+		m.Command = f[0]
+	}
+	if len(f) > 1 {
+		m.Message = strings.Join(f[1:], ",")
+	}
+	return m
+}
+
+// matches report whether the response answer msg, the V4 command field must equal the
+// command name of msg, the part before the first comma
+func (m commandResponse) matches(msg string) bool {
+	if m.Command == "" {
+		return false
+	}
+	if i := strings.IndexByte(msg, ','); i >= 0 {
+		msg = msg[:i]
+	}
+	return m.Command == msg
+}
+
+func bcd(b byte) int {
+	return int(b>>4)*10 + int(b&0x0F)
+}
+
+// parseBinaryID return the terminal id of binary frame
+func parseBinaryID(d []byte) string {
+	return hex.EncodeToString(d[1:6])
+}
+
+// parseBinaryLocation parse binary location frame, fields are BCD encoded
+//
+//	$ | id(5) | hhmmss(3) | ddmmyy(3) | lat(4) | battery(1) | lon(4.5) flag(0.5) | speed(1.5) course(1.5) | status(4) | ...
+func parseBinaryLocation(d []byte) location {
+	m := location{}
+	m.Timestamp = time.Date(bcd(d[11])+2000, time.Month(bcd(d[10])), bcd(d[9]), bcd(d[6]), bcd(d[7]), bcd(d[8]), 0, time.UTC)
+	lat := hex.EncodeToString(d[12:16])
+	lon := hex.EncodeToString(d[17:22])
+	flag := d[21] & 0x0F
+	latDeg, _ := strconv.Atoi(lat[:2])
+	latMin, _ := strconv.Atoi(lat[2:])
+	lonDeg, _ := strconv.Atoi(lon[:3])
+	lonMin, _ := strconv.Atoi(lon[3:9])
+	m.Latitude = float64(latDeg) + float64(latMin)/600000
+	m.Longitude = float64(lonDeg) + float64(lonMin)/600000
+	if flag&0x04 == 0 {
+		m.Latitude = -m.Latitude
+	}
+	if flag&0x08 == 0 {
+		m.Longitude = -m.Longitude
+	}
+	m.Valid = flag&0x02 != 0
+	sc := hex.EncodeToString(d[22:25])
+	knot, _ := strconv.Atoi(sc[:3])
+	m.Speed = float32(knot) * 1852 / 3600
+	m.Course, _ = strconv.Atoi(sc[3:])
+	m.statusInfo = parseStatus(uint32(d[25])<<24 | uint32(d[26])<<16 | uint32(d[27])<<8 | uint32(d[28]))
+	return m
+}
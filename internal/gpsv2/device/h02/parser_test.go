@@ -0,0 +1,170 @@
+package h02
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseText(t *testing.T) {
+	cases := []struct {
+		name   string
+		frame  string
+		id     string
+		typ    string
+		fields int
+		err    bool
+	}{
+		{"location", "*HQ,4210051415,V1,164549,A,0956.3869,N,08406.7068,W,000.00,000,221215,FFFFFBFF,712,01,0,0,6#", "4210051415", typeLocation, 15, false},
+		{"heartbeat", "*HQ,4210051415,XT,V,0,0#", "4210051415", typeHeartbeatAlt, 3, false},
+		{"command response", "*HQ,4210051415,V4,S20,1,1,164549,A#", "4210051415", typeCommandResponse, 5, false},
+		{"no type", "*HQ,4210051415#", "", "", 0, true},
+		{"no end", "*HQ,4210051415,V1,164549", "", "", 0, true},
+		{"empty", "", "", "", 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := parseText([]byte(c.frame))
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.ID != c.id || m.Type != c.typ || len(m.Fields) != c.fields {
+				t.Fatalf("got id %s type %s %d fields", m.ID, m.Type, len(m.Fields))
+			}
+		})
+	}
+}
+
+func TestParseTextLocation(t *testing.T) {
+	cases := []struct {
+		name  string
+		frame string
+		time  time.Time
+		lat   float64
+		lon   float64
+		speed float32
+		valid bool
+		acc   bool
+		alarm string
+	}{
+		{"west", "*HQ,4210051415,V1,164549,A,0956.3869,N,08406.7068,W,000.00,000,221215,FFFFFBFF,712,01,0,0,6#",
+			time.Date(2015, 12, 22, 16, 45, 49, 0, time.UTC), 9.939782, -84.111780, 0, true, true, ""},
+		{"south moving", "*HQ,353588010001689,V1,221116,A,1548.8220,S,04753.1679,W,10.00,271,300118,FFFFFFFF,2f8,0,0#",
+			time.Date(2018, 1, 30, 22, 11, 16, 0, time.UTC), -15.813700, -47.886132, 5.144444, true, false, ""},
+		{"invalid sos", "*HQ,865205030330012,V1,035512,V,3114.6412,N,12128.7719,E,0.00,0.00,050316,FFFFF9FD#",
+			time.Date(2016, 3, 5, 3, 55, 12, 0, time.UTC), 31.244020, 121.479532, 0, false, true, "sos"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := parseText([]byte(c.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := parseTextLocation(m.Fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !l.Timestamp.Equal(c.time) {
+				t.Errorf("time %v, expected %v", l.Timestamp, c.time)
+			}
+			if math.Abs(l.Latitude-c.lat) > 1e-6 || math.Abs(l.Longitude-c.lon) > 1e-6 {
+				t.Errorf("position %f,%f, expected %f,%f", l.Latitude, l.Longitude, c.lat, c.lon)
+			}
+			if math.Abs(float64(l.Speed-c.speed)) > 1e-4 {
+				t.Errorf("speed %f, expected %f", l.Speed, c.speed)
+			}
+			if l.Valid != c.valid || l.ACC != c.acc || l.Alarm != c.alarm {
+				t.Errorf("valid %v acc %v alarm %q", l.Valid, l.ACC, l.Alarm)
+			}
+			if loc := l.location(); loc.Altitude != 0 {
+				t.Errorf("altitude %f, expected 0", loc.Altitude)
+			}
+		})
+	}
+}
+
+func TestParseTextLocationTooShort(t *testing.T) {
+	m, err := parseText([]byte("*HQ,4210051415,V1,164549,A,0956.3869,N#"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTextLocation(m.Fields); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCommandResponseMatches(t *testing.T) {
+	cases := []struct {
+		fields []string
+		sent   string
+		match  bool
+	}{
+		{[]string{"S20", "1", "1", "164549", "A"}, "S20,1,1", true},
+		{[]string{"S71", "22", "30"}, "S71,22,30", true},
+		{[]string{"RESET"}, "RESET", true},
+		//empty or shorter command field must not match every command
+		{[]string{"", "OK"}, "S20,1,1", false},
+		{[]string{}, "S20,1,1", false},
+		{[]string{"S2", "1"}, "S20,1,1", false},
+		{[]string{"S20", "1"}, "S71,22,30", false},
+	}
+	for i, c := range cases {
+		if m := parseTextCommandResponse(c.fields); m.matches(c.sent) != c.match {
+			t.Errorf("case %d : %q answering %q, expected %v", i, m.Command, c.sent, c.match)
+		}
+	}
+}
+
+func TestParseBinaryLocation(t *testing.T) {
+	cases := []struct {
+		name   string
+		frame  string
+		id     string
+		time   time.Time
+		lat    float64
+		lon    float64
+		speed  float32
+		course int
+		valid  bool
+		acc    bool
+	}{
+		{"north east", "2441060008262153213108150441939006074041830e012150fffffbff001506",
+			"4106000826", time.Date(2015, 8, 31, 21, 53, 21, 0, time.UTC), 4.698983, 74.069717, 6.173333, 150, true, true},
+		{"south west invalid", "24421005141516454922121509563869000840670680000000ffffffff000000",
+			"4210051415", time.Date(2015, 12, 22, 16, 45, 49, 0, time.UTC), -9.939782, -84.111780, 0, 0, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := hex.DecodeString(c.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(d) != binaryLength {
+				t.Fatalf("frame is %d byte", len(d))
+			}
+			if id := parseBinaryID(d); id != c.id {
+				t.Errorf("id %s, expected %s", id, c.id)
+			}
+			l := parseBinaryLocation(d)
+			if !l.Timestamp.Equal(c.time) {
+				t.Errorf("time %v, expected %v", l.Timestamp, c.time)
+			}
+			if math.Abs(l.Latitude-c.lat) > 1e-6 || math.Abs(l.Longitude-c.lon) > 1e-6 {
+				t.Errorf("position %f,%f, expected %f,%f", l.Latitude, l.Longitude, c.lat, c.lon)
+			}
+			if math.Abs(float64(l.Speed-c.speed)) > 1e-4 || l.Course != c.course {
+				t.Errorf("speed %f course %d", l.Speed, l.Course)
+			}
+			if l.Valid != c.valid || l.ACC != c.acc {
+				t.Errorf("valid %v acc %v", l.Valid, l.ACC)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+// terminal control command word
+const controlReset byte = 4
+
+// terminal parameter id
+const paramReportInterval uint32 = 0x0029
+
+// text message flag, display on terminal
+const textDisplay byte = 0x04
+
+var capabilities = []device.CommandType{
+	device.COMMAND_SET_INTERVAL,
+	device.COMMAND_REBOOT,
+	device.COMMAND_RAW,
+}
+
+var resultString = map[byte]string{
+	0: "success",
+	1: "failure",
+	2: "message error",
+	3: "not supported",
+}
+
+func (j *JT808) Capabilities() []device.CommandType {
+	return capabilities
+}
+
+// SendCommand send text message, most terminal accept their configuration command this way
+func (j *JT808) SendCommand(msg string, force bool) (bool, error) {
+	body := append([]byte{textDisplay}, msg...)
+	return j.send_command(platformTextMessage, body, msg, force)
+}
+
+func (j *JT808) ExecuteCommand(cmd device.Command, force bool) (bool, error) {
+	switch cmd.Type {
+	case device.COMMAND_SET_INTERVAL:
+		if cmd.Interval < 1 {
+			return false, fmt.Errorf("%w : interval must be positive", device.ErrInvalidCommand)
+		}
+		body := make([]byte, 10)
+		body[0] = 1 //parameter count
+		binary.BigEndian.PutUint32(body[1:5], paramReportInterval)
+		body[5] = 4
+		binary.BigEndian.PutUint32(body[6:10], uint32(cmd.Interval))
+		return j.send_command(platformSetParam, body, fmt.Sprintf("set_interval %d", cmd.Interval), force)
+	case device.COMMAND_REBOOT:
+		return j.send_command(platformTerminalControl, []byte{controlReset}, "reboot", force)
+	case device.COMMAND_RAW:
+		if cmd.Raw == "" {
+			return false, fmt.Errorf("%w : empty raw command", device.ErrInvalidCommand)
+		}
+		return j.SendCommand(cmd.Raw, force)
+	}
+	return false, device.ErrCommandNotSupported
+}
+
+func (j *JT808) send_command(msg_id uint16, body []byte, msg string, force bool) (bool, error) {
+	j.cmd.mu.Lock()
+	if j.cmd.status != command_empty {
+		if !force {
+			j.cmd.mu.Unlock()
+			return true, nil
+		} else {
+			j.log.Warn().Msg("there is pending command")
+		}
+	}
+	j.cmd.current_msg = msg
+	j.cmd.status = command_submitted
+	j.cmd.mu.Unlock()
+
+	j.c_mu.RLock()
+	defer j.c_mu.RUnlock()
+	serial, err := j.send_serial(msg_id, body)
+	if err != nil {
+		j.log.Error().Err(err).Msg("error when sending command")
+		return false, err
+	}
+	t := time.Now().UTC()
+	j.cmd.mu.Lock()
+	j.cmd.status = command_sent
+	j.cmd.serial = serial
+	j.cmd.sent_time = t
+	j.cmd.mu.Unlock()
+	j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "command.sent", Message: msg, Data: map[string]uint32{"server_flag": uint32(serial)}, Time: t, HistoryOnly: true})
+	return false, nil
+}
+
+func (j *JT808) handle_command_response(res terminalResponseMessage, t time.Time) {
+	j.cmd.mu.Lock()
+	if j.cmd.status != command_sent || j.cmd.serial != res.ReplySerial {
+		j.cmd.mu.Unlock()
+		return
+	}
+	j.cmd.status = command_empty
+	cmd := j.cmd.current_msg
+	sent_time := j.cmd.sent_time
+	j.cmd.mu.Unlock()
+	result, ok := resultString[res.Result]
+	if !ok {
+		result = fmt.Sprintf("result %d", res.Result)
+	}
+	j.bus.PublishCommandResponse(&eventbus.CommandResponse{TrackerId: j.tid, ServerFlag: uint32(res.ReplySerial), Command: cmd, SentTime: sent_time, Response: result, Time: t})
+}
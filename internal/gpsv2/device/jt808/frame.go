@@ -0,0 +1,215 @@
+package jt808
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+)
+
+const (
+	flag   byte = 0x7e
+	escape byte = 0x7d
+
+	maxFrameLength int = 2048
+)
+
+func ReadMessage(c *conn.Conn, msg *Message) error {
+	return readMessage(c, msg)
+}
+
+// readMessage read one 0x7e delimited frame, unescape it into msg.Buffer and
+// verify the xor checksum
+func readMessage(c *conn.Conn, msg *Message) error {
+	var d []byte
+	var err error
+	for {
+		//consume start flag, anything before it is discarded
+		_, err = c.ReadSlice(flag)
+		if err != nil {
+			return err
+		}
+		d, err = c.ReadSlice(flag)
+		if err != nil {
+			return err
+		}
+		//two consecutive flags, the second one is the start of the frame
+		if len(d) > 1 {
+			break
+		}
+		err = c.UnreadByte()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := unescapeTo(msg.Buffer, d[:len(d)-1])
+	if err != nil {
+		return err
+	}
+	return msg.parse(msg.Buffer[:n])
+}
+
+// peekMessage return the unescaped first frame without consuming it
+func peekMessage(c *conn.Conn) (*Message, error) {
+	b, err := c.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != flag {
+		return nil, errBadFrame
+	}
+	n := c.Buffered()
+	for {
+		d, _ := c.Peek(n)
+		//skip repeated start flag
+		s := 1
+		for s < len(d) && d[s] == flag {
+			s++
+		}
+		idx := bytes.IndexByte(d[s:], flag)
+		if idx > 0 {
+			msg := &Message{Buffer: make([]byte, idx)}
+			l, err := unescapeTo(msg.Buffer, d[s:s+idx])
+			if err != nil {
+				return nil, err
+			}
+			return msg, msg.parse(msg.Buffer[:l])
+		}
+		if n >= maxFrameLength {
+			return nil, errBadFrame
+		}
+		n = len(d) + 1
+		_, err = c.Peek(n)
+		if err != nil {
+			return nil, err
+		}
+		n = c.Buffered()
+	}
+}
+
+func unescapeTo(dst []byte, src []byte) (int, error) {
+	n := 0
+	for i := 0; i < len(src); i++ {
+		if n >= len(dst) {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		b := src[i]
+		if b == escape {
+			i++
+			if i >= len(src) {
+				return 0, errBadFrame
+			}
+			switch src[i] {
+			case 0x01:
+				b = escape
+			case 0x02:
+				b = flag
+			default:
+				return 0, errBadFrame
+			}
+		}
+		dst[n] = b
+		n++
+	}
+	return n, nil
+}
+
+func escapeFrame(d []byte) []byte {
+	frame := make([]byte, 0, len(d)+4)
+	frame = append(frame, flag)
+	for _, b := range d {
+		switch b {
+		case flag:
+			frame = append(frame, escape, 0x02)
+		case escape:
+			frame = append(frame, escape, 0x01)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, flag)
+}
+
+func checksum(d []byte) byte {
+	var x byte
+	for _, b := range d {
+		x ^= b
+	}
+	return x
+}
+
+// parse split unescaped frame into header and body
+func (m *Message) parse(d []byte) error {
+	if len(d) < 13 {
+		return errBadFrame
+	}
+	if checksum(d[:len(d)-1]) != d[len(d)-1] {
+		return errBadChecksum
+	}
+	d = d[:len(d)-1]
+	m.MsgID = binary.BigEndian.Uint16(d[0:2])
+	props := binary.BigEndian.Uint16(d[2:4])
+	length := int(props & 0x03ff)
+	m.Subpackage = props&0x2000 != 0
+	m.Version2019 = props&0x4000 != 0
+	pos := 4
+	phone_len := 6
+	if m.Version2019 {
+		pos++ //protocol version
+		phone_len = 10
+	}
+	if len(d) < pos+phone_len+2 {
+		return errBadFrame
+	}
+	m.Phone = hex.EncodeToString(d[pos : pos+phone_len])
+	pos += phone_len
+	m.Serial = binary.BigEndian.Uint16(d[pos : pos+2])
+	pos += 2
+	if m.Subpackage {
+		pos += 4
+	}
+	if len(d) != pos+length {
+		return errBadFrame
+	}
+	m.Body = d[pos:]
+	return nil
+}
+
+// newFrame build, checksum and escape platform message addressed to phone
+func newFrame(msg_id uint16, phone string, version2019 bool, serial uint16, body []byte) []byte {
+	d := make([]byte, 0, len(body)+20)
+	props := uint16(len(body)) & 0x03ff
+	if version2019 {
+		props |= 0x4000
+	}
+	d = append(d, byte(msg_id>>8), byte(msg_id), byte(props>>8), byte(props))
+	if version2019 {
+		d = append(d, 0x01)
+	}
+	p, _ := hex.DecodeString(phone)
+	d = append(d, p...)
+	d = append(d, byte(serial>>8), byte(serial))
+	d = append(d, body...)
+	d = append(d, checksum(d))
+	return escapeFrame(d)
+}
+
+func newGeneralResponse(reply_serial uint16, reply_id uint16, result byte) []byte {
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint16(b[0:2], reply_serial)
+	binary.BigEndian.PutUint16(b[2:4], reply_id)
+	b[4] = result
+	return b
+}
+
+func newRegisterResponse(reply_serial uint16, result byte, auth_code string) []byte {
+	b := make([]byte, 3, 3+len(auth_code))
+	binary.BigEndian.PutUint16(b[0:2], reply_serial)
+	b[2] = result
+	if result == resultSuccess {
+		b = append(b, auth_code...)
+	}
+	return b
+}
@@ -0,0 +1,125 @@
+package jt808
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+)
+
+func TestEscape(t *testing.T) {
+	d := []byte{0x30, 0x7e, 0x08, 0x7d, 0x55}
+	frame := escapeFrame(d)
+	expected := []byte{0x7e, 0x30, 0x7d, 0x02, 0x08, 0x7d, 0x01, 0x55, 0x7e}
+	if !bytes.Equal(frame, expected) {
+		t.Fatalf("escaped % x, expected % x", frame, expected)
+	}
+	dst := make([]byte, len(d))
+	n, err := unescapeTo(dst, frame[1:len(frame)-1])
+	if err != nil || !bytes.Equal(dst[:n], d) {
+		t.Fatalf("unescaped % x %v", dst[:n], err)
+	}
+	bad := [][]byte{
+		{0x30, 0x7d, 0x03},
+		{0x30, 0x7d},
+	}
+	for _, b := range bad {
+		if _, err := unescapeTo(dst, b); err != errBadFrame {
+			t.Errorf("% x : expected bad frame, got %v", b, err)
+		}
+	}
+	if _, err := unescapeTo(make([]byte, 2), []byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error on small buffer")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	cases := []struct {
+		d []byte
+		x byte
+	}{
+		{[]byte{}, 0},
+		{[]byte{0x01, 0x02, 0x03}, 0x00},
+		{[]byte{0x12, 0x34}, 0x26},
+		{[]byte{0x02, 0x00, 0x00, 0x00, 0x01, 0x39, 0x12, 0x34, 0x56, 0x78, 0x00, 0x05}, 0x37},
+	}
+	for _, c := range cases {
+		if x := checksum(c.d); x != c.x {
+			t.Errorf("% x : checksum %02x, expected %02x", c.d, x, c.x)
+		}
+	}
+}
+
+func pipeConn(t *testing.T, d []byte) *conn.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		client.Write(d)
+		client.Close()
+	}()
+	return conn.NewConn(server, 1)
+}
+
+func TestReadMessage(t *testing.T) {
+	heartbeat := newFrame(terminalHeartbeat, "013912345678", false, 5, nil)
+	//body with flag and escape byte
+	response := newFrame(terminalResponse, "00000000013912345678", true, 6, []byte{0x00, 0x7e, 0x81, 0x05, 0x7d})
+	corrupted := newFrame(terminalHeartbeat, "013912345678", false, 7, nil)
+	corrupted[len(corrupted)-2] ^= 0xff
+	//noise and repeated flag between frame are skipped
+	stream := append(heartbeat, 0x01, 0x02, flag)
+	stream = append(stream, response...)
+	stream = append(stream, corrupted...)
+	c := pipeConn(t, stream)
+
+	first, err := peekMessage(c)
+	if err != nil || first.MsgID != terminalHeartbeat {
+		t.Fatalf("peeked %+v %v", first, err)
+	}
+	msg := &Message{Buffer: make([]byte, maxFrameLength)}
+	if err := readMessage(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgID != terminalHeartbeat || msg.Version2019 || msg.Phone != "013912345678" || msg.Serial != 5 || len(msg.Body) != 0 {
+		t.Fatalf("heartbeat %+v", msg)
+	}
+	if err := readMessage(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.MsgID != terminalResponse || !msg.Version2019 || msg.Phone != "00000000013912345678" || msg.Serial != 6 ||
+		!bytes.Equal(msg.Body, []byte{0x00, 0x7e, 0x81, 0x05, 0x7d}) {
+		t.Fatalf("response %+v", msg)
+	}
+	if err := readMessage(c, msg); err != errBadChecksum {
+		t.Fatalf("expected bad checksum, got %v", err)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	d := []byte{0x02, 0x00, 0x00, 0x00, 0x01, 0x39, 0x12, 0x34, 0x56, 0x78, 0x00, 0x05}
+	cases := []struct {
+		name string
+		d    []byte
+		err  error
+	}{
+		{"valid", append(append([]byte{}, d...), checksum(d)), nil},
+		{"bad checksum", append(append([]byte{}, d...), checksum(d)+1), errBadChecksum},
+		{"too short", []byte{0x00, 0x02, 0x00}, errBadFrame},
+		//length in the properties does not match the body
+		{"bad length", func() []byte {
+			b := append([]byte{}, d...)
+			b[3] = 0x04
+			return append(b, checksum(b))
+		}(), errBadFrame},
+	}
+	for _, c := range cases {
+		m := &Message{}
+		if err := m.parse(c.d); err != c.err {
+			t.Errorf("%s : error %v, expected %v", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package jt808
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+	"nuha.dev/gpstracker/internal/util"
+)
+
+type runningState int
+
+const (
+	created runningState = iota
+	running
+	paused
+)
+
+const (
+	CONNECTION_CLOSED string = "connection_closed"
+)
+
+const (
+	command_submitted int = iota
+	command_sent
+	command_empty
+)
+
+// tracker attribute holding the authentication code given on registration
+const AUTH_CODE_ATTRIBUTE string = "jt808_auth_code"
+
+type JT808Param struct {
+	Bus       *eventbus.EventBus
+	MiscStore store.MiscStore
+	//Running track the read loop goroutine so shutdown can wait for its last publish
+	Running *sync.WaitGroup
+	Logger  log.Logger
+}
+
+type JT808 struct {
+	c          *conn.Conn
+	c_next     *conn.Conn
+	c_mu       sync.RWMutex
+	c_next_mu  sync.Mutex
+	stopped    bool
+	stopped_mu sync.Mutex
+	err        error_state
+	out        out_state
+	auth       auth_state
+	cmd        command_state
+	msg        Message
+	log        log.Logger
+	ser        device.Serial
+	tid        uint64
+	conf       *device.DeviceConfig
+	validator  *device.LocationValidator
+	bus        *eventbus.EventBus
+	running    *sync.WaitGroup
+	misc_store store.MiscStore
+
+	runningState
+	rs_mu sync.Mutex
+	jt808_status
+	jt808_location
+}
+
+type error_state struct {
+	mu  sync.Mutex
+	err error
+	t   time.Time
+}
+
+// out_state hold what is needed to address platform message to the terminal
+type out_state struct {
+	mu          sync.Mutex
+	serial      uint16
+	phone       string
+	version2019 bool
+}
+
+// command_state track the last command, the terminal acknowledge it with a general
+// response carrying the platform serial of the command
+type command_state struct {
+	mu          sync.Mutex
+	sent_time   time.Time
+	status      int
+	current_msg string
+	serial      uint16
+}
+
+type auth_state struct {
+	mu            sync.Mutex
+	code          string
+	authenticated bool
+}
+
+type jt808_status struct {
+	mu   sync.Mutex
+	si   statusInfo
+	time time.Time
+}
+
+type jt808_location struct {
+	mu   sync.Mutex
+	loc  location
+	time time.Time
+}
+
+func NewJT808(tid uint64, ser device.Serial, phone string, c *conn.Conn, param *JT808Param, conf_attr *device.DeviceConfigAttribute) *JT808 {
+	o := &JT808{c: c}
+	o.log = param.Logger
+	o.log.Context = log.NewContext(nil).Str("module", "jt808").EmbedObject(ser).Value()
+	o.bus = param.Bus
+	o.running = param.Running
+	o.misc_store = param.MiscStore
+	o.runningState = created
+	o.msg.Buffer = make([]byte, maxFrameLength)
+	o.conf = conf_attr.Config
+	o.validator = device.NewLocationValidator(o.conf)
+	o.tid = tid
+	o.ser = ser
+	o.out.phone = phone
+	o.auth.code = conf_attr.Attribute[AUTH_CODE_ATTRIBUTE]
+	o.cmd.status = command_empty
+	return o
+}
+
+func (j *JT808) closeAndSetErr(err error, t time.Time) {
+	j.err.mu.Lock()
+	j.err.err = err
+	j.err.t = t
+	j.err.mu.Unlock()
+	j.log.Error().Err(err).Str("event", CONNECTION_CLOSED).Msg("connection closed caused by error")
+	j.c.Close()
+}
+
+func (j *JT808) Run() {
+	j.running.Add(1)
+	go j._run()
+}
+
+func (j *JT808) Stop() {
+	j.stop()
+	j.c.Close()
+}
+
+func (j *JT808) stop() {
+	j.stopped_mu.Lock()
+	j.stopped = true
+	j.stopped_mu.Unlock()
+}
+
+func (j *JT808) is_stopped() bool {
+	j.stopped_mu.Lock()
+	f := j.stopped
+	j.stopped_mu.Unlock()
+	return f
+}
+
+func (j *JT808) _run() {
+	defer j.running.Done()
+	defer func() {
+		j.rs_mu.Lock()
+		j.runningState = paused
+		j.rs_mu.Unlock()
+		j.log.Info().Msg("exit from goroutine runloop")
+	}()
+
+	j.rs_mu.Lock()
+	j.runningState = running
+	j.rs_mu.Unlock()
+	for {
+		j.run() //will block
+		if j.is_stopped() {
+			break
+		}
+		ok := j.use_next_conn()
+		if ok {
+			continue
+		} else {
+			break
+		}
+	}
+}
+
+func (j *JT808) Error() (error, time.Time) {
+	j.err.mu.Lock()
+	defer j.err.mu.Unlock()
+	return j.err.err, j.err.t
+}
+
+func (j *JT808) set_next_conn(c *conn.Conn) {
+	j.c_next_mu.Lock()
+	j.c_next = c
+	j.c_next_mu.Unlock()
+}
+
+func (j *JT808) set_conn(c *conn.Conn) {
+	j.c_mu.Lock()
+	j.c = c
+	j.c_mu.Unlock()
+}
+
+func (j *JT808) use_next_conn() bool {
+	j.c_next_mu.Lock()
+	defer j.c_next_mu.Unlock()
+
+	if j.c_next == nil {
+		return false
+	} else {
+		j.c_mu.Lock()
+		defer j.c_mu.Unlock()
+		j.c = j.c_next
+		j.c_next = nil
+		return true
+	}
+}
+
+func (j *JT808) ReplaceConn(c *conn.Conn) {
+	j.rs_mu.Lock()
+	if j.runningState == running {
+		j.set_next_conn(c)
+		j.rs_mu.Unlock()
+		j.log.Info().Str("event", CONNECTION_CLOSED).Msg("closing replaced connection")
+		//read lock, run hold it while reading the connection being closed
+		j.c_mu.RLock()
+		j.c.Close()
+		j.c_mu.RUnlock()
+
+	} else if j.runningState == paused {
+		j.set_conn(c)
+		j.rs_mu.Unlock()
+		j.running.Add(1)
+		go j._run()
+	} else {
+		j.rs_mu.Unlock()
+	}
+}
+
+// send write platform message, the caller must hold c_mu
+func (j *JT808) send(msg_id uint16, body []byte) error {
+	_, err := j.send_serial(msg_id, body)
+	return err
+}
+
+// send_serial write platform message and return the serial it was sent with
+func (j *JT808) send_serial(msg_id uint16, body []byte) (uint16, error) {
+	j.out.mu.Lock()
+	j.out.serial++
+	serial := j.out.serial
+	d := newFrame(msg_id, j.out.phone, j.out.version2019, serial, body)
+	j.out.mu.Unlock()
+	j.log.Trace().Str("msg_id", hexID(msg_id)).Hex("payload", d).Msg("writing message")
+	_, err := j.c.Write(d)
+	if err != nil {
+		j.log.Error().Err(err).Msg("Error while writing data")
+	}
+	return serial, err
+}
+
+func (j *JT808) respond(result byte) error {
+	return j.send(platformResponse, newGeneralResponse(j.msg.Serial, j.msg.MsgID, result))
+}
+
+func (j *JT808) is_authenticated() bool {
+	j.auth.mu.Lock()
+	defer j.auth.mu.Unlock()
+	return j.auth.authenticated
+}
+
+// handle_register issue an authentication code to a terminal without one, a terminal
+// already holding a code has to authenticate with it until ResetRegistration is called
+// so another terminal claiming the same phone number can not take over the tracker
+func (j *JT808) handle_register(t time.Time) error {
+	j.auth.mu.Lock()
+	if j.auth.code != "" {
+		j.auth.mu.Unlock()
+		j.log.Warn().Msg("terminal already registered, register refused")
+		j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "register.refused", Time: t, HistoryOnly: true})
+		return j.send(platformRegisterResponse, newRegisterResponse(j.msg.Serial, resultTerminalRegistered, ""))
+	}
+	code := util.GenRandomString([]byte{}, 12)
+	j.auth.code = code
+	j.auth.mu.Unlock()
+	j.misc_store.UpdateAttribute(j.tid, AUTH_CODE_ATTRIBUTE, code)
+	j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "registered", Time: t, HistoryOnly: true})
+	j.log.Info().Msg("terminal registered")
+	return j.send(platformRegisterResponse, newRegisterResponse(j.msg.Serial, resultSuccess, code))
+}
+
+// ResetRegistration forget the authentication code so the terminal can register again,
+// the stored attribute is removed by the caller
+func (j *JT808) ResetRegistration() {
+	j.auth.mu.Lock()
+	j.auth.code = ""
+	j.auth.authenticated = false
+	j.auth.mu.Unlock()
+	j.log.Info().Msg("registration reset")
+}
+
+func (j *JT808) handle_auth(t time.Time) error {
+	code := parseAuthCode(j.msg.Body, j.msg.Version2019)
+	j.auth.mu.Lock()
+	ok := j.auth.code != "" && code == j.auth.code
+	j.auth.authenticated = ok
+	j.auth.mu.Unlock()
+	if !ok {
+		j.log.Warn().Str("auth_code", code).Msg("authentication failed")
+		j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "auth.failed", Message: code, Time: t, HistoryOnly: true})
+		return j.respond(resultFailure)
+	}
+	j.log.Info().Msg("terminal authenticated")
+	return j.respond(resultSuccess)
+}
+
+func (j *JT808) handle_status(si statusInfo, t time.Time) {
+	changed := false
+	j.jt808_status.mu.Lock()
+	prev := j.jt808_status.si
+	if prev != si {
+		changed = true
+	}
+	j.jt808_status.time = t
+	j.jt808_status.si = si
+	j.jt808_status.mu.Unlock()
+
+	if changed {
+		j.log.Info().Object("status", &si).Msg("status changed")
+		j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "heartbeat.changed", Data: si, Time: t})
+	}
+	for _, topic := range raisedAlarms(prev.Alarm, si.Alarm) {
+		j.log.Info().Str("alarm", topic).Msg("alarm raised")
+		j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: topic, Data: si, Time: t})
+	}
+}
+
+func (j *JT808) handle_location(loc location, t time.Time) {
+	dloc := loc.location()
+	keep, reason := j.validator.Validate(&dloc, t)
+	if reason != "" {
+		j.log.Debug().Str("reason", reason).Bool("dropped", !keep).Msg("location failed validation")
+	}
+	if keep {
+		j.bus.PublishLocation(&eventbus.Location{TrackerId: j.tid, Nsn: j.ser.Nsn(), Location: &dloc, ServerTime: t, Store: j.conf.Store, Live: j.conf.SublistSend, Config: j.conf})
+		j.jt808_location.mu.Lock()
+		j.jt808_location.loc = loc
+		j.jt808_location.time = t
+		j.jt808_location.mu.Unlock()
+	}
+	j.handle_status(loc.statusInfo, t)
+}
+
+func (j *JT808) handle_diconnection(t time.Time) {
+	j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "disconnected", Time: t})
+}
+
+func (j *JT808) event_run(t time.Time) {
+	j.bus.PublishEvent(&eventbus.Event{TrackerId: j.tid, Topic: "started", Time: t})
+}
+
+func (j *JT808) RejectCounts() map[string]uint64 {
+	return j.validator.Counts()
+}
+
+func (j *JT808) GetLocation() device.Location {
+	j.jt808_location.mu.Lock()
+	defer j.jt808_location.mu.Unlock()
+	return j.jt808_location.loc.location()
+}
+
+func (j *JT808) CurrentConnInfo() []string {
+	j.c_mu.RLock()
+	defer j.c_mu.RUnlock()
+	return j.c.ConnAddr()
+}
+
+func (j *JT808) run() {
+	j.c_mu.RLock()
+	j.event_run(time.Now())
+	j.auth.mu.Lock()
+	j.auth.authenticated = false
+	j.auth.mu.Unlock()
+	defer func() {
+		j.c_mu.RUnlock()
+		j.log.Info().Msg("exit from readMessage loop")
+	}()
+	for {
+		err := j.readMessage()
+		if err != nil {
+			if err == errBadChecksum {
+				j.log.Error().Err(err).Msg("discarding message")
+				continue
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				j.log.Info().Msg("read deadline exceeded")
+			}
+			j.handle_diconnection(time.Now())
+			j.closeAndSetErr(err, time.Now())
+			return
+		}
+		tread := time.Now().UTC()
+		msg_id := hexID(j.msg.MsgID)
+		j.out.mu.Lock()
+		j.out.version2019 = j.msg.Version2019
+		j.out.mu.Unlock()
+		j.log.Trace().Str("msg_id", msg_id).Hex("payload", j.msg.Body).Int("serial", int(j.msg.Serial)).Msg("receive message from terminal")
+
+		switch j.msg.MsgID {
+		case terminalRegister:
+			err = j.handle_register(tread)
+		case terminalAuth:
+			err = j.handle_auth(tread)
+		case terminalHeartbeat:
+			err = j.respond(resultSuccess)
+		case terminalLogout:
+			j.auth.mu.Lock()
+			j.auth.authenticated = false
+			j.auth.mu.Unlock()
+			err = j.respond(resultSuccess)
+		case terminalResponse:
+			res, perr := parseTerminalResponse(j.msg.Body)
+			if perr == nil {
+				j.log.Info().Str("reply_id", hexID(res.ReplyID)).Int("reply_serial", int(res.ReplySerial)).Int("result", int(res.Result)).Msg("terminal response")
+				j.handle_command_response(res, tread)
+			}
+		case terminalLocation, terminalLocationList:
+			if !j.is_authenticated() {
+				j.log.Warn().Str("msg_id", msg_id).Msg("location from unauthenticated terminal")
+				err = j.respond(resultFailure)
+				break
+			}
+			var locs []location
+			var perr error
+			if j.msg.MsgID == terminalLocation {
+				var loc location
+				loc, perr = parseLocation(j.msg.Body)
+				locs = []location{loc}
+			} else {
+				locs, perr = parseLocationList(j.msg.Body)
+			}
+			if perr != nil {
+				j.log.Error().Err(perr).Str("msg_id", msg_id).Hex("payload", j.msg.Body).Msg("error parsing location")
+				err = j.respond(resultFailure)
+				break
+			}
+			for _, loc := range locs {
+				j.handle_location(loc, tread)
+			}
+			j.log.Debug().Str("msg_id", msg_id).Int("count", len(locs)).Msg("location update")
+			err = j.respond(resultSuccess)
+		default:
+			j.log.Error().Hex("data", j.msg.Body).Str("msg_id", msg_id).Str("error", "unknown message id").Msg("unhandled message")
+		}
+		if err != nil {
+			j.handle_diconnection(time.Now())
+			j.closeAndSetErr(err, time.Now())
+			return
+		}
+	}
+}
+
+func (j *JT808) readMessage() error {
+	minutes := j.conf.ReadDeadline
+	_ = j.c.SetReadDeadline(time.Now().Add(time.Duration(minutes) * time.Minute))
+	return readMessage(j.c, &j.msg)
+}
@@ -0,0 +1,47 @@
+package jt808
+
+import (
+	"fmt"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+func init() {
+	protocol.Register(&protocol.Protocol{
+		Name:    device.DEVICE_JT808,
+		PeekLen: 1,
+		Detect:  func(head []byte) bool { return head[0] == flag },
+		Login:   login,
+	})
+}
+
+type jt808Login struct {
+	ser   device.Serial
+	phone string
+}
+
+func (l *jt808Login) Serial() device.Serial {
+	return l.ser
+}
+
+func (l *jt808Login) NewDevice(tid uint64, c *conn.Conn, param *protocol.Param, conf_attr *device.DeviceConfigAttribute) device.DeviceIf {
+	p := JT808Param{Bus: param.Bus, Logger: param.Logger, MiscStore: param.MiscStore, Running: param.Running}
+	return NewJT808(tid, l.ser, l.phone, c, &p, conf_attr)
+}
+
+// login take the terminal phone number from the first frame header, registration
+// and authentication need the tracker attribute so the frame is left in the
+// connection buffer to be handled by the device
+func login(c *conn.Conn) (protocol.Login, error) {
+	m, err := peekMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := parsePhone(m.Phone)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing terminal phone number : %w", err)
+	}
+	return &jt808Login{ser: device.NewSerial(6, sn), phone: m.Phone}, nil
+}
@@ -0,0 +1,260 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+// terminal message id
+const (
+	terminalResponse     uint16 = 0x0001
+	terminalHeartbeat    uint16 = 0x0002
+	terminalLogout       uint16 = 0x0003
+	terminalRegister     uint16 = 0x0100
+	terminalAuth         uint16 = 0x0102
+	terminalLocation     uint16 = 0x0200
+	terminalLocationList uint16 = 0x0704
+)
+
+// platform message id
+const (
+	platformResponse         uint16 = 0x8001
+	platformRegisterResponse uint16 = 0x8100
+	platformSetParam         uint16 = 0x8103
+	platformTerminalControl  uint16 = 0x8105
+	platformTextMessage      uint16 = 0x8300
+)
+
+const (
+	resultSuccess byte = 0
+	resultFailure byte = 1
+	//register response only
+	resultTerminalRegistered byte = 3
+)
+
+// location report is in GMT+8
+var reportZone = time.FixedZone("GMT+8", 8*60*60)
+
+var errBadFrame = errors.New("Bad frame")
+var errBadChecksum = errors.New("Bad checksum")
+
+type Message struct {
+	MsgID       uint16
+	Subpackage  bool
+	Version2019 bool
+	Phone       string //BCD digits
+	Serial      uint16
+	Body        []byte
+	Buffer      []byte
+}
+
+type location struct {
+	Timestamp time.Time `json:"gps_time"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lon"`
+	Altitude  float32   `json:"alt"`
+	Speed     float32   `json:"speed"`
+	Course    uint16    `json:"course"`
+	Mileage   *float64  `json:"mileage,omitempty"`
+	SatCount  *int      `json:"sat_count,omitempty"`
+	statusInfo
+}
+
+func (l *location) location() device.Location {
+	course := float32(l.Course)
+	valid := l.Positioned
+	acc := l.ACC
+	return device.Location{
+		Latitude:  l.Latitude,
+		Longitude: l.Longitude,
+		Altitude:  l.Altitude,
+		Speed:     l.Speed,
+		Timestamp: l.Timestamp,
+		Course:    &course,
+		SatCount:  l.SatCount,
+		Valid:     &valid,
+		ACC:       &acc,
+		Odometer:  l.Mileage,
+	}
+}
+
+type statusInfo struct {
+	Alarm      uint32 `json:"alarm"`
+	Status     uint32 `json:"status"`
+	ACC        bool   `json:"acc"`
+	Positioned bool   `json:"positioned"`
+	OilCut     bool   `json:"oil_cut"`
+	CircuitCut bool   `json:"circuit_cut"`
+}
+
+func (s *statusInfo) MarshalObject(e *log.Entry) {
+	e.Bool("acc", s.ACC).Bool("positioned", s.Positioned).Bool("oil_cut", s.OilCut).Bool("circuit_cut", s.CircuitCut).Str("alarm", strconv.FormatUint(uint64(s.Alarm), 2))
+}
+
+type terminalResponseMessage struct {
+	ReplySerial uint16
+	ReplyID     uint16
+	Result      byte
+}
+
+// alarm flag bit and the event topic it is published as
+var alarmTopics = []struct {
+	bit   uint
+	topic string
+}{
+	{0, "alarm.sos"},
+	{1, "alarm.overspeed"},
+	{2, "alarm.fatigue"},
+	{4, "alarm.gnss_fault"},
+	{5, "alarm.gnss_antenna_cut"},
+	{7, "alarm.low_power"},
+	{8, "alarm.power_cut"},
+	{20, "alarm.geofence"},
+	{21, "alarm.route"},
+	{27, "alarm.illegal_ignition"},
+	{28, "alarm.illegal_move"},
+	{29, "alarm.collision"},
+	{30, "alarm.rollover"},
+}
+
+// raisedAlarms return topic of alarm bits set in cur but not in prev
+func raisedAlarms(prev, cur uint32) []string {
+	raised := cur &^ prev
+	topics := []string{}
+	for _, v := range alarmTopics {
+		if raised&(1<<v.bit) != 0 {
+			topics = append(topics, v.topic)
+		}
+	}
+	return topics
+}
+
+func bcd(b byte) int {
+	return int(b>>4)*10 + int(b&0x0F)
+}
+
+// maxPhone is the largest phone number fitting the 60 bit serial number, 2019 version
+// phone has 20 BCD digits but only number with leading zeros are used in practice
+const maxPhone uint64 = 0x0fffffffffffffff
+
+// parsePhone convert BCD phone number into serial number, phone number beyond the
+// serial number range is rejected instead of being truncated into another serial
+func parsePhone(phone string) (uint64, error) {
+	p := strings.TrimLeft(phone, "0")
+	if p == "" {
+		return 0, nil
+	}
+	sn, err := strconv.ParseUint(p, 10, 64)
+	if err != nil || sn > maxPhone {
+		return 0, fmt.Errorf("phone number %s is too large for a serial number", phone)
+	}
+	return sn, nil
+}
+
+func parseLocation(d []byte) (location, error) {
+	m := location{}
+	if len(d) < 28 {
+		return m, errBadFrame
+	}
+	m.Alarm = binary.BigEndian.Uint32(d[0:4])
+	m.Status = binary.BigEndian.Uint32(d[4:8])
+	m.ACC = m.Status&0x01 != 0
+	m.Positioned = m.Status&0x02 != 0
+	m.OilCut = m.Status&(1<<10) != 0
+	m.CircuitCut = m.Status&(1<<11) != 0
+	m.Latitude = float64(binary.BigEndian.Uint32(d[8:12])) / 1000000
+	m.Longitude = float64(binary.BigEndian.Uint32(d[12:16])) / 1000000
+	if m.Status&0x04 != 0 {
+		m.Latitude = -m.Latitude
+	}
+	if m.Status&0x08 != 0 {
+		m.Longitude = -m.Longitude
+	}
+	m.Altitude = float32(binary.BigEndian.Uint16(d[16:18]))
+	m.Speed = float32(binary.BigEndian.Uint16(d[18:20])) * 100 / 3600 //0.1 kmh to mps
+	m.Course = binary.BigEndian.Uint16(d[20:22])
+	m.Timestamp = time.Date(bcd(d[22])+2000, time.Month(bcd(d[23])), bcd(d[24]), bcd(d[25]), bcd(d[26]), bcd(d[27]), 0, reportZone).UTC()
+	//additional information items : id(1) length(1) value
+	for pos := 28; pos+2 <= len(d); {
+		id := d[pos]
+		l := int(d[pos+1])
+		pos += 2
+		if pos+l > len(d) {
+			break
+		}
+		v := d[pos : pos+l]
+		switch {
+		case id == 0x01 && l == 4:
+			mileage := float64(binary.BigEndian.Uint32(v)) * 100 //0.1 km to m
+			m.Mileage = &mileage
+		case id == 0x31 && l == 1:
+			sat := int(v[0])
+			m.SatCount = &sat
+		}
+		pos += l
+	}
+	return m, nil
+}
+
+// parseLocationList parse batch upload body : count(2) type(1) [length(2) location]...
+func parseLocationList(d []byte) ([]location, error) {
+	if len(d) < 3 {
+		return nil, errBadFrame
+	}
+	n := int(binary.BigEndian.Uint16(d[0:2]))
+	locs := make([]location, 0, n)
+	pos := 3
+	for i := 0; i < n; i++ {
+		if pos+2 > len(d) {
+			return nil, errBadFrame
+		}
+		l := int(binary.BigEndian.Uint16(d[pos : pos+2]))
+		pos += 2
+		if pos+l > len(d) {
+			return nil, errBadFrame
+		}
+		loc, err := parseLocation(d[pos : pos+l])
+		if err != nil {
+			return nil, err
+		}
+		locs = append(locs, loc)
+		pos += l
+	}
+	return locs, nil
+}
+
+func parseTerminalResponse(d []byte) (terminalResponseMessage, error) {
+	m := terminalResponseMessage{}
+	if len(d) < 5 {
+		return m, errBadFrame
+	}
+	m.ReplySerial = binary.BigEndian.Uint16(d[0:2])
+	m.ReplyID = binary.BigEndian.Uint16(d[2:4])
+	m.Result = d[4]
+	return m, nil
+}
+
+// parseAuthCode return authentication code, 2019 version prefix it with its length
+// and append imei and software version
+func parseAuthCode(d []byte, version2019 bool) string {
+	if version2019 && len(d) > 0 {
+		l := int(d[0])
+		if l+1 <= len(d) {
+			return string(d[1 : l+1])
+		}
+	}
+	return string(d)
+}
+
+func hexID(id uint16) string {
+	b := []byte{byte(id >> 8), byte(id)}
+	return hex.EncodeToString(b)
+}
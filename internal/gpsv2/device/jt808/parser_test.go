@@ -0,0 +1,105 @@
+package jt808
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParsePhone(t *testing.T) {
+	cases := []struct {
+		phone string
+		sn    uint64
+		err   bool
+	}{
+		{"013912345678", 13912345678, false},
+		{"00000000013912345678", 13912345678, false},
+		{"000000000000", 0, false},
+		{"01152921504606846975", 1152921504606846975, false},
+		{"01152921504606846976", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+	for _, c := range cases {
+		sn, err := parsePhone(c.phone)
+		if sn != c.sn || (err != nil) != c.err {
+			t.Errorf("%s : serial %d error %v, expected %d", c.phone, sn, err, c.sn)
+		}
+	}
+}
+
+// locationBody encode a location report south of the equator with acc on,
+// mileage and satellite count as additional information
+func locationBody() []byte {
+	d := make([]byte, 28)
+	binary.BigEndian.PutUint32(d[4:8], 0x01|0x02|0x04)
+	binary.BigEndian.PutUint32(d[8:12], 6200000)
+	binary.BigEndian.PutUint32(d[12:16], 106800000)
+	binary.BigEndian.PutUint16(d[16:18], 12)
+	binary.BigEndian.PutUint16(d[18:20], 600)
+	binary.BigEndian.PutUint16(d[20:22], 90)
+	copy(d[22:28], []byte{0x21, 0x09, 0x01, 0x18, 0x00, 0x00})
+	d = append(d, 0x01, 4, 0, 0, 0x30, 0x39)
+	d = append(d, 0x31, 1, 11)
+	//unknown item is skipped
+	d = append(d, 0x25, 2, 0, 0)
+	return d
+}
+
+func TestParseLocation(t *testing.T) {
+	loc, err := parseLocation(locationBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Latitude != -6.2 || loc.Longitude != 106.8 || loc.Altitude != 12 || loc.Course != 90 {
+		t.Fatalf("position %+v", loc)
+	}
+	if math.Abs(float64(loc.Speed)-60/3.6) > 0.01 {
+		t.Fatalf("speed %f", loc.Speed)
+	}
+	if !loc.Timestamp.Equal(time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("timestamp %s", loc.Timestamp)
+	}
+	if !loc.ACC || !loc.Positioned || loc.Mileage == nil || *loc.Mileage != 1234500 || loc.SatCount == nil || *loc.SatCount != 11 {
+		t.Fatalf("status %+v", loc)
+	}
+	if _, err := parseLocation(make([]byte, 27)); err == nil {
+		t.Fatal("expected error on short body")
+	}
+}
+
+func TestParseLocationList(t *testing.T) {
+	body := locationBody()
+	d := []byte{0, 2, 0}
+	for i := 0; i < 2; i++ {
+		d = append(d, byte(len(body)>>8), byte(len(body)))
+		d = append(d, body...)
+	}
+	locs, err := parseLocationList(d)
+	if err != nil || len(locs) != 2 || locs[1].Latitude != -6.2 {
+		t.Fatalf("locations %+v %v", locs, err)
+	}
+	if _, err := parseLocationList(d[:len(d)-1]); err == nil {
+		t.Fatal("expected error on truncated list")
+	}
+}
+
+func TestParseTerminalResponse(t *testing.T) {
+	m, err := parseTerminalResponse([]byte{0x00, 0x07, 0x81, 0x05, 0x01})
+	if err != nil || m.ReplySerial != 7 || m.ReplyID != platformTerminalControl || m.Result != 1 {
+		t.Fatalf("response %+v %v", m, err)
+	}
+	if _, err := parseTerminalResponse([]byte{0x00, 0x07}); err == nil {
+		t.Fatal("expected error on short body")
+	}
+}
+
+func TestParseAuthCode(t *testing.T) {
+	if code := parseAuthCode([]byte("abc123"), false); code != "abc123" {
+		t.Fatalf("auth code %s", code)
+	}
+	d := append([]byte{6}, []byte("abc123861234567890123V1.0")...)
+	if code := parseAuthCode(d, true); code != "abc123" {
+		t.Fatalf("2019 auth code %s", code)
+	}
+}
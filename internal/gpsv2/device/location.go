@@ -0,0 +1,77 @@
+package device
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// presence bit of optional location field in the binary extension
+const (
+	LOC_COURSE   byte = 1 << 0
+	LOC_SAT      byte = 1 << 1
+	LOC_HDOP     byte = 1 << 2
+	LOC_ACCURACY byte = 1 << 3
+	LOC_VALID    byte = 1 << 4
+	LOC_ACC      byte = 1 << 5
+	LOC_ODOMETER byte = 1 << 6
+)
+
+// AppendExtension append optional field of l in little endian :
+// presence(1) bool value(1) [course f32] [sat count u8] [hdop f32] [accuracy f32] [odometer f64],
+// bool value carry valid in bit 0 and acc in bit 1, absent field take no space
+func (l *Location) AppendExtension(b []byte) []byte {
+	var presence, bits byte
+	if l.Course != nil {
+		presence |= LOC_COURSE
+	}
+	if l.SatCount != nil {
+		presence |= LOC_SAT
+	}
+	if l.HDOP != nil {
+		presence |= LOC_HDOP
+	}
+	if l.Accuracy != nil {
+		presence |= LOC_ACCURACY
+	}
+	if l.Valid != nil {
+		presence |= LOC_VALID
+		if *l.Valid {
+			bits |= 1 << 0
+		}
+	}
+	if l.ACC != nil {
+		presence |= LOC_ACC
+		if *l.ACC {
+			bits |= 1 << 1
+		}
+	}
+	if l.Odometer != nil {
+		presence |= LOC_ODOMETER
+	}
+	b = append(b, presence, bits)
+	var tmp [8]byte
+	if l.Course != nil {
+		binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(*l.Course))
+		b = append(b, tmp[:4]...)
+	}
+	if l.SatCount != nil {
+		sat := *l.SatCount
+		if sat > 255 {
+			sat = 255
+		}
+		b = append(b, byte(sat))
+	}
+	if l.HDOP != nil {
+		binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(*l.HDOP))
+		b = append(b, tmp[:4]...)
+	}
+	if l.Accuracy != nil {
+		binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(*l.Accuracy))
+		b = append(b, tmp[:4]...)
+	}
+	if l.Odometer != nil {
+		binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(*l.Odometer))
+		b = append(b, tmp[:]...)
+	}
+	return b
+}
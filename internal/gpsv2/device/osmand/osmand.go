@@ -0,0 +1,128 @@
+package osmand
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// minimum interval between two updates of the battery attribute
+const attribute_interval = time.Minute
+
+var ErrStopped = errors.New("device stopped")
+
+type OsmAndParam struct {
+	Bus       *eventbus.EventBus
+	MiscStore store.MiscStore
+	Logger    log.Logger
+}
+
+// OsmAnd is a connectionless device, each http request carry one report
+// so there is no read loop and no connection to replace
+type OsmAnd struct {
+	//push_mu serialize report of the device so bus subscriber see them in order
+	push_mu    sync.Mutex
+	mu         sync.Mutex
+	stopped    bool
+	remote     []string
+	loc        device.Location
+	batt       float64
+	batt_time  time.Time
+	log        log.Logger
+	ser        device.Serial
+	tid        uint64
+	conf       *device.DeviceConfig
+	validator  *device.LocationValidator
+	bus        *eventbus.EventBus
+	misc_store store.MiscStore
+}
+
+func NewOsmAnd(tid uint64, ser device.Serial, remote []string, param *OsmAndParam, conf_attr *device.DeviceConfigAttribute) *OsmAnd {
+	o := &OsmAnd{}
+	o.log = param.Logger
+	o.log.Context = log.NewContext(nil).Str("module", "osmand").EmbedObject(ser).Value()
+	o.bus = param.Bus
+	o.misc_store = param.MiscStore
+	o.conf = conf_attr.Config
+	o.validator = device.NewLocationValidator(o.conf)
+	o.tid = tid
+	o.ser = ser
+	o.remote = remote
+	return o
+}
+
+func (o *OsmAnd) Run() {
+	t := time.Now()
+	o.bus.PublishEvent(&eventbus.Event{TrackerId: o.tid, Topic: "started", Time: t})
+}
+
+func (o *OsmAnd) Stop() {
+	o.mu.Lock()
+	o.stopped = true
+	o.mu.Unlock()
+}
+
+// ReplaceConn is never called by the server since osmand report does not go
+// through the tcp login handler
+func (o *OsmAnd) ReplaceConn(c *conn.Conn) {
+	c.Close()
+}
+
+func (o *OsmAnd) CurrentConnInfo() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.remote
+}
+
+func (o *OsmAnd) RejectCounts() map[string]uint64 {
+	return o.validator.Counts()
+}
+
+func (o *OsmAnd) GetLocation() device.Location {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.loc
+}
+
+// Push handle one report received from remote at t
+func (o *OsmAnd) Push(r Report, remote []string, t time.Time) error {
+	o.push_mu.Lock()
+	defer o.push_mu.Unlock()
+	o.mu.Lock()
+	if o.stopped {
+		o.mu.Unlock()
+		return ErrStopped
+	}
+	o.remote = remote
+	loc := r.location()
+	keep, reason := o.validator.Validate(&loc, t)
+	if keep {
+		o.loc = loc
+	}
+	update_batt := false
+	if r.Battery != nil && (*r.Battery != o.batt || o.batt_time.IsZero()) && t.Sub(o.batt_time) >= attribute_interval {
+		o.batt = *r.Battery
+		o.batt_time = t
+		update_batt = true
+	}
+	o.mu.Unlock()
+
+	o.log.Debug().Float64("lat", r.Latitude).Float64("lon", r.Longitude).Time("gps_time", r.Timestamp).Msg("location update")
+	if reason != "" {
+		o.log.Debug().Str("reason", reason).Bool("dropped", !keep).Msg("location failed validation")
+	}
+	if keep {
+		o.bus.PublishLocation(&eventbus.Location{TrackerId: o.tid, Nsn: o.ser.Nsn(), Location: &loc, ServerTime: t, Store: o.conf.Store, Live: o.conf.SublistSend, Config: o.conf})
+	}
+	if update_batt {
+		o.misc_store.UpdateAttribute(o.tid, "battery_level", strconv.FormatFloat(*r.Battery, 'f', -1, 64))
+	}
+	return nil
+}
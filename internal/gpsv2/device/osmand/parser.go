@@ -0,0 +1,139 @@
+package osmand
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+const knotToMps float64 = 0.514444
+
+var errMissingField = errors.New("missing field")
+
+type Report struct {
+	ID        string
+	Timestamp time.Time
+	Latitude  float64
+	Longitude float64
+	Altitude  float32
+	Speed     float32
+	Bearing   float32
+	Accuracy  *float64
+	Battery   *float64
+	Charge    *bool
+}
+
+func (r *Report) location() device.Location {
+	course := r.Bearing
+	loc := device.Location{Latitude: r.Latitude, Longitude: r.Longitude, Altitude: r.Altitude, Speed: r.Speed, Timestamp: r.Timestamp, Course: &course}
+	if r.Accuracy != nil {
+		acc := float32(*r.Accuracy)
+		loc.Accuracy = &acc
+	}
+	return loc
+}
+
+// ParseID return the device id, traccar client send it as `id` while some
+// other client use `deviceid`
+func ParseID(q url.Values) string {
+	id := q.Get("id")
+	if id == "" {
+		id = q.Get("deviceid")
+	}
+	return id
+}
+
+// ParseReport parse osmand query parameter, speed is in knot
+func ParseReport(q url.Values) (Report, error) {
+	r := Report{}
+	var err error
+	r.ID = ParseID(q)
+	if r.ID == "" {
+		return r, fmt.Errorf("%w : id", errMissingField)
+	}
+	lat, lon := q.Get("lat"), q.Get("lon")
+	if loc := q.Get("location"); loc != "" && lat == "" && lon == "" {
+		latlon := strings.SplitN(loc, ",", 2)
+		if len(latlon) == 2 {
+			lat, lon = latlon[0], latlon[1]
+		}
+	}
+	if lat == "" || lon == "" {
+		return r, fmt.Errorf("%w : lat/lon", errMissingField)
+	}
+	r.Latitude, err = strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return r, fmt.Errorf("invalid lat : %w", err)
+	}
+	r.Longitude, err = strconv.ParseFloat(lon, 64)
+	if err != nil {
+		return r, fmt.Errorf("invalid lon : %w", err)
+	}
+	if r.Latitude < -90 || r.Latitude > 90 || r.Longitude < -180 || r.Longitude > 180 {
+		return r, fmt.Errorf("lat/lon out of range")
+	}
+	r.Timestamp, err = parseTimestamp(q.Get("timestamp"))
+	if err != nil {
+		return r, err
+	}
+	if v, ok := parseFloat(q, "speed"); ok {
+		r.Speed = float32(v * knotToMps)
+	}
+	if v, ok := parseFloat(q, "altitude"); ok {
+		r.Altitude = float32(v)
+	}
+	if v, ok := parseFloat(q, "bearing"); ok {
+		r.Bearing = float32(v)
+	} else if v, ok := parseFloat(q, "heading"); ok {
+		r.Bearing = float32(v)
+	}
+	if v, ok := parseFloat(q, "accuracy"); ok {
+		r.Accuracy = &v
+	}
+	if v, ok := parseFloat(q, "batt"); ok {
+		r.Battery = &v
+	}
+	if v, err := strconv.ParseBool(q.Get("charge")); err == nil {
+		r.Charge = &v
+	}
+	return r, nil
+}
+
+func parseFloat(q url.Values, key string) (float64, bool) {
+	s := q.Get(key)
+	if s == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// parseTimestamp accept unix time in second or millisecond, RFC3339 and
+// `yyyy-MM-dd HH:mm:ss` in UTC, missing timestamp mean now
+func parseTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now().UTC(), nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if v > 1e12 {
+			return time.UnixMilli(v).UTC(), nil
+		}
+		return time.Unix(v, 0).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", s)
+	if err != nil {
+		return t, fmt.Errorf("invalid timestamp : %s", s)
+	}
+	return t, nil
+}
@@ -2,6 +2,8 @@ package simplejson
 
 import (
 	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
 )
 
 type FrameMessage struct {
@@ -54,6 +56,20 @@ type LocationMessage struct {
 	HasGSV      bool           `json:"-"`
 }
 
+func (l *LocationMessage) location() device.Location {
+	sat := l.SatUsed
+	valid := l.Fix
+	return device.Location{
+		Latitude:  l.Latitude,
+		Longitude: l.Longitude,
+		Altitude:  l.Altitude,
+		Speed:     l.Speed,
+		Timestamp: l.GpsTime,
+		SatCount:  &sat,
+		Valid:     &valid,
+	}
+}
+
 type StatusMessage struct {
 	GpsStatus      bool      `json:"gps_status"`
 	LastLongitude  float64   `json:"last_longitude,omitempty"`
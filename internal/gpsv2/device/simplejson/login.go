@@ -0,0 +1,66 @@
+package simplejson
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+func init() {
+	protocol.Register(&protocol.Protocol{
+		Name:    device.DEVICE_SIMPLEJSON,
+		PeekLen: 1,
+		Detect:  func(head []byte) bool { return head[0] == 0x99 },
+		Login:   login,
+	})
+}
+
+type simpleJSONLogin struct {
+	ser device.Serial
+	msg LoginMessage
+}
+
+func (l *simpleJSONLogin) Serial() device.Serial {
+	return l.ser
+}
+
+func (l *simpleJSONLogin) NewDevice(tid uint64, c *conn.Conn, param *protocol.Param, conf_attr *device.DeviceConfigAttribute) device.DeviceIf {
+	d := NewSimpleJSON(tid, l.ser, c, param.Bus, param.Logger, &l.msg, conf_attr.Config)
+	d.running = param.Running
+	return d
+}
+
+func login(c *conn.Conn) (protocol.Login, error) {
+	msg := FrameMessage{}
+	msg.Buffer = make([]byte, 100)
+	err := ReadMessage(c, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Protocol != LOGIN {
+		return nil, fmt.Errorf("message type is not login,type : %x", msg.Protocol)
+	}
+	loginMessage := LoginMessage{}
+	err = json.Unmarshal(msg.Payload, &loginMessage)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing login message : %w", err)
+	}
+	sn, err := strconv.ParseUint(loginMessage.Serial, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing serial number : %w", err)
+	}
+	var sn_type int
+	switch loginMessage.SnType {
+	case "mac":
+		sn_type = 1
+	case "aid":
+		sn_type = 2
+	default:
+		sn_type = 5
+	}
+	return &simpleJSONLogin{ser: device.NewSerial(sn_type, sn), msg: loginMessage}, nil
+}
@@ -7,10 +7,9 @@ import (
 
 	"github.com/phuslu/log"
 
+	"nuha.dev/gpstracker/internal/eventbus"
 	"nuha.dev/gpstracker/internal/gpsv2/conn"
 	"nuha.dev/gpstracker/internal/gpsv2/device"
-	"nuha.dev/gpstracker/internal/gpsv2/sublist"
-	"nuha.dev/gpstracker/internal/store"
 )
 
 type runningState int
@@ -27,6 +26,7 @@ const (
 
 type SimpleJSON struct {
 	conf       *device.DeviceConfig
+	validator  *device.LocationValidator
 	c          *conn.Conn
 	c_next     *conn.Conn
 	c_mu       sync.RWMutex
@@ -35,11 +35,12 @@ type SimpleJSON struct {
 	stopped_mu sync.Mutex
 
 	ser     device.Serial
+	tid     uint64
 	err     error
 	log     log.Logger
-	store   store.LocationStore
+	bus     *eventbus.EventBus
+	running *sync.WaitGroup
 	msg     FrameMessage
-	sublist *sublist.Sublist
 	runningState
 	rs_mu sync.Mutex
 	lastMsg
@@ -72,17 +73,19 @@ type lastMsg struct {
 	sat_time time.Time
 }
 
-func NewSimpleJSON(c *conn.Conn, store store.LocationStore, logger log.Logger, login_msg *LoginMessage, sublist *sublist.Sublist, conf *device.DeviceConfig) *SimpleJSON {
+func NewSimpleJSON(tid uint64, ser device.Serial, c *conn.Conn, bus *eventbus.EventBus, logger log.Logger, login_msg *LoginMessage, conf *device.DeviceConfig) *SimpleJSON {
 	o := &SimpleJSON{c: c}
 	o.log = logger
-	o.log.Context = log.NewContext(nil).Str("module", "simplejson").Value()
-	o.store = store
+	o.log.Context = log.NewContext(nil).Str("module", "simplejson").EmbedObject(ser).Value()
+	o.bus = bus
 	o.runningState = created
 	o.msg.Buffer = make([]byte, 1000)
 	o.parsedMsg.sat = make([]Sat, 0, 100)
 	o.lastMsg.sat = make([]Sat, 0, 100)
 	o.conf = conf
-	o.sublist = sublist
+	o.validator = device.NewLocationValidator(o.conf)
+	o.tid = tid
+	o.ser = ser
 	return o
 }
 
@@ -129,6 +132,7 @@ func (j *SimpleJSON) ReplaceConn(c *conn.Conn) {
 	} else if j.runningState == paused {
 		j.set_conn(c)
 		j.rs_mu.Unlock()
+		j.running.Add(1)
 		go j._run()
 	}
 }
@@ -138,6 +142,7 @@ func (j *SimpleJSON) Run() {
 	j.rs_mu.Lock()
 	j.runningState = running
 	j.rs_mu.Unlock()
+	j.running.Add(1)
 	go j._run()
 
 }
@@ -161,7 +166,7 @@ func (j *SimpleJSON) is_stopped() bool {
 }
 
 func (j *SimpleJSON) _run() {
-
+	defer j.running.Done()
 	defer func() {
 		j.rs_mu.Lock()
 		j.runningState = paused
@@ -186,16 +191,14 @@ func (j *SimpleJSON) _run() {
 	}
 }
 
+func (j *SimpleJSON) RejectCounts() map[string]uint64 {
+	return j.validator.Counts()
+}
+
 func (j *SimpleJSON) GetLocation() device.Location {
 	j.lastMsg.loc_mu.Lock()
 	defer j.lastMsg.loc_mu.Unlock()
-	loc := device.Location{}
-	loc.Speed = j.lastMsg.loc.Speed
-	loc.Longitude = j.lastMsg.loc.Longitude
-	loc.Latitude = j.lastMsg.loc.Latitude
-	loc.Timestamp = j.lastMsg.loc.GpsTime
-	loc.Altitude = j.lastMsg.loc.Altitude
-	return loc
+	return j.lastMsg.loc.location()
 }
 
 func (j *SimpleJSON) CurrentConnInfo() []string {
@@ -228,11 +231,13 @@ func (j *SimpleJSON) run() {
 			j.lastMsg.loc_time = tread
 			j.lastMsg.loc = loc
 			j.lastMsg.loc_mu.Unlock()
-			if j.conf.SublistSend {
-				j.sublist.SendLocation(loc.Latitude, loc.Longitude, loc.Speed, loc.GpsTime, tread)
+			dloc := loc.location()
+			keep, reason := j.validator.Validate(&dloc, tread)
+			if reason != "" {
+				j.log.Debug().Str("reason", reason).Bool("dropped", !keep).Msg("location failed validation")
 			}
-			if j.conf.Store {
-				j.store.Put(j.ser.Nsn(), loc.Latitude, loc.Longitude, loc.Altitude, loc.Speed, loc.GpsTime, tread)
+			if keep {
+				j.bus.PublishLocation(&eventbus.Location{TrackerId: j.tid, Nsn: j.ser.Nsn(), Location: &dloc, ServerTime: tread, Store: j.conf.Store, Live: j.conf.SublistSend, Config: j.conf})
 			}
 
 		case STATUS:
@@ -0,0 +1,45 @@
+package teltonika
+
+import (
+	"fmt"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+var capabilities = []device.CommandType{
+	device.COMMAND_ENGINE_CUT,
+	device.COMMAND_ENGINE_RESUME,
+	device.COMMAND_REBOOT,
+	device.COMMAND_RAW,
+}
+
+func (t *Teltonika) Capabilities() []device.CommandType {
+	return capabilities
+}
+
+func (t *Teltonika) ExecuteCommand(cmd device.Command, force bool) (bool, error) {
+	msg, err := translateCommand(cmd)
+	if err != nil {
+		return false, err
+	}
+	return t.SendCommand(msg, force)
+}
+
+// translateCommand map command into codec 12 sms command, engine cut drive dout1
+// which is where the relay is wired on fmb installation
+func translateCommand(cmd device.Command) (string, error) {
+	switch cmd.Type {
+	case device.COMMAND_ENGINE_CUT:
+		return "setdigout 1", nil
+	case device.COMMAND_ENGINE_RESUME:
+		return "setdigout 0", nil
+	case device.COMMAND_REBOOT:
+		return "cpureset", nil
+	case device.COMMAND_RAW:
+		if cmd.Raw == "" {
+			return "", fmt.Errorf("%w : empty raw command", device.ErrInvalidCommand)
+		}
+		return cmd.Raw, nil
+	}
+	return "", device.ErrCommandNotSupported
+}
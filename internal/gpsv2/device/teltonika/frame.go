@@ -0,0 +1,111 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/util/crc16"
+)
+
+const (
+	imeiLength   int = 15
+	headerLength int = 8 //preamble + data field length
+	maxDataLen   int = 8192
+)
+
+func ReadMessage(c *conn.Conn, msg *Message) error {
+	return readMessage(c, msg)
+}
+
+// readIMEI read the handshake message, 2 bytes length followed by ascii imei
+func readIMEI(c *conn.Conn) (string, error) {
+	buf := make([]byte, 2+imeiLength)
+	_, err := io.ReadFull(c, buf[:2])
+	if err != nil {
+		return "", err
+	}
+	if int(binary.BigEndian.Uint16(buf[:2])) != imeiLength {
+		return "", errBadFrame
+	}
+	_, err = io.ReadFull(c, buf[2:])
+	if err != nil {
+		return "", err
+	}
+	return string(buf[2:]), nil
+}
+
+func sendIMEIResponse(c *conn.Conn, accept bool) error {
+	var b byte
+	if accept {
+		b = 0x01
+	}
+	_, err := c.Write([]byte{b})
+	return err
+}
+
+func readMessage(c *conn.Conn, msg *Message) error {
+	if len(msg.Buffer) < headerLength {
+		return fmt.Errorf("buffer too small")
+	}
+	_, err := io.ReadFull(c, msg.Buffer[:headerLength])
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(msg.Buffer[:4]) != 0 {
+		return errBadFrame
+	}
+	length := int(binary.BigEndian.Uint32(msg.Buffer[4:8]))
+	if length > maxDataLen || length < 3 {
+		return errBadFrame
+	}
+	//data field is followed by 4 bytes crc
+	frame_length := headerLength + length + 4
+	if len(msg.Buffer) < frame_length {
+		return fmt.Errorf("buffer too small")
+	}
+	_, err = io.ReadFull(c, msg.Buffer[headerLength:frame_length])
+	if err != nil {
+		return err
+	}
+	data := msg.Buffer[headerLength : headerLength+length]
+	crc := binary.BigEndian.Uint32(msg.Buffer[headerLength+length : frame_length])
+	if uint32(crc16.Checksum(crc16.IBM, data)) != crc {
+		return errBadCRC
+	}
+	msg.Length = frame_length
+	msg.Codec = data[0]
+	msg.Payload = data
+	return nil
+}
+
+func newAck(count int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(count))
+	return b
+}
+
+// newFrame wrap data field with preamble, length and crc
+func newFrame(data []byte) []byte {
+	l := len(data)
+	frame := make([]byte, headerLength+l+4)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(l))
+	copy(frame[headerLength:], data)
+	crc := crc16.Checksum(crc16.IBM, data)
+	binary.BigEndian.PutUint32(frame[headerLength+l:], uint32(crc))
+	return frame
+}
+
+// newCommand encode codec 12 command
+func newCommand(cmd string) []byte {
+	l := len(cmd)
+	data := make([]byte, l+8)
+	data[0] = codec12
+	data[1] = 0x01 //command quantity
+	data[2] = codec12Command
+	binary.BigEndian.PutUint32(data[3:7], uint32(l))
+	copy(data[7:], cmd)
+	data[l+7] = 0x01
+	return newFrame(data)
+}
@@ -0,0 +1,52 @@
+package teltonika
+
+import (
+	"fmt"
+	"strconv"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+func init() {
+	protocol.Register(&protocol.Protocol{
+		Name:             device.DEVICE_TELTONIKA,
+		PeekLen:          2,
+		Detect:           func(head []byte) bool { return head[0] == 0x00 && int(head[1]) == imeiLength },
+		Login:            login,
+		DatagramDetect:   detectDatagram,
+		NewDatagramCodec: newDatagramCodec,
+	})
+}
+
+type teltonikaLogin struct {
+	ser device.Serial
+}
+
+func (l *teltonikaLogin) Serial() device.Serial {
+	return l.ser
+}
+
+// Accept send the imei acknowledge, the device close the connection when it is refused
+func (l *teltonikaLogin) Accept(c *conn.Conn, accepted bool) error {
+	return sendIMEIResponse(c, accepted)
+}
+
+func (l *teltonikaLogin) NewDevice(tid uint64, c *conn.Conn, param *protocol.Param, conf_attr *device.DeviceConfigAttribute) device.DeviceIf {
+	p := TeltonikaParam{Bus: param.Bus, Logger: param.Logger, MiscStore: param.MiscStore, Running: param.Running}
+	return NewTeltonika(tid, l.ser, c, &p, conf_attr)
+}
+
+func login(c *conn.Conn) (protocol.Login, error) {
+	imei, err := readIMEI(c)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := strconv.ParseUint(imei, 10, 64)
+	if err != nil {
+		_ = sendIMEIResponse(c, false)
+		return nil, fmt.Errorf("error parsing serial number : %w", err)
+	}
+	return &teltonikaLogin{ser: device.NewSerial(0, sn)}, nil
+}
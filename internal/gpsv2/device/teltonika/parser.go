@@ -0,0 +1,204 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+const (
+	codec8         byte = 0x08
+	codec8Extended byte = 0x8E
+	codec12        byte = 0x0C
+
+	codec12Command  byte = 0x05
+	codec12Response byte = 0x06
+)
+
+// IO element id as defined by FMB devices
+const (
+	ioIgnition        uint16 = 239
+	ioMovement        uint16 = 240
+	ioGSMSignal       uint16 = 21
+	ioExternalVoltage uint16 = 66
+	ioBatteryVoltage  uint16 = 67
+	ioTotalOdometer   uint16 = 16
+)
+
+const priorityPanic byte = 2
+
+var errBadFrame = errors.New("Bad frame")
+var errBadCRC = errors.New("Bad crc")
+var errShortData = errors.New("data too short")
+
+type Message struct {
+	Codec   byte
+	Length  int
+	Payload []byte
+	Buffer  []byte
+}
+
+type record struct {
+	Timestamp time.Time
+	Priority  byte
+	Latitude  float64
+	Longitude float64
+	Altitude  float32
+	Course    uint16
+	SatCount  int
+	Speed     float32
+	EventIO   uint16
+	IO        map[uint16]uint64
+}
+
+// location convert rec into device.Location, fix is valid when at least one satellite is used
+func (rec *record) location() device.Location {
+	course := float32(rec.Course)
+	sat := rec.SatCount
+	valid := rec.SatCount > 0
+	loc := device.Location{
+		Latitude:  rec.Latitude,
+		Longitude: rec.Longitude,
+		Altitude:  rec.Altitude,
+		Speed:     rec.Speed,
+		Timestamp: rec.Timestamp,
+		Course:    &course,
+		SatCount:  &sat,
+		Valid:     &valid,
+	}
+	if v, ok := rec.IO[ioIgnition]; ok {
+		acc := v != 0
+		loc.ACC = &acc
+	}
+	if v, ok := rec.IO[ioTotalOdometer]; ok {
+		odo := float64(v)
+		loc.Odometer = &odo
+	}
+	return loc
+}
+
+type reader struct {
+	d   []byte
+	pos int
+	err error
+}
+
+// next return n bytes, on short data it set the error and return zeroed bytes
+// so the fixed size readers below never panic
+func (r *reader) next(n int) []byte {
+	if r.err == nil && (n < 0 || r.pos+n > len(r.d)) {
+		r.err = errShortData
+	}
+	if r.err != nil {
+		if n < 0 || n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	b := r.d[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) u8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *reader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *reader) u32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *reader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+// parseAVL parse codec 8 and codec 8 extended data field
+func parseAVL(d []byte) ([]record, error) {
+	r := &reader{d: d}
+	codec := r.u8()
+	if codec != codec8 && codec != codec8Extended {
+		return nil, fmt.Errorf("unsupported codec %x", codec)
+	}
+	ext := codec == codec8Extended
+	n := int(r.u8())
+	recs := make([]record, 0, n)
+	for i := 0; i < n; i++ {
+		rec := record{}
+		rec.Timestamp = time.UnixMilli(int64(r.u64())).UTC()
+		rec.Priority = r.u8()
+		rec.Longitude = float64(int32(r.u32())) / 10000000
+		rec.Latitude = float64(int32(r.u32())) / 10000000
+		rec.Altitude = float32(int16(r.u16()))
+		rec.Course = r.u16()
+		rec.SatCount = int(r.u8())
+		rec.Speed = float32(r.u16()) * 1000 / 3600 //kmh to mps
+		rec.EventIO, rec.IO = parseIO(r, ext)
+		if r.err != nil {
+			return nil, r.err
+		}
+		recs = append(recs, rec)
+	}
+	if int(r.u8()) != n {
+		return nil, fmt.Errorf("record count mismatch")
+	}
+	return recs, r.err
+}
+
+func parseIO(r *reader, ext bool) (uint16, map[uint16]uint64) {
+	count := func() int {
+		if ext {
+			return int(r.u16())
+		}
+		return int(r.u8())
+	}
+	id := func() uint16 {
+		if ext {
+			return r.u16()
+		}
+		return uint16(r.u8())
+	}
+	event := id()
+	_ = count() //total io count
+	io := make(map[uint16]uint64)
+	for _, size := range []int{1, 2, 4, 8} {
+		n := count()
+		for i := 0; i < n && r.err == nil; i++ {
+			k := id()
+			v := r.next(size)
+			var val uint64
+			for _, b := range v {
+				val = val<<8 | uint64(b)
+			}
+			io[k] = val
+		}
+	}
+	if ext {
+		//variable length elements are not mapped
+		n := count()
+		for i := 0; i < n && r.err == nil; i++ {
+			_ = id()
+			r.next(int(r.u16()))
+		}
+	}
+	return event, io
+}
+
+// parseCommandResponse parse codec 12 response
+func parseCommandResponse(d []byte) (string, error) {
+	r := &reader{d: d}
+	_ = r.u8() //codec
+	_ = r.u8() //response quantity
+	if r.u8() != codec12Response {
+		return "", fmt.Errorf("not a command response")
+	}
+	size := int(r.u32())
+	resp := r.next(size)
+	return string(resp), r.err
+}
@@ -0,0 +1,450 @@
+package teltonika
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+type runningState int
+
+const (
+	created runningState = iota
+	running
+	paused
+)
+
+const (
+	CONNECTION_CLOSED string = "connection_closed"
+)
+
+const (
+	command_submitted int = iota
+	command_sent
+	command_empty
+)
+
+// minimum interval between two updates of the same attribute
+const attribute_interval = time.Minute
+
+type TeltonikaParam struct {
+	Bus       *eventbus.EventBus
+	MiscStore store.MiscStore
+	//Running track the read loop goroutine so shutdown can wait for its last publish
+	Running *sync.WaitGroup
+	Logger  log.Logger
+}
+
+type Teltonika struct {
+	c          *conn.Conn
+	c_next     *conn.Conn
+	c_mu       sync.RWMutex
+	c_next_mu  sync.Mutex
+	stopped    bool
+	stopped_mu sync.Mutex
+	err        error_state
+	cmd        command_state
+	msg        Message
+	log        log.Logger
+	ser        device.Serial
+	tid        uint64
+	conf       *device.DeviceConfig
+	validator  *device.LocationValidator
+	bus        *eventbus.EventBus
+	running    *sync.WaitGroup
+	misc_store store.MiscStore
+
+	runningState
+	rs_mu sync.Mutex
+	io    io_state
+	teltonika_location
+}
+
+type error_state struct {
+	mu  sync.Mutex
+	err error
+	t   time.Time
+}
+
+type command_state struct {
+	mu                  sync.Mutex
+	sent_time           time.Time
+	status              int
+	server_flag_counter uint32
+	current_msg         string
+	current_server_flag uint32
+}
+
+type io_state struct {
+	has_ignition bool
+	ignition     bool
+	attr         map[string]uint64
+	attr_time    map[string]time.Time
+}
+
+type teltonika_location struct {
+	mu   sync.Mutex
+	rec  record
+	time time.Time
+}
+
+type ignitionEvent struct {
+	Ignition bool `json:"ignition"`
+}
+
+func NewTeltonika(tid uint64, ser device.Serial, c *conn.Conn, param *TeltonikaParam, conf_attr *device.DeviceConfigAttribute) *Teltonika {
+	o := &Teltonika{c: c}
+	o.log = param.Logger
+	o.log.Context = log.NewContext(nil).Str("module", "teltonika").EmbedObject(ser).Value()
+	o.bus = param.Bus
+	o.running = param.Running
+	o.misc_store = param.MiscStore
+	o.runningState = created
+	o.msg.Buffer = make([]byte, headerLength+maxDataLen+4)
+	o.conf = conf_attr.Config
+	o.validator = device.NewLocationValidator(o.conf)
+	o.tid = tid
+	o.ser = ser
+	o.cmd.status = command_empty
+	o.io.attr = make(map[string]uint64)
+	o.io.attr_time = make(map[string]time.Time)
+	return o
+}
+
+func (t *Teltonika) closeAndSetErr(err error, tm time.Time) {
+	t.err.mu.Lock()
+	t.err.err = err
+	t.err.t = tm
+	t.err.mu.Unlock()
+	t.log.Error().Err(err).Str("event", CONNECTION_CLOSED).Msg("connection closed caused by error")
+	t.c.Close()
+}
+
+func (t *Teltonika) Run() {
+	t.running.Add(1)
+	go t._run()
+}
+
+func (t *Teltonika) Stop() {
+	t.stop()
+	t.c.Close()
+}
+
+func (t *Teltonika) stop() {
+	t.stopped_mu.Lock()
+	t.stopped = true
+	t.stopped_mu.Unlock()
+}
+
+func (t *Teltonika) is_stopped() bool {
+	t.stopped_mu.Lock()
+	f := t.stopped
+	t.stopped_mu.Unlock()
+	return f
+}
+
+func (t *Teltonika) _run() {
+	defer t.running.Done()
+	defer func() {
+		t.rs_mu.Lock()
+		t.runningState = paused
+		t.rs_mu.Unlock()
+		t.log.Info().Msg("exit from goroutine runloop")
+	}()
+
+	t.rs_mu.Lock()
+	t.runningState = running
+	t.rs_mu.Unlock()
+	for {
+		t.run() //will block
+		if t.is_stopped() {
+			break
+		}
+		ok := t.use_next_conn()
+		if ok {
+			continue
+		} else {
+			break
+		}
+	}
+}
+
+func (t *Teltonika) Error() (error, time.Time) {
+	t.err.mu.Lock()
+	defer t.err.mu.Unlock()
+	return t.err.err, t.err.t
+}
+
+// SendCommand send codec 12 command such as `getinfo` or `setdigout 1`
+func (t *Teltonika) SendCommand(msg string, force bool) (bool, error) {
+	t.cmd.mu.Lock()
+	if t.cmd.status != command_empty {
+		if !force {
+			t.cmd.mu.Unlock()
+			return true, nil
+		} else {
+			t.log.Warn().Msg("there is pending command")
+		}
+	}
+	t.cmd.server_flag_counter++
+	server_flag := t.cmd.server_flag_counter
+	t.cmd.current_server_flag = server_flag
+	t.cmd.current_msg = msg
+	d := newCommand(msg)
+	t.cmd.status = command_submitted
+	t.cmd.mu.Unlock()
+
+	t.c_mu.RLock()
+	defer t.c_mu.RUnlock()
+	t.log.Trace().Hex("sending command", d).Msg("")
+	_, err := t.c.Write(d)
+	if err != nil {
+		t.log.Error().Err(err).Msg("error when sending command")
+		return false, err
+	}
+	tm := time.Now().UTC()
+	t.cmd.mu.Lock()
+	t.cmd.status = command_sent
+	t.cmd.sent_time = tm
+	t.cmd.mu.Unlock()
+	t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: "command.sent", Message: msg, Data: map[string]uint32{"server_flag": server_flag}, Time: tm, HistoryOnly: true})
+	return false, nil
+}
+
+func (t *Teltonika) set_next_conn(c *conn.Conn) {
+	t.c_next_mu.Lock()
+	t.c_next = c
+	t.c_next_mu.Unlock()
+}
+
+func (t *Teltonika) set_conn(c *conn.Conn) {
+	t.c_mu.Lock()
+	t.c = c
+	t.c_mu.Unlock()
+}
+
+func (t *Teltonika) use_next_conn() bool {
+	t.c_next_mu.Lock()
+	defer t.c_next_mu.Unlock()
+
+	if t.c_next == nil {
+		return false
+	} else {
+		t.c_mu.Lock()
+		defer t.c_mu.Unlock()
+		t.c = t.c_next
+		t.c_next = nil
+		return true
+	}
+}
+
+func (t *Teltonika) ReplaceConn(c *conn.Conn) {
+	t.rs_mu.Lock()
+	if t.runningState == running {
+		t.set_next_conn(c)
+		t.rs_mu.Unlock()
+		t.log.Info().Str("event", CONNECTION_CLOSED).Msg("closing replaced connection")
+		t.c.Close()
+
+	} else if t.runningState == paused {
+		t.set_conn(c)
+		t.rs_mu.Unlock()
+		t.running.Add(1)
+		go t._run()
+	} else {
+		t.rs_mu.Unlock()
+	}
+}
+
+func (t *Teltonika) handle_location(rec record, tm time.Time) {
+	loc := rec.location()
+	keep, reason := t.validator.Validate(&loc, tm)
+	if reason != "" {
+		t.log.Debug().Str("reason", reason).Bool("dropped", !keep).Msg("location failed validation")
+	}
+	if keep {
+		t.bus.PublishLocation(&eventbus.Location{TrackerId: t.tid, Nsn: t.ser.Nsn(), Location: &loc, ServerTime: tm, Store: t.conf.Store, Live: t.conf.SublistSend, Config: t.conf})
+		t.teltonika_location.mu.Lock()
+		t.teltonika_location.rec = rec
+		t.teltonika_location.time = tm
+		t.teltonika_location.mu.Unlock()
+	}
+	if rec.Priority == priorityPanic {
+		t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: "alarm", Message: "panic", Data: rec.IO, Time: rec.Timestamp})
+	}
+	t.handle_io(rec)
+}
+
+// handle_io map io elements into events and tracker attributes, io state is only
+// touched from the read loop so it is not guarded
+func (t *Teltonika) handle_io(rec record) {
+	if v, ok := rec.IO[ioIgnition]; ok {
+		ign := v != 0
+		if !t.io.has_ignition || t.io.ignition != ign {
+			t.io.has_ignition = true
+			t.io.ignition = ign
+			evt := ignitionEvent{Ignition: ign}
+			t.log.Info().Bool("ignition", ign).Msg("ignition changed")
+			t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: "ignition.changed", Data: evt, Time: rec.Timestamp})
+		}
+	}
+	ext := t.update_attribute(rec.IO, ioExternalVoltage, "external_voltage", rec.Timestamp)
+	batt := t.update_attribute(rec.IO, ioBatteryVoltage, "battery_voltage", rec.Timestamp)
+	if ext || batt {
+		t.send_power_voltage(rec.IO, rec.Timestamp)
+	}
+	t.update_attribute(rec.IO, ioTotalOdometer, "odometer", rec.Timestamp)
+	t.update_attribute(rec.IO, ioGSMSignal, "gsm_signal", rec.Timestamp)
+}
+
+// update_attribute return true when the attribute is updated
+func (t *Teltonika) update_attribute(io map[uint16]uint64, id uint16, key string, tm time.Time) bool {
+	v, ok := io[id]
+	if !ok {
+		return false
+	}
+	last, ok := t.io.attr[key]
+	if ok && (last == v || tm.Sub(t.io.attr_time[key]) < attribute_interval) {
+		return false
+	}
+	t.io.attr[key] = v
+	t.io.attr_time[key] = tm
+	t.misc_store.UpdateAttribute(t.tid, key, strconv.FormatUint(v, 10))
+	return true
+}
+
+// send_power_voltage publish voltage io reported in millivolt
+func (t *Teltonika) send_power_voltage(io map[uint16]uint64, tm time.Time) {
+	pv := device.PowerVoltage{}
+	if v, ok := io[ioExternalVoltage]; ok {
+		ext := float64(v) / 1000
+		pv.External = &ext
+	}
+	if v, ok := io[ioBatteryVoltage]; ok {
+		batt := float64(v) / 1000
+		pv.Battery = &batt
+	}
+	t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: device.EVENT_POWER_VOLTAGE, Data: pv, Time: tm, LiveOnly: true})
+}
+
+func (t *Teltonika) handle_diconnection(tm time.Time) {
+	t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: "disconnected", Time: tm})
+}
+
+func (t *Teltonika) event_run(tm time.Time) {
+	t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: "started", Time: tm})
+}
+
+func (t *Teltonika) handle_command_response(response string, tm time.Time) {
+	flag_matched := false
+	var server_flag uint32
+	var cmd string
+	var sent_time time.Time
+	t.cmd.mu.Lock()
+	//codec 12 response carries no reference, it belongs to the last sent command
+	if t.cmd.status == command_sent {
+		flag_matched = true
+		t.cmd.status = command_empty
+		server_flag = t.cmd.current_server_flag
+		cmd = t.cmd.current_msg
+		sent_time = t.cmd.sent_time
+	} else {
+		t.log.Error().Msg("receive command response without pending command")
+	}
+	t.cmd.mu.Unlock()
+	t.bus.PublishEvent(&eventbus.Event{TrackerId: t.tid, Topic: "command.response", Message: response, Data: map[string]uint32{
+		"server_flag": server_flag}, Time: tm, HistoryOnly: true})
+	if flag_matched {
+		t.bus.PublishCommandResponse(&eventbus.CommandResponse{TrackerId: t.tid, ServerFlag: server_flag, Command: cmd, SentTime: sent_time, Response: response, Time: tm})
+	}
+}
+
+func (t *Teltonika) RejectCounts() map[string]uint64 {
+	return t.validator.Counts()
+}
+
+func (t *Teltonika) GetLocation() device.Location {
+	t.teltonika_location.mu.Lock()
+	defer t.teltonika_location.mu.Unlock()
+	return t.teltonika_location.rec.location()
+}
+
+func (t *Teltonika) CurrentConnInfo() []string {
+	t.c_mu.RLock()
+	defer t.c_mu.RUnlock()
+	return t.c.ConnAddr()
+}
+
+func (t *Teltonika) run() {
+	t.c_mu.RLock()
+	t.event_run(time.Now())
+	defer func() {
+		t.c_mu.RUnlock()
+		t.log.Info().Msg("exit from readMessage loop")
+	}()
+	for {
+		err := t.readMessage()
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				t.log.Info().Msg("read deadline exceeded")
+			}
+			t.handle_diconnection(time.Now())
+			t.closeAndSetErr(err, time.Now())
+			return
+		}
+		tread := time.Now().UTC()
+		codec := strconv.FormatUint(uint64(t.msg.Codec), 16)
+		t.log.Trace().Str("codec", codec).Hex("payload", t.msg.Payload).Msg("receive message from terminal")
+		switch t.msg.Codec {
+		case codec8, codec8Extended:
+			recs, err := parseAVL(t.msg.Payload)
+			if err != nil {
+				//without ack the device will resend the same records
+				t.log.Error().Err(err).Str("codec", codec).Hex("payload", t.msg.Payload).Msg("error parsing avl data")
+				continue
+			}
+			for _, rec := range recs {
+				t.handle_location(rec, tread)
+			}
+			err = t.write(newAck(len(recs)))
+			if err != nil {
+				t.handle_diconnection(time.Now())
+				t.closeAndSetErr(err, time.Now())
+				return
+			}
+			t.log.Debug().Str("codec", codec).Int("records", len(recs)).Msg("location update")
+		case codec12:
+			response, err := parseCommandResponse(t.msg.Payload)
+			if err != nil {
+				t.log.Error().Err(err).Hex("payload", t.msg.Payload).Msg("error parsing command response")
+				continue
+			}
+			t.handle_command_response(response, tread)
+			t.log.Info().Str("message", response).Msg("command response")
+		default:
+			t.log.Error().Hex("data", t.msg.Payload).Str("codec", codec).Str("error", "unknown codec").Msg("unhandled codec")
+		}
+	}
+}
+
+func (t *Teltonika) write(d []byte) error {
+	_, err := t.c.Write(d)
+	if err != nil {
+		t.log.Error().Err(err).Msg("Error while writing data")
+		return err
+	}
+	return nil
+}
+
+func (t *Teltonika) readMessage() error {
+	minutes := t.conf.ReadDeadline
+	_ = t.c.SetReadDeadline(time.Now().Add(time.Duration(minutes) * time.Minute))
+	return readMessage(t.c, &t.msg)
+}
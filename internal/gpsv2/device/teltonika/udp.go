@@ -0,0 +1,102 @@
+package teltonika
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+// every datagram start with the udp channel header followed by the avl packet header
+//
+//	length(2) | packet id(2) | packet type(1) | avl packet id(1) | imei length(2) | imei(15) | data
+const (
+	udpHeaderLength  int  = 2 + 2 + 1 + 1 + 2 + imeiLength
+	udpPacketType    byte = 0x01
+	udpMaxPendingAck int  = 64
+)
+
+// detectDatagram accept datagram whose length field cover the whole datagram and carrying an imei
+func detectDatagram(d []byte) bool {
+	return len(d) > udpHeaderLength && int(binary.BigEndian.Uint16(d[0:2])) == len(d)-2 &&
+		int(binary.BigEndian.Uint16(d[6:8])) == imeiLength
+}
+
+func newDatagramCodec() protocol.DatagramCodec {
+	return &udpCodec{}
+}
+
+type udpPacket struct {
+	packet_id     uint16
+	avl_packet_id byte
+}
+
+// udpCodec present datagram as the tcp stream, the first datagram also produce the imei
+// handshake. The device acknowledge record as it does over tcp and the codec answer with
+// the id of the oldest datagram not yet acknowledged
+type udpCodec struct {
+	mu      sync.Mutex
+	imei    string
+	pending []udpPacket
+	out_id  uint16
+}
+
+func (u *udpCodec) Decode(d []byte) ([]byte, error) {
+	if !detectDatagram(d) {
+		return nil, errBadFrame
+	}
+	imei := string(d[8:udpHeaderLength])
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var stream []byte
+	if u.imei == "" {
+		u.imei = imei
+		stream = append(stream, 0, byte(imeiLength))
+		stream = append(stream, imei...)
+	} else if u.imei != imei {
+		return nil, fmt.Errorf("imei %s sent in session of %s", imei, u.imei)
+	}
+	if len(u.pending) == udpMaxPendingAck {
+		u.pending = u.pending[1:]
+	}
+	u.pending = append(u.pending, udpPacket{packet_id: binary.BigEndian.Uint16(d[2:4]), avl_packet_id: d[5]})
+	return append(stream, newFrame(d[udpHeaderLength:])...), nil
+}
+
+func (u *udpCodec) Encode(p []byte) []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case len(p) == 1:
+		//imei handshake response, there is no handshake over udp
+		return nil
+	case len(p) == 4:
+		//record count acknowledge
+		if len(u.pending) == 0 {
+			return nil
+		}
+		pk := u.pending[0]
+		u.pending = u.pending[1:]
+		b := make([]byte, 7)
+		binary.BigEndian.PutUint16(b[0:2], 5)
+		binary.BigEndian.PutUint16(b[2:4], pk.packet_id)
+		b[4] = udpPacketType
+		b[5] = pk.avl_packet_id
+		b[6] = byte(binary.BigEndian.Uint32(p))
+		return b
+	case len(p) > headerLength+4:
+		//codec 12 frame, preamble, length and crc are replaced by the datagram header
+		data := p[headerLength : len(p)-4]
+		u.out_id++
+		b := make([]byte, udpHeaderLength+len(data))
+		binary.BigEndian.PutUint16(b[0:2], uint16(len(b)-2))
+		binary.BigEndian.PutUint16(b[2:4], u.out_id)
+		b[4] = udpPacketType
+		binary.BigEndian.PutUint16(b[6:8], uint16(imeiLength))
+		copy(b[8:], u.imei)
+		copy(b[udpHeaderLength:], data)
+		return b
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package teltonika
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+)
+
+// codec 8 datagram with one record and its acknowledge
+const (
+	udpSample    = "003DCAFE0105000F33353230393330383634303336353508010000016B4F815B30010000000000000000000000000000000103021503010101425DBC000001"
+	udpSampleAck = "0005CAFE010501"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDetectDatagram(t *testing.T) {
+	d := decodeHex(t, udpSample)
+	if !detectDatagram(d) {
+		t.Fatal("sample not detected")
+	}
+	if detectDatagram(d[:len(d)-1]) {
+		t.Fatal("truncated sample detected")
+	}
+	if detectDatagram(append([]byte{0x00, 0x0f}, "352093086403655"...)) {
+		t.Fatal("tcp imei handshake detected")
+	}
+}
+
+func TestUdpCodecDecode(t *testing.T) {
+	codec := newDatagramCodec()
+	stream, err := codec.Decode(decodeHex(t, udpSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(stream)
+		client.Close()
+	}()
+	c := conn.NewConn(server, 1)
+	imei, err := readIMEI(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imei != "352093086403655" {
+		t.Fatalf("imei %s", imei)
+	}
+	msg := Message{Buffer: make([]byte, headerLength+maxDataLen+4)}
+	if err := readMessage(c, &msg); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := parseAVL(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("%d records", len(recs))
+	}
+
+	//the handshake is only produced for the first datagram
+	stream, err = codec.Decode(decodeHex(t, udpSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(stream[0:4]) != 0 {
+		t.Fatalf("second datagram start with %x", stream[:4])
+	}
+
+	other := decodeHex(t, udpSample)
+	copy(other[8:], "352093086403656")
+	if _, err := codec.Decode(other); err == nil {
+		t.Fatal("expected error for another imei in the session")
+	}
+}
+
+func TestUdpCodecEncode(t *testing.T) {
+	codec := newDatagramCodec()
+	if _, err := codec.Decode(decodeHex(t, udpSample)); err != nil {
+		t.Fatal(err)
+	}
+	if d := codec.Encode([]byte{0x01}); d != nil {
+		t.Fatalf("imei response encoded to %x", d)
+	}
+	if d := codec.Encode(newAck(1)); !bytes.Equal(d, decodeHex(t, udpSampleAck)) {
+		t.Fatalf("ack encoded to %x", d)
+	}
+	if d := codec.Encode(newAck(1)); d != nil {
+		t.Fatalf("ack without datagram encoded to %x", d)
+	}
+
+	d := codec.Encode(newCommand("getinfo"))
+	if int(binary.BigEndian.Uint16(d[0:2])) != len(d)-2 || d[4] != udpPacketType {
+		t.Fatalf("command header %x", d[:udpHeaderLength])
+	}
+	if string(d[8:udpHeaderLength]) != "352093086403655" {
+		t.Fatalf("command imei %s", d[8:udpHeaderLength])
+	}
+	data := d[udpHeaderLength:]
+	if data[0] != codec12 || string(data[7:len(data)-1]) != "getinfo" {
+		t.Fatalf("command data %x", data)
+	}
+}
+
+// TestUdpCodecAck acknowledge datagram in the order they were received, each ack carry
+// the packet id and avl packet id of its datagram and the record count
+func TestUdpCodecAck(t *testing.T) {
+	codec := newDatagramCodec()
+	datagram := func(packet_id uint16, avl_packet_id byte) []byte {
+		d := decodeHex(t, udpSample)
+		binary.BigEndian.PutUint16(d[2:4], packet_id)
+		d[5] = avl_packet_id
+		return d
+	}
+	for i := 0; i < udpMaxPendingAck+2; i++ {
+		if _, err := codec.Decode(datagram(uint16(0x0100+i), byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the oldest pending datagram are dropped once udpMaxPendingAck is reached
+	for i := 2; i < udpMaxPendingAck+2; i++ {
+		d := codec.Encode(newAck(i % 3))
+		if len(d) != 7 || binary.BigEndian.Uint16(d[0:2]) != 5 || d[4] != udpPacketType {
+			t.Fatalf("ack %d header %x", i, d)
+		}
+		if id := binary.BigEndian.Uint16(d[2:4]); id != uint16(0x0100+i) {
+			t.Fatalf("ack %d packet id %04x", i, id)
+		}
+		if d[5] != byte(i) || d[6] != byte(i%3) {
+			t.Fatalf("ack %d avl packet id %d record count %d", i, d[5], d[6])
+		}
+	}
+	if d := codec.Encode(newAck(1)); d != nil {
+		t.Fatalf("ack without datagram encoded to %x", d)
+	}
+}
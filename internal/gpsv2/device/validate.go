@@ -0,0 +1,149 @@
+package device
+
+import (
+	"expvar"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	VALIDATION_DROP string = "drop"
+	VALIDATION_TAG  string = "tag"
+	VALIDATION_NONE string = "none"
+)
+
+// reason a location fail validation
+const (
+	REJECT_NO_FIX       string = "no_fix"
+	REJECT_NULL_ISLAND  string = "null_island"
+	REJECT_OUT_OF_RANGE string = "out_of_range"
+	REJECT_SPEED_JUMP   string = "speed_jump"
+	REJECT_FUTURE_TIME  string = "future_time"
+	REJECT_STALE_TIME   string = "stale_time"
+)
+
+const (
+	default_max_speed       float64 = 70 //m/s
+	default_max_future_time int     = 300
+	default_max_gps_age     int     = 7 * 24 * 60 * 60
+	//consecutive speed jump after which the last accepted location is considered wrong
+	max_speed_jump int = 3
+)
+
+// rejected location of every tracker by reason
+var rejected = expvar.NewMap("location_rejected")
+
+// RejectCounter is implemented by device validating location before storing it
+type RejectCounter interface {
+	RejectCounts() map[string]uint64
+}
+
+// LocationValidator check location of one tracker against the validation setting of DeviceConfig,
+// speed is checked against the last accepted location
+type LocationValidator struct {
+	conf   *DeviceConfig
+	mu     sync.Mutex
+	last   *Location
+	jumps  int
+	counts map[string]uint64
+}
+
+func NewLocationValidator(conf *DeviceConfig) *LocationValidator {
+	return &LocationValidator{conf: conf, counts: make(map[string]uint64)}
+}
+
+// Validate return false when loc should be dropped, with tag action a failing loc is kept and
+// marked as not valid. reason is empty when loc pass
+func (v *LocationValidator) Validate(loc *Location, t time.Time) (bool, string) {
+	action := v.conf.Validation
+	if action == "" {
+		action = VALIDATION_DROP
+	}
+	if action == VALIDATION_NONE {
+		return true, ""
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	reason := v.check(loc, t)
+	if reason == REJECT_SPEED_JUMP {
+		v.jumps++
+		if v.jumps >= max_speed_jump {
+			reason = ""
+		}
+	}
+	if reason == "" {
+		v.jumps = 0
+		l := *loc
+		v.last = &l
+		return true, ""
+	}
+	v.counts[reason]++
+	rejected.Add(reason, 1)
+	if action == VALIDATION_TAG {
+		valid := false
+		loc.Valid = &valid
+		return true, reason
+	}
+	return false, reason
+}
+
+func (v *LocationValidator) check(loc *Location, t time.Time) string {
+	if loc.Valid != nil && !*loc.Valid {
+		return REJECT_NO_FIX
+	}
+	if loc.Latitude == 0 && loc.Longitude == 0 {
+		return REJECT_NULL_ISLAND
+	}
+	if math.Abs(loc.Latitude) > 90 || math.Abs(loc.Longitude) > 180 {
+		return REJECT_OUT_OF_RANGE
+	}
+	max_future := v.conf.MaxFutureTime
+	if max_future == 0 {
+		max_future = default_max_future_time
+	}
+	if loc.Timestamp.Sub(t) > time.Duration(max_future)*time.Second {
+		return REJECT_FUTURE_TIME
+	}
+	max_age := v.conf.MaxGpsAge
+	if max_age == 0 {
+		max_age = default_max_gps_age
+	}
+	if t.Sub(loc.Timestamp) > time.Duration(max_age)*time.Second {
+		return REJECT_STALE_TIME
+	}
+	if v.last != nil {
+		max_speed := v.conf.MaxSpeed
+		if max_speed == 0 {
+			max_speed = default_max_speed
+		}
+		//batch upload may be out of order, at least one second apart so duplicate timestamp still count
+		dt := math.Max(math.Abs(loc.Timestamp.Sub(v.last.Timestamp).Seconds()), 1)
+		if Distance(v.last.Latitude, v.last.Longitude, loc.Latitude, loc.Longitude)/dt > max_speed {
+			return REJECT_SPEED_JUMP
+		}
+	}
+	return ""
+}
+
+// Counts return number of rejected location by reason
+func (v *LocationValidator) Counts() map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c := make(map[string]uint64, len(v.counts))
+	for k, n := range v.counts {
+		c[k] = n
+	}
+	return c
+}
+
+// Distance in meter between two coordinate using haversine formula
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const r = 6371000
+	p1 := lat1 * math.Pi / 180
+	p2 := lat2 * math.Pi / 180
+	dp := (lat2 - lat1) * math.Pi / 180
+	dl := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * r * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
@@ -0,0 +1,133 @@
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	invalid := false
+	at := func(lat, lon float64, sec int) Location {
+		return Location{Latitude: lat, Longitude: lon, Timestamp: now.Add(time.Duration(sec) * time.Second)}
+	}
+	type step struct {
+		loc    Location
+		keep   bool
+		reason string
+	}
+	cases := []struct {
+		name  string
+		conf  DeviceConfig
+		steps []step
+	}{
+		{"valid", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.201, 106.8, 10), true, ""},
+		}},
+		{"no fix", DeviceConfig{}, []step{
+			{Location{Latitude: -6.2, Longitude: 106.8, Timestamp: now, Valid: &invalid}, false, REJECT_NO_FIX},
+		}},
+		{"null island", DeviceConfig{}, []step{
+			{at(0, 0, 0), false, REJECT_NULL_ISLAND},
+		}},
+		{"out of range", DeviceConfig{}, []step{
+			{at(91, 106.8, 0), false, REJECT_OUT_OF_RANGE},
+			{at(-6.2, -181, 0), false, REJECT_OUT_OF_RANGE},
+		}},
+		{"future", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 300), true, ""},
+			{at(-6.2, 106.8, 301), false, REJECT_FUTURE_TIME},
+		}},
+		{"future configured", DeviceConfig{MaxFutureTime: 10}, []step{
+			{at(-6.2, 106.8, 11), false, REJECT_FUTURE_TIME},
+		}},
+		{"stale", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, -7*24*3600), true, ""},
+			{at(-6.2, 106.8, -7*24*3600-1), false, REJECT_STALE_TIME},
+		}},
+		{"stale configured", DeviceConfig{MaxGpsAge: 60}, []step{
+			{at(-6.2, 106.8, -61), false, REJECT_STALE_TIME},
+		}},
+		//0.01 degree is about 1112 meter
+		{"speed jump", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.21, 106.8, 10), false, REJECT_SPEED_JUMP},
+			//checked against the last accepted location
+			{at(-6.2001, 106.8, 20), true, ""},
+		}},
+		{"speed configured", DeviceConfig{MaxSpeed: 200}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.21, 106.8, 10), true, ""},
+		}},
+		{"duplicate timestamp", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.2001, 106.8, 0), true, ""},
+			{at(-6.201, 106.8, 0), false, REJECT_SPEED_JUMP},
+		}},
+		{"out of order", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.201, 106.8, -20), true, ""},
+		}},
+		//the last accepted location was wrong, consecutive jump accept the new position
+		{"consecutive jump reset", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.3, 106.8, 10), false, REJECT_SPEED_JUMP},
+			{at(-6.3001, 106.8, 20), false, REJECT_SPEED_JUMP},
+			{at(-6.3002, 106.8, 30), true, ""},
+			{at(-6.3003, 106.8, 40), true, ""},
+		}},
+		//a passing location reset the jump count
+		{"jump count reset", DeviceConfig{}, []step{
+			{at(-6.2, 106.8, 0), true, ""},
+			{at(-6.3, 106.8, 10), false, REJECT_SPEED_JUMP},
+			{at(-6.3001, 106.8, 20), false, REJECT_SPEED_JUMP},
+			{at(-6.2001, 106.8, 30), true, ""},
+			{at(-6.3, 106.8, 40), false, REJECT_SPEED_JUMP},
+			{at(-6.3001, 106.8, 50), false, REJECT_SPEED_JUMP},
+		}},
+		{"none", DeviceConfig{Validation: VALIDATION_NONE}, []step{
+			{at(0, 0, 0), true, ""},
+			{at(-6.2, 106.8, 10), true, ""},
+		}},
+	}
+	for _, c := range cases {
+		conf := c.conf
+		v := NewLocationValidator(&conf)
+		for i, s := range c.steps {
+			loc := s.loc
+			keep, reason := v.Validate(&loc, now)
+			if keep != s.keep || reason != s.reason {
+				t.Errorf("%s step %d : keep %v reason %q, expected %v %q", c.name, i, keep, reason, s.keep, s.reason)
+			}
+			if !loc.IsValid() && s.reason != REJECT_NO_FIX {
+				t.Errorf("%s step %d : dropped location tagged invalid", c.name, i)
+			}
+		}
+	}
+}
+
+func TestValidateTag(t *testing.T) {
+	now := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	v := NewLocationValidator(&DeviceConfig{Validation: VALIDATION_TAG})
+	locs := []Location{
+		{Latitude: -6.2, Longitude: 106.8, Timestamp: now},
+		{Latitude: 0, Longitude: 0, Timestamp: now},
+		{Latitude: -6.3, Longitude: 106.8, Timestamp: now.Add(10 * time.Second)},
+		{Latitude: -6.2001, Longitude: 106.8, Timestamp: now.Add(20 * time.Second)},
+	}
+	expected := []string{"", REJECT_NULL_ISLAND, REJECT_SPEED_JUMP, ""}
+	for i := range locs {
+		keep, reason := v.Validate(&locs[i], now)
+		if !keep || reason != expected[i] {
+			t.Errorf("location %d : keep %v reason %q, expected %q", i, keep, reason, expected[i])
+		}
+		if locs[i].IsValid() != (expected[i] == "") {
+			t.Errorf("location %d : valid %v", i, locs[i].IsValid())
+		}
+	}
+	counts := v.Counts()
+	if len(counts) != 2 || counts[REJECT_NULL_ISLAND] != 1 || counts[REJECT_SPEED_JUMP] != 1 {
+		t.Fatalf("counts %v", counts)
+	}
+}
@@ -0,0 +1,139 @@
+package geofence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const (
+	GEOFENCE_ENTER string = "geofence.enter"
+	GEOFENCE_EXIT  string = "geofence.exit"
+)
+
+const (
+	default_hysteresis float64 = 20 //meter
+	//geofence edited through the api are picked up after this long
+	reload_interval = time.Minute
+)
+
+type Crossing struct {
+	GeofenceId uint64    `json:"geofence_id"`
+	Name       string    `json:"name"`
+	Latitude   float64   `json:"lat"`
+	Longitude  float64   `json:"lon"`
+	Timestamp  time.Time `json:"gps_time"`
+}
+
+// Evaluator track which geofence a tracker is in. A tracker enter a geofence once it is
+// inside by the hysteresis distance and exit once it is outside by the same distance, so
+// location jumping around the boundary does not flap. The first location only set the state
+type Evaluator struct {
+	mu    sync.Mutex
+	tid   uint64
+	conf  *device.DeviceConfig
+	store store.GeofenceStore
+	bus   *eventbus.EventBus
+	log   log.Logger
+
+	fences    []store.Geofence
+	loaded_at time.Time
+	loading   bool
+	inside    map[uint64]bool
+}
+
+// NewEvaluator return nil when st is nil, geofence evaluation is then disabled
+func NewEvaluator(tid uint64, st store.GeofenceStore, bus *eventbus.EventBus, conf *device.DeviceConfig, logger log.Logger) *Evaluator {
+	if st == nil {
+		return nil
+	}
+	return &Evaluator{tid: tid, conf: conf, store: st, bus: bus, log: logger, inside: make(map[uint64]bool)}
+}
+
+// Push evaluate an accepted location received at t
+func (e *Evaluator) Push(loc *device.Location, t time.Time) {
+	e.mu.Lock()
+	if !e.loading && t.Sub(e.loaded_at) >= reload_interval {
+		e.loading = true
+		go e.reload(t)
+	}
+	margin := e.conf.GeofenceHysteresis
+	if margin == 0 {
+		margin = default_hysteresis
+	}
+	crossings := make([]Crossing, 0)
+	topics := make([]string, 0)
+	for i := range e.fences {
+		g := &e.fences[i]
+		d := signed_distance(g, loc.Latitude, loc.Longitude)
+		in, known := e.inside[g.Id]
+		if !known {
+			e.inside[g.Id] = d < 0
+			continue
+		}
+		if !in && d <= -margin {
+			e.inside[g.Id] = true
+			topics = append(topics, GEOFENCE_ENTER)
+		} else if in && d >= margin {
+			e.inside[g.Id] = false
+			topics = append(topics, GEOFENCE_EXIT)
+		} else {
+			continue
+		}
+		crossings = append(crossings, Crossing{GeofenceId: g.Id, Name: g.Name, Latitude: loc.Latitude, Longitude: loc.Longitude, Timestamp: loc.Timestamp})
+	}
+	e.mu.Unlock()
+	for i, c := range crossings {
+		e.bus.PublishEvent(&eventbus.Event{TrackerId: e.tid, Topic: topics[i], Message: c.Name, Data: c, Time: t})
+	}
+}
+
+// reload fetch the geofence in the background so Push never wait on the database, location
+// pushed meanwhile are evaluated against the previous list. The group is read from the
+// tracker current config by the store. reload keep the state of geofence still assigned,
+// a failed reload keep the previous list
+func (e *Evaluator) reload(t time.Time) {
+	fences, err := e.store.TrackerGeofences(e.tid)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loading = false
+	e.loaded_at = t
+	if err != nil {
+		e.log.Error().Err(err).Uint64("tracker_id", e.tid).Msg("error loading geofence")
+		return
+	}
+	inside := make(map[uint64]bool, len(fences))
+	for _, g := range fences {
+		if in, ok := e.inside[g.Id]; ok {
+			inside[g.Id] = in
+		}
+	}
+	e.fences = fences
+	e.inside = inside
+}
+
+// Subscribe run an Evaluator for every tracker publishing location on bus, location
+// tagged invalid is ignored
+func Subscribe(bus *eventbus.EventBus, st store.GeofenceStore) {
+	logger := log.DefaultLogger
+	logger.Context = log.NewContext(nil).Str("module", "geofence").Value()
+	var mu sync.Mutex
+	evaluators := make(map[uint64]*Evaluator)
+	bus.SubscribeLocation(func(l *eventbus.Location) {
+		if !l.Location.IsValid() {
+			return
+		}
+		mu.Lock()
+		e, ok := evaluators[l.TrackerId]
+		if !ok {
+			e = NewEvaluator(l.TrackerId, st, bus, l.Config, logger)
+			evaluators[l.TrackerId] = e
+		}
+		mu.Unlock()
+		e.Push(l.Location, l.ServerTime)
+	})
+}
@@ -0,0 +1,101 @@
+package geofence
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+type fakeStore struct {
+	mu     sync.Mutex
+	fences []store.Geofence
+	calls  int
+}
+
+func (s *fakeStore) TrackerGeofences(tid uint64) ([]store.Geofence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return s.fences, nil
+}
+
+func testEvaluator(st *fakeStore, conf *device.DeviceConfig, t time.Time) (*Evaluator, *[]string) {
+	bus := eventbus.NewEventBus()
+	topics := make([]string, 0)
+	bus.SubscribeEvent(func(e *eventbus.Event) {
+		topics = append(topics, e.Topic+" "+e.Message)
+	})
+	e := NewEvaluator(1, st, bus, conf, log.DefaultLogger)
+	e.reload(t)
+	return e, &topics
+}
+
+func TestHysteresis(t *testing.T) {
+	st := &fakeStore{fences: []store.Geofence{{Id: 1, Name: "depot", Kind: store.GEOFENCE_CIRCLE, Latitude: -6.2, Longitude: 106.8, Radius: 100}}}
+	cases := []struct {
+		name   string
+		conf   device.DeviceConfig
+		meters []float64
+		topics []string
+	}{
+		//the first location only set the state
+		{"start inside", device.DeviceConfig{}, []float64{0, 110}, []string{}},
+		{"start outside", device.DeviceConfig{}, []float64{200, 90}, []string{}},
+		{"exit and enter", device.DeviceConfig{}, []float64{0, 90, 110, 125, 105, 90, 75}, []string{GEOFENCE_EXIT + " depot", GEOFENCE_ENTER + " depot"}},
+		{"flapping", device.DeviceConfig{}, []float64{0, 115, 85, 115, 85}, []string{}},
+		{"configured", device.DeviceConfig{GeofenceHysteresis: 5}, []float64{0, 110, 90}, []string{GEOFENCE_EXIT + " depot", GEOFENCE_ENTER + " depot"}},
+	}
+	now := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		conf := c.conf
+		e, topics := testEvaluator(st, &conf, now)
+		for i, m := range c.meters {
+			loc := device.Location{Latitude: -6.2 + m/lat_meter, Longitude: 106.8, Timestamp: now.Add(time.Duration(i) * time.Second)}
+			e.Push(&loc, loc.Timestamp)
+		}
+		if !reflect.DeepEqual(*topics, c.topics) {
+			t.Errorf("%s : events %v, expected %v", c.name, *topics, c.topics)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	depot := store.Geofence{Id: 1, Name: "depot", Kind: store.GEOFENCE_CIRCLE, Latitude: -6.2, Longitude: 106.8, Radius: 100}
+	st := &fakeStore{fences: []store.Geofence{depot}}
+	now := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	e, topics := testEvaluator(st, &device.DeviceConfig{}, now)
+	loc := device.Location{Latitude: -6.2, Longitude: 106.8, Timestamp: now}
+	e.Push(&loc, now)
+
+	//a geofence added to the group is loaded in the background, the state of depot is kept
+	st.mu.Lock()
+	st.fences = []store.Geofence{depot, {Id: 2, Name: "yard", Kind: store.GEOFENCE_CIRCLE, Latitude: -6.2, Longitude: 106.8, Radius: 50}}
+	st.mu.Unlock()
+	later := now.Add(reload_interval)
+	e.Push(&loc, later)
+	for {
+		e.mu.Lock()
+		loading := e.loading
+		e.mu.Unlock()
+		if !loading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(e.fences) != 2 || !e.inside[1] {
+		t.Fatalf("fences %v inside %v", e.fences, e.inside)
+	}
+	e.Push(&loc, later)
+	far := device.Location{Latitude: -6.2 + 200/lat_meter, Longitude: 106.8, Timestamp: now}
+	e.Push(&far, later)
+	expected := []string{GEOFENCE_EXIT + " depot", GEOFENCE_EXIT + " yard"}
+	if !reflect.DeepEqual(*topics, expected) || st.calls != 2 {
+		t.Fatalf("events %v, %d load", *topics, st.calls)
+	}
+}
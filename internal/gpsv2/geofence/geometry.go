@@ -0,0 +1,54 @@
+package geofence
+
+import (
+	"math"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const earth_radius = 6371000
+
+// signed_distance return distance in meter from lat, lon to the boundary of g,
+// negative when the point is inside
+func signed_distance(g *store.Geofence, lat, lon float64) float64 {
+	if g.Kind == store.GEOFENCE_CIRCLE {
+		return device.Distance(g.Latitude, g.Longitude, lat, lon) - g.Radius
+	}
+	if len(g.Polygon) < 3 {
+		return math.Inf(1)
+	}
+	//project vertex on a plane centred on the point, fine for fence of a few km
+	kx := earth_radius * math.Pi / 180 * math.Cos(lat*math.Pi/180)
+	ky := earth_radius * math.Pi / 180
+	n := len(g.Polygon)
+	xs := make([]float64, n)
+	ys := make([]float64, n)
+	for i, v := range g.Polygon {
+		xs[i] = (v[1] - lon) * kx
+		ys[i] = (v[0] - lat) * ky
+	}
+	inside := false
+	min := math.Inf(1)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		if (ys[i] > 0) != (ys[j] > 0) && 0 < (xs[j]-xs[i])*(0-ys[i])/(ys[j]-ys[i])+xs[i] {
+			inside = !inside
+		}
+		min = math.Min(min, segment_distance(xs[j], ys[j], xs[i], ys[i]))
+	}
+	if inside {
+		return -min
+	}
+	return min
+}
+
+// segment_distance return distance from origin to segment a-b
+func segment_distance(ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	l := dx*dx + dy*dy
+	t := 0.0
+	if l > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
@@ -0,0 +1,61 @@
+package geofence
+
+import (
+	"math"
+	"testing"
+
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// meter per degree of latitude with the earth radius used by signed_distance
+const lat_meter = earth_radius * math.Pi / 180
+
+func TestSignedDistanceCircle(t *testing.T) {
+	g := &store.Geofence{Kind: store.GEOFENCE_CIRCLE, Latitude: -6.2, Longitude: 106.8, Radius: 100}
+	cases := []struct {
+		lat, lon float64
+		distance float64
+	}{
+		{-6.2, 106.8, -100},
+		{-6.2 + 50/lat_meter, 106.8, -50},
+		{-6.2 + 150/lat_meter, 106.8, 50},
+	}
+	for _, c := range cases {
+		if d := signed_distance(g, c.lat, c.lon); math.Abs(d-c.distance) > 1 {
+			t.Errorf("%f,%f : distance %.1f, expected %.1f", c.lat, c.lon, d, c.distance)
+		}
+	}
+}
+
+func TestSignedDistancePolygon(t *testing.T) {
+	//L shaped polygon in step of 0.001 degree, the notch at the top right is outside
+	const s = 0.001
+	lshape := [][2]float64{{0, 0}, {0, 2 * s}, {s, 2 * s}, {s, s}, {2 * s, s}, {2 * s, 0}}
+	for i := range lshape {
+		lshape[i][0] += -6.2
+		lshape[i][1] += 106.8
+	}
+	g := &store.Geofence{Kind: store.GEOFENCE_POLYGON, Polygon: lshape}
+	kx := lat_meter * math.Cos(-6.2*math.Pi/180)
+	cases := []struct {
+		name     string
+		lat, lon float64
+		distance float64
+	}{
+		{"inside bottom", -6.2 + 0.5*s, 106.8 + 1.5*s, -0.5 * s * lat_meter},
+		{"inside left", -6.2 + 1.5*s, 106.8 + 0.25*s, -0.25 * s * kx},
+		{"notch", -6.2 + 1.75*s, 106.8 + 1.5*s, 0.5 * s * kx},
+		{"below", -6.2 - s, 106.8 + s, s * lat_meter},
+		{"corner", -6.2 - s, 106.8 - s, math.Hypot(s*lat_meter, s*kx)},
+	}
+	for _, c := range cases {
+		if d := signed_distance(g, c.lat, c.lon); math.Abs(d-c.distance) > 1 {
+			t.Errorf("%s : distance %.1f, expected %.1f", c.name, d, c.distance)
+		}
+	}
+	//too few vertex is never entered
+	g.Polygon = lshape[:2]
+	if d := signed_distance(g, -6.2, 106.8); !math.IsInf(d, 1) {
+		t.Fatalf("degenerate polygon distance %.1f", d)
+	}
+}
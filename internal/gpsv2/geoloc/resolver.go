@@ -0,0 +1,210 @@
+package geoloc
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const (
+	SOURCE_LBS  string = "lbs"
+	SOURCE_WIFI string = "wifi"
+)
+
+// Fix is an approximate location, Accuracy is radius in meter
+type Fix struct {
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lon"`
+	Accuracy  float64   `json:"accuracy"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"gps_time"`
+}
+
+type ResolverConfig struct {
+	//how long a looked up cell or access point is cached, default 24 hour
+	CacheTTL time.Duration
+	//max cached entry, default 100000
+	CacheSize int
+}
+
+// Resolver estimate location from observed cell tower and wifi access point
+// using the locally imported table behind store.GeoStore
+type Resolver struct {
+	store store.GeoStore
+	log   log.Logger
+	conf  ResolverConfig
+
+	mu    sync.Mutex
+	cells map[store.Cell]cache_entry
+	wifi  map[string]cache_entry
+}
+
+type cache_entry struct {
+	p     store.GeoPoint
+	found bool
+	t     time.Time
+}
+
+func NewResolver(st store.GeoStore, config *ResolverConfig) *Resolver {
+	r := &Resolver{store: st}
+	if config != nil {
+		r.conf = *config
+	}
+	if r.conf.CacheTTL == 0 {
+		r.conf.CacheTTL = 24 * time.Hour
+	}
+	if r.conf.CacheSize == 0 {
+		r.conf.CacheSize = 100000
+	}
+	r.log = log.DefaultLogger
+	r.log.Context = log.NewContext(nil).Str("module", "geoloc").Value()
+	r.cells = make(map[store.Cell]cache_entry)
+	r.wifi = make(map[string]cache_entry)
+	return r
+}
+
+// observation is a located cell or access point, signal is in dBm and 0 when unknown
+type observation struct {
+	signal int
+	p      store.GeoPoint
+}
+
+// ResolveCells return weighted centre of the known cells, the first cell is the serving one
+func (r *Resolver) ResolveCells(cells []store.Cell, signal []int) (Fix, bool) {
+	if len(cells) == 0 {
+		return Fix{}, false
+	}
+	now := time.Now()
+	found := make(map[store.Cell]store.GeoPoint)
+	missing := make([]store.Cell, 0)
+	r.mu.Lock()
+	for _, c := range cells {
+		e, ok := r.cells[c]
+		if ok && now.Sub(e.t) < r.conf.CacheTTL {
+			if e.found {
+				found[c] = e.p
+			}
+			continue
+		}
+		missing = append(missing, c)
+	}
+	r.mu.Unlock()
+	if len(missing) > 0 {
+		res, err := r.store.LocateCells(missing)
+		if err != nil {
+			r.log.Error().Err(err).Msg("error looking up cell")
+			return Fix{}, false
+		}
+		r.mu.Lock()
+		if len(r.cells)+len(missing) > r.conf.CacheSize {
+			r.cells = make(map[store.Cell]cache_entry)
+		}
+		for _, c := range missing {
+			p, ok := res[c]
+			r.cells[c] = cache_entry{p: p, found: ok, t: now}
+			if ok {
+				found[c] = p
+			}
+		}
+		r.mu.Unlock()
+	}
+	obs := make([]observation, 0, len(found))
+	for i, c := range cells {
+		p, ok := found[c]
+		if !ok {
+			continue
+		}
+		o := observation{p: p}
+		if i < len(signal) {
+			o.signal = signal[i]
+		}
+		obs = append(obs, o)
+	}
+	return centre(obs, SOURCE_LBS)
+}
+
+// ResolveWiFi return weighted centre of the known access points, mac is in aa:bb:cc:dd:ee:ff form
+func (r *Resolver) ResolveWiFi(macs []string, signal []int) (Fix, bool) {
+	if len(macs) == 0 {
+		return Fix{}, false
+	}
+	now := time.Now()
+	found := make(map[string]store.GeoPoint)
+	missing := make([]string, 0)
+	r.mu.Lock()
+	for _, m := range macs {
+		e, ok := r.wifi[m]
+		if ok && now.Sub(e.t) < r.conf.CacheTTL {
+			if e.found {
+				found[m] = e.p
+			}
+			continue
+		}
+		missing = append(missing, m)
+	}
+	r.mu.Unlock()
+	if len(missing) > 0 {
+		res, err := r.store.LocateWiFi(missing)
+		if err != nil {
+			r.log.Error().Err(err).Msg("error looking up wifi access point")
+			return Fix{}, false
+		}
+		r.mu.Lock()
+		if len(r.wifi)+len(missing) > r.conf.CacheSize {
+			r.wifi = make(map[string]cache_entry)
+		}
+		for _, m := range missing {
+			p, ok := res[m]
+			r.wifi[m] = cache_entry{p: p, found: ok, t: now}
+			if ok {
+				found[m] = p
+			}
+		}
+		r.mu.Unlock()
+	}
+	obs := make([]observation, 0, len(found))
+	for i, m := range macs {
+		p, ok := found[m]
+		if !ok {
+			continue
+		}
+		o := observation{p: p}
+		if i < len(signal) {
+			o.signal = signal[i]
+		}
+		obs = append(obs, o)
+	}
+	return centre(obs, SOURCE_WIFI)
+}
+
+// centre weight each point by its inverse range and by signal strength when known,
+// accuracy is the weighted distance to the centre plus the weighted range
+func centre(obs []observation, source string) (Fix, bool) {
+	if len(obs) == 0 {
+		return Fix{}, false
+	}
+	var sw, lat, lon float64
+	w := make([]float64, len(obs))
+	for i, o := range obs {
+		rng := math.Max(o.p.Range, 50)
+		w[i] = 1 / rng
+		if o.signal < 0 {
+			//every 10 dB stronger double the weight
+			w[i] *= math.Pow(2, float64(o.signal+100)/10)
+		}
+		sw += w[i]
+		lat += o.p.Latitude * w[i]
+		lon += o.p.Longitude * w[i]
+	}
+	f := Fix{Latitude: lat / sw, Longitude: lon / sw, Source: source}
+	for i, o := range obs {
+		d := device.Distance(f.Latitude, f.Longitude, o.p.Latitude, o.p.Longitude)
+		f.Accuracy += (d + math.Max(o.p.Range, 50)) * w[i] / sw
+	}
+	f.Accuracy = math.Round(f.Accuracy)
+	return f, true
+}
@@ -0,0 +1,128 @@
+package natspub
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+type PublisherConfig struct {
+	//first subject token, default "tracker"
+	Prefix string
+}
+
+// Location is published on <prefix>.<tid>.location
+type Location struct {
+	TrackerId  uint64           `json:"tracker_id"`
+	ServerTime time.Time        `json:"server_time"`
+	Location   *device.Location `json:"location"`
+}
+
+// Event is published on <prefix>.<tid>.event.<topic>
+type Event struct {
+	TrackerId uint64          `json:"tracker_id"`
+	Topic     string          `json:"topic"`
+	Time      time.Time       `json:"time"`
+	Message   string          `json:"message,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Publisher publish location and event from the bus to nats as json, event only kept
+// in history are not published. Publishing does not wait for the server, while nats is
+// reconnecting message are buffered by the connection and dropped once its buffer is full
+type Publisher struct {
+	nc     *nats.Conn
+	log    log.Logger
+	prefix string
+
+	mu      sync.Mutex
+	failing bool
+}
+
+// NewPublisher subscribe the publisher to bus, nc is owned by the publisher and closed on shutdown
+func NewPublisher(nc *nats.Conn, bus *eventbus.EventBus, config *PublisherConfig) *Publisher {
+	p := &Publisher{nc: nc, prefix: config.Prefix}
+	if p.prefix == "" {
+		p.prefix = "tracker"
+	}
+	p.log = log.DefaultLogger
+	p.log.Context = log.NewContext(nil).Str("module", "nats").Value()
+	bus.SubscribeLocation(p.handle_location)
+	bus.SubscribeEvent(p.handle_event)
+	return p
+}
+
+// Connect dial url and keep reconnecting for as long as the server run
+func Connect(url string) (*nats.Conn, error) {
+	return nats.Connect(url, nats.Name("gpstracker"), nats.MaxReconnects(-1))
+}
+
+// LocationSubject return the subject location of tid is published on
+func (p *Publisher) LocationSubject(tid uint64) string {
+	return p.prefix + "." + strconv.FormatUint(tid, 10) + ".location"
+}
+
+// EventSubject return the subject event of tid is published on, character not allowed
+// in a subject token are replaced so topic keep its dot separated form
+func (p *Publisher) EventSubject(tid uint64, topic string) string {
+	topic = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '*' || r == '>' {
+			return '_'
+		}
+		return r
+	}, topic)
+	return p.prefix + "." + strconv.FormatUint(tid, 10) + ".event." + topic
+}
+
+func (p *Publisher) handle_location(l *eventbus.Location) {
+	buf, err := json.Marshal(Location{TrackerId: l.TrackerId, ServerTime: l.ServerTime, Location: l.Location})
+	if err != nil {
+		p.log.Error().Err(err).Uint64("tid", l.TrackerId).Msg("error encoding location")
+		return
+	}
+	p.publish(p.LocationSubject(l.TrackerId), buf)
+}
+
+func (p *Publisher) handle_event(e *eventbus.Event) {
+	if e.HistoryOnly {
+		return
+	}
+	ev := Event{TrackerId: e.TrackerId, Topic: e.Topic, Time: e.Time, Message: e.Message}
+	if e.Data != nil {
+		ev.Data = e.Payload()
+	}
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		p.log.Error().Err(err).Uint64("tid", e.TrackerId).Str("topic", e.Topic).Msg("error encoding event")
+		return
+	}
+	p.publish(p.EventSubject(e.TrackerId, e.Topic), buf)
+}
+
+// publish log the first failure and the recovery instead of every failed message
+func (p *Publisher) publish(subject string, buf []byte) {
+	err := p.nc.Publish(subject, buf)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && !p.failing {
+		p.failing = true
+		p.log.Error().Err(err).Str("subject", subject).Msg("error publishing to nats")
+	} else if err == nil && p.failing {
+		p.failing = false
+		p.log.Info().Msg("publishing to nats resumed")
+	}
+}
+
+// Shutdown flush buffered message then close the connection
+func (p *Publisher) Shutdown(ctx context.Context) error {
+	defer p.nc.Close()
+	return p.nc.FlushWithContext(ctx)
+}
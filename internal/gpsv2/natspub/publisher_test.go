@@ -0,0 +1,118 @@
+package natspub
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+func TestPublisher(t *testing.T) {
+	srv := test.RunRandClientPortServer()
+	defer srv.Shutdown()
+	sub, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	locations, err := sub.SubscribeSync("tracker.*.location")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := sub.SubscribeSync("tracker.*.event.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := eventbus.NewEventBus()
+	p := NewPublisher(nc, bus, &PublisherConfig{})
+
+	gpst := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	course := float32(90)
+	bus.PublishLocation(&eventbus.Location{TrackerId: 12, Nsn: 34, ServerTime: gpst.Add(time.Second), Store: true, Live: true,
+		Location: &device.Location{Latitude: -6.2, Longitude: 106.8, Speed: 10, Timestamp: gpst, Course: &course}})
+	bus.PublishEvent(&eventbus.Event{TrackerId: 12, Topic: "cell_info.observed", Time: gpst, HistoryOnly: true})
+	bus.PublishEvent(&eventbus.Event{TrackerId: 12, Topic: "alarm.sos", Message: "SOS", Data: map[string]int{"code": 1}, Time: gpst})
+	bus.PublishEvent(&eventbus.Event{TrackerId: 12, Topic: "started", Time: gpst})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := locations.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "tracker.12.location" {
+		t.Fatalf("location subject %s", msg.Subject)
+	}
+	l := Location{}
+	if err := json.Unmarshal(msg.Data, &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.TrackerId != 12 || !l.ServerTime.Equal(gpst.Add(time.Second)) || l.Location.Latitude != -6.2 ||
+		l.Location.Longitude != 106.8 || !l.Location.Timestamp.Equal(gpst) || l.Location.Course == nil || *l.Location.Course != 90 {
+		t.Fatalf("location %s", msg.Data)
+	}
+
+	//the history only event is skipped
+	msg, err = events.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "tracker.12.event.alarm.sos" {
+		t.Fatalf("event subject %s", msg.Subject)
+	}
+	e := Event{}
+	if err := json.Unmarshal(msg.Data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.TrackerId != 12 || e.Topic != "alarm.sos" || e.Message != "SOS" || string(e.Data) != `{"code":1}` || !e.Time.Equal(gpst) {
+		t.Fatalf("event %s", msg.Data)
+	}
+	msg, err = events.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "tracker.12.event.started" {
+		t.Fatalf("event subject %s", msg.Subject)
+	}
+	if _, err := events.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("unexpected event, %v", err)
+	}
+}
+
+func TestEventSubject(t *testing.T) {
+	p := &Publisher{prefix: "gps"}
+	cases := []struct {
+		topic   string
+		subject string
+	}{
+		{"alarm.sos", "gps.5.event.alarm.sos"},
+		{"heartbeat changed", "gps.5.event.heartbeat_changed"},
+		{"tab\tseparated", "gps.5.event.tab_separated"},
+		{"alarm.*", "gps.5.event.alarm._"},
+		{"alarm.>", "gps.5.event.alarm._"},
+	}
+	for _, c := range cases {
+		if s := p.EventSubject(5, c.topic); s != c.subject {
+			t.Errorf("%q published on %s, expected %s", c.topic, s, c.subject)
+		}
+	}
+	if s := p.LocationSubject(5); s != "gps.5.location" {
+		t.Errorf("location published on %s", s)
+	}
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/geoloc"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// Param is handed to a protocol when the server creates a new device
+type Param struct {
+	//Bus receive location and event published by the device
+	Bus       *eventbus.EventBus
+	MiscStore store.MiscStore
+	//CommandStore is nil when the command queue is disabled
+	CommandStore store.CommandStore
+	//Geolocator is nil when cell and wifi geolocation is disabled
+	Geolocator *geoloc.Resolver
+	//Running track the read loop goroutine so shutdown can wait for its last publish
+	Running *sync.WaitGroup
+	Logger  log.Logger
+}
+
+// Login is the result of a successful login exchange, it carries the serial claimed
+// by the device and knows how to create the device once the tracker is registered
+type Login interface {
+	Serial() device.Serial
+	NewDevice(tid uint64, c *conn.Conn, param *Param, conf_attr *device.DeviceConfigAttribute) device.DeviceIf
+}
+
+// Acceptor is implemented by Login of protocol acknowledging the login message only
+// once the server decided whether the tracker is allowed to connect
+type Acceptor interface {
+	Accept(c *conn.Conn, accepted bool) error
+}
+
+// Reconnector is implemented by Login of protocol whose device keep state derived from
+// the login message, Reconnect is used instead of ReplaceConn when the tracker is
+// already served by a device
+type Reconnector interface {
+	Reconnect(d device.DeviceIf, c *conn.Conn)
+}
+
+// DatagramCodec convert between the datagram of one udp session and the stream the
+// protocol login and device read loop expect
+type DatagramCodec interface {
+	//Decode return the stream carried by datagram d
+	Decode(d []byte) ([]byte, error)
+	//Encode return the datagram carrying p written by the device, nil when nothing is sent
+	Encode(p []byte) []byte
+}
+
+type Protocol struct {
+	Name string
+	//number of bytes peeked from connection and passed to Detect
+	PeekLen int
+	Detect  func(head []byte) bool
+	//Login read the login message from connection and acknowledge it when needed, unless
+	//the returned Login is an Acceptor
+	Login func(c *conn.Conn) (Login, error)
+	//DatagramDetect and NewDatagramCodec are set by protocol whose udp framing differ from
+	//its tcp framing, datagram of other protocol carry the same frame as the tcp stream
+	DatagramDetect   func(d []byte) bool
+	NewDatagramCodec func() DatagramCodec
+}
+
+var (
+	mu        sync.RWMutex
+	protocols []*Protocol
+)
+
+// Register make protocol available to the server, it is meant to be called from init of device package
+func Register(p *Protocol) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range protocols {
+		if v.Name == p.Name {
+			panic("protocol: Register called twice for " + p.Name)
+		}
+	}
+	protocols = append(protocols, p)
+}
+
+// Protocols return registered protocols in registration order
+func Protocols() []*Protocol {
+	mu.RLock()
+	defer mu.RUnlock()
+	l := make([]*Protocol, len(protocols))
+	copy(l, protocols)
+	return l
+}
+
+// MaxPeekLen return the largest PeekLen of registered protocols
+func MaxPeekLen() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	n := 0
+	for _, v := range protocols {
+		if v.PeekLen > n {
+			n = v.PeekLen
+		}
+	}
+	return n
+}
+
+// Detect return the first registered protocol accepting head
+func Detect(head []byte) (*Protocol, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, v := range protocols {
+		if len(head) < v.PeekLen {
+			continue
+		}
+		if v.Detect(head[:v.PeekLen]) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// DetectDatagram return the first registered protocol with its own udp framing accepting d
+func DetectDatagram(d []byte) (*Protocol, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, v := range protocols {
+		if v.DatagramDetect != nil && v.DatagramDetect(d) {
+			return v, true
+		}
+	}
+	return nil, false
+}
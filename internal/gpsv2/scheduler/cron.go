@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five field cron expression : minute hour day-of-month month day-of-week.
+// Each field accept `*`, a value, a range `a-b`, a step `*/n` or `a-b/n` and comma separated list.
+// As in cron, when both day fields are restricted a day matching either of them is selected
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	dom_star, dow_star            bool
+}
+
+var fieldBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func ParseCron(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseField(f, fieldBounds[i][0], fieldBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron field %d : %w", i+1, err)
+		}
+		bits[i] = b
+	}
+	s := &Schedule{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4]}
+	s.dom_star = fields[2] == "*"
+	s.dow_star = fields[4] == "*"
+	return s, nil
+}
+
+func parseField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			if i := strings.IndexByte(part, '-'); i >= 0 {
+				a, err1 := strconv.Atoi(part[:i])
+				b, err2 := strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+				lo, hi = a, b
+			} else {
+				a, err := strconv.Atoi(part)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+				lo, hi = a, a
+				if step > 1 {
+					hi = max
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.dom_star || s.dow_star {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next return the first minute strictly after t matching the schedule, zero time
+// when nothing match within five years
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
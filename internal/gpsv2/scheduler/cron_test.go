@@ -0,0 +1,83 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronError(t *testing.T) {
+	exprs := []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"*/0 * * * *",
+		"a * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+	}
+	for _, e := range exprs {
+		if _, err := ParseCron(e); err == nil {
+			t.Errorf("%q : expected error", e)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	//2021-09-01 is a wednesday
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		expr string
+		from time.Time
+		next time.Time
+	}{
+		{"* * * * *", at(9, 1, 10, 7).Add(30 * time.Second), at(9, 1, 10, 8)},
+		{"*/15 * * * *", at(9, 1, 10, 7), at(9, 1, 10, 15)},
+		{"*/15 * * * *", at(9, 1, 10, 15), at(9, 1, 10, 30)},
+		{"5/20 * * * *", at(9, 1, 10, 30), at(9, 1, 10, 45)},
+		{"5,10-12 * * * *", at(9, 1, 10, 5), at(9, 1, 10, 10)},
+		{"5,10-12 * * * *", at(9, 1, 10, 12), at(9, 1, 11, 5)},
+		{"0 */6 * * *", at(9, 1, 10, 0), at(9, 1, 12, 0)},
+		{"0 2 * * *", at(9, 1, 10, 0), at(9, 2, 2, 0)},
+		{"30 8 * * 1-5", at(9, 3, 9, 0), at(9, 6, 8, 30)},
+		{"0 0 * * 0", at(9, 1, 10, 0), at(9, 5, 0, 0)},
+		{"0 0 1 * *", at(9, 1, 0, 0), at(10, 1, 0, 0)},
+		{"0 0 31 * *", at(9, 1, 0, 0), at(10, 31, 0, 0)},
+		{"0 0 1 1 *", at(9, 1, 0, 0), time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", at(3, 1, 0, 0), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		//both day field restricted, either of them match
+		{"0 12 13 * 5", at(9, 1, 0, 0), at(9, 3, 12, 0)},
+		{"0 12 2 * 5", at(9, 1, 0, 0), at(9, 2, 12, 0)},
+		//one day field restricted, both must match
+		{"0 12 * 9 5", at(9, 1, 0, 0), at(9, 3, 12, 0)},
+		{"0 0 30 2 *", at(9, 1, 0, 0), time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%q : %v", c.expr, err)
+		}
+		if next := s.Next(c.from); !next.Equal(c.next) {
+			t.Errorf("%q from %s : next %s, expected %s", c.expr, c.from, next, c.next)
+		}
+	}
+}
+
+func TestCronNextLocation(t *testing.T) {
+	s, err := ParseCron("0 7 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jakarta := time.FixedZone("WIB", 7*60*60)
+	from := time.Date(2021, 9, 1, 1, 0, 0, 0, time.UTC)
+	next := s.Next(from.In(jakarta))
+	if !next.Equal(time.Date(2021, 9, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("next %s", next)
+	}
+}
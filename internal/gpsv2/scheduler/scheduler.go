@@ -0,0 +1,269 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	gpsv2 "nuha.dev/gpstracker/internal/gpsv2/server"
+)
+
+// Scheduler dispatch command job into the persistent command queue. A job target a
+// single tracker, every tracker of a protocol or every tracker of a group using that
+// protocol, command being protocol specific. It either run once at run_at or recurrently
+// following its cron expression, tracker protocol is recorded by the server on login :
+//
+//	CREATE TABLE command_job (
+//		id bigserial PRIMARY KEY,
+//		name text NOT NULL,
+//		command text NOT NULL,
+//		tracker_id bigint REFERENCES tracker(id) ON DELETE CASCADE,
+//		protocol text,
+//		tracker_group text,
+//		cron text,
+//		expire_in int NOT NULL DEFAULT 60,
+//		enabled bool NOT NULL DEFAULT true,
+//		next_run timestamptz,
+//		last_run timestamptz,
+//		created_at timestamptz NOT NULL DEFAULT now()
+//	);
+//	ALTER TABLE tracker_command ADD COLUMN job_id bigint REFERENCES command_job(id) ON DELETE SET NULL;
+//	ALTER TABLE gt06_command_response ADD COLUMN job_id bigint;
+//	ALTER TABLE tracker ADD COLUMN protocol text;
+type Scheduler struct {
+	db     *pgxpool.Pool
+	gps    *gpsv2.Server
+	log    log.Logger
+	config *SchedulerConfig
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type SchedulerConfig struct {
+	//cron expression are evaluated in this location
+	Location *time.Location
+}
+
+type job struct {
+	id        uint64
+	command   string
+	tracker   *uint64
+	protocol  *string
+	group     *string
+	cron      *string
+	expire_in int
+}
+
+func NewScheduler(db *pgxpool.Pool, gps *gpsv2.Server, config *SchedulerConfig) *Scheduler {
+	s := &Scheduler{db: db, gps: gps, config: config}
+	if s.config.Location == nil {
+		s.config.Location = time.Local
+	}
+	s.log = log.DefaultLogger
+	s.log.Context = log.NewContext(nil).Str("module", "scheduler").Value()
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	return s
+}
+
+// NextRun compute the next run of a cron expression after t in the scheduler location
+func (s *Scheduler) NextRun(cron string, t time.Time) (time.Time, error) {
+	sched, err := ParseCron(cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.Next(t.In(s.config.Location)), nil
+}
+
+func (s *Scheduler) Run() {
+	s.log.Info().Msg("starting scheduler")
+	defer close(s.done)
+	for {
+		now := time.Now()
+		wait := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+		select {
+		case <-time.After(wait):
+			s.dispatch(time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dispatch queue command of every due job, job row are locked so several instance
+// sharing the database do not dispatch the same job twice. Each job is queued in its
+// own savepoint, a failing job is skipped until its next run without holding back the others
+func (s *Scheduler) dispatch(now time.Time) {
+	ctx := context.Background()
+	s.schedule_new(ctx, now)
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		s.log.Error().Err(err).Msg("error starting transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `SELECT id,command,tracker_id,protocol,tracker_group,cron,expire_in FROM command_job WHERE enabled AND next_run <= $1 FOR UPDATE SKIP LOCKED`, now)
+	if err != nil {
+		s.log.Error().Err(err).Msg("error fetching due job")
+		return
+	}
+	jobs := make([]job, 0)
+	for rows.Next() {
+		j := job{}
+		err := rows.Scan(&j.id, &j.command, &j.tracker, &j.protocol, &j.group, &j.cron, &j.expire_in)
+		if err != nil {
+			rows.Close()
+			s.log.Error().Err(err).Msg("error fetching due job")
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+	if len(jobs) == 0 {
+		return
+	}
+
+	targets := make(map[uint64]bool)
+	for _, j := range jobs {
+		tids, err := s.queue_job_savepoint(ctx, tx, j)
+		if err != nil {
+			s.log.Error().Err(err).Uint64("job_id", j.id).Msg("error queueing job command, skipping run")
+			err = s.skip_job(ctx, tx, j)
+			if err != nil {
+				s.log.Error().Err(err).Uint64("job_id", j.id).Msg("error skipping job")
+				return
+			}
+			continue
+		}
+		for _, tid := range tids {
+			targets[tid] = true
+		}
+		s.log.Info().Uint64("job_id", j.id).Str("command", j.command).Int("trackers", len(tids)).Msg("job dispatched")
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		s.log.Error().Err(err).Msg("error committing dispatched job")
+		return
+	}
+	for tid := range targets {
+		dev, ok := s.gps.GetDevice(tid)
+		if !ok {
+			continue
+		}
+		if q, ok := dev.Dev.(device.CommandQueuer); ok {
+			q.DeliverQueued()
+		}
+	}
+}
+
+// schedule_new compute the first run of recurring job created through the api
+func (s *Scheduler) schedule_new(ctx context.Context, now time.Time) {
+	rows, err := s.db.Query(ctx, `SELECT id,cron FROM command_job WHERE enabled AND cron IS NOT NULL AND next_run IS NULL`)
+	if err != nil {
+		s.log.Error().Err(err).Msg("error fetching new job")
+		return
+	}
+	next := make(map[uint64]*time.Time)
+	for rows.Next() {
+		var id uint64
+		var cron string
+		err := rows.Scan(&id, &cron)
+		if err != nil {
+			break
+		}
+		n, err := s.NextRun(cron, now)
+		if err != nil || n.IsZero() {
+			s.log.Error().Err(err).Uint64("job_id", id).Msg("invalid cron expression, disabling job")
+			next[id] = nil
+		} else {
+			next[id] = &n
+		}
+	}
+	rows.Close()
+	for id, n := range next {
+		_, err := s.db.Exec(ctx, `UPDATE command_job SET next_run = $1, enabled = $2 WHERE id = $3`, n, n != nil, id)
+		if err != nil {
+			s.log.Error().Err(err).Uint64("job_id", id).Msg("error scheduling job")
+		}
+	}
+}
+
+func (s *Scheduler) queue_job_savepoint(ctx context.Context, tx pgx.Tx, j job) ([]uint64, error) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sp.Rollback(ctx)
+	tids, err := s.queue_job(ctx, sp, j)
+	if err != nil {
+		return nil, err
+	}
+	return tids, sp.Commit(ctx)
+}
+
+// skip_job schedule the next run of a job which failed to be queued, one shot job and
+// job whose cron can not be evaluated are disabled
+func (s *Scheduler) skip_job(ctx context.Context, tx pgx.Tx, j job) error {
+	next := s.next_run(j)
+	_, err := tx.Exec(ctx, `UPDATE command_job SET next_run = $1, enabled = $2 WHERE id = $3`, next, next != nil, j.id)
+	return err
+}
+
+func (s *Scheduler) next_run(j job) *time.Time {
+	if j.cron == nil {
+		return nil
+	}
+	n, err := s.NextRun(*j.cron, time.Now())
+	if err != nil {
+		s.log.Error().Err(err).Uint64("job_id", j.id).Msg("invalid cron expression, disabling job")
+		return nil
+	}
+	if n.IsZero() {
+		return nil
+	}
+	return &n
+}
+
+// queue_job insert the job command for every target tracker and schedule its next run,
+// one shot job and job whose cron can not be evaluated are disabled
+func (s *Scheduler) queue_job(ctx context.Context, tx pgx.Tx, j job) ([]uint64, error) {
+	rows, err := tx.Query(ctx, `INSERT INTO tracker_command (tracker_id,command,expire_at,job_id)
+	SELECT id, $1, now() + make_interval(mins => $2), $3 FROM tracker
+	WHERE id = $4 OR (protocol = $5 AND ($6::text IS NULL OR config->>'group' = $6))
+	RETURNING tracker_id`,
+		j.command, j.expire_in, j.id, j.tracker, j.protocol, j.group)
+	if err != nil {
+		return nil, err
+	}
+	tids := make([]uint64, 0)
+	for rows.Next() {
+		var tid uint64
+		err := rows.Scan(&tid)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tids = append(tids, tid)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	next := s.next_run(j)
+	_, err = tx.Exec(ctx, `UPDATE command_job SET last_run = now(), next_run = $1, enabled = $2 WHERE id = $3`, next, next != nil, j.id)
+	return tids, err
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/device/osmand"
+)
+
+// runHttpListener accept location report using osmand protocol as sent by
+// traccar client, both query string and form encoded body are accepted
+func (s *Server) runHttpListener() {
+	s.log.Info().Msgf("starting osmand http listener on %s", s.config.HttpListenerAddr)
+	hs := &http.Server{
+		Addr:           s.config.HttpListenerAddr,
+		Handler:        http.HandlerFunc(s.serve_osmand),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	s.mu.Lock()
+	s.http_server = hs
+	s.mu.Unlock()
+	err := hs.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		s.log.Error().Err(err).Msg("unable to listen")
+	}
+}
+
+func (s *Server) serve_osmand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	t := time.Now().UTC()
+	sourceip, sourceport, _ := net.SplitHostPort(r.RemoteAddr)
+	remote := []string{sourceip, sourceport}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rep, err := osmand.ParseReport(r.Form)
+	if err != nil {
+		s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).Strs("remote", remote).Str("query", r.Form.Encode()).Msg("invalid osmand report")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sn, err := strconv.ParseUint(rep.ID, 10, 64)
+	if err == nil && sn > 0x0fffffffffffffff {
+		err = fmt.Errorf("id does not fit a serial number")
+	}
+	if err != nil {
+		s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).Strs("remote", remote).Str("id", rep.ID).Msg("error parsing serial number")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	//osmand id is chosen by the user, it has its own sn_type so it can not claim the imei of another tracker
+	ser := device.NewSerial(7, sn)
+	dev, status := s.osmand_device(ser, remote)
+	if dev == nil {
+		w.WriteHeader(status)
+		return
+	}
+	err = dev.Push(rep, remote, t)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// osmand_device return the registered osmand device for ser, creating it on its first
+// report. When nil is returned the int is the http status to reply with
+func (s *Server) osmand_device(ser device.Serial, remote []string) (*osmand.OsmAnd, int) {
+	s.http_mu.Lock()
+	defer s.http_mu.Unlock()
+	dev, ok := s.device_list.deviceNsn(ser.Nsn())
+	if ok && !dev.Deleted {
+		d, ok := dev.Dev.(*osmand.OsmAnd)
+		if !ok {
+			s.log.Error().Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(ser).Str("device_type", dev.Type).Msg("serial is used by another protocol")
+			return nil, http.StatusConflict
+		}
+		return d, 0
+	}
+	s.log.Info().Str("event", LOGIN_MESSAGE).Str("device_type", device.DEVICE_OSMAND).Strs("remote", remote).EmbedObject(ser).Msg("")
+	tid, conf_attr, err := s.register_and_fetch_config_attr(device.DEVICE_OSMAND, ser.Nsn())
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	if !conf_attr.Config.AllowConnect {
+		s.log.Info().Str("event", ALLOW_CONNECT_FALSE).Str("device_type", device.DEVICE_OSMAND).EmbedObject(ser).Msg("device not allowed to connect")
+		return nil, http.StatusForbidden
+	}
+	s.log.Info().Str("event", NEW_DEVICE_CREATED).Str("device_type", device.DEVICE_OSMAND).EmbedObject(ser).Msg("new device")
+	var logger = log.DefaultLogger
+	logger.Level = log.ParseLevel(conf_attr.Config.LogLevel)
+	param := osmand.OsmAndParam{Bus: s.bus, Logger: logger, MiscStore: s.misc_store}
+	d := osmand.NewOsmAnd(tid, ser, remote, &param, conf_attr)
+	d.Run()
+	s.device_list.addDevice(ser, tid, d, device.DEVICE_OSMAND)
+	return d, 0
+}
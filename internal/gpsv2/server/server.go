@@ -2,9 +2,9 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"net"
-	"strconv"
+	"net/http"
 	"sync"
 	"time"
 
@@ -12,11 +12,11 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/phuslu/log"
 	proxyproto "github.com/pires/go-proxyproto"
+	"nuha.dev/gpstracker/internal/eventbus"
 	"nuha.dev/gpstracker/internal/gpsv2/conn"
 	"nuha.dev/gpstracker/internal/gpsv2/device"
-	"nuha.dev/gpstracker/internal/gpsv2/device/gt06"
-	"nuha.dev/gpstracker/internal/gpsv2/device/simplejson"
-	"nuha.dev/gpstracker/internal/gpsv2/sublist"
+	"nuha.dev/gpstracker/internal/gpsv2/geoloc"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
 	"nuha.dev/gpstracker/internal/store"
 )
 
@@ -26,6 +26,8 @@ const (
 	LOGIN_MESSAGE_ERROR string = "login_message_error"
 	ALLOW_CONNECT_FALSE string = "allow_connect_false"
 	NEW_DEVICE_CREATED  string = "new_device_created"
+	UNKNOWN_PROTOCOL    string = "unknown_protocol"
+	SERVER_SHUTDOWN     string = "server_shutdown"
 )
 
 type Device struct {
@@ -73,25 +75,36 @@ type Server struct {
 	db            *pgxpool.Pool
 	config        *ServerConfig
 	cid_counter   uint64
-	store         store.LocationStore
+	bus           *eventbus.EventBus
 	misc_store    store.MiscStore
+	command_store store.CommandStore
+	geolocator    *geoloc.Resolver
 	listener      net.Listener
 	proxylistener proxyproto.Listener
+	http_server   *http.Server
+	http_mu       sync.Mutex
+	udp_listener  *udpListener
+	tls_listener  net.Listener
 	device_list   *DeviceList
-	sublist       *sublist.SublistMap
+	//closing is set under mu once shutdown started, no device is created or resumed after it
+	closing bool
+	//login handing a connection to a device, shutdown wait for them before stopping device
+	logins  sync.WaitGroup
+	running sync.WaitGroup
 }
 
-func NewServer(db *pgxpool.Pool, store store.LocationStore, misc_store store.MiscStore, sublistmap *sublist.SublistMap, config *ServerConfig) *Server {
+func NewServer(db *pgxpool.Pool, bus *eventbus.EventBus, misc_store store.MiscStore, command_store store.CommandStore, geolocator *geoloc.Resolver, config *ServerConfig) *Server {
 
 	s := &Server{}
 	s.log = log.DefaultLogger
 	s.log.Context = log.NewContext(nil).Str("module", "gps-server").Value()
 	s.config = config
 	s.db = db
-	s.store = store
+	s.bus = bus
 	s.misc_store = misc_store
+	s.command_store = command_store
+	s.geolocator = geolocator
 	s.device_list = &DeviceList{nsnlist: make(map[uint64]uint64), list: make(map[uint64]Device)}
-	s.sublist = sublistmap
 	return s
 }
 
@@ -111,6 +124,19 @@ func NewServer(db *pgxpool.Pool, store store.LocationStore, misc_store store.Mis
 
 type ServerConfig struct {
 	ListenerAddr string
+	//osmand http listener is disabled when empty
+	HttpListenerAddr string
+	//udp listener is disabled when empty
+	UdpListenerAddr string
+	//udp session without datagram for this long are closed, default to 5 minutes
+	UdpIdleTimeout time.Duration
+	//tls listener is disabled when empty
+	TlsListenerAddr string
+	TlsCertFile     string
+	TlsKeyFile      string
+	//client certificate are verified against this ca, its subject common name bind the connection to a serial
+	TlsClientCAFile      string
+	TlsRequireClientCert bool
 }
 
 type LoginHandler struct {
@@ -120,9 +146,93 @@ type LoginHandler struct {
 }
 
 func (s *Server) Run() {
+	if s.config.HttpListenerAddr != "" {
+		go s.runHttpListener()
+	}
+	if s.config.UdpListenerAddr != "" {
+		go s.runUdpListener()
+	}
+	if s.config.TlsListenerAddr != "" {
+		go s.runTlsListener()
+	}
 	s.runListener()
 }
 
+// Shutdown stop accepting connection, stop every device and record a server_shutdown
+// event for each of them. Stopping a device close its connection so its read loop
+// record the disconnection as usual, Shutdown return once every read loop exited. Every
+// device is stopped even when ctx is done, ctx error is then returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.log.Info().Str("event", SERVER_SHUTDOWN).Msg("shutting down gps-server")
+	s.mu.Lock()
+	s.closing = true
+	ln, tln, ul, hs := s.listener, s.tls_listener, s.udp_listener, s.http_server
+	s.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	if tln != nil {
+		tln.Close()
+	}
+	if ul != nil {
+		ul.close()
+	}
+	var err error
+	if hs != nil {
+		err = hs.Shutdown(ctx)
+	}
+
+	//device created by a login in progress is in the list once it is done
+	wait(ctx, &s.logins)
+
+	s.device_list.mu.Lock()
+	devs := make([]Device, 0, len(s.device_list.list))
+	for _, d := range s.device_list.list {
+		devs = append(devs, d)
+	}
+	s.device_list.mu.Unlock()
+	//every device is stopped even past the deadline, only waiting for them is cut short
+	t := time.Now()
+	for _, d := range devs {
+		d.Dev.Stop()
+		s.bus.PublishEvent(&eventbus.Event{TrackerId: d.TrackerId, Topic: SERVER_SHUTDOWN, Time: t})
+	}
+	//read loop publish the disconnection once its connection is closed, wait for it so
+	//nothing is published after the subscribers are shut down
+	wait(ctx, &s.running)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// wait report whether wg is done before ctx
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// begin_login register a login about to hand its connection to a device, it is
+// refused once shutdown started. The caller call logins.Done when it is handed
+func (s *Server) begin_login() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.logins.Add(1)
+	return true
+}
+
 func (s *Server) GetDevice(tid uint64) (Device, bool) {
 	s.device_list.mu.Lock()
 	defer s.device_list.mu.Unlock()
@@ -147,6 +257,14 @@ func (s *Server) NewLoginHandler(c *conn.Conn) *LoginHandler {
 	return &lh
 }
 
+func (s *Server) next_cid() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cid := s.cid_counter
+	s.cid_counter = s.cid_counter + 1
+	return cid
+}
+
 func (s *Server) runListener() {
 	s.log.Info().Msgf("starting gps-server on %s", s.config.ListenerAddr)
 	ln, err := net.Listen("tcp", s.config.ListenerAddr)
@@ -163,14 +281,18 @@ func (s *Server) runListener() {
 	for {
 		s.log.Info().Msg("accepting connection ...")
 		_c, err := pln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.log.Info().Msg("gps-server listener closed")
+			return
+		}
 		if err != nil {
 			s.log.Error().Err(err).Msg("failed to accept new connection")
 			pln.Close()
 			return
 		}
-		c := conn.NewConn(_c, s.cid_counter)
-		s.cid_counter = s.cid_counter + 1
-		s.log.Info().Str("event", string(NEW_CONNECTION)).EmbedObject(c).Uint64("cid", s.cid_counter).Msg("")
+		cid := s.next_cid()
+		c := conn.NewConn(_c, cid)
+		s.log.Info().Str("event", string(NEW_CONNECTION)).EmbedObject(c).Uint64("cid", cid).Msg("")
 		h := s.NewLoginHandler(c)
 		go h.handle()
 	}
@@ -212,11 +334,11 @@ func (s *Server) runListener() {
 // 	}
 // }
 
-func (s *Server) add_tracker_default(nsn uint64) (uint64, *device.DeviceConfig, error) {
+func (s *Server) add_tracker_default(protocol string, nsn uint64) (uint64, *device.DeviceConfig, error) {
 	var tid uint64
 	var config device.DeviceConfig
-	query := `INSERT INTO tracker(nsn,config) SELECT $1, config FROM config_template WHERE name='tracker_default_config' RETURNING id,config`
-	err := s.db.QueryRow(context.Background(), query, nsn).Scan(&tid, &config)
+	query := `INSERT INTO tracker(nsn,config,protocol) SELECT $1, config, $2 FROM config_template WHERE name='tracker_default_config' RETURNING id,config`
+	err := s.db.QueryRow(context.Background(), query, nsn, protocol).Scan(&tid, &config)
 	if err != nil {
 		return 0, nil, err
 	} else {
@@ -225,6 +347,10 @@ func (s *Server) add_tracker_default(nsn uint64) (uint64, *device.DeviceConfig,
 
 }
 
+// register_and_fetch_config_attr record the protocol the tracker logged in with :
+//
+//	ALTER TABLE tracker ADD COLUMN protocol text;
+//	CREATE INDEX ON tracker (protocol);
 func (s *Server) register_and_fetch_config_attr(protocol string, nsn uint64) (uint64, *device.DeviceConfigAttribute, error) {
 
 	var tid uint64
@@ -232,11 +358,12 @@ func (s *Server) register_and_fetch_config_attr(protocol string, nsn uint64) (ui
 	conf := device.DeviceConfig{}
 	attr := make(map[string]string)
 
-	selectSql := `SELECT id ,config,attribute FROM "tracker" where  nsn=$1`
-	err := s.db.QueryRow(context.Background(), selectSql, nsn).Scan(&tid, &conf, &attr)
+	var cur_protocol *string
+	selectSql := `SELECT id ,config,attribute,protocol FROM "tracker" where  nsn=$1`
+	err := s.db.QueryRow(context.Background(), selectSql, nsn).Scan(&tid, &conf, &attr, &cur_protocol)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			tid, conf, err := s.add_tracker_default(nsn)
+			tid, conf, err := s.add_tracker_default(protocol, nsn)
 			if err != nil {
 				return 0, nil, err
 			} else {
@@ -248,185 +375,141 @@ func (s *Server) register_and_fetch_config_attr(protocol string, nsn uint64) (ui
 			return 0, nil, err
 		}
 	} else {
+		//keep protocol current so job can target every tracker of a protocol, it rarely
+		//change so the row is only written when it did
+		if cur_protocol == nil || *cur_protocol != protocol {
+			_, err = s.db.Exec(context.Background(), `UPDATE tracker SET protocol = $1 WHERE id = $2`, protocol, tid)
+			if err != nil {
+				s.log.Error().Err(err).Msg("error updating tracker protocol")
+			}
+		}
 		conf_attr.Attribute = attr
 		conf_attr.Config = &conf
 		return tid, &conf_attr, nil
 	}
 }
 
-// func NewDevice(device_type string, c *conn.Conn, store store.Store) device.DeviceIf {
-
-// 	switch device_type {
-// 	case device.DEVICE_GT06:
-// 		dev := gt06.NewGT06(c, store)
-// 		dev.Run()
-// 		return dev
-// 	case device.DEVICE_SIMPLEJSON:
-// 		dev := simplejson.NewSimpleJSON(c, store)
-// 		dev.Run()
-// 		return dev
-// 	default:
-// 		dev := simplejson.NewSimpleJSON(c, store)
-// 		dev.Run()
-// 		return dev
-// 	}
-// }
-
 func (h *LoginHandler) handle() {
 	var err error
 	_ = h.c.SetReadDeadline(time.Now().Add(2 * time.Second))
-	b, err := h.c.Peek(1)
+	_, err = h.c.Peek(1)
 	if err != nil {
 		h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h.c).Msg("error peeking from connection, will close")
 		h.c.Close()
 		return
 	}
-
-	if b[0] == 0x99 {
-		h.device_type = device.DEVICE_SIMPLEJSON
-		h.s.log.Trace().EmbedObject(h.c).Msgf("detected as %s", device.DEVICE_SIMPLEJSON)
-		h.handleAsSimpleJson()
-
-	} else if b[0] == 0x78 {
-		h.device_type = device.DEVICE_GT06
-		h.s.log.Trace().EmbedObject(h.c).Msgf("detected as %s", device.DEVICE_GT06)
-		h.handleAsGT06()
+	proto, head, ok := h.detect()
+	if !ok {
+		h.s.log.Error().Str("event", UNKNOWN_PROTOCOL).EmbedObject(h.c).Hex("head", head).Msg("unable to detect protocol, will close")
+		h.c.Close()
+		return
 	}
+	h.device_type = proto.Name
+	h.s.log.Trace().EmbedObject(h.c).Msgf("detected as %s", proto.Name)
 
-}
-
-func (h *LoginHandler) MarshalObject(e *log.Entry) {
-	e.EmbedObject(h.c).Str("device_type", h.device_type)
-}
-
-func (h *LoginHandler) handleAsGT06() {
-	var err error
-	msg := gt06.Message{}
-	msg.Buffer = make([]byte, 100)
-	err = gt06.ReadMessage(h.c, &msg)
+	login, err := proto.Login(h.c)
 	if err != nil {
-		h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error reading login message")
+		h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error handling login message")
 		h.c.Close()
 		return
 	}
 	_ = h.c.SetReadDeadline(time.Time{})
-	if msg.Protocol == gt06.LOGIN {
-		loginMessage := gt06.ParseLoginMessage(msg.Payload)
-		if err != nil {
-			h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error parsing login message")
-			h.c.Close()
-			return
-		} else {
-			var sn uint64
-			sn, err = strconv.ParseUint(loginMessage.SN, 10, 64)
-			if err != nil {
-				h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error parsing serial number")
-				h.c.Close()
-				return
-			}
-			err := gt06.SendLoginOK(h.c, msg.Serial)
-			if err != nil {
-				h.s.log.Error().Err(err).EmbedObject(h).Msg("error sending login acknowledge")
-				h.c.Close()
-				return
-			}
-			ser := device.NewSerial(0, sn)
-			h.s.log.Info().Str("event", LOGIN_MESSAGE).EmbedObject(h).EmbedObject(ser).Msg("")
-			dev, ok := h.s.device_list.deviceNsn(ser.Nsn())
-			if ok && !dev.Deleted {
-				h.s.log.Trace().EmbedObject(h).Msgf("replacing older connection for %d", sn)
-				dev.Dev.ReplaceConn(h.c)
-			} else {
-				tid, conf_attr, err := h.s.register_and_fetch_config_attr("gt06", ser.Nsn())
-				if err != nil {
-					h.c.Close()
-					return
-				}
-				if !conf_attr.Config.AllowConnect {
-					h.s.log.Info().Str("event", ALLOW_CONNECT_FALSE).EmbedObject(h).EmbedObject(ser).Msg("")
-					h.c.Close()
-					return
-				}
-				h.s.log.Info().Str("event", NEW_DEVICE_CREATED).EmbedObject(h).EmbedObject(ser).Msg("")
-				var logger = log.DefaultLogger
-				logger.Level = log.ParseLevel(conf_attr.Config.LogLevel)
-				s, _ := h.s.sublist.GetSublist(tid, true)
-				param := gt06.GT06Param{Store: h.s.store, Logger: logger, Sublist: s, MiscStore: h.s.misc_store}
-				dev := gt06.NewGT06(tid, ser, h.c, &loginMessage, &param, conf_attr)
-				dev.Run()
-				h.s.device_list.addDevice(ser, tid, dev, device.DEVICE_GT06)
-			}
-		}
-	} else {
-		h.s.log.Error().EmbedObject(h).Str("event", LOGIN_MESSAGE_ERROR).Msgf("message type is not login,type : %x", msg.Protocol)
-		h.c.Close()
-		return
-	}
-
-}
-
-func (h *LoginHandler) handleAsSimpleJson() {
-	var err error
-	msg := simplejson.FrameMessage{}
-	msg.Buffer = make([]byte, 100)
-	err = simplejson.ReadMessage(h.c, &msg)
+	ser := login.Serial()
+	h.s.log.Info().Str("event", LOGIN_MESSAGE).EmbedObject(h).EmbedObject(ser).Msg("")
+	err = verifyIdentity(h.c, ser)
 	if err != nil {
-		h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error reading login message")
-		h.c.Close()
+		h.s.log.Error().Err(err).Str("event", LOGIN_IDENTITY_MISMATCH).EmbedObject(h).EmbedObject(ser).Msg("login serial does not match client certificate, will close")
+		h.reject(login)
 		return
 	}
-	_ = h.c.SetReadDeadline(time.Time{})
-	if msg.Protocol == simplejson.LOGIN {
-		loginMessage := simplejson.LoginMessage{}
-		err = json.Unmarshal(msg.Payload, &loginMessage)
-		if err != nil {
-			h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error parsing login message")
-			h.c.Close()
+	dev, ok := h.s.device_list.deviceNsn(ser.Nsn())
+	if ok && !dev.Deleted {
+		if !h.accept(login) {
 			return
 		}
-		sn, err := strconv.ParseUint(loginMessage.Serial, 16, 64)
-		if err != nil {
-			h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error parsing serial number")
+		h.s.log.Trace().EmbedObject(h).Msgf("replacing older connection for %s", ser.SnString())
+		//s.mu is not held while the device take the connection, it may need next_cid
+		if !h.s.begin_login() {
 			h.c.Close()
 			return
 		}
-		var sn_type int
-		switch loginMessage.SnType {
-		case "mac":
-			sn_type = 1
-		case "aid":
-			sn_type = 2
-		default:
-			sn_type = 5
-		}
-		ser := device.NewSerial(sn_type, sn)
-		h.s.log.Info().Str("event", LOGIN_MESSAGE).EmbedObject(h).EmbedObject(ser).Msg("")
-		dev, ok := h.s.device_list.deviceNsn(ser.Nsn())
-		if ok && !dev.Deleted {
-			h.s.log.Trace().EmbedObject(h).Msgf("replacing older connection for %d", sn)
-			dev.Dev.ReplaceConn(h.c)
+		defer h.s.logins.Done()
+		if r, ok := login.(protocol.Reconnector); ok {
+			r.Reconnect(dev.Dev, h.c)
 		} else {
-			tid, conf_attr, err := h.s.register_and_fetch_config_attr("simplejson", ser.Nsn())
-			if err != nil {
-				h.c.Close()
-				return
-			}
-			if !conf_attr.Config.AllowConnect {
-				h.s.log.Info().Str("event", ALLOW_CONNECT_FALSE).EmbedObject(h).EmbedObject(ser).Msg("device not alloweed to connect")
-				h.c.Close()
-				return
-			}
-			h.s.log.Info().Str("event", NEW_DEVICE_CREATED).EmbedObject(h).EmbedObject(ser).Msg("new device")
-			var logger = log.DefaultLogger
-			logger.Level = log.ParseLevel(conf_attr.Config.LogLevel)
-			s, _ := h.s.sublist.GetSublist(tid, true)
-			dev := simplejson.NewSimpleJSON(h.c, h.s.store, logger, &loginMessage, s, conf_attr.Config)
-			dev.Run()
-			h.s.device_list.addDevice(ser, tid, dev, device.DEVICE_GT06)
+			dev.Dev.ReplaceConn(h.c)
 		}
-	} else {
-		h.s.log.Error().EmbedObject(h).Str("event", LOGIN_MESSAGE_ERROR).Msgf("message type is not login,type : %x", msg.Protocol)
+		return
+	}
+	tid, conf_attr, err := h.s.register_and_fetch_config_attr(proto.Name, ser.Nsn())
+	if err != nil {
+		h.reject(login)
+		return
+	}
+	if !conf_attr.Config.AllowConnect {
+		h.s.log.Info().Str("event", ALLOW_CONNECT_FALSE).EmbedObject(h).EmbedObject(ser).Msg("device not allowed to connect")
+		h.reject(login)
+		return
+	}
+	if !h.accept(login) {
+		return
+	}
+	h.s.log.Info().Str("event", NEW_DEVICE_CREATED).EmbedObject(h).EmbedObject(ser).Msg("new device")
+	var logger = log.DefaultLogger
+	logger.Level = log.ParseLevel(conf_attr.Config.LogLevel)
+	param := protocol.Param{Bus: h.s.bus, Logger: logger, MiscStore: h.s.misc_store, CommandStore: h.s.command_store, Geolocator: h.s.geolocator, Running: &h.s.running}
+	d := login.NewDevice(tid, h.c, &param, conf_attr)
+	if !h.s.begin_login() {
 		h.c.Close()
 		return
 	}
+	defer h.s.logins.Done()
+	d.Run()
+	h.s.device_list.addDevice(ser, tid, d, proto.Name)
+}
+
+// accept acknowledge the login of protocol deferring it to the server, the connection is
+// closed when the acknowledge can not be sent
+func (h *LoginHandler) accept(login protocol.Login) bool {
+	a, ok := login.(protocol.Acceptor)
+	if !ok {
+		return true
+	}
+	err := a.Accept(h.c, true)
+	if err != nil {
+		h.s.log.Error().Err(err).Str("event", LOGIN_MESSAGE_ERROR).EmbedObject(h).Msg("error sending login acknowledge")
+		h.c.Close()
+		return false
+	}
+	return true
+}
+
+// reject tell the device its login is refused when its protocol has a way to, then close
+func (h *LoginHandler) reject(login protocol.Login) {
+	if a, ok := login.(protocol.Acceptor); ok {
+		_ = a.Accept(h.c, false)
+	}
+	h.c.Close()
+}
+
+// detect try registered protocols against what is already buffered, only blocking
+// for more data when no protocol matched with the buffered head
+func (h *LoginHandler) detect() (*protocol.Protocol, []byte, bool) {
+	max := protocol.MaxPeekLen()
+	n := h.c.Buffered()
+	if n > max {
+		n = max
+	}
+	head, _ := h.c.Peek(n)
+	proto, ok := protocol.Detect(head)
+	if ok || n == max {
+		return proto, head, ok
+	}
+	head, _ = h.c.Peek(max)
+	proto, ok = protocol.Detect(head)
+	return proto, head, ok
+}
+
+func (h *LoginHandler) MarshalObject(e *log.Entry) {
+	e.EmbedObject(h.c).Str("device_type", h.device_type)
 }
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+type fakeDevice struct {
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (d *fakeDevice) Run()                         {}
+func (d *fakeDevice) ReplaceConn(c *conn.Conn)     {}
+func (d *fakeDevice) CurrentConnInfo() []string    { return nil }
+func (d *fakeDevice) GetLocation() device.Location { return device.Location{} }
+func (d *fakeDevice) Stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+}
+
+func (d *fakeDevice) is_stopped() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopped
+}
+
+func testServer() (*Server, *[]uint64) {
+	bus := eventbus.NewEventBus()
+	var mu sync.Mutex
+	shutdown := make([]uint64, 0)
+	bus.SubscribeEvent(func(e *eventbus.Event) {
+		if e.Topic == SERVER_SHUTDOWN {
+			mu.Lock()
+			shutdown = append(shutdown, e.TrackerId)
+			mu.Unlock()
+		}
+	})
+	return NewServer(nil, bus, nil, nil, nil, &ServerConfig{}), &shutdown
+}
+
+// TestShutdownDeadline stop every device even once ctx is done, the read loop of a
+// device never exiting only cut the wait short
+func TestShutdownDeadline(t *testing.T) {
+	s, shutdown := testServer()
+	devs := make([]*fakeDevice, 3)
+	for i := range devs {
+		devs[i] = &fakeDevice{}
+		s.device_list.list[uint64(i+1)] = Device{Dev: devs[i], TrackerId: uint64(i + 1)}
+	}
+	s.running.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Shutdown(ctx); err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	for i, d := range devs {
+		if !d.is_stopped() {
+			t.Fatalf("device %d not stopped", i+1)
+		}
+	}
+	if len(*shutdown) != 3 {
+		t.Fatalf("server_shutdown recorded for %v", *shutdown)
+	}
+}
+
+// TestShutdownLogin stop the device of a login in progress and refuse login afterward
+func TestShutdownLogin(t *testing.T) {
+	s, _ := testServer()
+	if !s.begin_login() {
+		t.Fatal("login refused before shutdown")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(ctx)
+	}()
+	for {
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if closing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s.begin_login() {
+		t.Fatal("login accepted during shutdown")
+	}
+	//next_cid is not blocked while a login hand its connection over
+	s.next_cid()
+	d := &fakeDevice{}
+	s.device_list.mu.Lock()
+	s.device_list.list[1] = Device{Dev: d, TrackerId: 1}
+	s.device_list.mu.Unlock()
+	s.logins.Done()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !d.is_stopped() {
+		t.Fatal("device of the login in progress not stopped")
+	}
+}
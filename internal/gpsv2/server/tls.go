@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+const (
+	LOGIN_IDENTITY_MISMATCH string = "login_identity_mismatch"
+)
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.TlsCertFile, s.config.TlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.config.TlsClientCAFile != "" {
+		pem, err := os.ReadFile(s.config.TlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", s.config.TlsClientCAFile)
+		}
+		conf.ClientCAs = pool
+		if s.config.TlsRequireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return conf, nil
+}
+
+// runTlsListener accept tls connection, handshake happen on the first read done by
+// the login handler so a slow client does not block the accept loop
+func (s *Server) runTlsListener() {
+	s.log.Info().Msgf("starting tls listener on %s", s.config.TlsListenerAddr)
+	conf, err := s.tlsConfig()
+	if err != nil {
+		s.log.Error().Err(err).Msg("unable to load tls config")
+		return
+	}
+	ln, err := tls.Listen("tcp", s.config.TlsListenerAddr, conf)
+	if err != nil {
+		s.log.Error().Err(err).Msg("unable to listen")
+		return
+	}
+	s.mu.Lock()
+	s.tls_listener = ln
+	s.mu.Unlock()
+
+	for {
+		_c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.log.Info().Msg("tls listener closed")
+			return
+		}
+		if err != nil {
+			s.log.Error().Err(err).Msg("failed to accept new connection")
+			ln.Close()
+			return
+		}
+		cid := s.next_cid()
+		c := conn.NewConn(_c, cid)
+		s.log.Info().Str("event", string(NEW_CONNECTION)).EmbedObject(c).Uint64("cid", cid).Str("network", "tls").Msg("")
+		h := s.NewLoginHandler(c)
+		go h.handle()
+	}
+}
+
+// verifyIdentity check the serial claimed in the login message against the client
+// certificate, whose subject common name must be formatted as `<sn_type>:<sn>`.
+// Connection without client certificate are not checked
+func verifyIdentity(c *conn.Conn, ser device.Serial) error {
+	cert := c.PeerCertificate()
+	if cert == nil {
+		return nil
+	}
+	cert_ser, err := device.ParseSerial(cert.Subject.CommonName)
+	if err != nil {
+		return fmt.Errorf("invalid certificate subject : %w", err)
+	}
+	if cert_ser.Nsn() != ser.Nsn() {
+		return fmt.Errorf("certificate is issued to %s:%s", cert_ser.SnTypeString(), cert_ser.SnString())
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/conn"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+const (
+	UDP_SESSION_EXPIRED string = "udp_session_expired"
+
+	udp_default_idle_timeout = 5 * time.Minute
+	udp_session_queue        = 32
+	udp_max_datagram         = 65535
+)
+
+var errUnknownProtocol = errors.New("unknown protocol")
+
+// udpSession present datagrams from one source address as a stream so it can go through
+// the same login handler and device read loop as a tcp connection. codec is nil when the
+// protocol datagram carry its tcp frame as is
+type udpSession struct {
+	l       *udpListener
+	addr    net.Addr
+	codec   protocol.DatagramCodec
+	in      chan []byte
+	buf     []byte
+	closed  chan struct{}
+	once    sync.Once
+	dl_mu   sync.Mutex
+	dl      time.Time
+	last_rx int64
+}
+
+func (u *udpSession) Read(p []byte) (int, error) {
+	if len(u.buf) == 0 {
+		u.dl_mu.Lock()
+		dl := u.dl
+		u.dl_mu.Unlock()
+		var timeout <-chan time.Time
+		if !dl.IsZero() {
+			timer := time.NewTimer(time.Until(dl))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case d := <-u.in:
+			u.buf = d
+		case <-u.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+func (u *udpSession) Write(p []byte) (int, error) {
+	select {
+	case <-u.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if u.codec == nil {
+		return u.l.pc.WriteTo(p, u.addr)
+	}
+	d := u.codec.Encode(p)
+	if d != nil {
+		if _, err := u.l.pc.WriteTo(d, u.addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (u *udpSession) Close() error {
+	u.once.Do(func() {
+		close(u.closed)
+		u.l.remove(u)
+	})
+	return nil
+}
+
+func (u *udpSession) LocalAddr() net.Addr {
+	return u.l.pc.LocalAddr()
+}
+
+func (u *udpSession) RemoteAddr() net.Addr {
+	return u.addr
+}
+
+func (u *udpSession) SetDeadline(t time.Time) error {
+	return u.SetReadDeadline(t)
+}
+
+func (u *udpSession) SetReadDeadline(t time.Time) error {
+	u.dl_mu.Lock()
+	u.dl = t
+	u.dl_mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writing a datagram does not block
+func (u *udpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (u *udpSession) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&u.last_rx)))
+}
+
+type udpListener struct {
+	mu       sync.Mutex
+	pc       net.PacketConn
+	sessions map[string]*udpSession
+	closed   chan struct{}
+}
+
+// close stop reading datagram and close every session
+func (l *udpListener) close() {
+	l.mu.Lock()
+	select {
+	case <-l.closed:
+		l.mu.Unlock()
+		return
+	default:
+		close(l.closed)
+	}
+	sessions := make([]*udpSession, 0, len(l.sessions))
+	for _, u := range l.sessions {
+		sessions = append(sessions, u)
+	}
+	l.mu.Unlock()
+	l.pc.Close()
+	for _, u := range sessions {
+		u.Close()
+	}
+}
+
+func (l *udpListener) remove(u *udpSession) {
+	l.mu.Lock()
+	if l.sessions[u.addr.String()] == u {
+		delete(l.sessions, u.addr.String())
+	}
+	l.mu.Unlock()
+}
+
+// session return the established session of addr
+func (l *udpListener) session(addr net.Addr) (*udpSession, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u, ok := l.sessions[addr.String()]
+	return u, ok
+}
+
+// add register a session for addr, an existing session is kept and returned
+func (l *udpListener) add(u *udpSession) (*udpSession, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.sessions[u.addr.String()]; ok {
+		return v, false
+	}
+	l.sessions[u.addr.String()] = u
+	return u, true
+}
+
+func (l *udpListener) expire(now time.Time, timeout time.Duration) []*udpSession {
+	expired := []*udpSession{}
+	l.mu.Lock()
+	for _, u := range l.sessions {
+		if u.idle(now) > timeout {
+			expired = append(expired, u)
+		}
+	}
+	l.mu.Unlock()
+	return expired
+}
+
+func (s *Server) runUdpListener() {
+	s.log.Info().Msgf("starting udp listener on %s", s.config.UdpListenerAddr)
+	pc, err := net.ListenPacket("udp", s.config.UdpListenerAddr)
+	if err != nil {
+		s.log.Error().Err(err).Msg("unable to listen")
+		return
+	}
+	l := &udpListener{pc: pc, sessions: make(map[string]*udpSession), closed: make(chan struct{})}
+	s.mu.Lock()
+	s.udp_listener = l
+	s.mu.Unlock()
+
+	timeout := s.config.UdpIdleTimeout
+	if timeout == 0 {
+		timeout = udp_default_idle_timeout
+	}
+	go s.expireUdpSession(l, timeout)
+
+	buf := make([]byte, udp_max_datagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			s.log.Info().Msg("udp listener closed")
+			return
+		}
+		if err != nil {
+			s.log.Error().Err(err).Msg("failed to read datagram")
+			pc.Close()
+			return
+		}
+		d := buf[:n]
+		u, ok := l.session(addr)
+		if !ok {
+			u, d, err = s.newUdpSession(l, addr, d)
+			if err != nil {
+				s.log.Debug().Err(err).Str("remote", addr.String()).Hex("head", head(d)).Msg("datagram without login, dropping")
+				continue
+			}
+		} else if u.codec != nil {
+			d, err = u.codec.Decode(d)
+			if err != nil {
+				s.log.Warn().Err(err).Str("remote", addr.String()).Msg("invalid datagram, dropping")
+				continue
+			}
+		}
+		if u.codec == nil {
+			//buf is reused by the next read, the codec already return a new slice
+			d = append([]byte(nil), d...)
+		}
+		atomic.StoreInt64(&u.last_rx, time.Now().UnixNano())
+		select {
+		case u.in <- d:
+		default:
+			s.log.Warn().Str("remote", addr.String()).Msg("udp session queue full, dropping datagram")
+		}
+	}
+}
+
+// newUdpSession create the session of a source address once its first datagram carry a
+// login the protocol can parse, so stray datagram does not allocate a session. The login
+// is parsed again by the login handler of the session which also send its response
+func (s *Server) newUdpSession(l *udpListener, addr net.Addr, d []byte) (*udpSession, []byte, error) {
+	var codec protocol.DatagramCodec
+	if proto, ok := protocol.DetectDatagram(d); ok {
+		codec = proto.NewDatagramCodec()
+		var err error
+		d, err = codec.Decode(d)
+		if err != nil {
+			return nil, d, err
+		}
+	}
+	err := probeLogin(d, addr, l.pc.LocalAddr())
+	if err != nil {
+		return nil, d, err
+	}
+	u := &udpSession{l: l, addr: addr, codec: codec, in: make(chan []byte, udp_session_queue), closed: make(chan struct{})}
+	u, created := l.add(u)
+	if created {
+		c := conn.NewConn(u, s.next_cid())
+		s.log.Info().Str("event", string(NEW_CONNECTION)).EmbedObject(c).Str("network", "udp").Msg("")
+		h := s.NewLoginHandler(c)
+		go h.handle()
+	}
+	return u, d, nil
+}
+
+// probeLogin run the login of the detected protocol against stream, what it writes is discarded
+func probeLogin(stream []byte, remote net.Addr, local net.Addr) error {
+	proto, ok := protocol.Detect(head(stream))
+	if !ok {
+		return errUnknownProtocol
+	}
+	_, err := proto.Login(conn.NewConn(&probeConn{Reader: bytes.NewReader(stream), remote: remote, local: local}, 0))
+	return err
+}
+
+func head(d []byte) []byte {
+	n := protocol.MaxPeekLen()
+	if n > len(d) {
+		n = len(d)
+	}
+	return d[:n]
+}
+
+// probeConn read a single datagram and discard what is written
+type probeConn struct {
+	*bytes.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (p *probeConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (p *probeConn) Close() error                       { return nil }
+func (p *probeConn) LocalAddr() net.Addr                { return p.local }
+func (p *probeConn) RemoteAddr() net.Addr               { return p.remote }
+func (p *probeConn) SetDeadline(t time.Time) error      { return nil }
+func (p *probeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *probeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// expireUdpSession close session which has not received any datagram for timeout,
+// closing the session end the device read loop the same way a dropped tcp connection does
+func (s *Server) expireUdpSession(l *udpListener, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, u := range l.expire(now, timeout) {
+				s.log.Info().Str("event", UDP_SESSION_EXPIRED).Str("remote", u.addr.String()).Msg("")
+				u.Close()
+			}
+		case <-l.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/h02"
+	_ "nuha.dev/gpstracker/internal/gpsv2/device/teltonika"
+	"nuha.dev/gpstracker/internal/gpsv2/protocol"
+)
+
+func TestProbeLogin(t *testing.T) {
+	teltonika, _ := hex.DecodeString("003DCAFE0105000F33353230393330383634303336353508010000016B4F815B30010000000000000000000000000000000103021503010101425DBC000001")
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	cases := []struct {
+		name     string
+		datagram []byte
+		ok       bool
+	}{
+		{"teltonika", teltonika, true},
+		{"truncated teltonika", teltonika[:30], false},
+		{"h02", []byte("*HQ,4210051415,V1,164549,A,0956.3869,N,08406.7068,W,000.00,000,221215,FFFFFBFF#"), true},
+		{"truncated h02", []byte("*HQ,4210051415,V1,1645"), false},
+		{"garbage", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+		{"empty", []byte{}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := c.datagram
+			if proto, ok := protocol.DetectDatagram(d); ok {
+				var err error
+				d, err = proto.NewDatagramCodec().Decode(d)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := probeLogin(d, remote, local)
+			if c.ok && err != nil {
+				t.Fatalf("expected login, got %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
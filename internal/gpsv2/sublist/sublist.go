@@ -7,6 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
 	"nuha.dev/gpstracker/internal/gpsv2/subscriber"
 )
 
@@ -99,6 +101,24 @@ func (s *SublistMap) GetSublist(key uint64, create bool) (*Sublist, bool) {
 	}
 }
 
+// Attach subscribe the sublist of every tracker to the location and event sent live
+func (s *SublistMap) Attach(bus *eventbus.EventBus) {
+	bus.SubscribeLocation(func(l *eventbus.Location) {
+		if !l.Live {
+			return
+		}
+		sl, _ := s.GetSublist(l.TrackerId, true)
+		sl.SendLocation(l.Location, l.ServerTime)
+	})
+	bus.SubscribeEvent(func(e *eventbus.Event) {
+		if e.HistoryOnly {
+			return
+		}
+		sl, _ := s.GetSublist(e.TrackerId, true)
+		sl.SendEvent(e.Topic, e.Payload(), e.Time)
+	})
+}
+
 func (s *Sublist) Subscribe(sub subscriber.Subscriber) {
 	s.mu.Lock()
 	s.list[sub] = true
@@ -113,10 +133,10 @@ func (s *Sublist) Unsubscribe(sub subscriber.Subscriber) {
 	s.mu.Unlock()
 }
 
-func (s *Sublist) SendLocation(lat, lon float64, speed float32, gps_time, server_time time.Time) {
+func (s *Sublist) SendLocation(loc *device.Location, server_time time.Time) {
 
 	// obj := downstream_type{TrackerId: s.key, GpsTime: gps_time, ServerTime: server_time, Speed: speed, Latitude: lat, Longitude: lon}
-	s.data = encode_location(s.key, lat, lon, speed, gps_time, server_time)
+	s.data = encode_location(s.key, loc, server_time)
 	s.mu.Lock()
 	for sub := range s.list {
 		closed := sub.Push(s.key, s.data)
@@ -159,16 +179,18 @@ func encode_event(tracker_id uint64, topic string, message []byte, t time.Time)
 	return buf
 }
 
-func encode_location(tracker_id uint64, lat, lon float64, speed float32, gps_time, server_time time.Time) []byte {
-	buf := make([]byte, 39)
+// encode_location write the 39 bytes location frame followed by the optional field
+// extension, client reading only the first 39 bytes keep working
+func encode_location(tracker_id uint64, loc *device.Location, server_time time.Time) []byte {
+	buf := make([]byte, 39, 39+26)
 	buf[0] = 0x00
 	binary.LittleEndian.PutUint16(buf[1:], uint16(tracker_id))
-	binary.LittleEndian.PutUint64(buf[3:], math.Float64bits(lat))
-	binary.LittleEndian.PutUint64(buf[11:], math.Float64bits(lon))
-	binary.LittleEndian.PutUint32(buf[19:], math.Float32bits(speed))
-	binary.LittleEndian.PutUint64(buf[23:], uint64(gps_time.UnixMilli()))
+	binary.LittleEndian.PutUint64(buf[3:], math.Float64bits(loc.Latitude))
+	binary.LittleEndian.PutUint64(buf[11:], math.Float64bits(loc.Longitude))
+	binary.LittleEndian.PutUint32(buf[19:], math.Float32bits(loc.Speed))
+	binary.LittleEndian.PutUint64(buf[23:], uint64(loc.Timestamp.UnixMilli()))
 	binary.LittleEndian.PutUint64(buf[31:], uint64(server_time.UnixMilli()))
-	return buf
+	return loc.AppendExtension(buf)
 }
 
 // type downstream_type struct {
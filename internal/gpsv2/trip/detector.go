@@ -0,0 +1,70 @@
+package trip
+
+import (
+	"sync"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// Detector segment live location of a connected tracker, completed trip and stop are
+// persisted and trip start and end are published as event. The trip in progress is
+// lost when the server restart, it can be recovered by rebuilding trip from history
+type Detector struct {
+	mu    sync.Mutex
+	seg   *Segmenter
+	tid   uint64
+	store store.TripStore
+	bus   *eventbus.EventBus
+}
+
+// NewDetector return nil when st is nil, trip detection is then disabled
+func NewDetector(tid uint64, st store.TripStore, bus *eventbus.EventBus, conf *device.DeviceConfig) *Detector {
+	if st == nil {
+		return nil
+	}
+	return &Detector{seg: NewSegmenter(tid, conf), tid: tid, store: st, bus: bus}
+}
+
+// Push feed an accepted location received at t
+func (d *Detector) Push(loc *device.Location, t time.Time) {
+	d.mu.Lock()
+	done, started := d.seg.Push(loc)
+	cur, _ := d.seg.Current()
+	d.mu.Unlock()
+	for i := range done {
+		d.store.SaveSegment(&done[i])
+		if done[i].Kind == store.SEGMENT_TRIP {
+			d.send_event("trip.ended", done[i], t)
+		}
+	}
+	if started {
+		d.send_event("trip.started", cur, t)
+	}
+}
+
+func (d *Detector) send_event(topic string, seg store.Segment, t time.Time) {
+	d.bus.PublishEvent(&eventbus.Event{TrackerId: d.tid, Topic: topic, Data: seg, Time: t})
+}
+
+// Subscribe run a Detector for every tracker publishing location on bus, location
+// tagged invalid is ignored
+func Subscribe(bus *eventbus.EventBus, st store.TripStore) {
+	var mu sync.Mutex
+	detectors := make(map[uint64]*Detector)
+	bus.SubscribeLocation(func(l *eventbus.Location) {
+		if !l.Location.IsValid() {
+			return
+		}
+		mu.Lock()
+		d, ok := detectors[l.TrackerId]
+		if !ok {
+			d = NewDetector(l.TrackerId, st, bus, l.Config)
+			detectors[l.TrackerId] = d
+		}
+		mu.Unlock()
+		d.Push(l.Location, l.ServerTime)
+	})
+}
@@ -0,0 +1,182 @@
+package trip
+
+import (
+	"math"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const (
+	default_min_speed     float64 = 1.5 //m/s
+	default_stop_duration int     = 300
+	default_min_distance  float64 = 300 //meter
+	//dwell after which a tracker reporting acc off is stopped
+	acc_off_duration int = 60
+)
+
+// Segmenter split time ordered location of one tracker into trip and stop.
+// A tracker is moving when its speed reach the min speed while acc is on or unknown,
+// a trip end once the tracker has not moved for the stop duration, or a shorter while
+// with acc off. Trip shorter than the min distance is gps drift and is merged into the stop around it
+type Segmenter struct {
+	tid  uint64
+	conf *device.DeviceConfig
+
+	last     device.Location
+	has_last bool
+
+	//current stop, start is zero until the first trip end
+	stop store.Segment
+
+	in_trip   bool
+	confirmed bool
+	trip      store.Segment
+	//first location of the tracker standing still during a trip
+	still      device.Location
+	still_dist float64
+	has_still  bool
+}
+
+func NewSegmenter(tid uint64, conf *device.DeviceConfig) *Segmenter {
+	return &Segmenter{tid: tid, conf: conf}
+}
+
+// Push feed the next location, location not newer than the previous one is ignored.
+// It return the trip and stop completed by loc and whether loc confirmed the start of a trip
+func (s *Segmenter) Push(loc *device.Location) ([]store.Segment, bool) {
+	if s.has_last && !loc.Timestamp.After(s.last.Timestamp) {
+		return nil, false
+	}
+	if !s.has_last {
+		s.last = *loc
+		s.has_last = true
+		if s.moving(loc) {
+			s.start_trip(loc)
+		}
+		return nil, false
+	}
+	var done []store.Segment
+	started := false
+	d := device.Distance(s.last.Latitude, s.last.Longitude, loc.Latitude, loc.Longitude)
+	moving := s.moving(loc)
+	if s.in_trip && loc.Timestamp.Sub(s.last.Timestamp) >= s.stop_duration(false) {
+		//tracker went silent long enough to have stopped at its last location
+		if !s.has_still {
+			s.mark_still(&s.last)
+		}
+		done = s.end_trip(done)
+	}
+	if !s.in_trip && moving {
+		start := loc
+		//movement started from the last location when it is recent enough
+		if loc.Timestamp.Sub(s.last.Timestamp) < s.stop_duration(false) {
+			start = &s.last
+		}
+		s.start_trip(start)
+		if start != loc {
+			s.trip.Distance += d
+			s.trip.MaxSpeed = float32(math.Max(float64(s.trip.MaxSpeed), float64(loc.Speed)))
+		}
+	} else if s.in_trip {
+		if moving && !s.confirmed && s.has_still {
+			//the unconfirmed movement was drift, the trip start where the tracker stood
+			s.start_trip(&s.last)
+		}
+		s.trip.Distance += d
+		if moving {
+			s.trip.MaxSpeed = float32(math.Max(float64(s.trip.MaxSpeed), float64(loc.Speed)))
+			s.has_still = false
+		} else {
+			if !s.has_still {
+				s.mark_still(loc)
+			}
+			if loc.Timestamp.Sub(s.still.Timestamp) >= s.stop_duration(loc.ACC != nil && !*loc.ACC) {
+				done = s.end_trip(done)
+			}
+		}
+	}
+	if s.in_trip && !s.confirmed && s.trip.Distance >= s.min_distance() {
+		s.confirmed = true
+		started = true
+		if !s.stop.Start.IsZero() {
+			s.stop.End = s.trip.Start
+			s.stop.Duration = int64(s.stop.End.Sub(s.stop.Start).Seconds())
+			done = append(done, s.stop)
+		}
+	}
+	s.last = *loc
+	return done, started
+}
+
+// Current return the trip in progress once it is confirmed
+func (s *Segmenter) Current() (store.Segment, bool) {
+	if !s.in_trip || !s.confirmed {
+		return store.Segment{}, false
+	}
+	return s.trip, true
+}
+
+func (s *Segmenter) moving(loc *device.Location) bool {
+	if loc.ACC != nil && !*loc.ACC {
+		return false
+	}
+	min := s.conf.TripMinSpeed
+	if min == 0 {
+		min = default_min_speed
+	}
+	return float64(loc.Speed) >= min
+}
+
+func (s *Segmenter) stop_duration(acc_off bool) time.Duration {
+	dur := s.conf.TripStopDuration
+	if dur == 0 {
+		dur = default_stop_duration
+	}
+	if acc_off && acc_off_duration < dur {
+		dur = acc_off_duration
+	}
+	return time.Duration(dur) * time.Second
+}
+
+func (s *Segmenter) min_distance() float64 {
+	if s.conf.TripMinDistance == 0 {
+		return default_min_distance
+	}
+	return s.conf.TripMinDistance
+}
+
+func (s *Segmenter) start_trip(loc *device.Location) {
+	s.in_trip = true
+	s.confirmed = false
+	s.has_still = false
+	s.trip = store.Segment{TrackerId: s.tid, Kind: store.SEGMENT_TRIP, Start: loc.Timestamp, StartLat: loc.Latitude, StartLon: loc.Longitude, MaxSpeed: loc.Speed}
+}
+
+func (s *Segmenter) mark_still(loc *device.Location) {
+	s.still = *loc
+	s.still_dist = s.trip.Distance
+	s.has_still = true
+}
+
+// end_trip close the trip where the tracker started standing still, unconfirmed trip is
+// dropped and the stop before it carry on
+func (s *Segmenter) end_trip(done []store.Segment) []store.Segment {
+	s.in_trip = false
+	s.has_still = false
+	if !s.confirmed {
+		return done
+	}
+	t := s.trip
+	t.End = s.still.Timestamp
+	t.EndLat = s.still.Latitude
+	t.EndLon = s.still.Longitude
+	t.Distance = math.Round(s.still_dist)
+	t.Duration = int64(t.End.Sub(t.Start).Seconds())
+	if t.Duration > 0 {
+		t.AvgSpeed = float32(s.still_dist / float64(t.Duration))
+	}
+	s.stop = store.Segment{TrackerId: s.tid, Kind: store.SEGMENT_STOP, Start: t.End, StartLat: t.EndLat, StartLon: t.EndLon, EndLat: t.EndLat, EndLon: t.EndLon}
+	return append(done, t)
+}
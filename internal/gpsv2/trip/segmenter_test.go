@@ -0,0 +1,155 @@
+package trip
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+// step is a location sec after the start, north step of 0.001 degree (about 111.2 meter)
+// from the starting point. acc is "on", "off" or unknown when empty
+type step struct {
+	sec     int
+	north   int
+	speed   float32
+	acc     string
+	done    []string
+	started bool
+}
+
+func TestSegmenter(t *testing.T) {
+	cases := []struct {
+		name  string
+		conf  device.DeviceConfig
+		steps []step
+	}{
+		{"start and stop", device.DeviceConfig{}, []step{
+			{0, 0, 0, "", nil, false},
+			//trip start from the last location, confirmed after the min distance
+			{10, 1, 11, "", nil, false},
+			{20, 2, 11, "", nil, false},
+			{30, 3, 11, "", nil, true},
+			{40, 3, 0, "", nil, false},
+			{200, 3, 0, "", nil, false},
+			//ended where the tracker stood still once it stood for the stop duration
+			{340, 3, 0, "", []string{"trip 0-40"}, false},
+			{350, 4, 11, "", nil, false},
+			{360, 5, 11, "", nil, false},
+			{370, 6, 11, "", []string{"stop 40-340"}, true},
+		}},
+		{"drift", device.DeviceConfig{}, []step{
+			{0, 0, 0, "", nil, false},
+			{10, 1, 11, "", nil, false},
+			{20, 1, 0, "", nil, false},
+			//movement shorter than the min distance is not a trip
+			{320, 1, 0, "", nil, false},
+			{330, 2, 11, "", nil, false},
+			{340, 3, 11, "", nil, false},
+			{350, 4, 11, "", nil, true},
+		}},
+		{"acc off", device.DeviceConfig{}, []step{
+			{0, 0, 0, "", nil, false},
+			{10, 1, 11, "on", nil, false},
+			{20, 2, 11, "on", nil, false},
+			{30, 3, 11, "on", nil, true},
+			{40, 3, 0, "off", nil, false},
+			//acc off shorten the stop duration
+			{100, 3, 0, "off", []string{"trip 0-40"}, false},
+			//speed with acc off is not movement
+			{110, 4, 11, "off", nil, false},
+			{120, 5, 11, "off", nil, false},
+			{130, 6, 11, "off", nil, false},
+			{140, 7, 11, "off", nil, false},
+		}},
+		{"gap", device.DeviceConfig{}, []step{
+			{0, 0, 0, "", nil, false},
+			{10, 1, 11, "", nil, false},
+			{20, 2, 11, "", nil, false},
+			{30, 3, 11, "", nil, true},
+			//silent for the stop duration, stopped at the last location
+			{630, 3, 0, "", []string{"trip 0-30"}, false},
+			//movement after a gap start from the new location
+			{1000, 4, 11, "", nil, false},
+			{1010, 5, 11, "", nil, false},
+			{1020, 6, 11, "", nil, false},
+			{1030, 7, 11, "", []string{"stop 30-1000"}, true},
+		}},
+		{"gap while moving", device.DeviceConfig{}, []step{
+			{0, 0, 0, "", nil, false},
+			{10, 1, 11, "", nil, false},
+			{20, 2, 11, "", nil, false},
+			{30, 3, 11, "", nil, true},
+			{630, 4, 11, "", []string{"trip 0-30"}, false},
+			{640, 5, 11, "", nil, false},
+			{650, 6, 11, "", nil, false},
+			{660, 7, 11, "", []string{"stop 30-630"}, true},
+		}},
+		{"out of order", device.DeviceConfig{}, []step{
+			{0, 0, 0, "", nil, false},
+			{10, 1, 11, "", nil, false},
+			{5, 5, 11, "", nil, false},
+			{20, 2, 11, "", nil, false},
+			{30, 3, 11, "", nil, true},
+		}},
+		{"configured", device.DeviceConfig{TripMinSpeed: 20, TripMinDistance: 100, TripStopDuration: 30}, []step{
+			{0, 0, 0, "", nil, false},
+			{10, 1, 11, "", nil, false},
+			{20, 2, 25, "", nil, true},
+			{30, 2, 0, "", nil, false},
+			{60, 2, 0, "", []string{"trip 10-30"}, false},
+		}},
+	}
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		conf := c.conf
+		s := NewSegmenter(1, &conf)
+		for i, st := range c.steps {
+			loc := device.Location{Latitude: -6.2 + float64(st.north)*0.001, Longitude: 106.8, Speed: st.speed, Timestamp: start.Add(time.Duration(st.sec) * time.Second)}
+			if st.acc != "" {
+				acc := st.acc == "on"
+				loc.ACC = &acc
+			}
+			done, started := s.Push(&loc)
+			var got []string
+			for _, seg := range done {
+				got = append(got, fmt.Sprintf("%s %.0f-%.0f", seg.Kind, seg.Start.Sub(start).Seconds(), seg.End.Sub(start).Seconds()))
+			}
+			if !reflect.DeepEqual(got, st.done) || started != st.started {
+				t.Errorf("%s step %d : done %v started %v, expected %v %v", c.name, i, got, started, st.done, st.started)
+			}
+		}
+	}
+}
+
+func TestSegmenterTrip(t *testing.T) {
+	s := NewSegmenter(1, &device.DeviceConfig{})
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	speeds := []float32{0, 11, 15, 11, 0, 0}
+	secs := []int{0, 10, 20, 30, 40, 340}
+	north := []int{0, 1, 2, 3, 3, 3}
+	var trip []string
+	for i := range speeds {
+		loc := device.Location{Latitude: -6.2 + float64(north[i])*0.001, Longitude: 106.8, Speed: speeds[i], Timestamp: start.Add(time.Duration(secs[i]) * time.Second)}
+		done, _ := s.Push(&loc)
+		if i == 3 {
+			if cur, ok := s.Current(); !ok || !cur.Start.Equal(start) {
+				t.Fatalf("current %+v %v", cur, ok)
+			}
+		}
+		for _, seg := range done {
+			if seg.Distance < 333 || seg.Distance > 334 || seg.MaxSpeed != 15 || seg.Duration != 40 || seg.EndLat != loc.Latitude {
+				t.Fatalf("trip %+v", seg)
+			}
+			trip = append(trip, seg.Kind)
+		}
+	}
+	if len(trip) != 1 {
+		t.Fatalf("segments %v", trip)
+	}
+	if _, ok := s.Current(); ok {
+		t.Fatal("trip still in progress")
+	}
+}
@@ -0,0 +1,203 @@
+package usage
+
+import (
+	"sync"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const (
+	//distance from the last counted fix under which movement is gps jitter
+	min_distance float64 = 20
+	//acc state older than this is not trusted to still hold, the tracker was likely offline
+	max_acc_gap    = 30 * time.Minute
+	flush_interval = time.Minute
+)
+
+type day_usage struct {
+	distance float64
+	engine   time.Duration
+}
+
+// Meter accumulate odometer and engine hour of one tracker and persist them as daily
+// total. Distance come from the device odometer once it reported one, haversine between
+// validated fix otherwise. Engine hour is the time acc is on, measured in server time
+type Meter struct {
+	mu    sync.Mutex
+	tid   uint64
+	store store.UsageStore
+	zone  *time.Location
+
+	anchor     device.Location
+	has_anchor bool
+	device_odo *float64
+
+	acc      bool
+	acc_time time.Time
+
+	pending    map[time.Time]*day_usage
+	last_flush time.Time
+}
+
+// NewMeter return nil when st is nil, usage accounting is then disabled. Day boundary
+// follow the tracker timezone, server local time when it is not configured
+func NewMeter(tid uint64, st store.UsageStore, conf *device.DeviceConfig) *Meter {
+	if st == nil {
+		return nil
+	}
+	zone := time.Local
+	if conf.Timezone != "" {
+		if z, err := device.ParseTimezone(conf.Timezone); err == nil {
+			zone = z
+		}
+	}
+	return &Meter{tid: tid, store: st, zone: zone, pending: make(map[time.Time]*day_usage), last_flush: time.Now()}
+}
+
+// Location account an accepted location received at t, fix tagged invalid only count for acc
+func (m *Meter) Location(loc *device.Location, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if loc.ACC != nil {
+		m.set_acc(*loc.ACC, t)
+	}
+	//acc is still reported by a fix failing validation, its position is not
+	if loc.Valid != nil && !*loc.Valid {
+		m.flush_due(t)
+		return
+	}
+	if m.has_anchor && !loc.Timestamp.After(m.anchor.Timestamp) {
+		return
+	}
+	if loc.Odometer != nil {
+		if m.device_odo != nil && *loc.Odometer > *m.device_odo {
+			m.day(loc.Timestamp).distance += *loc.Odometer - *m.device_odo
+		} else if m.device_odo == nil && m.has_anchor {
+			//first report after fix without odometer, close the gap with haversine
+			if d := device.Distance(m.anchor.Latitude, m.anchor.Longitude, loc.Latitude, loc.Longitude); d >= min_distance {
+				m.day(loc.Timestamp).distance += d
+			}
+		}
+		//first report or odometer reset, count from there
+		odo := *loc.Odometer
+		m.device_odo = &odo
+		m.anchor = *loc
+		m.has_anchor = true
+	} else if !m.has_anchor {
+		m.anchor = *loc
+		m.has_anchor = true
+	} else if m.device_odo != nil {
+		//distance is counted by the next odometer report, only keep the anchor current
+		m.anchor = *loc
+	} else {
+		d := device.Distance(m.anchor.Latitude, m.anchor.Longitude, loc.Latitude, loc.Longitude)
+		if d >= min_distance {
+			m.day(loc.Timestamp).distance += d
+			m.anchor = *loc
+		}
+	}
+	m.flush_due(t)
+}
+
+// ACC account acc state reported at t by a status packet
+func (m *Meter) ACC(on bool, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set_acc(on, t)
+	m.flush_due(t)
+}
+
+func (m *Meter) set_acc(on bool, t time.Time) {
+	if !t.After(m.acc_time) {
+		return
+	}
+	if m.acc && t.Sub(m.acc_time) <= max_acc_gap {
+		from := m.acc_time
+		//split at midnight so each day get its own share
+		for from.Before(t) {
+			y, mo, d := from.In(m.zone).Date()
+			next := time.Date(y, mo, d+1, 0, 0, 0, 0, m.zone)
+			if next.After(t) {
+				next = t
+			}
+			m.day(from).engine += next.Sub(from)
+			from = next
+		}
+	}
+	m.acc = on
+	m.acc_time = t
+}
+
+func (m *Meter) day(t time.Time) *day_usage {
+	y, mo, d := t.In(m.zone).Date()
+	key := time.Date(y, mo, d, 0, 0, 0, 0, time.UTC)
+	u, ok := m.pending[key]
+	if !ok {
+		u = &day_usage{}
+		m.pending[key] = u
+	}
+	return u
+}
+
+func (m *Meter) flush_due(t time.Time) {
+	if len(m.pending) > 1 || t.Sub(m.last_flush) >= flush_interval {
+		m.flush(t)
+	}
+}
+
+func (m *Meter) flush(t time.Time) {
+	for day, u := range m.pending {
+		if u.distance > 0 || u.engine > 0 {
+			m.store.AddUsage(m.tid, day, u.distance, u.engine.Seconds())
+		}
+		delete(m.pending, day)
+	}
+	m.last_flush = t
+}
+
+// Flush persist usage not yet written, it is called when the device stop
+func (m *Meter) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flush(time.Now())
+}
+
+// Subscribe run a Meter for every tracker publishing location or status on bus, location
+// tagged invalid is ignored. Usage not yet written is flushed when the tracker disconnect
+// or the server shut down
+func Subscribe(bus *eventbus.EventBus, st store.UsageStore) {
+	var mu sync.Mutex
+	meters := make(map[uint64]*Meter)
+	meter := func(tid uint64, conf *device.DeviceConfig) *Meter {
+		mu.Lock()
+		defer mu.Unlock()
+		m, ok := meters[tid]
+		if !ok {
+			m = NewMeter(tid, st, conf)
+			meters[tid] = m
+		}
+		return m
+	}
+	bus.SubscribeLocation(func(l *eventbus.Location) {
+		if l.Location.IsValid() {
+			meter(l.TrackerId, l.Config).Location(l.Location, l.ServerTime)
+		}
+	})
+	bus.SubscribeStatus(func(s *eventbus.Status) {
+		meter(s.TrackerId, s.Config).ACC(s.ACC, s.Time)
+	})
+	bus.SubscribeEvent(func(e *eventbus.Event) {
+		if e.Topic != "disconnected" && e.Topic != "server_shutdown" {
+			return
+		}
+		mu.Lock()
+		m, ok := meters[e.TrackerId]
+		mu.Unlock()
+		if ok {
+			m.Flush()
+		}
+	})
+}
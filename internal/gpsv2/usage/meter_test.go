@@ -0,0 +1,113 @@
+package usage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+type fakeStore struct {
+	distance float64
+	engine   float64
+}
+
+func (s *fakeStore) AddUsage(tid uint64, day time.Time, distance float64, engine_seconds float64) {
+	s.distance += distance
+	s.engine += engine_seconds
+}
+
+// fix is a location step north of a starting point, 0.001 degree is about 111.2 meter
+type fix struct {
+	step     int
+	odometer float64
+	invalid  bool
+	null     bool
+}
+
+func TestMeterDistance(t *testing.T) {
+	const step = 111.195
+	cases := []struct {
+		name     string
+		fixes    []fix
+		distance float64
+	}{
+		{"odometer only", []fix{{0, 1000, false, false}, {1, 1500, false, false}, {2, 2300, false, false}}, 1300},
+		{"odometer reset", []fix{{0, 5000, false, false}, {1, 100, false, false}, {2, 300, false, false}}, 200},
+		{"haversine only", []fix{{0, 0, false, false}, {1, 0, false, false}, {2, 0, false, false}, {3, 0, false, false}}, 3 * step},
+		{"jitter", []fix{{0, 0, false, false}, {0, 0, false, false}, {0, 0, false, false}}, 0},
+		{"mixed", []fix{{0, 1000, false, false}, {1, 0, false, false}, {2, 0, false, false}, {3, 1200, false, false}, {4, 0, false, false}}, 200},
+		{"haversine then odometer", []fix{{0, 0, false, false}, {1, 0, false, false}, {2, 5000, false, false}, {3, 5100, false, false}}, 2*step + 100},
+		{"invalid fix", []fix{{0, 0, false, false}, {0, 0, true, true}, {1, 0, false, false}, {2, 0, true, false}, {3, 0, false, false}}, 3 * step},
+		{"invalid odometer", []fix{{0, 1000, false, false}, {1, 900000, true, false}, {2, 1300, false, false}}, 300},
+	}
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		st := &fakeStore{}
+		m := NewMeter(1, st, &device.DeviceConfig{Timezone: "UTC"})
+		for i, f := range c.fixes {
+			loc := device.Location{Latitude: -6.2 + float64(f.step)*0.001, Longitude: 106.8, Timestamp: start.Add(time.Duration(i) * time.Minute)}
+			if f.null {
+				loc.Latitude, loc.Longitude = 0, 0
+			}
+			if f.odometer != 0 {
+				odo := f.odometer
+				loc.Odometer = &odo
+			}
+			if f.invalid {
+				valid := false
+				loc.Valid = &valid
+			}
+			m.Location(&loc, loc.Timestamp)
+		}
+		m.Flush()
+		if math.Abs(st.distance-c.distance) > 0.5 {
+			t.Errorf("%s : distance %.1f, expected %.1f", c.name, st.distance, c.distance)
+		}
+	}
+}
+
+func TestMeterEngine(t *testing.T) {
+	st := &fakeStore{}
+	m := NewMeter(1, st, &device.DeviceConfig{Timezone: "UTC"})
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	m.ACC(true, start)
+	m.ACC(true, start.Add(10*time.Minute))
+	//acc of an invalid fix still count
+	on, valid := true, false
+	m.Location(&device.Location{Timestamp: start, ACC: &on, Valid: &valid}, start.Add(20*time.Minute))
+	m.ACC(false, start.Add(25*time.Minute))
+	//acc on after a gap longer than max_acc_gap is not counted
+	m.ACC(true, start.Add(30*time.Minute))
+	m.ACC(false, start.Add(90*time.Minute))
+	m.Flush()
+	if st.engine != 25*60 {
+		t.Fatalf("engine %.0f second, expected %d", st.engine, 25*60)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	st := &fakeStore{}
+	bus := eventbus.NewEventBus()
+	Subscribe(bus, st)
+	conf := &device.DeviceConfig{Timezone: "UTC"}
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	invalid := false
+	odo := []float64{1000, 1200, 900000, 1500}
+	for i, o := range odo {
+		o := o
+		loc := device.Location{Latitude: -6.2, Longitude: 106.8, Timestamp: start.Add(time.Duration(i) * time.Minute), Odometer: &o}
+		if o == 900000 {
+			loc.Valid = &invalid
+		}
+		bus.PublishLocation(&eventbus.Location{TrackerId: 3, Location: &loc, ServerTime: loc.Timestamp, Config: conf})
+	}
+	bus.PublishStatus(&eventbus.Status{TrackerId: 3, ACC: true, Time: start, Config: conf})
+	bus.PublishStatus(&eventbus.Status{TrackerId: 3, ACC: false, Time: start.Add(10 * time.Minute), Config: conf})
+	bus.PublishEvent(&eventbus.Event{TrackerId: 3, Topic: "disconnected", Time: start.Add(10 * time.Minute)})
+	if st.distance != 500 || st.engine != 600 {
+		t.Fatalf("distance %.0f engine %.0f", st.distance, st.engine)
+	}
+}
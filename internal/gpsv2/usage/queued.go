@@ -0,0 +1,26 @@
+package usage
+
+import (
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+type queued_store struct {
+	st store.UsageStore
+	w  *eventbus.Worker
+}
+
+// Queued return st writing through w, meter are flushed by a bus subscriber running on
+// the device read loop which must not wait for the database. Daily total is not dropped
+// when w is full
+func Queued(st store.UsageStore, w *eventbus.Worker) store.UsageStore {
+	return &queued_store{st: st, w: w}
+}
+
+func (q *queued_store) AddUsage(tid uint64, day time.Time, distance float64, engine_seconds float64) {
+	q.w.SubmitWait(func() {
+		q.st.AddUsage(tid, day, distance, engine_seconds)
+	})
+}
@@ -0,0 +1,383 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+const (
+	TYPE_LOCATION string = "location"
+	TYPE_EVENT    string = "event"
+)
+
+// header of every delivery, the signature is only sent when the webhook has a secret
+const (
+	HEADER_WEBHOOK   string = "X-Webhook-Id"
+	HEADER_TIMESTAMP string = "X-Webhook-Timestamp"
+	HEADER_SIGNATURE string = "X-Webhook-Signature"
+)
+
+// delivery outcome of every webhook
+var deliveries = expvar.NewMap("webhook_delivery")
+
+type DispatcherConfig struct {
+	//concurrent delivery, default 4
+	Workers int
+	//delivery waiting for a worker, observation beyond it are dropped, default 1000
+	QueueSize int
+	//attempt before a delivery is dead lettered, default 8
+	MaxAttempts int
+	//wait before the first retry, doubled on every retry up to RetryMax, default 1 second and 5 minute
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	//webhook edited through the api are picked up after this long, default 1 minute
+	ReloadInterval time.Duration
+	//default client has a 10 second timeout
+	Client *http.Client
+}
+
+// Payload is the json body posted to the webhook, Time is the server time of a location
+type Payload struct {
+	Type      string           `json:"type"`
+	TrackerId uint64           `json:"tracker_id"`
+	Topic     string           `json:"topic,omitempty"`
+	Time      time.Time        `json:"time"`
+	Location  *device.Location `json:"location,omitempty"`
+	Message   json.RawMessage  `json:"message,omitempty"`
+}
+
+// Dispatcher post location and event published on the bus to the subscribed webhook, event only
+// kept in history are not delivered. Delivery failing with a
+// network error, 408, 429 or 5xx is retried with exponential backoff, other failure and delivery
+// out of attempt are written to the dead letter store. Delivery order is not guaranteed
+type Dispatcher struct {
+	store  store.WebhookStore
+	log    log.Logger
+	config *DispatcherConfig
+
+	mu      sync.Mutex
+	hooks   []*hook
+	pending map[*delivery]*time.Timer
+	closed  bool
+	queue   chan *delivery
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type hook struct {
+	store.Webhook
+	events   map[string]bool
+	prefixes []string
+	trackers map[uint64]bool
+}
+
+type delivery struct {
+	hook        *hook
+	body        []byte
+	attempts    int
+	last_status int
+	last_err    string
+}
+
+// NewDispatcher subscribe the dispatcher to bus
+func NewDispatcher(st store.WebhookStore, bus *eventbus.EventBus, config *DispatcherConfig) *Dispatcher {
+	d := &Dispatcher{store: st, config: config}
+	if d.config.Workers == 0 {
+		d.config.Workers = 4
+	}
+	if d.config.QueueSize == 0 {
+		d.config.QueueSize = 1000
+	}
+	if d.config.MaxAttempts == 0 {
+		d.config.MaxAttempts = 8
+	}
+	if d.config.RetryBase == 0 {
+		d.config.RetryBase = time.Second
+	}
+	if d.config.RetryMax == 0 {
+		d.config.RetryMax = 5 * time.Minute
+	}
+	if d.config.ReloadInterval == 0 {
+		d.config.ReloadInterval = time.Minute
+	}
+	if d.config.Client == nil {
+		d.config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	d.log = log.DefaultLogger
+	d.log.Context = log.NewContext(nil).Str("module", "webhook").Value()
+	d.pending = make(map[*delivery]*time.Timer)
+	d.queue = make(chan *delivery, d.config.QueueSize)
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	bus.SubscribeLocation(d.handle_location)
+	bus.SubscribeEvent(d.handle_event)
+	return d
+}
+
+func (d *Dispatcher) Run() {
+	d.log.Info().Msg("starting webhook dispatcher")
+	defer close(d.done)
+	d.reload()
+	var wg sync.WaitGroup
+	for i := 0; i < d.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work()
+		}()
+	}
+	reload := time.NewTicker(d.config.ReloadInterval)
+	defer reload.Stop()
+loop:
+	for {
+		select {
+		case <-reload.C:
+			d.reload()
+		case <-d.stop:
+			break loop
+		}
+	}
+	wg.Wait()
+	//nothing is queued or scheduled once closed, what is left is kept as dead letter
+	d.mu.Lock()
+	left := make([]*delivery, 0, len(d.pending)+len(d.queue))
+	for dl, timer := range d.pending {
+		if timer.Stop() {
+			left = append(left, dl)
+		}
+	}
+	d.pending = nil
+	for len(d.queue) > 0 {
+		left = append(left, <-d.queue)
+	}
+	d.mu.Unlock()
+	for _, dl := range left {
+		if dl.last_err == "" {
+			dl.last_err = "dispatcher shutdown"
+		}
+		d.dead_letter(dl)
+	}
+}
+
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	close(d.stop)
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reload keep the previous webhooks when loading fail
+func (d *Dispatcher) reload() {
+	webhooks, err := d.store.Webhooks()
+	if err != nil {
+		d.log.Error().Err(err).Msg("error loading webhook")
+		return
+	}
+	hooks := make([]*hook, 0, len(webhooks))
+	for _, w := range webhooks {
+		h := &hook{Webhook: w, events: make(map[string]bool)}
+		for _, e := range w.Events {
+			if strings.HasSuffix(e, "*") {
+				h.prefixes = append(h.prefixes, strings.TrimSuffix(e, "*"))
+			} else {
+				h.events[e] = true
+			}
+		}
+		if len(w.Trackers) > 0 {
+			h.trackers = make(map[uint64]bool, len(w.Trackers))
+			for _, tid := range w.Trackers {
+				h.trackers[tid] = true
+			}
+		}
+		hooks = append(hooks, h)
+	}
+	d.mu.Lock()
+	d.hooks = hooks
+	d.mu.Unlock()
+}
+
+func (h *hook) match(tid uint64, topic string) bool {
+	if h.trackers != nil && !h.trackers[tid] {
+		return false
+	}
+	if len(h.Events) == 0 || h.events[topic] {
+		return true
+	}
+	for _, p := range h.prefixes {
+		if strings.HasPrefix(topic, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dispatcher) handle_location(l *eventbus.Location) {
+	d.dispatch(l.TrackerId, TYPE_LOCATION, &Payload{Type: TYPE_LOCATION, TrackerId: l.TrackerId, Time: l.ServerTime, Location: l.Location})
+}
+
+func (d *Dispatcher) handle_event(e *eventbus.Event) {
+	if e.HistoryOnly {
+		return
+	}
+	p := &Payload{Type: TYPE_EVENT, TrackerId: e.TrackerId, Topic: e.Topic, Time: e.Time}
+	if e.Data != nil {
+		p.Message = e.Payload()
+	}
+	d.dispatch(e.TrackerId, e.Topic, p)
+}
+
+// dispatch queue the payload for every matching webhook without blocking the device
+func (d *Dispatcher) dispatch(tid uint64, topic string, p *Payload) {
+	var body []byte
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	for _, h := range d.hooks {
+		if !h.match(tid, topic) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(p)
+			if err != nil {
+				d.log.Error().Err(err).Uint64("tid", tid).Msg("error encoding webhook payload")
+				return
+			}
+		}
+		select {
+		case d.queue <- &delivery{hook: h, body: body}:
+		default:
+			deliveries.Add("dropped", 1)
+			d.log.Warn().Uint64("webhook_id", h.Id).Uint64("tid", tid).Str("topic", topic).Msg("webhook queue full, dropping")
+		}
+	}
+}
+
+func (d *Dispatcher) work() {
+	for {
+		select {
+		case dl := <-d.queue:
+			d.deliver(dl)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(dl *delivery) {
+	dl.attempts++
+	status, err := d.post(dl)
+	dl.last_status = status
+	if err == nil && status >= 200 && status < 300 {
+		deliveries.Add("delivered", 1)
+		return
+	}
+	if err != nil {
+		dl.last_err = err.Error()
+	} else {
+		dl.last_err = http.StatusText(status)
+	}
+	retry := err != nil || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	if !retry || dl.attempts >= d.config.MaxAttempts {
+		d.dead_letter(dl)
+		return
+	}
+	wait := d.config.RetryBase << (dl.attempts - 1)
+	if wait > d.config.RetryMax || wait <= 0 {
+		wait = d.config.RetryMax
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		d.dead_letter(dl)
+		return
+	}
+	deliveries.Add("retried", 1)
+	d.pending[dl] = time.AfterFunc(wait, func() { d.requeue(dl) })
+	d.mu.Unlock()
+}
+
+// requeue is called by the retry timer, enqueueing under the lock so shutdown either see
+// the delivery in the queue or the timer still pending
+func (d *Dispatcher) requeue(dl *delivery) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		d.dead_letter(dl)
+		return
+	}
+	delete(d.pending, dl)
+	select {
+	case d.queue <- dl:
+		d.mu.Unlock()
+	default:
+		d.mu.Unlock()
+		dl.last_err = "webhook queue full"
+		d.dead_letter(dl)
+	}
+}
+
+func (d *Dispatcher) post(dl *delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, dl.hook.Url, bytes.NewReader(dl.body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_WEBHOOK, strconv.FormatUint(dl.hook.Id, 10))
+	req.Header.Set(HEADER_TIMESTAMP, ts)
+	if dl.hook.Secret != "" {
+		req.Header.Set(HEADER_SIGNATURE, Sign(dl.hook.Secret, ts, dl.body))
+	}
+	res, err := d.config.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func (d *Dispatcher) dead_letter(dl *delivery) {
+	deliveries.Add("dead", 1)
+	d.log.Warn().Uint64("webhook_id", dl.hook.Id).Int("attempts", dl.attempts).Str("error", dl.last_err).Msg("webhook delivery failed")
+	err := d.store.SaveDeadLetter(&store.WebhookDeadLetter{WebhookId: dl.hook.Id, Payload: dl.body, Attempts: dl.attempts,
+		LastStatus: dl.last_status, LastError: dl.last_err, FailedAt: time.Now()})
+	if err != nil {
+		d.log.Error().Err(err).Uint64("webhook_id", dl.hook.Id).Msg("error saving webhook dead letter")
+	}
+}
+
+// Sign return the signature header value, hex hmac-sha256 of timestamp, a dot and the body
+// keyed by the webhook secret. Receiver should also reject stale timestamp
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
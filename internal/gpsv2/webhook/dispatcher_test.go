@@ -0,0 +1,257 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"nuha.dev/gpstracker/internal/eventbus"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+type fakeStore struct {
+	hooks []store.Webhook
+	dead  chan *store.WebhookDeadLetter
+}
+
+func (s *fakeStore) Webhooks() ([]store.Webhook, error) {
+	return s.hooks, nil
+}
+
+func (s *fakeStore) SaveDeadLetter(d *store.WebhookDeadLetter) error {
+	s.dead <- d
+	return nil
+}
+
+type request struct {
+	header http.Header
+	body   []byte
+	t      time.Time
+}
+
+// receiver answer with the status of every attempt in turn, the last one is repeated
+type receiver struct {
+	mu       sync.Mutex
+	status   []int
+	requests []request
+	received chan struct{}
+}
+
+func newReceiver(status ...int) (*receiver, *httptest.Server) {
+	r := &receiver{status: status, received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		status := r.status[0]
+		if len(r.status) > 1 {
+			r.status = r.status[1:]
+		}
+		r.requests = append(r.requests, request{header: req.Header, body: body, t: time.Now()})
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+	return r, srv
+}
+
+func (r *receiver) wait(t *testing.T, n int) []request {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d request, expected %d", i, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request{}, r.requests...)
+}
+
+func startDispatcher(t *testing.T, st *fakeStore, config *DispatcherConfig) (*Dispatcher, *eventbus.EventBus) {
+	bus := eventbus.NewEventBus()
+	d := NewDispatcher(st, bus, config)
+	go d.Run()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		loaded := len(d.hooks) > 0
+		d.mu.Unlock()
+		if loaded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("webhook not loaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return d, bus
+}
+
+func shutdown(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitDeadLetter(t *testing.T, st *fakeStore) *store.WebhookDeadLetter {
+	select {
+	case dl := <-st.dead:
+		return dl
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter")
+	}
+	return nil
+}
+
+func publish(bus *eventbus.EventBus) {
+	bus.PublishEvent(&eventbus.Event{TrackerId: 7, Topic: "alarm.sos", Message: "SOS", Data: map[string]int{"code": 1}, Time: time.Unix(1600000000, 0).UTC()})
+}
+
+func TestDispatcherSignature(t *testing.T) {
+	r, srv := newReceiver(http.StatusOK)
+	defer srv.Close()
+	st := &fakeStore{hooks: []store.Webhook{{Id: 3, Url: srv.URL, Secret: "s3cret", Events: []string{"alarm.*"}}}, dead: make(chan *store.WebhookDeadLetter, 10)}
+	d, bus := startDispatcher(t, st, &DispatcherConfig{})
+	//history only event and topic not subscribed are not delivered
+	bus.PublishEvent(&eventbus.Event{TrackerId: 7, Topic: "alarm.sos", Time: time.Now(), HistoryOnly: true})
+	bus.PublishEvent(&eventbus.Event{TrackerId: 7, Topic: "started", Time: time.Now()})
+	publish(bus)
+	req := r.wait(t, 1)[0]
+	shutdown(t, d)
+
+	ts := req.header.Get(HEADER_TIMESTAMP)
+	if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+		t.Fatalf("timestamp %q", ts)
+	}
+	if sig := req.header.Get(HEADER_SIGNATURE); sig != Sign("s3cret", ts, req.body) {
+		t.Fatalf("signature %q", sig)
+	}
+	if id := req.header.Get(HEADER_WEBHOOK); id != "3" {
+		t.Fatalf("webhook id %q", id)
+	}
+	p := Payload{}
+	if err := json.Unmarshal(req.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != TYPE_EVENT || p.TrackerId != 7 || p.Topic != "alarm.sos" || string(p.Message) != `{"code":1}` {
+		t.Fatalf("payload %s", req.body)
+	}
+	select {
+	case <-r.received:
+		t.Fatal("unsubscribed event delivered")
+	default:
+	}
+}
+
+func TestSign(t *testing.T) {
+	sig := Sign("key", "1600000000", []byte(`{}`))
+	if sig != "sha256=068d0b330e50151f36064ff01089c224ffc1fc64ce4803e1296c5ba8e88de732" {
+		t.Fatalf("signature %s", sig)
+	}
+	if Sign("key", "1600000001", []byte(`{}`)) == sig || Sign("other", "1600000000", []byte(`{}`)) == sig {
+		t.Fatal("signature does not depend on timestamp and secret")
+	}
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	r, srv := newReceiver(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	defer srv.Close()
+	st := &fakeStore{hooks: []store.Webhook{{Id: 1, Url: srv.URL}}, dead: make(chan *store.WebhookDeadLetter, 10)}
+	base := 20 * time.Millisecond
+	d, bus := startDispatcher(t, st, &DispatcherConfig{RetryBase: base})
+	publish(bus)
+	reqs := r.wait(t, 3)
+	shutdown(t, d)
+	if w := reqs[1].t.Sub(reqs[0].t); w < base {
+		t.Fatalf("first retry after %s", w)
+	}
+	if w := reqs[2].t.Sub(reqs[1].t); w < 2*base {
+		t.Fatalf("second retry after %s", w)
+	}
+	if string(reqs[0].body) != string(reqs[2].body) {
+		t.Fatal("retry body differ")
+	}
+	select {
+	case dl := <-st.dead:
+		t.Fatalf("delivered request dead lettered : %+v", dl)
+	default:
+	}
+}
+
+func TestDispatcherClientError(t *testing.T) {
+	r, srv := newReceiver(http.StatusBadRequest)
+	defer srv.Close()
+	st := &fakeStore{hooks: []store.Webhook{{Id: 1, Url: srv.URL}}, dead: make(chan *store.WebhookDeadLetter, 10)}
+	d, bus := startDispatcher(t, st, &DispatcherConfig{RetryBase: time.Millisecond})
+	publish(bus)
+	dl := waitDeadLetter(t, st)
+	shutdown(t, d)
+	if dl.WebhookId != 1 || dl.Attempts != 1 || dl.LastStatus != http.StatusBadRequest {
+		t.Fatalf("dead letter %+v", dl)
+	}
+	if n := len(r.wait(t, 1)); n != 1 {
+		t.Fatalf("%d attempt", n)
+	}
+}
+
+func TestDispatcherMaxAttempts(t *testing.T) {
+	r, srv := newReceiver(http.StatusInternalServerError)
+	defer srv.Close()
+	st := &fakeStore{hooks: []store.Webhook{{Id: 1, Url: srv.URL}}, dead: make(chan *store.WebhookDeadLetter, 10)}
+	d, bus := startDispatcher(t, st, &DispatcherConfig{RetryBase: time.Millisecond, MaxAttempts: 3})
+	publish(bus)
+	dl := waitDeadLetter(t, st)
+	shutdown(t, d)
+	if dl.Attempts != 3 || dl.LastStatus != http.StatusInternalServerError {
+		t.Fatalf("dead letter %+v", dl)
+	}
+	if n := len(r.wait(t, 3)); n != 3 {
+		t.Fatalf("%d attempt", n)
+	}
+	var p Payload
+	if err := json.Unmarshal(dl.Payload, &p); err != nil || p.Topic != "alarm.sos" {
+		t.Fatalf("dead letter payload %s", dl.Payload)
+	}
+}
+
+func TestDispatcherShutdownPending(t *testing.T) {
+	r, srv := newReceiver(http.StatusBadGateway)
+	defer srv.Close()
+	st := &fakeStore{hooks: []store.Webhook{{Id: 1, Url: srv.URL}}, dead: make(chan *store.WebhookDeadLetter, 10)}
+	d, bus := startDispatcher(t, st, &DispatcherConfig{RetryBase: time.Hour})
+	publish(bus)
+	r.wait(t, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		n := len(d.pending)
+		d.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retry not scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	shutdown(t, d)
+	dl := waitDeadLetter(t, st)
+	if dl.Attempts != 1 || dl.LastStatus != http.StatusBadGateway {
+		t.Fatalf("dead letter %+v", dl)
+	}
+	//nothing is delivered after shutdown
+	publish(bus)
+	select {
+	case <-r.received:
+		t.Fatal("delivered after shutdown")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
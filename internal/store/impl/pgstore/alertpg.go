@@ -0,0 +1,83 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// PgAlertStore keep alert rule in alert_rule and triggered alert in alert :
+//
+//	CREATE TABLE alert_rule (
+//		id bigserial PRIMARY KEY,
+//		name text NOT NULL,
+//		kind text NOT NULL,
+//		tracker_id bigint REFERENCES tracker(id) ON DELETE CASCADE,
+//		tracker_group text,
+//		params jsonb NOT NULL DEFAULT '{}',
+//		enabled bool NOT NULL DEFAULT true,
+//		created_at timestamptz NOT NULL DEFAULT now()
+//	);
+//	CREATE TABLE alert (
+//		id bigserial PRIMARY KEY,
+//		rule_id bigint REFERENCES alert_rule(id) ON DELETE SET NULL,
+//		tracker_id bigint NOT NULL REFERENCES tracker(id) ON DELETE CASCADE,
+//		kind text NOT NULL,
+//		name text NOT NULL,
+//		detail jsonb,
+//		status text NOT NULL DEFAULT 'open',
+//		triggered_at timestamptz NOT NULL,
+//		acknowledged_at timestamptz,
+//		resolved_at timestamptz,
+//		note text
+//	);
+//	CREATE INDEX ON alert (tracker_id, id);
+//	CREATE INDEX ON alert (id) WHERE status <> 'resolved';
+type PgAlertStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewAlertStore(db *pgxpool.Pool) *PgAlertStore {
+	m := PgAlertStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "alert_store").Value()
+	return &m
+}
+
+// AlertRules return enabled rule, tracker of group rule are resolved from the group in tracker config
+func (st *PgAlertStore) AlertRules() ([]store.AlertRule, error) {
+	rows, err := st.db.Query(context.Background(), `SELECT r.id,r.name,r.kind,r.tracker_id,r.tracker_group,r.params,
+	CASE WHEN r.tracker_id IS NOT NULL THEN ARRAY[r.tracker_id]
+	WHEN r.tracker_group IS NOT NULL THEN ARRAY(SELECT t.id FROM tracker t WHERE t.config->>'group' = r.tracker_group) END
+	FROM alert_rule r WHERE r.enabled ORDER BY r.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := make([]store.AlertRule, 0)
+	for rows.Next() {
+		r := store.AlertRule{}
+		var trackers []int64
+		err := rows.Scan(&r.Id, &r.Name, &r.Kind, &r.TrackerId, &r.Group, &r.Params, &trackers)
+		if err != nil {
+			return nil, err
+		}
+		if r.TrackerId != nil || r.Group != nil {
+			r.Trackers = make([]uint64, len(trackers))
+			for i, tid := range trackers {
+				r.Trackers[i] = uint64(tid)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (st *PgAlertStore) SaveAlert(a *store.Alert) error {
+	return st.db.QueryRow(context.Background(), `INSERT INTO alert (rule_id,tracker_id,kind,name,detail,triggered_at) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id`,
+		a.RuleId, a.TrackerId, a.Kind, a.Name, a.Detail, a.TriggeredAt).Scan(&a.Id)
+}
@@ -0,0 +1,86 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// PgCommandStore keep the command queue in tracker_command :
+//
+//	CREATE TABLE tracker_command (
+//		id bigserial PRIMARY KEY,
+//		tracker_id bigint NOT NULL REFERENCES tracker(id) ON DELETE CASCADE,
+//		command text NOT NULL,
+//		status text NOT NULL DEFAULT 'queued',
+//		attempt int NOT NULL DEFAULT 0,
+//		max_attempt int NOT NULL DEFAULT 3,
+//		created_at timestamptz NOT NULL DEFAULT now(),
+//		expire_at timestamptz NOT NULL,
+//		sent_at timestamptz,
+//		response text,
+//		response_at timestamptz,
+//		reason text
+//	);
+//	CREATE INDEX ON tracker_command (tracker_id, id) WHERE status IN ('queued','sent');
+type PgCommandStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewCommandStore(db *pgxpool.Pool) *PgCommandStore {
+	m := PgCommandStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "command_store").Value()
+	return &m
+}
+
+func (st *PgCommandStore) PendingCommands(tid uint64) ([]store.QueuedCommand, error) {
+	ctx := context.Background()
+	_, err := st.db.Exec(ctx, `UPDATE tracker_command SET status = $1 WHERE tracker_id = $2 AND status IN ($3,$4) AND expire_at < now()`,
+		store.COMMAND_EXPIRED, tid, store.COMMAND_QUEUED, store.COMMAND_SENT)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := st.db.Query(ctx, `SELECT id,tracker_id,command,status,attempt,max_attempt,sent_at,expire_at FROM tracker_command WHERE tracker_id = $1 AND status IN ($2,$3) ORDER BY id ASC`,
+		tid, store.COMMAND_QUEUED, store.COMMAND_SENT)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cmds := make([]store.QueuedCommand, 0)
+	for rows.Next() {
+		c := store.QueuedCommand{}
+		err := rows.Scan(&c.Id, &c.TrackerId, &c.Command, &c.Status, &c.Attempt, &c.MaxAttempt, &c.SentAt, &c.ExpireAt)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, c)
+	}
+	return cmds, rows.Err()
+}
+
+func (st *PgCommandStore) MarkCommandSent(id uint64, attempt int, t time.Time) {
+	_, err := st.db.Exec(context.Background(), `UPDATE tracker_command SET status = $1, attempt = $2, sent_at = $3 WHERE id = $4`, store.COMMAND_SENT, attempt, t, id)
+	if err != nil {
+		st.log.Error().Err(err).Uint64("command_id", id).Msg("error marking command sent")
+	}
+}
+
+func (st *PgCommandStore) MarkCommandAcknowledged(id uint64, response string, t time.Time) {
+	_, err := st.db.Exec(context.Background(), `UPDATE tracker_command SET status = $1, response = $2, response_at = $3 WHERE id = $4`, store.COMMAND_ACKNOWLEDGED, response, t, id)
+	if err != nil {
+		st.log.Error().Err(err).Uint64("command_id", id).Msg("error marking command acknowledged")
+	}
+}
+
+func (st *PgCommandStore) MarkCommandFailed(id uint64, reason string, t time.Time) {
+	_, err := st.db.Exec(context.Background(), `UPDATE tracker_command SET status = $1, reason = $2, response_at = $3 WHERE id = $4`, store.COMMAND_FAILED, reason, t, id)
+	if err != nil {
+		st.log.Error().Err(err).Uint64("command_id", id).Msg("error marking command failed")
+	}
+}
@@ -0,0 +1,60 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// PgGeofenceStore read geofence from geofence :
+//
+//	CREATE TABLE geofence (
+//		id bigserial PRIMARY KEY,
+//		name text NOT NULL,
+//		tracker_id bigint REFERENCES tracker(id) ON DELETE CASCADE,
+//		tracker_group text,
+//		kind text NOT NULL,
+//		lat double precision NOT NULL DEFAULT 0,
+//		lon double precision NOT NULL DEFAULT 0,
+//		radius double precision NOT NULL DEFAULT 0,
+//		polygon jsonb,
+//		created_at timestamptz NOT NULL DEFAULT now(),
+//		CHECK (tracker_id IS NOT NULL OR tracker_group IS NOT NULL)
+//	);
+//	CREATE INDEX ON geofence (tracker_id);
+//	CREATE INDEX ON geofence (tracker_group);
+type PgGeofenceStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewGeofenceStore(db *pgxpool.Pool) *PgGeofenceStore {
+	m := PgGeofenceStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "geofence_store").Value()
+	return &m
+}
+
+// TrackerGeofences read the group from the tracker config, a group changed through the api
+// apply on the next reload without the tracker reconnecting
+func (st *PgGeofenceStore) TrackerGeofences(tid uint64) ([]store.Geofence, error) {
+	rows, err := st.db.Query(context.Background(), `SELECT id,name,tracker_id,tracker_group,kind,lat,lon,radius,polygon FROM geofence
+	WHERE tracker_id = $1 OR tracker_group = (SELECT NULLIF(config->>'group','') FROM tracker WHERE id = $1) ORDER BY id`, tid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fences := make([]store.Geofence, 0)
+	for rows.Next() {
+		g := store.Geofence{}
+		err := rows.Scan(&g.Id, &g.Name, &g.TrackerId, &g.Group, &g.Kind, &g.Latitude, &g.Longitude, &g.Radius, &g.Polygon)
+		if err != nil {
+			return nil, err
+		}
+		fences = append(fences, g)
+	}
+	return fences, rows.Err()
+}
@@ -0,0 +1,256 @@
+package pgstore
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// PgGeoStore look up cell tower and wifi access point imported from OpenCellID or
+// Mozilla Location Service export :
+//
+//	CREATE TABLE cell_tower (
+//		mcc int NOT NULL,
+//		mnc int NOT NULL,
+//		lac int NOT NULL,
+//		cell_id bigint NOT NULL,
+//		radio text NOT NULL,
+//		lat double precision NOT NULL,
+//		lon double precision NOT NULL,
+//		range double precision NOT NULL,
+//		samples int NOT NULL DEFAULT 0,
+//		updated_at timestamptz NOT NULL DEFAULT now(),
+//		PRIMARY KEY (mcc, mnc, lac, cell_id)
+//	);
+//	CREATE TABLE wifi_ap (
+//		mac macaddr PRIMARY KEY,
+//		lat double precision NOT NULL,
+//		lon double precision NOT NULL,
+//		range double precision NOT NULL,
+//		updated_at timestamptz NOT NULL DEFAULT now()
+//	);
+type PgGeoStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewGeoStore(db *pgxpool.Pool) *PgGeoStore {
+	m := PgGeoStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "geo_store").Value()
+	return &m
+}
+
+func (st *PgGeoStore) LocateCells(cells []store.Cell) (map[store.Cell]store.GeoPoint, error) {
+	res := make(map[store.Cell]store.GeoPoint)
+	if len(cells) == 0 {
+		return res, nil
+	}
+	mcc := make([]int32, len(cells))
+	mnc := make([]int32, len(cells))
+	lac := make([]int32, len(cells))
+	cid := make([]int64, len(cells))
+	for i, c := range cells {
+		mcc[i], mnc[i], lac[i], cid[i] = int32(c.MCC), int32(c.MNC), int32(c.LAC), int64(c.CellID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := st.db.Query(ctx, `SELECT mcc,mnc,lac,cell_id,lat,lon,range FROM cell_tower
+	JOIN unnest($1::int[],$2::int[],$3::int[],$4::bigint[]) AS q(mcc,mnc,lac,cell_id) USING (mcc,mnc,lac,cell_id)`, mcc, mnc, lac, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := store.Cell{}
+		p := store.GeoPoint{}
+		err := rows.Scan(&c.MCC, &c.MNC, &c.LAC, &c.CellID, &p.Latitude, &p.Longitude, &p.Range)
+		if err != nil {
+			return nil, err
+		}
+		res[c] = p
+	}
+	return res, rows.Err()
+}
+
+// LocateWiFi take mac address in aa:bb:cc:dd:ee:ff form
+func (st *PgGeoStore) LocateWiFi(macs []string) (map[string]store.GeoPoint, error) {
+	res := make(map[string]store.GeoPoint)
+	if len(macs) == 0 {
+		return res, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := st.db.Query(ctx, `SELECT mac::text,lat,lon,range FROM wifi_ap WHERE mac = ANY($1::macaddr[])`, macs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mac string
+		p := store.GeoPoint{}
+		err := rows.Scan(&mac, &p.Latitude, &p.Longitude, &p.Range)
+		if err != nil {
+			return nil, err
+		}
+		res[mac] = p
+	}
+	return res, rows.Err()
+}
+
+// csvSource feed csv rows to CopyFrom, rows failing to parse are skipped and counted
+type csvSource struct {
+	r       *csv.Reader
+	parse   func(rec []string) ([]interface{}, error)
+	row     []interface{}
+	err     error
+	skipped int
+}
+
+func (s *csvSource) Next() bool {
+	for {
+		rec, err := s.r.Read()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				s.skipped++
+				continue
+			}
+			s.err = err
+			return false
+		}
+		row, err := s.parse(rec)
+		if err != nil {
+			s.skipped++
+			continue
+		}
+		s.row = row
+		return true
+	}
+}
+
+func (s *csvSource) Values() ([]interface{}, error) {
+	return s.row, nil
+}
+
+func (s *csvSource) Err() error {
+	return s.err
+}
+
+// parseCellRecord parse OpenCellID/MLS row :
+// radio,mcc,net,area,cell,unit,lon,lat,range,samples,changeable,created,updated,averageSignal
+func parseCellRecord(rec []string) ([]interface{}, error) {
+	if len(rec) < 10 {
+		return nil, fmt.Errorf("expecting at least 10 column, got %d", len(rec))
+	}
+	ints := make([]int64, 4)
+	for i, idx := range []int{1, 2, 3, 4} {
+		v, err := strconv.ParseInt(rec[idx], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = v
+	}
+	floats := make([]float64, 3)
+	for i, idx := range []int{7, 6, 8} {
+		v, err := strconv.ParseFloat(rec[idx], 64)
+		if err != nil {
+			return nil, err
+		}
+		floats[i] = v
+	}
+	samples, err := strconv.ParseInt(rec[9], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{int32(ints[0]), int32(ints[1]), int32(ints[2]), ints[3], rec[0], floats[0], floats[1], floats[2], int32(samples)}, nil
+}
+
+// parseWiFiRecord parse mac,lat,lon,range row
+func parseWiFiRecord(rec []string) ([]interface{}, error) {
+	if len(rec) < 4 {
+		return nil, fmt.Errorf("expecting 4 column, got %d", len(rec))
+	}
+	mac, err := net.ParseMAC(strings.TrimSpace(rec[0]))
+	if err != nil {
+		return nil, err
+	}
+	floats := make([]float64, 3)
+	for i := range floats {
+		v, err := strconv.ParseFloat(strings.TrimSpace(rec[i+1]), 64)
+		if err != nil {
+			return nil, err
+		}
+		floats[i] = v
+	}
+	return []interface{}{mac.String(), floats[0], floats[1], floats[2]}, nil
+}
+
+// ImportCells load OpenCellID/MLS csv into cell_tower, existing cell is replaced.
+// it return number of imported and skipped row
+func (st *PgGeoStore) ImportCells(ctx context.Context, r io.Reader) (int64, int, error) {
+	return st.import_csv(ctx, r, parseCellRecord,
+		`CREATE TEMP TABLE cell_tower_import (mcc int, mnc int, lac int, cell_id bigint, radio text, lat double precision, lon double precision, range double precision, samples int) ON COMMIT DROP`,
+		"cell_tower_import", []string{"mcc", "mnc", "lac", "cell_id", "radio", "lat", "lon", "range", "samples"},
+		`INSERT INTO cell_tower (mcc,mnc,lac,cell_id,radio,lat,lon,range,samples)
+	SELECT DISTINCT ON (mcc,mnc,lac,cell_id) mcc,mnc,lac,cell_id,radio,lat,lon,range,samples FROM cell_tower_import ORDER BY mcc,mnc,lac,cell_id,samples DESC
+	ON CONFLICT (mcc,mnc,lac,cell_id) DO UPDATE SET radio = EXCLUDED.radio, lat = EXCLUDED.lat, lon = EXCLUDED.lon, range = EXCLUDED.range, samples = EXCLUDED.samples, updated_at = now()`)
+}
+
+// ImportWiFi load mac,lat,lon,range csv into wifi_ap, existing access point is replaced.
+// it return number of imported and skipped row
+func (st *PgGeoStore) ImportWiFi(ctx context.Context, r io.Reader) (int64, int, error) {
+	return st.import_csv(ctx, r, parseWiFiRecord,
+		`CREATE TEMP TABLE wifi_ap_import (mac macaddr, lat double precision, lon double precision, range double precision) ON COMMIT DROP`,
+		"wifi_ap_import", []string{"mac", "lat", "lon", "range"},
+		`INSERT INTO wifi_ap (mac,lat,lon,range)
+	SELECT DISTINCT ON (mac) mac,lat,lon,range FROM wifi_ap_import
+	ON CONFLICT (mac) DO UPDATE SET lat = EXCLUDED.lat, lon = EXCLUDED.lon, range = EXCLUDED.range, updated_at = now()`)
+}
+
+// import_csv copy csv into a temporary table then merge it into the target table in one transaction,
+// a header row fail to parse and is skipped
+func (st *PgGeoStore) import_csv(ctx context.Context, r io.Reader, parse func([]string) ([]interface{}, error), create string, tmp string, cols []string, merge string) (int64, int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	src := &csvSource{r: cr, parse: parse}
+
+	tx, err := st.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, create)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{tmp}, cols, src)
+	if err != nil {
+		return 0, src.skipped, err
+	}
+	tag, err := tx.Exec(ctx, merge)
+	if err != nil {
+		return 0, src.skipped, err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, src.skipped, err
+	}
+	return tag.RowsAffected(), src.skipped, nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
 )
 
 type PgMiscStore struct {
@@ -22,7 +23,14 @@ func NewMiscStore(db *pgxpool.Pool) *PgMiscStore {
 
 func (st *PgMiscStore) SaveCommandResponse(tid uint64, server_flag uint32, command string, ct time.Time, response string, rt time.Time) {
 	var err error
-	_, err = st.db.Exec(context.Background(), `INSERT INTO gt06_command_response (tracker_id,server_flag,command,command_time,response,response_time) VALUES ($1,$2,$3,$4,$5,$6)`, tid, server_flag, command, ct, response, rt)
+	//response to a queued command reference the job which queued it
+	var command_id *uint64
+	if server_flag&store.QUEUE_SERVER_FLAG != 0 {
+		id := uint64(server_flag &^ store.QUEUE_SERVER_FLAG)
+		command_id = &id
+	}
+	_, err = st.db.Exec(context.Background(), `INSERT INTO gt06_command_response (tracker_id,server_flag,command,command_time,response,response_time,job_id)
+	VALUES ($1,$2,$3,$4,$5,$6,(SELECT job_id FROM tracker_command WHERE id = $7))`, tid, server_flag, command, ct, response, rt, command_id)
 	if err != nil {
 		st.log.Error().Err(err).Msg("error saving command response")
 	}
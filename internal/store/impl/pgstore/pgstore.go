@@ -2,30 +2,50 @@ package pgstore
 
 import (
 	"context"
+	"errors"
+	"expvar"
+	"math"
 	"sync"
 	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
 )
 
 type PgStore struct {
 	config *StoreConfig
-	cond   *sync.Cond
 	wlock  *sync.Mutex
-	rbuf   buffer
 	wbuf   buffer
-	dbc    *pgxpool.Conn
-	dbp    *pgxpool.Pool
-	log    log.Logger
-	table  string
+	flushc chan buffer
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+	//the table lack the optional column, only used by the flusher
+	legacy bool
+	spool  *spool
+	//buffer being spooled by Put because the flusher is behind
+	spill_mu sync.Mutex
+	spilled  *sync.Cond
+	spilling int
+	//copy_batch insert a batch into the database, it is st.copy outside of test
+	copy_batch func(recs []record) error
+	dbp        *pgxpool.Pool
+	log        log.Logger
+	table      string
 }
 
 type StoreConfig struct {
 	BufSize     int
 	TickerDur   time.Duration
 	MaxAgeFlush time.Duration
+	//failed batch are kept in this directory and replayed once the database recover,
+	//spooling is disabled when empty
+	SpoolDir   string
+	SpoolRetry time.Duration
 }
 
 type buffer struct {
@@ -40,13 +60,9 @@ func new_buffer(seq uint64, len int) buffer {
 }
 
 type record struct {
-	nsn   uint64
-	lon   float64
-	lat   float64
-	alt   float32
-	speed float32
-	gpst  time.Time
-	srvt  time.Time
+	nsn  uint64
+	loc  device.Location
+	srvt time.Time
 }
 
 func NewStore(db *pgxpool.Pool, table string, config *StoreConfig) *PgStore {
@@ -56,55 +72,161 @@ func NewStore(db *pgxpool.Pool, table string, config *StoreConfig) *PgStore {
 	o.dbp = db
 	o.log = log.DefaultLogger
 	o.log.Context = log.NewContext(nil).Str("module", "pgstore").Value()
-	o.wbuf = new_buffer(0, o.config.BufSize)
 	o.wlock = &sync.Mutex{}
-	o.cond = sync.NewCond(&sync.Mutex{})
+	o.spilled = sync.NewCond(&o.spill_mu)
+	o.copy_batch = o.copy
+	o.flushc = make(chan buffer, flush_queue)
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	var seq uint64
+	if config.SpoolDir != "" {
+		sp, err := open_spool(config.SpoolDir)
+		if err != nil {
+			o.log.Error().Err(err).Str("dir", config.SpoolDir).Msg("unable to open spool, failed batch will be dropped")
+		} else {
+			o.spool = sp
+			//buffer sequence name the spooled batch, carry on after the batch already spooled
+			seq = sp.next
+			name := "pgstore_spool_" + table
+			if expvar.Get(name) == nil {
+				expvar.Publish(name, expvar.Func(func() interface{} { return o.SpoolStats() }))
+			}
+		}
+	}
+	o.wbuf = new_buffer(seq, o.config.BufSize)
 	return o
 }
 
-func (st *PgStore) Run() {
-	var err error
-	st.dbc, err = st.dbp.Acquire(context.Background())
-	if err != nil {
-		return
+// SpoolStats report batches waiting in the spool, zero when spooling is disabled
+func (st *PgStore) SpoolStats() SpoolStats {
+	if st.spool == nil {
+		return SpoolStats{}
 	}
+	return st.spool.stats()
+}
+
+const copy_timeout = 30 * time.Second
+
+// number of full buffer waiting for the flusher, further buffer are spooled directly
+const flush_queue = 4
+
+func (st *PgStore) Run() {
 	go st.timer_flusher()
 	go st.handle()
 }
 
+// Close flush buffered records and wait for the flusher to finish or ctx to expire,
+// Put after Close drop the record
+func (st *PgStore) Close(ctx context.Context) error {
+	st.wlock.Lock()
+	if st.closed {
+		st.wlock.Unlock()
+		return nil
+	}
+	st.closed = true
+	spill := st.flush()
+	close(st.flushc)
+	close(st.stop)
+	st.wlock.Unlock()
+	st.spill(spill)
+	select {
+	case <-st.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (st *PgStore) timer_flusher() {
 	ticker := time.NewTicker(st.config.TickerDur)
-	for t := range ticker.C {
-		st.wlock.Lock()
-		if len(st.wbuf.buf) != 0 && t.Sub(st.wbuf.t1) > st.config.MaxAgeFlush {
-			st.flush()
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			var spill *buffer
+			st.wlock.Lock()
+			if !st.closed && len(st.wbuf.buf) != 0 && t.Sub(st.wbuf.t1) > st.config.MaxAgeFlush {
+				spill = st.flush()
+			}
+			st.wlock.Unlock()
+			st.spill(spill)
+		case <-st.stop:
+			return
 		}
-		st.wlock.Unlock()
 	}
 }
 
-func (st *PgStore) Put(nsn uint64, lon float64, lat float64, alt float32, speed float32, gpst time.Time, srvt time.Time) {
-	rec := record{nsn: nsn, lon: lon, lat: lat, alt: alt, speed: speed, gpst: gpst, srvt: srvt}
+func (st *PgStore) Put(nsn uint64, loc *device.Location, srvt time.Time) {
+	rec := record{nsn: nsn, loc: *loc, srvt: srvt}
 	st.wlock.Lock()
+	if st.closed {
+		st.wlock.Unlock()
+		st.log.Warn().Uint64("nsn", nsn).Msg("store closed, dropping record")
+		return
+	}
 	if len(st.wbuf.buf) == 0 {
 		st.wbuf.t1 = time.Now().UTC()
 	}
 	st.wbuf.buf = append(st.wbuf.buf, rec)
+	var spill *buffer
 	if len(st.wbuf.buf) == st.config.BufSize {
-		st.flush()
+		spill = st.flush()
 	}
 	st.wlock.Unlock()
+	st.spill(spill)
+}
+
+// flush hand the write buffer to the flusher, the caller must hold wlock.
+// When the flusher is behind the buffer is returned to be spooled by the caller once it
+// released wlock, so Put never wait for the database nor the disk. The flusher wait for
+// buffer being spooled before replaying so buffer are inserted in the order they were filled
+func (st *PgStore) flush() *buffer {
+	if len(st.wbuf.buf) == 0 {
+		return nil
+	}
+	buf := st.wbuf
+	buf.t2 = time.Now().UTC()
+	st.wbuf = new_buffer(buf.seq+1, st.config.BufSize)
+	select {
+	case st.flushc <- buf:
+		return nil
+	default:
+	}
+	if st.spool == nil {
+		st.log.Error().Int("length", len(buf.buf)).Msg("flusher is behind, dropping buffer")
+		return nil
+	}
+	st.spill_mu.Lock()
+	st.spilling++
+	st.spill_mu.Unlock()
+	return &buf
 }
 
-func (st *PgStore) flush() {
-	next := st.wbuf.seq + 1
-	st.wbuf.t2 = time.Now().UTC()
-	st.cond.L.Lock()
-	st.rbuf = st.wbuf
-	st.cond.L.Unlock()
-	st.cond.Signal()
-	st.wbuf = new_buffer(next, st.config.BufSize)
+// spill spool a buffer flush could not hand to the flusher, buf may be nil
+func (st *PgStore) spill(buf *buffer) {
+	if buf == nil {
+		return
+	}
+	if err := st.spool.write(buf.seq, buf.buf); err != nil {
+		st.log.Error().Err(err).Int("length", len(buf.buf)).Msg("flusher is behind, spool error, dropping buffer")
+	} else {
+		st.log.Warn().Int("length", len(buf.buf)).Msg("flusher is behind, buffer spooled")
+	}
+	st.spill_mu.Lock()
+	st.spilling--
+	if st.spilling == 0 {
+		st.spilled.Broadcast()
+	}
+	st.spill_mu.Unlock()
+}
 
+// wait_spill wait for buffer being spooled by Put
+func (st *PgStore) wait_spill() {
+	st.spill_mu.Lock()
+	for st.spilling > 0 {
+		st.spilled.Wait()
+	}
+	st.spill_mu.Unlock()
 }
 
 // func (st *Store) flush(data []record) {
@@ -126,27 +248,167 @@ func (st *PgStore) flush() {
 // }
 
 func (st *PgStore) handle() {
-	var err error
 	st.log.Info().Msg("starting flusher task")
+	defer func() {
+		close(st.done)
+		st.log.Info().Msg("flusher task stopped")
+	}()
+	retry_dur := st.config.SpoolRetry
+	if retry_dur == 0 {
+		retry_dur = 30 * time.Second
+	}
+	retry := time.NewTicker(retry_dur)
+	defer retry.Stop()
+	if st.spool != nil && st.spool.len() > 0 {
+		st.log.Info().Int("files", st.spool.len()).Msg("spool is not empty, replaying")
+		st.replay(math.MaxUint64)
+	}
 	for {
-		st.cond.L.Lock()
-		st.cond.Wait()
-		st.log.Debug().Msg("flusher task signalled")
-		buf := st.rbuf
-		st.cond.L.Unlock()
-		t1 := time.Now()
-		_, err = st.dbc.CopyFrom(context.Background(),
-			pgx.Identifier{st.table},
-			[]string{"nsn", "longitude", "latitude", "altitude", "speed", "gps_timestamp", "server_timestamp"},
-			pgx.CopyFromSlice(len(buf.buf), func(i int) ([]interface{}, error) {
-				d := buf.buf[i]
-				return []interface{}{d.nsn, d.lon, d.lat, d.alt, d.speed, d.gpst, d.srvt}, nil
-			}))
+		select {
+		case buf, ok := <-st.flushc:
+			if !ok {
+				return
+			}
+			st.log.Debug().Msg("flusher task signalled")
+			st.write(buf)
+		case <-retry.C:
+			//queued buffer are older than the spooled one, their write replay the spool
+			if st.spool != nil && st.spool.len() > 0 && len(st.flushc) == 0 {
+				st.wait_spill()
+				st.replay(math.MaxUint64)
+			}
+		}
+	}
+}
+
+// write copy the batch into the database, spooled batch older than buf are replayed
+// first and buf is spooled when the copy fail or when older batch are still spooled so
+// the insertion order is kept. Batch the database refuse is quarantined, retrying it
+// would never succeed
+func (st *PgStore) write(buf buffer) {
+	if st.spool == nil {
+		err := st.copy_batch(buf.buf)
 		if err != nil {
-			st.log.Error().Err(err).Msg("flush error")
-		} else {
-			st.log.Debug().Str("action", "flush").Int("length", len(buf.buf)).Dur("time_taken", time.Since(t1)).Msg("flush successfull")
+			st.log.Error().Err(err).Int("length", len(buf.buf)).Msg("flush error, dropping buffer")
+		}
+		return
+	}
+	st.wait_spill()
+	st.replay(buf.seq)
+	if !st.spool.older(buf.seq) {
+		err := st.copy_batch(buf.buf)
+		if err == nil {
+			return
+		}
+		if permanent(err) {
+			st.log.Error().Err(err).Int("length", len(buf.buf)).Msg("buffer refused by the database, quarantining")
+			err = st.spool.write_quarantine(buf.seq, buf.buf)
+			if err != nil {
+				st.log.Error().Err(err).Int("length", len(buf.buf)).Msg("spool error, dropping buffer")
+			}
+			return
 		}
+		st.log.Error().Err(err).Int("length", len(buf.buf)).Msg("flush error, spooling buffer")
 	}
+	err := st.spool.write(buf.seq, buf.buf)
+	if err != nil {
+		st.log.Error().Err(err).Int("length", len(buf.buf)).Msg("spool error, dropping buffer")
+	}
+}
 
+// replay copy spooled batch older than before in sequence order, stopping at the first
+// transient failure. Unreadable batch and batch refused by the database are quarantined
+func (st *PgStore) replay(before uint64) {
+	for {
+		sf, recs, err := st.spool.oldest()
+		if err == nil && recs == nil || sf.seq >= before {
+			return
+		}
+		if err == nil {
+			err = st.copy_batch(recs)
+			if err != nil && !permanent(err) {
+				st.log.Warn().Err(err).Uint64("seq", sf.seq).Msg("spool replay failed")
+				return
+			}
+		}
+		if err != nil {
+			st.log.Error().Err(err).Uint64("seq", sf.seq).Msg("spool file refused, quarantining")
+			err = st.spool.quarantine(sf)
+			if err != nil {
+				st.log.Error().Err(err).Uint64("seq", sf.seq).Msg("error quarantining spool file")
+				return
+			}
+			continue
+		}
+		err = st.spool.remove(sf)
+		if err != nil {
+			st.log.Error().Err(err).Uint64("seq", sf.seq).Msg("error removing replayed spool file")
+			return
+		}
+		st.log.Info().Uint64("seq", sf.seq).Int("length", len(recs)).Msg("spool replayed")
+	}
+}
+
+// permanent report whether the database refused the data itself : data exception (22)
+// or integrity constraint violation (23). Any other error is worth retrying, connection
+// failure as well as missing table or privilege (42) during a migration
+func permanent(err error) bool {
+	var pgerr *pgconn.PgError
+	if !errors.As(err, &pgerr) {
+		return false
+	}
+	return pgerrcode.IsDataException(pgerr.Code) || pgerrcode.IsIntegrityConstraintViolation(pgerr.Code)
+}
+
+// copy insert the batch, optional field are null when absent :
+//
+//	ALTER TABLE locations_history ADD COLUMN course real, ADD COLUMN sat_count smallint,
+//		ADD COLUMN hdop real, ADD COLUMN accuracy real, ADD COLUMN valid boolean,
+//		ADD COLUMN acc boolean, ADD COLUMN odometer double precision;
+//
+// Until the table is migrated the batch is inserted without optional field, the store
+// check for the column again after a restart
+func (st *PgStore) copy(recs []record) error {
+	if !st.legacy {
+		err := st.copy_columns(recs, false)
+		var pgerr *pgconn.PgError
+		if !errors.As(err, &pgerr) || pgerr.Code != pgerrcode.UndefinedColumn {
+			return err
+		}
+		st.log.Warn().Err(err).Str("table", st.table).Msg("optional location column missing, storing without optional field")
+		st.legacy = true
+	}
+	return st.copy_columns(recs, true)
+}
+
+var (
+	legacy_location_columns = []string{"nsn", "longitude", "latitude", "altitude", "speed", "gps_timestamp", "server_timestamp"}
+	location_columns        = append(legacy_location_columns[:len(legacy_location_columns):len(legacy_location_columns)],
+		"course", "sat_count", "hdop", "accuracy", "valid", "acc", "odometer")
+)
+
+func (st *PgStore) copy_columns(recs []record, legacy bool) error {
+	t1 := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), copy_timeout)
+	defer cancel()
+	cols := location_columns
+	if legacy {
+		cols = legacy_location_columns
+	}
+	_, err := st.dbp.CopyFrom(ctx,
+		pgx.Identifier{st.table},
+		cols,
+		pgx.CopyFromSlice(len(recs), func(i int) ([]interface{}, error) {
+			d := recs[i]
+			l := &d.loc
+			if legacy {
+				return []interface{}{d.nsn, l.Longitude, l.Latitude, l.Altitude, l.Speed, l.Timestamp, d.srvt}, nil
+			}
+			return []interface{}{d.nsn, l.Longitude, l.Latitude, l.Altitude, l.Speed, l.Timestamp, d.srvt,
+				l.Course, l.SatCount, l.HDOP, l.Accuracy, l.Valid, l.ACC, l.Odometer}, nil
+		}))
+	if err == nil {
+		st.log.Debug().Str("action", "flush").Int("length", len(recs)).Dur("time_taken", time.Since(t1)).Msg("flush successfull")
+	}
+	return err
 }
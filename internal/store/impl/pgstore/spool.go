@@ -0,0 +1,376 @@
+package pgstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+// spooled record : nsn(8) lon(8) lat(8) alt(4) speed(4) gpst(8) srvt(8), big endian,
+// time is unix nanosecond.
+// version 2 append presence(1) bool value(1) course(4) sat(2) hdop(4) accuracy(4) odometer(8)
+// using the presence bit of device.Location extension, absent field is zeroed
+const (
+	spool_record_size    = 48
+	spool_record_size_v2 = spool_record_size + 24
+)
+
+const (
+	spool_ext    = ".spool"
+	spool_ext_v2 = ".spool2"
+)
+
+// batch the database refuse are moved to this subdirectory of the spool, they can be moved
+// back into the spool directory to be replayed once the cause is fixed
+const spool_quarantine_dir = "quarantine"
+
+// spool keep batches which failed to be copied into the database, one file per batch,
+// named after the sequence of its buffer so replay happen in the order the buffers were
+// filled whatever the order they were spooled in
+type spool struct {
+	mu    sync.Mutex
+	dir   string
+	files []spool_file
+	//first sequence not used by a spooled or quarantined batch when the spool was opened
+	next        uint64
+	quarantined int
+}
+
+type spool_file struct {
+	seq     uint64
+	version int
+	records int
+	size    int64
+	t       time.Time
+}
+
+type SpoolStats struct {
+	Files     int     `json:"files"`
+	Records   int     `json:"records"`
+	Bytes     int64   `json:"bytes"`
+	OldestAge float64 `json:"oldest_age_seconds"`
+	//batch in the quarantine directory
+	Quarantined int `json:"quarantined"`
+}
+
+func open_spool(dir string) (*spool, error) {
+	err := os.MkdirAll(filepath.Join(dir, spool_quarantine_dir), 0o750)
+	if err != nil {
+		return nil, err
+	}
+	quarantined, err := os.ReadDir(filepath.Join(dir, spool_quarantine_dir))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sp := &spool{dir: dir, quarantined: len(quarantined)}
+	for _, e := range quarantined {
+		if seq, _, ok := parse_spool_name(e.Name()); ok && seq >= sp.next {
+			sp.next = seq + 1
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			//incomplete write from a crash, the batch was never acknowledged as spooled
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, version, ok := parse_spool_name(name)
+		if !ok {
+			continue
+		}
+		rsize := int64(spool_record_size)
+		if version == 2 {
+			rsize = spool_record_size_v2
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		sp.files = append(sp.files, spool_file{seq: seq, version: version, records: int(info.Size() / rsize), size: info.Size(), t: info.ModTime()})
+	}
+	sort.Slice(sp.files, func(i, j int) bool { return sp.files[i].seq < sp.files[j].seq })
+	if len(sp.files) > 0 && sp.files[len(sp.files)-1].seq >= sp.next {
+		sp.next = sp.files[len(sp.files)-1].seq + 1
+	}
+	return sp, nil
+}
+
+func parse_spool_name(name string) (uint64, int, bool) {
+	version, ext := 1, spool_ext
+	if strings.HasSuffix(name, spool_ext_v2) {
+		version, ext = 2, spool_ext_v2
+	} else if !strings.HasSuffix(name, spool_ext) {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return seq, version, true
+}
+
+func (sp *spool) path(seq uint64, version int) string {
+	ext := spool_ext
+	if version == 2 {
+		ext = spool_ext_v2
+	}
+	return filepath.Join(sp.dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+func (sp *spool) len() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.files)
+}
+
+// older report whether a batch older than seq is spooled
+func (sp *spool) older(seq uint64) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.files) > 0 && sp.files[0].seq < seq
+}
+
+// write spool batch seq at its place in the sequence, it is written without holding the
+// spool lock so replay is not held back by the disk
+func (sp *spool) write(seq uint64, recs []record) error {
+	d := encode_records(recs)
+	err := write_file(sp.path(seq, 2), d)
+	if err != nil {
+		return err
+	}
+	sf := spool_file{seq: seq, version: 2, records: len(recs), size: int64(len(d)), t: time.Now()}
+	sp.mu.Lock()
+	i := sort.Search(len(sp.files), func(i int) bool { return sp.files[i].seq > seq })
+	sp.files = append(sp.files, spool_file{})
+	copy(sp.files[i+1:], sp.files[i:])
+	sp.files[i] = sf
+	sp.mu.Unlock()
+	return nil
+}
+
+// write_quarantine write batch the database refused straight into the quarantine directory
+func (sp *spool) write_quarantine(seq uint64, recs []record) error {
+	p := sp.path(seq, 2)
+	err := write_file(filepath.Join(sp.dir, spool_quarantine_dir, filepath.Base(p)), encode_records(recs))
+	if err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	sp.quarantined++
+	sp.mu.Unlock()
+	return nil
+}
+
+func encode_records(recs []record) []byte {
+	d := make([]byte, len(recs)*spool_record_size_v2)
+	for i, r := range recs {
+		b := d[i*spool_record_size_v2:]
+		binary.BigEndian.PutUint64(b[0:8], r.nsn)
+		binary.BigEndian.PutUint64(b[8:16], math.Float64bits(r.loc.Longitude))
+		binary.BigEndian.PutUint64(b[16:24], math.Float64bits(r.loc.Latitude))
+		binary.BigEndian.PutUint32(b[24:28], math.Float32bits(r.loc.Altitude))
+		binary.BigEndian.PutUint32(b[28:32], math.Float32bits(r.loc.Speed))
+		binary.BigEndian.PutUint64(b[32:40], uint64(r.loc.Timestamp.UnixNano()))
+		binary.BigEndian.PutUint64(b[40:48], uint64(r.srvt.UnixNano()))
+		encode_optional(b[48:spool_record_size_v2], &r.loc)
+	}
+	return d
+}
+
+// write_file sync the file and rename it into place so a crash never leave a partially
+// written batch
+func write_file(p string, d []byte) error {
+	f, err := os.OpenFile(p+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p+".tmp", p)
+	}
+	if err != nil {
+		os.Remove(p + ".tmp")
+	}
+	return err
+}
+
+// oldest read the first batch of the spool, a trailing partial record is ignored
+func (sp *spool) oldest() (spool_file, []record, error) {
+	sp.mu.Lock()
+	if len(sp.files) == 0 {
+		sp.mu.Unlock()
+		return spool_file{}, nil, nil
+	}
+	sf := sp.files[0]
+	sp.mu.Unlock()
+	d, err := os.ReadFile(sp.path(sf.seq, sf.version))
+	if err != nil {
+		return sf, nil, err
+	}
+	rsize := spool_record_size
+	if sf.version == 2 {
+		rsize = spool_record_size_v2
+	}
+	n := len(d) / rsize
+	recs := make([]record, n)
+	for i := range recs {
+		b := d[i*rsize:]
+		recs[i] = record{
+			nsn: binary.BigEndian.Uint64(b[0:8]),
+			loc: device.Location{
+				Longitude: math.Float64frombits(binary.BigEndian.Uint64(b[8:16])),
+				Latitude:  math.Float64frombits(binary.BigEndian.Uint64(b[16:24])),
+				Altitude:  math.Float32frombits(binary.BigEndian.Uint32(b[24:28])),
+				Speed:     math.Float32frombits(binary.BigEndian.Uint32(b[28:32])),
+				Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(b[32:40]))).UTC(),
+			},
+			srvt: time.Unix(0, int64(binary.BigEndian.Uint64(b[40:48]))).UTC(),
+		}
+		if sf.version == 2 {
+			decode_optional(b[48:spool_record_size_v2], &recs[i].loc)
+		}
+	}
+	return sf, recs, nil
+}
+
+func encode_optional(b []byte, l *device.Location) {
+	var presence, bits byte
+	if l.Course != nil {
+		presence |= device.LOC_COURSE
+		binary.BigEndian.PutUint32(b[2:6], math.Float32bits(*l.Course))
+	}
+	if l.SatCount != nil {
+		presence |= device.LOC_SAT
+		binary.BigEndian.PutUint16(b[6:8], uint16(*l.SatCount))
+	}
+	if l.HDOP != nil {
+		presence |= device.LOC_HDOP
+		binary.BigEndian.PutUint32(b[8:12], math.Float32bits(*l.HDOP))
+	}
+	if l.Accuracy != nil {
+		presence |= device.LOC_ACCURACY
+		binary.BigEndian.PutUint32(b[12:16], math.Float32bits(*l.Accuracy))
+	}
+	if l.Valid != nil {
+		presence |= device.LOC_VALID
+		if *l.Valid {
+			bits |= 1 << 0
+		}
+	}
+	if l.ACC != nil {
+		presence |= device.LOC_ACC
+		if *l.ACC {
+			bits |= 1 << 1
+		}
+	}
+	if l.Odometer != nil {
+		presence |= device.LOC_ODOMETER
+		binary.BigEndian.PutUint64(b[16:24], math.Float64bits(*l.Odometer))
+	}
+	b[0] = presence
+	b[1] = bits
+}
+
+func decode_optional(b []byte, l *device.Location) {
+	presence, bits := b[0], b[1]
+	if presence&device.LOC_COURSE != 0 {
+		v := math.Float32frombits(binary.BigEndian.Uint32(b[2:6]))
+		l.Course = &v
+	}
+	if presence&device.LOC_SAT != 0 {
+		v := int(binary.BigEndian.Uint16(b[6:8]))
+		l.SatCount = &v
+	}
+	if presence&device.LOC_HDOP != 0 {
+		v := math.Float32frombits(binary.BigEndian.Uint32(b[8:12]))
+		l.HDOP = &v
+	}
+	if presence&device.LOC_ACCURACY != 0 {
+		v := math.Float32frombits(binary.BigEndian.Uint32(b[12:16]))
+		l.Accuracy = &v
+	}
+	if presence&device.LOC_VALID != 0 {
+		v := bits&(1<<0) != 0
+		l.Valid = &v
+	}
+	if presence&device.LOC_ACC != 0 {
+		v := bits&(1<<1) != 0
+		l.ACC = &v
+	}
+	if presence&device.LOC_ODOMETER != 0 {
+		v := math.Float64frombits(binary.BigEndian.Uint64(b[16:24]))
+		l.Odometer = &v
+	}
+}
+
+func (sp *spool) remove(sf spool_file) error {
+	err := os.Remove(sp.path(sf.seq, sf.version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sp.mu.Lock()
+	sp.drop(sf.seq)
+	sp.mu.Unlock()
+	return nil
+}
+
+// quarantine move the oldest batch out of the spool so replay can go on with the next one
+func (sp *spool) quarantine(sf spool_file) error {
+	p := sp.path(sf.seq, sf.version)
+	err := os.Rename(p, filepath.Join(sp.dir, spool_quarantine_dir, filepath.Base(p)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sp.mu.Lock()
+	sp.drop(sf.seq)
+	sp.quarantined++
+	sp.mu.Unlock()
+	return nil
+}
+
+// drop forget the batch seq, the caller must hold mu
+func (sp *spool) drop(seq uint64) {
+	for i := range sp.files {
+		if sp.files[i].seq == seq {
+			sp.files = append(sp.files[:i], sp.files[i+1:]...)
+			return
+		}
+	}
+}
+
+func (sp *spool) stats() SpoolStats {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	s := SpoolStats{Files: len(sp.files), Quarantined: sp.quarantined}
+	for _, f := range sp.files {
+		s.Records += f.records
+		s.Bytes += f.size
+	}
+	if len(sp.files) > 0 {
+		s.OldestAge = time.Since(sp.files[0].t).Seconds()
+	}
+	return s
+}
@@ -0,0 +1,263 @@
+package pgstore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+)
+
+func testRecord(nsn uint64) record {
+	gpst := time.Date(2021, 9, 1, 10, 0, int(nsn), 0, time.UTC)
+	return record{nsn: nsn, loc: device.Location{Latitude: -6.2, Longitude: 106.8, Altitude: 12.5, Speed: 3, Timestamp: gpst}, srvt: gpst.Add(time.Second)}
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := open_spool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	course, hdop, acc := float32(270.5), float32(0.9), float32(35)
+	sat, valid, on, odo := 11, false, true, 123456.75
+	full := testRecord(1)
+	full.loc.Course, full.loc.HDOP, full.loc.Accuracy = &course, &hdop, &acc
+	full.loc.SatCount, full.loc.Valid, full.loc.ACC, full.loc.Odometer = &sat, &valid, &on, &odo
+	//written out of order, read in sequence order
+	if err := sp.write(5, []record{full, testRecord(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.write(2, []record{testRecord(3)}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sp.stats(); s.Files != 2 || s.Records != 3 || s.Bytes != 3*spool_record_size_v2 {
+		t.Fatalf("stats %+v", s)
+	}
+
+	//reopening find the same batches
+	sp, err = open_spool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.next != 6 {
+		t.Fatalf("next sequence %d", sp.next)
+	}
+	if !sp.older(3) || sp.older(2) {
+		t.Fatal("older batch not reported")
+	}
+	sf, recs, err := sp.oldest()
+	if err != nil || sf.seq != 2 || !reflect.DeepEqual(recs, []record{testRecord(3)}) {
+		t.Fatalf("oldest %d %+v %v", sf.seq, recs, err)
+	}
+	if err := sp.remove(sf); err != nil {
+		t.Fatal(err)
+	}
+	sf, recs, err = sp.oldest()
+	if err != nil || sf.seq != 5 || !reflect.DeepEqual(recs, []record{full, testRecord(2)}) {
+		t.Fatalf("oldest %d %+v %v", sf.seq, recs, err)
+	}
+	if err := sp.remove(sf); err != nil {
+		t.Fatal(err)
+	}
+	if sf, recs, err := sp.oldest(); err != nil || recs != nil {
+		t.Fatalf("empty spool returned %d %+v %v", sf.seq, recs, err)
+	}
+}
+
+func TestSpoolVersion1(t *testing.T) {
+	dir := t.TempDir()
+	r := testRecord(7)
+	d := make([]byte, spool_record_size)
+	binary.BigEndian.PutUint64(d[0:8], r.nsn)
+	binary.BigEndian.PutUint64(d[8:16], math.Float64bits(r.loc.Longitude))
+	binary.BigEndian.PutUint64(d[16:24], math.Float64bits(r.loc.Latitude))
+	binary.BigEndian.PutUint32(d[24:28], math.Float32bits(r.loc.Altitude))
+	binary.BigEndian.PutUint32(d[28:32], math.Float32bits(r.loc.Speed))
+	binary.BigEndian.PutUint64(d[32:40], uint64(r.loc.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint64(d[40:48], uint64(r.srvt.UnixNano()))
+	//trailing partial record from an interrupted write
+	d = append(d, 1, 2, 3)
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000003.spool"), d, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000004.spool2.tmp"), []byte{1}, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	sp, err := open_spool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000004.spool2.tmp")); !os.IsNotExist(err) {
+		t.Fatal("incomplete write not removed")
+	}
+	sf, recs, err := sp.oldest()
+	if err != nil || sf.seq != 3 || sf.version != 1 || !reflect.DeepEqual(recs, []record{r}) {
+		t.Fatalf("oldest %+v %+v %v", sf, recs, err)
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := open_spool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.write(1, []record{testRecord(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.write_quarantine(9, []record{testRecord(2)}); err != nil {
+		t.Fatal(err)
+	}
+	sf, _, _ := sp.oldest()
+	if err := sp.quarantine(sf); err != nil {
+		t.Fatal(err)
+	}
+	if s := sp.stats(); s.Files != 0 || s.Quarantined != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+	sp, err = open_spool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//quarantined batch keep their sequence
+	if s := sp.stats(); s.Files != 0 || s.Quarantined != 2 || sp.next != 10 {
+		t.Fatalf("stats %+v next %d", s, sp.next)
+	}
+}
+
+// fakeCopy record the nsn of every copied batch, err decide the outcome of each copy
+type fakeCopy struct {
+	mu     sync.Mutex
+	copied [][]uint64
+	err    func(nsn []uint64) error
+}
+
+func (f *fakeCopy) copy(recs []record) error {
+	nsn := make([]uint64, len(recs))
+	for i := range recs {
+		nsn[i] = recs[i].nsn
+	}
+	if f.err != nil {
+		if err := f.err(nsn); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.copied = append(f.copied, nsn)
+	f.mu.Unlock()
+	return nil
+}
+
+func testStore(t *testing.T, dir string, f *fakeCopy) *PgStore {
+	st := NewStore(nil, "locations_history", &StoreConfig{BufSize: 1, TickerDur: time.Hour, MaxAgeFlush: time.Hour, SpoolDir: dir, SpoolRetry: time.Hour})
+	if st.spool == nil {
+		t.Fatal("spool not opened")
+	}
+	st.copy_batch = f.copy
+	return st
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	f := &fakeCopy{}
+	st := testStore(t, dir, f)
+	for seq := uint64(0); seq < 4; seq++ {
+		if err := st.spool.write(seq, []record{testRecord(seq)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transient := errors.New("connection refused")
+	f.err = func(nsn []uint64) error {
+		if nsn[0] == 2 {
+			return transient
+		}
+		return nil
+	}
+	st.replay(math.MaxUint64)
+	if !reflect.DeepEqual(f.copied, [][]uint64{{0}, {1}}) || st.spool.len() != 2 {
+		t.Fatalf("copied %v, %d batch left", f.copied, st.spool.len())
+	}
+
+	//missing table during a migration is retried, constraint violation is quarantined
+	f.err = func(nsn []uint64) error {
+		return &pgconn.PgError{Code: "42P01"}
+	}
+	st.replay(math.MaxUint64)
+	if st.spool.len() != 2 || st.SpoolStats().Quarantined != 0 {
+		t.Fatalf("%+v", st.SpoolStats())
+	}
+	f.err = func(nsn []uint64) error {
+		if nsn[0] == 2 {
+			return &pgconn.PgError{Code: "23505"}
+		}
+		return nil
+	}
+	st.replay(math.MaxUint64)
+	if !reflect.DeepEqual(f.copied, [][]uint64{{0}, {1}, {3}}) || st.spool.len() != 0 || st.SpoolStats().Quarantined != 1 {
+		t.Fatalf("copied %v, %+v", f.copied, st.SpoolStats())
+	}
+	if _, err := os.Stat(filepath.Join(dir, spool_quarantine_dir, "00000000000000000002.spool2")); err != nil {
+		t.Fatal(err)
+	}
+
+	//replay stop at the batch not older than before
+	if err := st.spool.write(5, []record{testRecord(5)}); err != nil {
+		t.Fatal(err)
+	}
+	st.replay(5)
+	if st.spool.len() != 1 {
+		t.Fatal("newer batch replayed")
+	}
+}
+
+// TestWriteOrder fill the store while the database is stuck, buffer the flusher can not
+// take are spooled and must still be inserted in the order they were filled
+func TestWriteOrder(t *testing.T) {
+	dir := t.TempDir()
+	f := &fakeCopy{}
+	st := testStore(t, dir, f)
+	release := make(chan struct{})
+	var once sync.Once
+	f.err = func(nsn []uint64) error {
+		once.Do(func() { <-release })
+		return nil
+	}
+	st.Run()
+	const n = 12
+	for i := uint64(0); i < n; i++ {
+		r := testRecord(i)
+		st.Put(r.nsn, &r.loc, r.srvt)
+	}
+	if st.spool.len() == 0 {
+		t.Fatal("nothing spooled")
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := st.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	//batch spooled after the last queued buffer are replayed on the next start
+	st = testStore(t, dir, f)
+	st.Run()
+	if err := st.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.copied) != n {
+		t.Fatalf("copied %v", f.copied)
+	}
+	for i, nsn := range f.copied {
+		if nsn[0] != uint64(i) {
+			t.Fatalf("copied out of order %v", f.copied)
+		}
+	}
+}
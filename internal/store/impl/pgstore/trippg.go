@@ -0,0 +1,54 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// PgTripStore keep trip and stop in tracker_segment :
+//
+//	CREATE TABLE tracker_segment (
+//		id bigserial PRIMARY KEY,
+//		tracker_id bigint NOT NULL REFERENCES tracker(id) ON DELETE CASCADE,
+//		kind text NOT NULL,
+//		start_time timestamptz NOT NULL,
+//		end_time timestamptz NOT NULL,
+//		start_lat double precision NOT NULL,
+//		start_lon double precision NOT NULL,
+//		end_lat double precision NOT NULL,
+//		end_lon double precision NOT NULL,
+//		distance double precision NOT NULL DEFAULT 0,
+//		max_speed real NOT NULL DEFAULT 0,
+//		avg_speed real NOT NULL DEFAULT 0,
+//		duration bigint NOT NULL,
+//		UNIQUE (tracker_id, kind, start_time)
+//	);
+//	CREATE INDEX ON tracker_segment (tracker_id, start_time);
+type PgTripStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewTripStore(db *pgxpool.Pool) *PgTripStore {
+	m := PgTripStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "trip_store").Value()
+	return &m
+}
+
+// SaveSegment replace the segment of the same kind starting at the same time, so live
+// detection and rebuild from history does not duplicate each other
+func (st *PgTripStore) SaveSegment(seg *store.Segment) {
+	_, err := st.db.Exec(context.Background(), `INSERT INTO tracker_segment (tracker_id,kind,start_time,end_time,start_lat,start_lon,end_lat,end_lon,distance,max_speed,avg_speed,duration)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+	ON CONFLICT (tracker_id,kind,start_time) DO UPDATE SET end_time = EXCLUDED.end_time, end_lat = EXCLUDED.end_lat, end_lon = EXCLUDED.end_lon,
+	distance = EXCLUDED.distance, max_speed = EXCLUDED.max_speed, avg_speed = EXCLUDED.avg_speed, duration = EXCLUDED.duration`,
+		seg.TrackerId, seg.Kind, seg.Start, seg.End, seg.StartLat, seg.StartLon, seg.EndLat, seg.EndLon, seg.Distance, seg.MaxSpeed, seg.AvgSpeed, seg.Duration)
+	if err != nil {
+		st.log.Error().Err(err).Uint64("tracker_id", seg.TrackerId).Str("kind", seg.Kind).Msg("error saving segment")
+	}
+}
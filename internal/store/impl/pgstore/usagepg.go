@@ -0,0 +1,41 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+)
+
+// PgUsageStore keep daily distance and engine time in tracker_usage :
+//
+//	CREATE TABLE tracker_usage (
+//		tracker_id bigint NOT NULL REFERENCES tracker(id) ON DELETE CASCADE,
+//		day date NOT NULL,
+//		distance double precision NOT NULL DEFAULT 0,
+//		engine_seconds double precision NOT NULL DEFAULT 0,
+//		PRIMARY KEY (tracker_id, day)
+//	);
+type PgUsageStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewUsageStore(db *pgxpool.Pool) *PgUsageStore {
+	m := PgUsageStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "usage_store").Value()
+	return &m
+}
+
+// AddUsage add to the total of day, only the date of day is used
+func (st *PgUsageStore) AddUsage(tid uint64, day time.Time, distance float64, engine_seconds float64) {
+	_, err := st.db.Exec(context.Background(), `INSERT INTO tracker_usage (tracker_id,day,distance,engine_seconds) VALUES ($1,$2::date,$3,$4)
+	ON CONFLICT (tracker_id,day) DO UPDATE SET distance = tracker_usage.distance + EXCLUDED.distance, engine_seconds = tracker_usage.engine_seconds + EXCLUDED.engine_seconds`,
+		tid, day.Format("2006-01-02"), distance, engine_seconds)
+	if err != nil {
+		st.log.Error().Err(err).Uint64("tracker_id", tid).Msg("error saving usage")
+	}
+}
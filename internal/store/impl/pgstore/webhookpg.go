@@ -0,0 +1,73 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/phuslu/log"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+// PgWebhookStore keep webhook in webhook and failed delivery in webhook_dead_letter :
+//
+//	CREATE TABLE webhook (
+//		id bigserial PRIMARY KEY,
+//		url text NOT NULL,
+//		secret text NOT NULL DEFAULT '',
+//		events text[] NOT NULL DEFAULT '{}',
+//		trackers bigint[] NOT NULL DEFAULT '{}',
+//		enabled bool NOT NULL DEFAULT true,
+//		created_at timestamptz NOT NULL DEFAULT now()
+//	);
+//	CREATE TABLE webhook_dead_letter (
+//		id bigserial PRIMARY KEY,
+//		webhook_id bigint NOT NULL REFERENCES webhook(id) ON DELETE CASCADE,
+//		payload jsonb NOT NULL,
+//		attempts int NOT NULL,
+//		last_status int,
+//		last_error text,
+//		failed_at timestamptz NOT NULL
+//	);
+//	CREATE INDEX ON webhook_dead_letter (webhook_id, id);
+type PgWebhookStore struct {
+	db  *pgxpool.Pool
+	log log.Logger
+}
+
+func NewWebhookStore(db *pgxpool.Pool) *PgWebhookStore {
+	m := PgWebhookStore{}
+	m.db = db
+	m.log = log.DefaultLogger
+	m.log.Context = log.NewContext(nil).Str("module", "webhook_store").Value()
+	return &m
+}
+
+// Webhooks return enabled webhook
+func (st *PgWebhookStore) Webhooks() ([]store.Webhook, error) {
+	rows, err := st.db.Query(context.Background(), `SELECT id,url,secret,events,trackers FROM webhook WHERE enabled ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := make([]store.Webhook, 0)
+	for rows.Next() {
+		w := store.Webhook{}
+		var trackers []int64
+		err := rows.Scan(&w.Id, &w.Url, &w.Secret, &w.Events, &trackers)
+		if err != nil {
+			return nil, err
+		}
+		w.Trackers = make([]uint64, len(trackers))
+		for i, tid := range trackers {
+			w.Trackers[i] = uint64(tid)
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+func (st *PgWebhookStore) SaveDeadLetter(d *store.WebhookDeadLetter) error {
+	_, err := st.db.Exec(context.Background(), `INSERT INTO webhook_dead_letter (webhook_id,payload,attempts,last_status,last_error,failed_at) VALUES ($1,$2,$3,nullif($4,0),$5,$6)`,
+		d.WebhookId, string(d.Payload), d.Attempts, d.LastStatus, d.LastError, d.FailedAt)
+	return err
+}
@@ -2,10 +2,12 @@ package store
 
 import (
 	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/device"
 )
 
 type LocationStore interface {
-	Put(nsn uint64, lon float64, lat float64, alt float32, speed float32, gpst time.Time, srvt time.Time)
+	Put(nsn uint64, loc *device.Location, srvt time.Time)
 }
 
 type MiscStore interface {
@@ -13,3 +15,196 @@ type MiscStore interface {
 	SaveEvent(tid uint64, event_type string, message string, message_obj interface{}, t time.Time)
 	UpdateAttribute(tid uint64, key string, value string)
 }
+
+// server flag of command delivered from the queue carry the command id with this bit set
+const QUEUE_SERVER_FLAG uint32 = 0x80000000
+
+const (
+	COMMAND_QUEUED       string = "queued"
+	COMMAND_SENT         string = "sent"
+	COMMAND_ACKNOWLEDGED string = "acknowledged"
+	COMMAND_FAILED       string = "failed"
+	COMMAND_EXPIRED      string = "expired"
+)
+
+type QueuedCommand struct {
+	Id         uint64
+	TrackerId  uint64
+	Command    string
+	Status     string
+	Attempt    int
+	MaxAttempt int
+	SentAt     *time.Time
+	ExpireAt   time.Time
+}
+
+// CommandStore persist command queued for a tracker until the device acknowledge them
+type CommandStore interface {
+	//PendingCommands expire overdue command then return queued and sent command, oldest first
+	PendingCommands(tid uint64) ([]QueuedCommand, error)
+	MarkCommandSent(id uint64, attempt int, t time.Time)
+	MarkCommandAcknowledged(id uint64, response string, t time.Time)
+	MarkCommandFailed(id uint64, reason string, t time.Time)
+}
+
+type Cell struct {
+	MCC    int
+	MNC    int
+	LAC    int
+	CellID int
+}
+
+// GeoPoint is known position of a cell tower or wifi access point, Range is in meter
+type GeoPoint struct {
+	Latitude  float64
+	Longitude float64
+	Range     float64
+}
+
+// GeoStore look up position of cell tower and wifi access point, unknown one is absent from the result
+type GeoStore interface {
+	LocateCells(cells []Cell) (map[Cell]GeoPoint, error)
+	LocateWiFi(macs []string) (map[string]GeoPoint, error)
+}
+
+const (
+	SEGMENT_TRIP string = "trip"
+	SEGMENT_STOP string = "stop"
+)
+
+// Segment is a trip or a stop of a tracker, a stop start and end at the same place.
+// Distance is in meter, speed in m/s and duration in second
+type Segment struct {
+	TrackerId uint64    `json:"tracker_id"`
+	Kind      string    `json:"kind"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	StartLat  float64   `json:"start_lat"`
+	StartLon  float64   `json:"start_lon"`
+	EndLat    float64   `json:"end_lat"`
+	EndLon    float64   `json:"end_lon"`
+	Distance  float64   `json:"distance"`
+	MaxSpeed  float32   `json:"max_speed"`
+	AvgSpeed  float32   `json:"avg_speed"`
+	Duration  int64     `json:"duration"`
+}
+
+// TripStore persist trip and stop detected from live location
+type TripStore interface {
+	SaveSegment(seg *Segment)
+}
+
+// UsageStore accumulate distance in meter and engine second of a tracker per day
+type UsageStore interface {
+	AddUsage(tid uint64, day time.Time, distance float64, engine_seconds float64)
+}
+
+const (
+	GEOFENCE_CIRCLE  string = "circle"
+	GEOFENCE_POLYGON string = "polygon"
+)
+
+// Geofence belong to one tracker or to every tracker of a group. Circle use Latitude, Longitude
+// and Radius in meter, polygon use Polygon as list of [lat, lon]
+type Geofence struct {
+	Id        uint64       `json:"id"`
+	Name      string       `json:"name"`
+	TrackerId *uint64      `json:"tracker_id"`
+	Group     *string      `json:"group"`
+	Kind      string       `json:"kind"`
+	Latitude  float64      `json:"lat"`
+	Longitude float64      `json:"lon"`
+	Radius    float64      `json:"radius"`
+	Polygon   [][2]float64 `json:"polygon"`
+}
+
+// GeofenceStore return geofence of a tracker, including those of the group in its current config
+type GeofenceStore interface {
+	TrackerGeofences(tid uint64) ([]Geofence, error)
+}
+
+const (
+	RULE_OVERSPEED     string = "overspeed"
+	RULE_ACC_HOURS     string = "acc_off_hours"
+	RULE_OFFLINE       string = "offline"
+	RULE_LOW_VOLTAGE   string = "low_voltage"
+	RULE_GEOFENCE      string = "geofence"
+	ALERT_OPEN         string = "open"
+	ALERT_ACKNOWLEDGED string = "acknowledged"
+	ALERT_RESOLVED     string = "resolved"
+)
+
+// AlertRule apply to one tracker, to the trackers of a group or to every tracker when
+// both are nil. Trackers is the resolved list of tracker, nil when the rule apply to every tracker
+type AlertRule struct {
+	Id        uint64
+	Name      string
+	Kind      string
+	TrackerId *uint64
+	Group     *string
+	Params    RuleParams
+	Trackers  []uint64
+}
+
+// RuleParams hold the setting of every rule kind, only those of the rule kind are used
+type RuleParams struct {
+	//overspeed, speed in m/s held for duration second
+	Speed    float64 `json:"speed,omitempty"`
+	Duration int     `json:"duration,omitempty"`
+	//acc_off_hours, business hours as hh:mm, weekday 0 is sunday, every day when empty
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Weekdays []int  `json:"weekdays,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	//offline, minute without any message
+	Minutes int `json:"minutes,omitempty"`
+	//low_voltage, battery voltage unless External is set
+	Voltage  float64 `json:"voltage,omitempty"`
+	External bool    `json:"external,omitempty"`
+	//geofence, every geofence when zero, enter, exit or both when empty
+	GeofenceId uint64 `json:"geofence_id,omitempty"`
+	Transition string `json:"transition,omitempty"`
+}
+
+type Alert struct {
+	Id          uint64      `json:"id"`
+	RuleId      uint64      `json:"rule_id"`
+	TrackerId   uint64      `json:"tracker_id"`
+	Kind        string      `json:"kind"`
+	Name        string      `json:"name"`
+	Detail      interface{} `json:"detail"`
+	TriggeredAt time.Time   `json:"triggered_at"`
+}
+
+// AlertStore load enabled alert rule and record alert triggered by them
+type AlertStore interface {
+	AlertRules() ([]AlertRule, error)
+	SaveAlert(a *Alert) error
+}
+
+// Webhook receive location and event of the trackers it is subscribed to. Events hold the
+// topic delivered, "location" for location, a topic ending with * match by prefix and
+// every topic is delivered when empty. Trackers empty means every tracker
+type Webhook struct {
+	Id       uint64
+	Url      string
+	Secret   string
+	Events   []string
+	Trackers []uint64
+}
+
+// WebhookDeadLetter is a delivery given up after its last attempt
+type WebhookDeadLetter struct {
+	WebhookId  uint64
+	Payload    []byte
+	Attempts   int
+	LastStatus int
+	LastError  string
+	FailedAt   time.Time
+}
+
+// WebhookStore load enabled webhook and keep delivery which could not be made
+type WebhookStore interface {
+	Webhooks() ([]Webhook, error)
+	SaveDeadLetter(d *WebhookDeadLetter) error
+}
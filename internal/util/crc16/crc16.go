@@ -42,6 +42,12 @@ var (
 		IniVal: 0x0, FinVal: 0x0,
 		BigEnd: false,
 	}
+	ARC = &Conf{
+		Poly: 0x8005, BitRev: true,
+		IniVal: 0x0, FinVal: 0x0,
+		BigEnd: false,
+	}
+	IBM = ARC
 )
 
 // Conf is a CRC configuration. It is passed to functions New and
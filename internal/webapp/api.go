@@ -1,6 +1,7 @@
 package webapp
 
 import (
+	"context"
 	"net/http"
 	"time"
 
@@ -56,9 +57,39 @@ func NewApi(db *pgxpool.Pool, gps *server.Server, config *ApiConfig) *Api {
 	disp.Add("GetTrackerEvent", tracker_api.GetTrackerEvent, "tracker-monitor")
 	disp.Add("GetGT06CmdHistory", tracker_api.GetGT06CmdHistory, "tracker-monitor")
 	disp.Add("GetTrackerCurrentConnInfo", tracker_api.GetTrackerCurrentConnInfo, "tracker-monitor")
+	disp.Add("GetCommandJobs", tracker_api.GetCommandJobs, "tracker-monitor")
+	disp.Add("GetQueuedCommands", tracker_api.GetQueuedCommands, "tracker-monitor")
+	disp.Add("GetTrackerCapability", tracker_api.GetTrackerCapability, "tracker-monitor")
+	disp.Add("GetTrackerRejectCount", tracker_api.GetTrackerRejectCount, "tracker-monitor")
+	disp.Add("GetTrackerTrips", tracker_api.GetTrackerTrips, "tracker-monitor")
+	disp.Add("GetTrackerUsage", tracker_api.GetTrackerUsage, "tracker-monitor")
+	disp.Add("GetGeofences", tracker_api.GetGeofences, "tracker-monitor")
+	disp.Add("GetAlertRules", tracker_api.GetAlertRules, "tracker-monitor")
+	disp.Add("GetAlerts", tracker_api.GetAlerts, "tracker-monitor")
+	disp.Add("AcknowledgeAlert", tracker_api.AcknowledgeAlert, "tracker-monitor")
+	disp.Add("ResolveAlert", tracker_api.ResolveAlert, "tracker-monitor")
 	disp.AddRaw("GetTrackerLocationHistory", tracker_api.GetTrackerLocationHistory, "tracker-monitor")
 
 	disp.Add("SendCommand2", tracker_api.SendCommand2, "tracker-admin")
+	disp.Add("SendTrackerCommand", tracker_api.SendTrackerCommand, "tracker-admin")
+	disp.Add("ResetTrackerRegistration", tracker_api.ResetTrackerRegistration, "tracker-admin")
+	disp.Add("EnqueueCommand", tracker_api.EnqueueCommand, "tracker-admin")
+	disp.Add("CancelQueuedCommand", tracker_api.CancelQueuedCommand, "tracker-admin")
+	disp.Add("CreateCommandJob", tracker_api.CreateCommandJob, "tracker-admin")
+	disp.Add("SetCommandJobEnabled", tracker_api.SetCommandJobEnabled, "tracker-admin")
+	disp.Add("DeleteCommandJob", tracker_api.DeleteCommandJob, "tracker-admin")
+	disp.Add("CreateGeofence", tracker_api.CreateGeofence, "tracker-admin")
+	disp.Add("UpdateGeofence", tracker_api.UpdateGeofence, "tracker-admin")
+	disp.Add("DeleteGeofence", tracker_api.DeleteGeofence, "tracker-admin")
+	disp.Add("CreateAlertRule", tracker_api.CreateAlertRule, "tracker-admin")
+	disp.Add("SetAlertRuleEnabled", tracker_api.SetAlertRuleEnabled, "tracker-admin")
+	disp.Add("DeleteAlertRule", tracker_api.DeleteAlertRule, "tracker-admin")
+	disp.Add("CreateWebhook", tracker_api.CreateWebhook, "tracker-admin")
+	disp.Add("GetWebhooks", tracker_api.GetWebhooks, "tracker-admin")
+	disp.Add("SetWebhookEnabled", tracker_api.SetWebhookEnabled, "tracker-admin")
+	disp.Add("DeleteWebhook", tracker_api.DeleteWebhook, "tracker-admin")
+	disp.Add("GetWebhookDeadLetters", tracker_api.GetWebhookDeadLetters, "tracker-admin")
+	disp.Add("RebuildTrackerTrips", tracker_api.RebuildTrackerTrips, "tracker-admin")
 	disp.Add("EditTrackerSettings", tracker_api.EditTrackerSettings, "tracker-admin")
 	disp.Add("SetTrackerName", tracker_api.SetTrackerName, "tracker-admin")
 	disp.Add("PurgeTracker", tracker_api.PurgeTracker, "tracker-admin")
@@ -106,12 +137,17 @@ func NewApi(db *pgxpool.Pool, gps *server.Server, config *ApiConfig) *Api {
 func (api *Api) Run() {
 	api.log.Info().Msgf("starting api-server on : %s", api.s.Addr)
 	err := api.s.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		api.log.Error().Err(err).Msg("")
 		panic(err)
 	}
 }
 
+func (api *Api) Shutdown(ctx context.Context) error {
+	api.log.Info().Msg("shutting down api-server")
+	return api.s.Shutdown(ctx)
+}
+
 func xsrf_verify(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hsrf := r.Header.Get("X-XSRF-TOKEN")
@@ -0,0 +1,235 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/alert"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/store"
+	"nuha.dev/gpstracker/internal/webapp/common"
+)
+
+type CreateAlertRuleReq struct {
+	Name      string           `json:"name" validate:"required"`
+	Kind      string           `json:"kind" validate:"required,oneof=overspeed acc_off_hours offline low_voltage geofence"`
+	TrackerId *uint64          `json:"tracker_id"`
+	Group     *string          `json:"group"`
+	Params    store.RuleParams `json:"params"`
+}
+
+type CreateAlertRuleRes struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+	RuleId  uint64 `json:"rule_id"`
+}
+
+type AlertRuleModel struct {
+	Id        uint64           `json:"id"`
+	Name      string           `json:"name"`
+	Kind      string           `json:"kind"`
+	TrackerId *uint64          `json:"tracker_id"`
+	Group     *string          `json:"group"`
+	Params    store.RuleParams `json:"params"`
+	Enabled   bool             `json:"enabled"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+type AlertRuleIdRequestModel struct {
+	RuleId uint64 `json:"rule_id" validate:"required"`
+}
+
+type SetAlertRuleEnabledReq struct {
+	RuleId  uint64 `json:"rule_id" validate:"required"`
+	Enabled bool   `json:"enabled"`
+}
+
+type GetAlertsReq struct {
+	//every tracker when zero
+	TrackerId uint64 `json:"tracker_id"`
+	//open, acknowledged or resolved, every status when empty
+	Status  string `json:"status" validate:"omitempty,oneof=open acknowledged resolved"`
+	Pointer uint64 `json:"pointer"`
+	Limit   int    `json:"limit"`
+}
+
+type AlertModel struct {
+	Id             uint64          `json:"id"`
+	RuleId         *uint64         `json:"rule_id"`
+	TrackerId      uint64          `json:"tracker_id"`
+	Kind           string          `json:"kind"`
+	Name           string          `json:"name"`
+	Detail         json.RawMessage `json:"detail"`
+	Status         string          `json:"status"`
+	TriggeredAt    time.Time       `json:"triggered_at"`
+	AcknowledgedAt *time.Time      `json:"acknowledged_at"`
+	ResolvedAt     *time.Time      `json:"resolved_at"`
+	Note           *string         `json:"note"`
+}
+
+type AlertActionReq struct {
+	AlertId uint64 `json:"alert_id" validate:"required"`
+	Note    string `json:"note"`
+}
+
+// check_rule_params validate the params used by the rule kind
+func check_rule_params(kind string, p *store.RuleParams) error {
+	switch kind {
+	case store.RULE_OVERSPEED:
+		if p.Speed <= 0 || p.Duration < 0 {
+			return fmt.Errorf("overspeed rule need a positive speed and duration")
+		}
+	case store.RULE_ACC_HOURS:
+		if _, err := alert.ParseClock(p.Start); err != nil {
+			return err
+		}
+		if _, err := alert.ParseClock(p.End); err != nil {
+			return err
+		}
+		for _, d := range p.Weekdays {
+			if d < 0 || d > 6 {
+				return fmt.Errorf("invalid weekday %d", d)
+			}
+		}
+		if p.Timezone != "" {
+			if _, err := device.ParseTimezone(p.Timezone); err != nil {
+				return err
+			}
+		}
+	case store.RULE_OFFLINE:
+		if p.Minutes <= 0 {
+			return fmt.Errorf("offline rule need a positive minutes")
+		}
+	case store.RULE_LOW_VOLTAGE:
+		if p.Voltage <= 0 {
+			return fmt.Errorf("low voltage rule need a positive voltage")
+		}
+	case store.RULE_GEOFENCE:
+		if p.Transition != "" && p.Transition != "enter" && p.Transition != "exit" {
+			return fmt.Errorf("transition must be enter or exit")
+		}
+	}
+	return nil
+}
+
+// CreateAlertRule store a rule, the alert engine pick it up within a minute
+func (t *Tracker) CreateAlertRule(ctx context.Context, req *CreateAlertRuleReq, res *CreateAlertRuleRes) error {
+	if err := check_rule_params(req.Kind, &req.Params); err != nil {
+		res.Status = -1
+		res.Message = err.Error()
+		return nil
+	}
+	sqlStmt := `INSERT INTO alert_rule (name,kind,tracker_id,tracker_group,params) VALUES ($1,$2,$3,$4,$5) RETURNING id`
+	err := t.db.QueryRow(ctx, sqlStmt, req.Name, req.Kind, req.TrackerId, req.Group, req.Params).Scan(&res.RuleId)
+	if err != nil {
+		return err
+	}
+	res.Status = 0
+	return nil
+}
+
+func (t *Tracker) GetAlertRules(ctx context.Context, res *[]*AlertRuleModel) error {
+	rows, err := t.db.Query(ctx, `SELECT id,name,kind,tracker_id,tracker_group,params,enabled,created_at FROM alert_rule ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	rules := make([]*AlertRuleModel, 0)
+	for rows.Next() {
+		r := &AlertRuleModel{}
+		err := rows.Scan(&r.Id, &r.Name, &r.Kind, &r.TrackerId, &r.Group, &r.Params, &r.Enabled, &r.CreatedAt)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	*res = rules
+	return rows.Err()
+}
+
+func (t *Tracker) SetAlertRuleEnabled(ctx context.Context, req *SetAlertRuleEnabledReq, res *common.BasicResponse) error {
+	ct, err := t.db.Exec(ctx, `UPDATE alert_rule SET enabled = $1 WHERE id = $2`, req.Enabled, req.RuleId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "rule not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+func (t *Tracker) DeleteAlertRule(ctx context.Context, req *AlertRuleIdRequestModel, res *common.BasicResponse) error {
+	ct, err := t.db.Exec(ctx, `DELETE FROM alert_rule WHERE id = $1`, req.RuleId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "rule not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+// GetAlerts return alert newest first, pointer is the id of the last alert of the previous page
+func (t *Tracker) GetAlerts(ctx context.Context, req *GetAlertsReq, res *[]*AlertModel) error {
+	if req.Limit == 0 {
+		req.Limit = 20
+	}
+	query := `SELECT id,rule_id,tracker_id,kind,name,detail,status,triggered_at,acknowledged_at,resolved_at,note FROM alert
+	WHERE ($1 = 0 OR tracker_id = $1) AND ($2 = '' OR status = $2) AND ($3 = 0 OR id < $3) ORDER BY id DESC LIMIT $4`
+	rows, err := t.db.Query(ctx, query, req.TrackerId, req.Status, req.Pointer, req.Limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	alerts := make([]*AlertModel, 0)
+	for rows.Next() {
+		a := &AlertModel{}
+		err := rows.Scan(&a.Id, &a.RuleId, &a.TrackerId, &a.Kind, &a.Name, &a.Detail, &a.Status, &a.TriggeredAt, &a.AcknowledgedAt, &a.ResolvedAt, &a.Note)
+		if err != nil {
+			return err
+		}
+		alerts = append(alerts, a)
+	}
+	*res = alerts
+	return rows.Err()
+}
+
+// AcknowledgeAlert mark an open alert as being handled
+func (t *Tracker) AcknowledgeAlert(ctx context.Context, req *AlertActionReq, res *common.BasicResponse) error {
+	sqlStmt := `UPDATE alert SET status = 'acknowledged', acknowledged_at = now(), note = coalesce(nullif($1,''),note) WHERE id = $2 AND status = 'open'`
+	ct, err := t.db.Exec(ctx, sqlStmt, req.Note, req.AlertId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "alert not found or not open"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+// ResolveAlert close an open or acknowledged alert
+func (t *Tracker) ResolveAlert(ctx context.Context, req *AlertActionReq, res *common.BasicResponse) error {
+	sqlStmt := `UPDATE alert SET status = 'resolved', resolved_at = now(), acknowledged_at = coalesce(acknowledged_at,now()), note = coalesce(nullif($1,''),note) WHERE id = $2 AND status <> 'resolved'`
+	ct, err := t.db.Exec(ctx, sqlStmt, req.Note, req.AlertId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "alert not found or already resolved"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"nuha.dev/gpstracker/internal/store"
+	"nuha.dev/gpstracker/internal/webapp/common"
+)
+
+type GeofenceReq struct {
+	Name      string       `json:"name" validate:"required"`
+	TrackerId *uint64      `json:"tracker_id" validate:"required_without=Group"`
+	Group     *string      `json:"group" validate:"required_without=TrackerId"`
+	Kind      string       `json:"kind" validate:"required,oneof=circle polygon"`
+	Latitude  float64      `json:"lat"`
+	Longitude float64      `json:"lon"`
+	Radius    float64      `json:"radius"`
+	Polygon   [][2]float64 `json:"polygon"`
+}
+
+type UpdateGeofenceReq struct {
+	GeofenceId uint64 `json:"geofence_id" validate:"required"`
+	GeofenceReq
+}
+
+type CreateGeofenceRes struct {
+	Status     int    `json:"status"`
+	Message    string `json:"message,omitempty"`
+	GeofenceId uint64 `json:"geofence_id"`
+}
+
+type GeofenceIdRequestModel struct {
+	GeofenceId uint64 `json:"geofence_id" validate:"required"`
+}
+
+type GetGeofencesReq struct {
+	//geofence of the tracker including its group, every geofence when zero
+	TrackerId uint64 `json:"tracker_id"`
+}
+
+// check validate the shape, the other kind field are cleared
+func (g *GeofenceReq) check() error {
+	if g.Kind == store.GEOFENCE_CIRCLE {
+		if g.Radius <= 0 {
+			return fmt.Errorf("radius must be positive")
+		}
+		if math.Abs(g.Latitude) > 90 || math.Abs(g.Longitude) > 180 {
+			return fmt.Errorf("invalid centre")
+		}
+		g.Polygon = nil
+		return nil
+	}
+	if len(g.Polygon) < 3 {
+		return fmt.Errorf("polygon need at least 3 vertex")
+	}
+	for _, v := range g.Polygon {
+		if math.Abs(v[0]) > 90 || math.Abs(v[1]) > 180 {
+			return fmt.Errorf("invalid vertex %v", v)
+		}
+	}
+	g.Latitude, g.Longitude, g.Radius = 0, 0, 0
+	return nil
+}
+
+// CreateGeofence store a geofence, connected tracker pick it up within a minute
+func (t *Tracker) CreateGeofence(ctx context.Context, req *GeofenceReq, res *CreateGeofenceRes) error {
+	if err := req.check(); err != nil {
+		res.Status = -1
+		res.Message = err.Error()
+		return nil
+	}
+	sqlStmt := `INSERT INTO geofence (name,tracker_id,tracker_group,kind,lat,lon,radius,polygon) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id`
+	err := t.db.QueryRow(ctx, sqlStmt, req.Name, req.TrackerId, req.Group, req.Kind, req.Latitude, req.Longitude, req.Radius, req.Polygon).Scan(&res.GeofenceId)
+	if err != nil {
+		return err
+	}
+	res.Status = 0
+	return nil
+}
+
+func (t *Tracker) GetGeofences(ctx context.Context, req *GetGeofencesReq, res *[]*store.Geofence) error {
+	sqlStmt := `SELECT id,name,tracker_id,tracker_group,kind,lat,lon,radius,polygon FROM geofence
+	WHERE $1 = 0 OR tracker_id = $1 OR tracker_group = (SELECT config->>'group' FROM tracker WHERE id = $1) ORDER BY id`
+	rows, err := t.db.Query(ctx, sqlStmt, req.TrackerId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	fences := make([]*store.Geofence, 0)
+	for rows.Next() {
+		g := &store.Geofence{}
+		err := rows.Scan(&g.Id, &g.Name, &g.TrackerId, &g.Group, &g.Kind, &g.Latitude, &g.Longitude, &g.Radius, &g.Polygon)
+		if err != nil {
+			return err
+		}
+		fences = append(fences, g)
+	}
+	*res = fences
+	return rows.Err()
+}
+
+func (t *Tracker) UpdateGeofence(ctx context.Context, req *UpdateGeofenceReq, res *common.BasicResponse) error {
+	if err := req.check(); err != nil {
+		res.Status = -1
+		res.Message = err.Error()
+		return nil
+	}
+	sqlStmt := `UPDATE geofence SET name = $1, tracker_id = $2, tracker_group = $3, kind = $4, lat = $5, lon = $6, radius = $7, polygon = $8 WHERE id = $9`
+	ct, err := t.db.Exec(ctx, sqlStmt, req.Name, req.TrackerId, req.Group, req.Kind, req.Latitude, req.Longitude, req.Radius, req.Polygon, req.GeofenceId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "geofence not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+func (t *Tracker) DeleteGeofence(ctx context.Context, req *GeofenceIdRequestModel, res *common.BasicResponse) error {
+	ct, err := t.db.Exec(ctx, `DELETE FROM geofence WHERE id = $1`, req.GeofenceId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "geofence not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
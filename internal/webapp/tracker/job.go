@@ -0,0 +1,129 @@
+package tracker
+
+import (
+	"context"
+	"time"
+
+	"nuha.dev/gpstracker/internal/gpsv2/scheduler"
+	"nuha.dev/gpstracker/internal/webapp/common"
+)
+
+type CreateCommandJobReq struct {
+	Name      string  `json:"name" validate:"required"`
+	Command   string  `json:"command" validate:"required"`
+	TrackerId *uint64 `json:"tracker_id" validate:"required_without=Protocol"`
+	//every tracker of the protocol, command is protocol specific
+	Protocol *string `json:"protocol" validate:"required_without=TrackerId,required_with=Group"`
+	//restrict the protocol to tracker whose config group match
+	Group *string `json:"group"`
+	//recurring job, five field cron expression
+	Cron *string `json:"cron" validate:"required_without=RunAt"`
+	//one shot job
+	RunAt *time.Time `json:"run_at" validate:"required_without=Cron"`
+	//minutes before queued command expire, default to one hour
+	ExpireIn int `json:"expire_in" validate:"gte=0"`
+}
+
+type CreateCommandJobRes struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+	JobId   uint64 `json:"job_id"`
+}
+
+type CommandJobModel struct {
+	Id        uint64     `json:"id"`
+	Name      string     `json:"name"`
+	Command   string     `json:"command"`
+	TrackerId *uint64    `json:"tracker_id"`
+	Protocol  *string    `json:"protocol"`
+	Group     *string    `json:"group"`
+	Cron      *string    `json:"cron"`
+	ExpireIn  int        `json:"expire_in"`
+	Enabled   bool       `json:"enabled"`
+	NextRun   *time.Time `json:"next_run"`
+	LastRun   *time.Time `json:"last_run"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type CommandJobIdRequestModel struct {
+	JobId uint64 `json:"job_id" validate:"required"`
+}
+
+type SetCommandJobEnabledReq struct {
+	JobId   uint64 `json:"job_id" validate:"required"`
+	Enabled bool   `json:"enabled"`
+}
+
+// CreateCommandJob store a job dispatched by the scheduler, the first run of a
+// recurring job is computed by the scheduler in its own location
+func (t *Tracker) CreateCommandJob(ctx context.Context, req *CreateCommandJobReq, res *CreateCommandJobRes) error {
+	if req.Cron != nil {
+		_, err := scheduler.ParseCron(*req.Cron)
+		if err != nil {
+			res.Status = -1
+			res.Message = err.Error()
+			return nil
+		}
+		req.RunAt = nil
+	}
+	if req.ExpireIn == 0 {
+		req.ExpireIn = 60
+	}
+	sqlStmt := `INSERT INTO command_job (name,command,tracker_id,protocol,tracker_group,cron,expire_in,next_run) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id`
+	err := t.db.QueryRow(ctx, sqlStmt, req.Name, req.Command, req.TrackerId, req.Protocol, req.Group, req.Cron, req.ExpireIn, req.RunAt).Scan(&res.JobId)
+	if err != nil {
+		return err
+	}
+	res.Status = 0
+	return nil
+}
+
+func (t *Tracker) GetCommandJobs(ctx context.Context, res *[]*CommandJobModel) error {
+	sqlStmt := `SELECT id,name,command,tracker_id,protocol,tracker_group,cron,expire_in,enabled,next_run,last_run,created_at FROM command_job ORDER BY id`
+	rows, err := t.db.Query(ctx, sqlStmt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	jobs := make([]*CommandJobModel, 0)
+	for rows.Next() {
+		j := &CommandJobModel{}
+		err := rows.Scan(&j.Id, &j.Name, &j.Command, &j.TrackerId, &j.Protocol, &j.Group, &j.Cron, &j.ExpireIn, &j.Enabled, &j.NextRun, &j.LastRun, &j.CreatedAt)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, j)
+	}
+	*res = jobs
+	return nil
+}
+
+// SetCommandJobEnabled enable or disable a job, enabling a recurring job reschedule it
+func (t *Tracker) SetCommandJobEnabled(ctx context.Context, req *SetCommandJobEnabledReq, res *common.BasicResponse) error {
+	sqlStmt := `UPDATE command_job SET enabled = $1, next_run = CASE WHEN cron IS NOT NULL THEN NULL ELSE next_run END WHERE id = $2`
+	ct, err := t.db.Exec(ctx, sqlStmt, req.Enabled, req.JobId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "job not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+func (t *Tracker) DeleteCommandJob(ctx context.Context, req *CommandJobIdRequestModel, res *common.BasicResponse) error {
+	ct, err := t.db.Exec(ctx, `DELETE FROM command_job WHERE id = $1`, req.JobId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "job not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
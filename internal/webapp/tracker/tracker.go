@@ -15,7 +15,7 @@ import (
 	"github.com/phuslu/log"
 
 	"nuha.dev/gpstracker/internal/gpsv2/device"
-	"nuha.dev/gpstracker/internal/gpsv2/device/gt06"
+	"nuha.dev/gpstracker/internal/gpsv2/device/jt808"
 	"nuha.dev/gpstracker/internal/gpsv2/server"
 	"nuha.dev/gpstracker/internal/util"
 	"nuha.dev/gpstracker/internal/webapp/common"
@@ -32,12 +32,24 @@ type SetTrackerNameRequestModel struct {
 }
 
 type TrackerConfigs struct {
-	AllowConnect *bool   `json:"allow_connect,omitempty"`
-	SublistSend  *bool   `json:"sublist_send,omitempty"`
-	Store        *bool   `json:"store,omitempty"`
-	Broadcast    *bool   `json:"broadcast,omitempty"`
-	LogLevel     *string `json:"log_level,omitempty" validate:"omitempty,oneof=trace debug warn info error"`
-	ReadDeadline *int    `json:"read_deadline,omitempty" validate:"omitempty,ne=0"`
+	AllowConnect       *bool    `json:"allow_connect,omitempty"`
+	SublistSend        *bool    `json:"sublist_send,omitempty"`
+	Store              *bool    `json:"store,omitempty"`
+	Broadcast          *bool    `json:"broadcast,omitempty"`
+	LogLevel           *string  `json:"log_level,omitempty" validate:"omitempty,oneof=trace debug warn info error"`
+	ReadDeadline       *int     `json:"read_deadline,omitempty" validate:"omitempty,ne=0"`
+	CommandTimeout     *int     `json:"command_timeout,omitempty" validate:"omitempty,gt=0"`
+	Validation         *string  `json:"validation,omitempty" validate:"omitempty,oneof=drop tag none"`
+	MaxSpeed           *float64 `json:"max_speed,omitempty" validate:"omitempty,gt=0"`
+	MaxFutureTime      *int     `json:"max_future_time,omitempty" validate:"omitempty,gt=0"`
+	MaxGpsAge          *int     `json:"max_gps_age,omitempty" validate:"omitempty,gt=0"`
+	Timezone           *string  `json:"timezone,omitempty"`
+	MaxClockDrift      *int     `json:"max_clock_drift,omitempty" validate:"omitempty,gt=0"`
+	TripMinSpeed       *float64 `json:"trip_min_speed,omitempty" validate:"omitempty,gt=0"`
+	TripStopDuration   *int     `json:"trip_stop_duration,omitempty" validate:"omitempty,gt=0"`
+	TripMinDistance    *float64 `json:"trip_min_distance,omitempty" validate:"omitempty,gt=0"`
+	Group              *string  `json:"group,omitempty"`
+	GeofenceHysteresis *float64 `json:"geofence_hysteresis,omitempty" validate:"omitempty,gte=0"`
 }
 
 type TrackerIdRequestModel struct {
@@ -124,6 +136,7 @@ type GT06CmdResponseModel struct {
 	CommandTime  time.Time `json:"command_timestamp"`
 	Response     string    `json:"response"`
 	ResponseTime time.Time `json:"response_timestamp"`
+	JobId        *uint64   `json:"job_id"`
 }
 
 type Tracker struct {
@@ -150,6 +163,8 @@ type TrackerHistoryRequestModel struct {
 	To    time.Time `json:"to" validate:"required"`
 	Limit int       `json:"limit"`
 	Chunk int       `json:"chunk"`
+	//Rich append optional field extension of device.Location after each record
+	Rich bool `json:"rich"`
 }
 
 type TrackerLocationHistoryResponseModel struct {
@@ -231,6 +246,14 @@ func (t *Tracker) CreateWsToken(ctx context.Context, res *common.StringResponse)
 }
 
 func (t *Tracker) EditTrackerSettings(ctx context.Context, req *EditTrackerRequestModel, res *common.BasicResponse) error {
+	if req.Config.Timezone != nil && *req.Config.Timezone != "" {
+		_, err := device.ParseTimezone(*req.Config.Timezone)
+		if err != nil {
+			res.Status = -1
+			res.Message = err.Error()
+			return nil
+		}
+	}
 	sqlStmt := `UPDATE tracker SET config = config || $1 where tracker.id = $2`
 	ct, err := t.db.Exec(ctx, sqlStmt, req.Config, req.TrackerId)
 	if err != nil {
@@ -392,10 +415,10 @@ func (t *Tracker) GetGT06CmdHistory(ctx context.Context, req *TrackerIdTimeReque
 		tracker_id_flag = false
 	}
 	if req.Pointer == 0 {
-		query = `SELECT id, tracker_id,server_flag,response, response_time,command,command_time FROM gt06_command_response WHERE (tracker_id = $1 OR $2) AND response_time < $3 ORDER BY response_time DESC LIMIT $4`
+		query = `SELECT id, tracker_id,server_flag,response, response_time,command,command_time,job_id FROM gt06_command_response WHERE (tracker_id = $1 OR $2) AND response_time < $3 ORDER BY response_time DESC LIMIT $4`
 		rows, err = t.db.Query(ctx, query, req.TrackerId, tracker_id_flag, before, req.Limit)
 	} else {
-		query = `SELECT id, tracker_id,server_flag,response, response_time,command,command_time FROM gt06_command_response WHERE (tracker_id = $1 OR $2) AND id < $3 ORDER BY id DESC LIMIT $4`
+		query = `SELECT id, tracker_id,server_flag,response, response_time,command,command_time,job_id FROM gt06_command_response WHERE (tracker_id = $1 OR $2) AND id < $3 ORDER BY id DESC LIMIT $4`
 		rows, err = t.db.Query(ctx, query, req.TrackerId, tracker_id_flag, req.Pointer, req.Limit)
 	}
 
@@ -406,7 +429,7 @@ func (t *Tracker) GetGT06CmdHistory(ctx context.Context, req *TrackerIdTimeReque
 
 	for rows.Next() {
 		cmd := &GT06CmdResponseModel{}
-		err := rows.Scan(&cmd.Id, &cmd.TrackerId, &cmd.ServerFlag, &cmd.Response, &cmd.ResponseTime, &cmd.Command, &cmd.CommandTime)
+		err := rows.Scan(&cmd.Id, &cmd.TrackerId, &cmd.ServerFlag, &cmd.Response, &cmd.ResponseTime, &cmd.Command, &cmd.CommandTime, &cmd.JobId)
 		if err != nil {
 			return err
 		}
@@ -445,11 +468,15 @@ func (t *Tracker) GetTrackerLocationHistory(ctx context.Context, req *TrackerHis
 	var query string
 	var rows pgx.Rows
 	var err error
+	columns := `nsn,latitude,longitude,altitude,speed,gps_timestamp,server_timestamp`
+	if req.Rich {
+		columns += `,course,sat_count,hdop,accuracy,valid,acc,odometer`
+	}
 	if req.Limit == 0 || len(req.NSN) > 1 {
-		query = `SELECT nsn,latitude,longitude,altitude,speed,gps_timestamp,server_timestamp FROM locations_history WHERE nsn = ANY($1) AND server_timestamp BETWEEN $2 AND $3 ORDER BY server_timestamp ASC`
+		query = `SELECT ` + columns + ` FROM locations_history WHERE nsn = ANY($1) AND server_timestamp BETWEEN $2 AND $3 ORDER BY server_timestamp ASC`
 		rows, err = t.db.Query(ctx, query, req.NSN, req.From, req.To)
 	} else {
-		query = `SELECT nsn,latitude,longitude,altitude,speed,gps_timestamp,server_timestamp FROM locations_history WHERE nsn = ANY($1)  AND server_timestamp BETWEEN $2 AND $3 ORDER BY server_timestamp ASC LIMIT $4`
+		query = `SELECT ` + columns + ` FROM locations_history WHERE nsn = ANY($1)  AND server_timestamp BETWEEN $2 AND $3 ORDER BY server_timestamp ASC LIMIT $4`
 		rows, err = t.db.Query(ctx, query, req.NSN, req.From, req.To, req.Limit)
 	}
 
@@ -468,7 +495,13 @@ func (t *Tracker) GetTrackerLocationHistory(ctx context.Context, req *TrackerHis
 		var alt, speed float32
 		var gps_time, server_time time.Time
 		var nsn uint64
-		err := rows.Scan(&nsn, &lat, &lon, &alt, &speed, &gps_time, &server_time)
+		var loc device.Location
+		if req.Rich {
+			err = rows.Scan(&nsn, &lat, &lon, &alt, &speed, &gps_time, &server_time,
+				&loc.Course, &loc.SatCount, &loc.HDOP, &loc.Accuracy, &loc.Valid, &loc.ACC, &loc.Odometer)
+		} else {
+			err = rows.Scan(&nsn, &lat, &lon, &alt, &speed, &gps_time, &server_time)
+		}
 		if err != nil {
 			return err
 		}
@@ -479,6 +512,9 @@ func (t *Tracker) GetTrackerLocationHistory(ctx context.Context, req *TrackerHis
 		_ = binary.Write(buf, binary.LittleEndian, speed)
 		_ = binary.Write(buf, binary.LittleEndian, gps_time.UnixMilli())
 		_ = binary.Write(buf, binary.LittleEndian, server_time.UnixMilli())
+		if req.Rich {
+			buf.Write(loc.AppendExtension(nil))
+		}
 		group_cnt[nsn]++
 
 		count++
@@ -575,6 +611,11 @@ type SendCommand2Req struct {
 	Force     bool   `json:"force"`
 }
 
+// commandSender is implemented by device accepting free form text command
+type commandSender interface {
+	SendCommand(msg string, force bool) (bool, error)
+}
+
 func (t *Tracker) SendCommand2(ctx context.Context, req *SendCommand2Req, res *common.BasicResponse) error {
 	dev, ok := t.gps.GetDevice(req.TrackerId)
 	if !ok {
@@ -583,13 +624,13 @@ func (t *Tracker) SendCommand2(ctx context.Context, req *SendCommand2Req, res *c
 
 		return nil
 	} else {
-		gt06dev, ok := dev.Dev.(*gt06.GT06)
+		sender, ok := dev.Dev.(commandSender)
 		if !ok {
 			res.Status = -1
-			res.Message = "device is not gt06"
+			res.Message = "device does not accept command"
 			return nil
 		} else {
-			pending, err := gt06dev.SendCommand(req.Command, req.Force)
+			pending, err := sender.SendCommand(req.Command, req.Force)
 			if pending {
 				res.Status = -1
 				res.Message = "has pending message, use force flag"
@@ -605,3 +646,207 @@ func (t *Tracker) SendCommand2(ctx context.Context, req *SendCommand2Req, res *c
 	}
 
 }
+
+type TrackerCapabilityModel struct {
+	Status   int                  `json:"status"`
+	Message  string               `json:"message,omitempty"`
+	Commands []device.CommandType `json:"commands"`
+}
+
+// GetTrackerCapability list the command the connected device accept, empty when the
+// device does not accept command
+func (t *Tracker) GetTrackerCapability(ctx context.Context, req *TrackerIdRequestModel, res *TrackerCapabilityModel) error {
+	res.Commands = []device.CommandType{}
+	dev, ok := t.gps.GetDevice(req.TrackerId)
+	if !ok {
+		res.Status = -1
+		res.Message = "device not found"
+		return nil
+	}
+	commander, ok := dev.Dev.(device.Commander)
+	if ok {
+		res.Commands = commander.Capabilities()
+	}
+	res.Status = 0
+	return nil
+}
+
+type TrackerRejectCountModel struct {
+	Status  int               `json:"status"`
+	Message string            `json:"message,omitempty"`
+	Counts  map[string]uint64 `json:"counts"`
+}
+
+// GetTrackerRejectCount return number of location the connected device rejected by reason
+// since it was created
+func (t *Tracker) GetTrackerRejectCount(ctx context.Context, req *TrackerIdRequestModel, res *TrackerRejectCountModel) error {
+	res.Counts = map[string]uint64{}
+	dev, ok := t.gps.GetDevice(req.TrackerId)
+	if !ok {
+		res.Status = -1
+		res.Message = "device not found"
+		return nil
+	}
+	counter, ok := dev.Dev.(device.RejectCounter)
+	if ok {
+		res.Counts = counter.RejectCounts()
+	}
+	res.Status = 0
+	return nil
+}
+
+// ResetTrackerRegistration remove the authentication code of a tracker so its terminal
+// can register again, used when the terminal lost its code
+func (t *Tracker) ResetTrackerRegistration(ctx context.Context, req *TrackerIdRequestModel, res *common.BasicResponse) error {
+	tag, err := t.db.Exec(ctx, `UPDATE tracker SET attribute = attribute - $1::text WHERE id = $2`, jt808.AUTH_CODE_ATTRIBUTE, req.TrackerId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		res.Status = -1
+		res.Message = "tracker not found"
+		return nil
+	}
+	dev, ok := t.gps.GetDevice(req.TrackerId)
+	if ok {
+		if r, ok := dev.Dev.(device.Registrar); ok {
+			r.ResetRegistration()
+		}
+	}
+	res.Status = 0
+	return nil
+}
+
+type SendTrackerCommandReq struct {
+	TrackerId uint64         `json:"tracker_id" validate:"required"`
+	Command   device.Command `json:"command" validate:"required"`
+	Force     bool           `json:"force"`
+}
+
+func (t *Tracker) SendTrackerCommand(ctx context.Context, req *SendTrackerCommandReq, res *common.BasicResponse) error {
+	dev, ok := t.gps.GetDevice(req.TrackerId)
+	if !ok {
+		res.Status = -1
+		res.Message = "device not found"
+		return nil
+	}
+	commander, ok := dev.Dev.(device.Commander)
+	if !ok || !device.HasCapability(commander, req.Command.Type) {
+		res.Status = -1
+		res.Message = device.ErrCommandNotSupported.Error()
+		return nil
+	}
+	pending, err := commander.ExecuteCommand(req.Command, req.Force)
+	if pending {
+		res.Status = -1
+		res.Message = "has pending message, use force flag"
+	}
+	if err != nil {
+		res.Status = -1
+		res.Message = err.Error()
+	}
+	return nil
+}
+
+type EnqueueCommandReq struct {
+	TrackerId uint64 `json:"tracker_id" validate:"required"`
+	Command   string `json:"command" validate:"required"`
+	//minutes before the command expire when not delivered, default to one day
+	ExpireIn   int `json:"expire_in" validate:"gte=0"`
+	MaxAttempt int `json:"max_attempt" validate:"gte=0"`
+}
+
+type EnqueueCommandRes struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message,omitempty"`
+	CommandId uint64 `json:"command_id"`
+}
+
+// EnqueueCommand persist command to be delivered when the device is connected
+func (t *Tracker) EnqueueCommand(ctx context.Context, req *EnqueueCommandReq, res *EnqueueCommandRes) error {
+	if req.ExpireIn == 0 {
+		req.ExpireIn = 24 * 60
+	}
+	if req.MaxAttempt == 0 {
+		req.MaxAttempt = 3
+	}
+	sqlStmt := `INSERT INTO tracker_command (tracker_id,command,max_attempt,expire_at) VALUES ($1,$2,$3,now() + make_interval(mins => $4)) RETURNING id`
+	err := t.db.QueryRow(ctx, sqlStmt, req.TrackerId, req.Command, req.MaxAttempt, req.ExpireIn).Scan(&res.CommandId)
+	if err != nil {
+		pgerr, ok := err.(*pgconn.PgError)
+		if ok && pgerr.Code == "23503" {
+			res.Status = -1
+			res.Message = "tracker not found"
+			return nil
+		}
+		return err
+	}
+	dev, ok := t.gps.GetDevice(req.TrackerId)
+	if ok {
+		if q, ok := dev.Dev.(device.CommandQueuer); ok {
+			q.DeliverQueued()
+		}
+	}
+	res.Status = 0
+	return nil
+}
+
+type QueuedCommandModel struct {
+	Id         uint64     `json:"id"`
+	TrackerId  uint64     `json:"tracker_id"`
+	Command    string     `json:"command"`
+	Status     string     `json:"status"`
+	Attempt    int        `json:"attempt"`
+	MaxAttempt int        `json:"max_attempt"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpireAt   time.Time  `json:"expire_at"`
+	SentAt     *time.Time `json:"sent_at"`
+	Response   *string    `json:"response"`
+	ResponseAt *time.Time `json:"response_at"`
+	Reason     *string    `json:"reason"`
+}
+
+func (t *Tracker) GetQueuedCommands(ctx context.Context, req *TrackerIdTimeRequestModel, res *[]*QueuedCommandModel) error {
+	if req.Limit == 0 {
+		req.Limit = 20
+	}
+	var tracker_id_flag = req.TrackerId == 0
+	var pointer_flag = req.Pointer == 0
+	query := `SELECT id,tracker_id,command,status,attempt,max_attempt,created_at,expire_at,sent_at,response,response_at,reason FROM tracker_command WHERE (tracker_id = $1 OR $2) AND (id < $3 OR $4) ORDER BY id DESC LIMIT $5`
+	rows, err := t.db.Query(ctx, query, req.TrackerId, tracker_id_flag, req.Pointer, pointer_flag, req.Limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cmds := make([]*QueuedCommandModel, 0)
+	for rows.Next() {
+		c := &QueuedCommandModel{}
+		err := rows.Scan(&c.Id, &c.TrackerId, &c.Command, &c.Status, &c.Attempt, &c.MaxAttempt, &c.CreatedAt, &c.ExpireAt, &c.SentAt, &c.Response, &c.ResponseAt, &c.Reason)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, c)
+	}
+	*res = cmds
+	return nil
+}
+
+type CommandIdRequestModel struct {
+	CommandId uint64 `json:"command_id" validate:"required"`
+}
+
+// CancelQueuedCommand fail a command which has not been acknowledged yet
+func (t *Tracker) CancelQueuedCommand(ctx context.Context, req *CommandIdRequestModel, res *common.BasicResponse) error {
+	sqlStmt := `UPDATE tracker_command SET status = 'failed', reason = 'cancelled', response_at = now() WHERE id = $1 AND status IN ('queued','sent')`
+	ct, err := t.db.Exec(ctx, sqlStmt, req.CommandId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "command not found or already completed"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
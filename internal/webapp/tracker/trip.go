@@ -0,0 +1,164 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"nuha.dev/gpstracker/internal/gpsv2/device"
+	"nuha.dev/gpstracker/internal/gpsv2/trip"
+	"nuha.dev/gpstracker/internal/store"
+)
+
+type TrackerTripsRequestModel struct {
+	TrackerId uint64    `json:"tracker_id" validate:"required"`
+	From      time.Time `json:"from" validate:"required"`
+	To        time.Time `json:"to" validate:"required"`
+	//trip or stop, both when empty
+	Kind string `json:"kind" validate:"omitempty,oneof=trip stop"`
+}
+
+type RebuildTripsRes struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+	Trips   int    `json:"trips"`
+	Stops   int    `json:"stops"`
+}
+
+// GetTrackerTrips return trip and stop starting between from and to, oldest first
+func (t *Tracker) GetTrackerTrips(ctx context.Context, req *TrackerTripsRequestModel, res *[]*store.Segment) error {
+	query := `SELECT tracker_id,kind,start_time,end_time,start_lat,start_lon,end_lat,end_lon,distance,max_speed,avg_speed,duration FROM tracker_segment
+	WHERE tracker_id = $1 AND start_time BETWEEN $2 AND $3 AND (kind = $4 OR $4 = '') ORDER BY start_time ASC`
+	rows, err := t.db.Query(ctx, query, req.TrackerId, req.From, req.To, req.Kind)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	segs := make([]*store.Segment, 0)
+	for rows.Next() {
+		s := &store.Segment{}
+		err := rows.Scan(&s.TrackerId, &s.Kind, &s.Start, &s.End, &s.StartLat, &s.StartLon, &s.EndLat, &s.EndLon, &s.Distance, &s.MaxSpeed, &s.AvgSpeed, &s.Duration)
+		if err != nil {
+			return err
+		}
+		segs = append(segs, s)
+	}
+	*res = segs
+	return rows.Err()
+}
+
+// longest history RebuildTrackerTrips segment in one call
+const max_rebuild_range = 31 * 24 * time.Hour
+
+// RebuildTrackerTrips segment the stored location history between from and to with the
+// tracker current trip setting, trip and stop starting in the range are replaced.
+// Location are streamed into the segmenter, the range is limited to max_rebuild_range.
+// Trip and stop already stored for the same start are kept and not counted
+func (t *Tracker) RebuildTrackerTrips(ctx context.Context, req *TrackerTripsRequestModel, res *RebuildTripsRes) error {
+	if req.To.Before(req.From) || req.To.Sub(req.From) > max_rebuild_range {
+		res.Status = -1
+		res.Message = "range must not exceed 31 days"
+		return nil
+	}
+	var nsn uint64
+	conf := &device.DeviceConfig{}
+	err := t.db.QueryRow(ctx, `SELECT nsn,config FROM tracker WHERE id = $1`, req.TrackerId).Scan(&nsn, conf)
+	if err == pgx.ErrNoRows {
+		res.Status = -1
+		res.Message = "tracker not found"
+		return nil
+	} else if err != nil {
+		return err
+	}
+	segs, err := t.segment_history(ctx, req, nsn, conf, false)
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) && pgerr.Code == pgerrcode.UndefinedColumn {
+		//history table not migrated yet, segment without acc and validation tag
+		segs, err = t.segment_history(ctx, req, nsn, conf, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := t.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `DELETE FROM tracker_segment WHERE tracker_id = $1 AND start_time BETWEEN $2 AND $3`, req.TrackerId, req.From, req.To)
+	if err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	for _, s := range segs {
+		batch.Queue(`INSERT INTO tracker_segment (tracker_id,kind,start_time,end_time,start_lat,start_lon,end_lat,end_lon,distance,max_speed,avg_speed,duration)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12) ON CONFLICT (tracker_id,kind,start_time) DO NOTHING`,
+			s.TrackerId, s.Kind, s.Start, s.End, s.StartLat, s.StartLon, s.EndLat, s.EndLon, s.Distance, s.MaxSpeed, s.AvgSpeed, s.Duration)
+	}
+	br := tx.SendBatch(ctx, batch)
+	for _, s := range segs {
+		ct, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return err
+		}
+		//segment skipped by the conflict is not counted
+		if ct.RowsAffected() == 0 {
+			continue
+		}
+		if s.Kind == store.SEGMENT_TRIP {
+			res.Trips++
+		} else {
+			res.Stops++
+		}
+	}
+	err = br.Close()
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	res.Status = 0
+	return nil
+}
+
+// segment_history stream the location history of nsn between from and to into a segmenter,
+// legacy read a history table without the valid and acc column
+func (t *Tracker) segment_history(ctx context.Context, req *TrackerTripsRequestModel, nsn uint64, conf *device.DeviceConfig, legacy bool) ([]store.Segment, error) {
+	query := `SELECT latitude,longitude,altitude,speed,gps_timestamp,valid,acc FROM locations_history
+	WHERE nsn = $1 AND gps_timestamp BETWEEN $2 AND $3 ORDER BY gps_timestamp ASC`
+	if legacy {
+		query = `SELECT latitude,longitude,altitude,speed,gps_timestamp FROM locations_history
+	WHERE nsn = $1 AND gps_timestamp BETWEEN $2 AND $3 ORDER BY gps_timestamp ASC`
+	}
+	rows, err := t.db.Query(ctx, query, nsn, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	segmenter := trip.NewSegmenter(req.TrackerId, conf)
+	segs := make([]store.Segment, 0)
+	for rows.Next() {
+		var loc device.Location
+		dest := []interface{}{&loc.Latitude, &loc.Longitude, &loc.Altitude, &loc.Speed, &loc.Timestamp}
+		if !legacy {
+			dest = append(dest, &loc.Valid, &loc.ACC)
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		//location tagged by validation is not trusted
+		if !loc.IsValid() {
+			continue
+		}
+		done, _ := segmenter.Push(&loc)
+		segs = append(segs, done...)
+	}
+	return segs, rows.Err()
+}
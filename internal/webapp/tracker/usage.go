@@ -0,0 +1,51 @@
+package tracker
+
+import (
+	"context"
+	"time"
+)
+
+type TrackerUsageRequestModel struct {
+	TrackerId uint64    `json:"tracker_id" validate:"required"`
+	From      time.Time `json:"from" validate:"required"`
+	To        time.Time `json:"to" validate:"required"`
+}
+
+type DailyUsageModel struct {
+	Day           string  `json:"day"`
+	Distance      float64 `json:"distance"`
+	EngineSeconds float64 `json:"engine_seconds"`
+}
+
+type TrackerUsageModel struct {
+	//lifetime total, distance in meter
+	Odometer      float64            `json:"odometer"`
+	EngineSeconds float64            `json:"engine_seconds"`
+	Days          []*DailyUsageModel `json:"days"`
+}
+
+// GetTrackerUsage return daily distance and engine time between from and to, with the lifetime
+// total the service interval is scheduled from. Usage of the last minute may not be written yet
+func (t *Tracker) GetTrackerUsage(ctx context.Context, req *TrackerUsageRequestModel, res *TrackerUsageModel) error {
+	err := t.db.QueryRow(ctx, `SELECT coalesce(sum(distance),0),coalesce(sum(engine_seconds),0) FROM tracker_usage WHERE tracker_id = $1`,
+		req.TrackerId).Scan(&res.Odometer, &res.EngineSeconds)
+	if err != nil {
+		return err
+	}
+	rows, err := t.db.Query(ctx, `SELECT to_char(day,'YYYY-MM-DD'),distance,engine_seconds FROM tracker_usage WHERE tracker_id = $1 AND day BETWEEN $2::date AND $3::date ORDER BY day ASC`,
+		req.TrackerId, req.From, req.To)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	res.Days = make([]*DailyUsageModel, 0)
+	for rows.Next() {
+		d := &DailyUsageModel{}
+		err := rows.Scan(&d.Day, &d.Distance, &d.EngineSeconds)
+		if err != nil {
+			return err
+		}
+		res.Days = append(res.Days, d)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"nuha.dev/gpstracker/internal/webapp/common"
+)
+
+type CreateWebhookReq struct {
+	Url    string `json:"url" validate:"required"`
+	Secret string `json:"secret"`
+	//topic to deliver, "location" for location, a trailing * match by prefix, every topic when empty
+	Events []string `json:"events"`
+	//every tracker when empty
+	Trackers []uint64 `json:"trackers"`
+}
+
+type CreateWebhookRes struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message,omitempty"`
+	WebhookId uint64 `json:"webhook_id"`
+}
+
+// WebhookModel does not return the secret, only whether one is set
+type WebhookModel struct {
+	Id        uint64    `json:"id"`
+	Url       string    `json:"url"`
+	HasSecret bool      `json:"has_secret"`
+	Events    []string  `json:"events"`
+	Trackers  []int64   `json:"trackers"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookIdRequestModel struct {
+	WebhookId uint64 `json:"webhook_id" validate:"required"`
+}
+
+type SetWebhookEnabledReq struct {
+	WebhookId uint64 `json:"webhook_id" validate:"required"`
+	Enabled   bool   `json:"enabled"`
+}
+
+type GetWebhookDeadLettersReq struct {
+	WebhookId uint64 `json:"webhook_id" validate:"required"`
+	Pointer   uint64 `json:"pointer"`
+	Limit     int    `json:"limit"`
+}
+
+type WebhookDeadLetterModel struct {
+	Id         uint64          `json:"id"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastStatus *int            `json:"last_status"`
+	LastError  *string         `json:"last_error"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+// CreateWebhook store a webhook, the dispatcher pick it up within a minute
+func (t *Tracker) CreateWebhook(ctx context.Context, req *CreateWebhookReq, res *CreateWebhookRes) error {
+	u, err := url.Parse(req.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		res.Status = -1
+		res.Message = fmt.Sprintf("invalid url %q", req.Url)
+		return nil
+	}
+	events := req.Events
+	if events == nil {
+		events = []string{}
+	}
+	trackers := make([]int64, len(req.Trackers))
+	for i, tid := range req.Trackers {
+		trackers[i] = int64(tid)
+	}
+	sqlStmt := `INSERT INTO webhook (url,secret,events,trackers) VALUES ($1,$2,$3,$4) RETURNING id`
+	err = t.db.QueryRow(ctx, sqlStmt, req.Url, req.Secret, events, trackers).Scan(&res.WebhookId)
+	if err != nil {
+		return err
+	}
+	res.Status = 0
+	return nil
+}
+
+func (t *Tracker) GetWebhooks(ctx context.Context, res *[]*WebhookModel) error {
+	rows, err := t.db.Query(ctx, `SELECT id,url,secret <> '',events,trackers,enabled,created_at FROM webhook ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	hooks := make([]*WebhookModel, 0)
+	for rows.Next() {
+		w := &WebhookModel{}
+		err := rows.Scan(&w.Id, &w.Url, &w.HasSecret, &w.Events, &w.Trackers, &w.Enabled, &w.CreatedAt)
+		if err != nil {
+			return err
+		}
+		hooks = append(hooks, w)
+	}
+	*res = hooks
+	return rows.Err()
+}
+
+func (t *Tracker) SetWebhookEnabled(ctx context.Context, req *SetWebhookEnabledReq, res *common.BasicResponse) error {
+	ct, err := t.db.Exec(ctx, `UPDATE webhook SET enabled = $1 WHERE id = $2`, req.Enabled, req.WebhookId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "webhook not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+// DeleteWebhook also delete its dead letter
+func (t *Tracker) DeleteWebhook(ctx context.Context, req *WebhookIdRequestModel, res *common.BasicResponse) error {
+	ct, err := t.db.Exec(ctx, `DELETE FROM webhook WHERE id = $1`, req.WebhookId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() < 1 {
+		res.Status = -1
+		res.Message = "webhook not found"
+	} else {
+		res.Status = 0
+	}
+	return nil
+}
+
+// GetWebhookDeadLetters return failed delivery newest first, pointer is the id of the last one of the previous page
+func (t *Tracker) GetWebhookDeadLetters(ctx context.Context, req *GetWebhookDeadLettersReq, res *[]*WebhookDeadLetterModel) error {
+	if req.Limit == 0 {
+		req.Limit = 20
+	}
+	query := `SELECT id,payload,attempts,last_status,last_error,failed_at FROM webhook_dead_letter
+	WHERE webhook_id = $1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3`
+	rows, err := t.db.Query(ctx, query, req.WebhookId, req.Pointer, req.Limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	letters := make([]*WebhookDeadLetterModel, 0)
+	for rows.Next() {
+		l := &WebhookDeadLetterModel{}
+		err := rows.Scan(&l.Id, &l.Payload, &l.Attempts, &l.LastStatus, &l.LastError, &l.FailedAt)
+		if err != nil {
+			return err
+		}
+		letters = append(letters, l)
+	}
+	*res = letters
+	return rows.Err()
+}
@@ -26,6 +26,8 @@ type WebstreamServer struct {
 	config     WebStreamConfig
 	db         *pgxpool.Pool
 	sublistmap *sublist.SublistMap
+	clients_mu sync.Mutex
+	clients    map[*WebstreamClient]bool
 }
 
 type WebStreamConfig struct {
@@ -69,18 +71,48 @@ func NewWebstream(db *pgxpool.Pool, gps_server *gpsv2.Server, sublistmap *sublis
 	o.gsrv = gps_server
 	o.db = db
 	o.sublistmap = sublistmap
+	o.clients = make(map[*WebstreamClient]bool)
 	return o
 }
 
 func (ws *WebstreamServer) Run() {
 	ws.log.Info().Msgf("starting ws-server on : %s", ws.server.Addr)
 	err := ws.server.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		ws.log.Error().Err(err).Msg("")
 		panic(err)
 	}
 }
 
+// Shutdown stop accepting connection and close every websocket with going away status,
+// hijacked websocket connection are not tracked by http.Server so they are closed here
+func (ws *WebstreamServer) Shutdown(ctx context.Context) error {
+	ws.log.Info().Msg("shutting down ws-server")
+	err := ws.server.Shutdown(ctx)
+	ws.clients_mu.Lock()
+	clients := make([]*WebstreamClient, 0, len(ws.clients))
+	for wc := range ws.clients {
+		clients = append(clients, wc)
+	}
+	ws.clients_mu.Unlock()
+	for _, wc := range clients {
+		wc.c.Close(websocket.StatusGoingAway, "server shutdown")
+	}
+	return err
+}
+
+func (ws *WebstreamServer) add_client(wc *WebstreamClient) {
+	ws.clients_mu.Lock()
+	ws.clients[wc] = true
+	ws.clients_mu.Unlock()
+}
+
+func (ws *WebstreamServer) remove_client(wc *WebstreamClient) {
+	ws.clients_mu.Lock()
+	delete(ws.clients, wc)
+	ws.clients_mu.Unlock()
+}
+
 func (ws *WebstreamServer) serve_http(w http.ResponseWriter, r *http.Request) {
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true, CompressionMode: websocket.CompressionDisabled,
@@ -111,6 +143,8 @@ func (ws *WebstreamServer) serve_http(w http.ResponseWriter, r *http.Request) {
 		wc.wg = sync.WaitGroup{}
 		wc.lock = sync.Mutex{}
 		wc.sublist = make(map[uint64]*sublist.Sublist)
+		ws.add_client(wc)
+		defer ws.remove_client(wc)
 		wc.wg.Add(1)
 		go wc.writeLoop()
 		wc.wg.Add(1)
@@ -218,6 +252,10 @@ func (wc *WebstreamClient) writeLoop() {
 	delay := delay{}
 	for {
 		wc.lock.Lock()
+		if wc.closed {
+			wc.lock.Unlock()
+			return
+		}
 		l := len(wc.buf)
 		for _, d := range wc.buf {
 			err := wc.c.Write(context.Background(), websocket.MessageBinary, d)
@@ -263,6 +301,7 @@ func (d *delay) get_delay() int {
 func (wc *WebstreamClient) Push(sender uint64, data []byte) bool {
 	wc.lock.Lock()
 	if wc.closed {
+		wc.lock.Unlock()
 		return true
 	}
 	wc.buf = append(wc.buf, data)